@@ -0,0 +1,707 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/agentapi"
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/halt"
+	"github.com/huanwei/kube-chaos/pkg/multus"
+	"github.com/huanwei/kube-chaos/pkg/peers"
+	"github.com/huanwei/kube-chaos/pkg/record"
+	"github.com/huanwei/kube-chaos/pkg/report"
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	"github.com/huanwei/kube-chaos/pkg/selection"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/state"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// driftMetrics counts the syncs that found drift, and the operations that corrected it.
+var driftMetrics = expvar.NewMap("kube_chaos_drift")
+
+// agentMetrics has degraded set to 1 while the agent can't reach the API server and removed all
+// chaos.
+var agentMetrics = expvar.NewMap("kube_chaos_agent")
+
+// agent syncs the chaos tc applies on the node with the chaos of the pods.
+type agent struct {
+	clientset      kubernetes.Interface
+	endpoint       string
+	labelSelector  string
+	maxPerWorkload *intstr.IntOrString
+	hostname       string
+	// nodeName is the node of the agent, only its pods get Events from it
+	nodeName string
+	// exec runs the commands of the agent, e.g. an exec.DryRunExec
+	exec exec.Interface
+	// dryRun is set when exec only logs the commands changing the node, the chaos then never gets
+	// applied so there is no drift to correct
+	dryRun bool
+	// etcdTimeout bounds the lookup of a pod's veth in calico's etcd
+	etcdTimeout time.Duration
+	// workers bounds how many pods' veths are looked up at once
+	workers int
+
+	// recorder is nil when no Events must be recorded
+	recorder *record.EventRecorder
+	policy   *safeguard.Policy
+	expander *workload.Expander
+	reporter *report.Reporter
+	manual   *agentapi.Store
+	api      *agentapi.Server
+	// hosts keeps the addresses of the hostnames named as peers across syncs
+	hosts *peers.Hosts
+	// apiLock serialises the tc changes of the agent API, it is taken for good to stop them
+	apiLock sync.Locker
+
+	haltLock sync.Mutex
+	// halt is the ConfigMap halting all chaos, nil when chaos isn't halted
+	halt *v1.ConfigMap
+	// complied is set once all chaos is removed for the current halt
+	complied bool
+	// halted is 1 while chaos is halted, set before the halt is enforced. A sync checks it under
+	// the ifb locks without haltLock, enforceHalt holds haltLock while it waits for them.
+	halted int32
+
+	// gracePeriod is how long the agent may fail to list the pods before it removes all chaos,
+	// zero to never remove it
+	gracePeriod time.Duration
+	// listed is when the pods were last listed
+	listed time.Time
+	// degraded is set once all chaos is removed because the pods couldn't be listed
+	degraded bool
+
+	// previous is the chaos last applied without errors, guarded by apiLock
+	previous *flow.Desired
+	// applied are the targets of the last sync that applied chaos, the agent API applies their
+	// chaos with its impairments, guarded by apiLock
+	applied []target
+	// reported are the uids of the pods whose chaos state is reported in the current sync
+	reported sets.String
+}
+
+// target is an interface of a selected pod and the veth its chaos is applied on.
+type target struct {
+	pod v1.Pod
+	// iface is the pod interface or network-attachment the chaos specs name
+	iface   string
+	cidr    string
+	veth    string
+	egress  string
+	ingress string
+	// egressPeers and ingressPeers are the peers of the Services and hosts the specs name
+	egressPeers  []flow.Peer
+	ingressPeers []flow.Peer
+	err          error
+}
+
+// eventf records an Event about a pod of the agent's node, it returns false if the Event was
+// recorded before or the pod runs on another node.
+func (a *agent) eventf(pod *v1.Pod, reason, messageFmt string, args ...interface{}) bool {
+	// every agent lists the pods of the whole cluster, the pod's own agent records its Events
+	if pod.Spec.NodeName != a.nodeName {
+		return false
+	}
+	if a.recorder == nil {
+		return true
+	}
+	return a.recorder.Eventf(pod, v1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+func (a *agent) reportState(pod *v1.Pod, phase, message string) {
+	ingressChaosInfo, egressChaosInfo, _ := flow.ExtractPodChaosInfo(pod.Annotations)
+	a.reporter.Report(pod, report.State{
+		Phase:   phase,
+		Egress:  egressChaosInfo,
+		Ingress: ingressChaosInfo,
+		Source:  pod.Annotations[workload.SourceAnnotation],
+		Message: message,
+	})
+	a.reported.Insert(string(pod.UID))
+}
+
+// selectPods returns the pods to do chaos on, or an error if the pods or the workloads they inherit
+// chaos from can't be listed.
+func (a *agent) selectPods() ([]v1.Pod, error) {
+	//pods, err := clientset.CoreV1().Pods("").List(meta_v1.ListOptions{FieldSelector: "spec.nodeName=10.10.103.182", LabelSelector: labelSelector})
+	pods, err := listChaosPods(a.clientset, a.labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	// pods of annotated workloads and services inherit their chaos
+	pods, err = a.expander.Expand(pods)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand workload chaos: %v", err)
+	}
+	glog.V(4).Infof("There are %d pods need to do chaos in the cluster\n", len(pods))
+	if a.recorder != nil {
+		// the events of pods that are gone are recorded no more
+		uids := sets.String{}
+		for _, pod := range pods {
+			uids.Insert(string(pod.UID))
+		}
+		a.recorder.Retain("Pod", uids)
+	}
+
+	candidates := []v1.Pod{}
+	for _, pod := range pods {
+		if refusal := a.policy.Check(&pod); refusal != nil {
+			if !wantsChaos(&pod) {
+				// e.g. a kube-system pod listed by an empty label selector
+				continue
+			}
+			a.reportState(&pod, report.PhaseRefused, refusal.Message)
+			if a.eventf(&pod, refusal.Reason, "Refused to apply chaos: %s", refusal.Message) {
+				glog.Warningf("Refused to apply chaos to pod %s/%s: %s", pod.Namespace, pod.Name, refusal.Message)
+			} else {
+				glog.V(4).Infof("Refused to apply chaos to pod %s/%s: %s", pod.Namespace, pod.Name, refusal.Message)
+			}
+			continue
+		}
+		ingressChaosInfo, egressChaosInfo, err := flow.ExtractPodChaosInfo(pod.Annotations)
+		if err != nil {
+			glog.Errorf("Failed extract pod's chaos info: %v", err)
+		}
+		if ingressChaosInfo == "" && egressChaosInfo == "" {
+			glog.Warning("chaos is on, but the pod's chaos info was not set")
+			continue
+		}
+		if err := flow.ValidateChaosInfo(ingressChaosInfo, egressChaosInfo); err != nil {
+			if a.eventf(&pod, "ChaosInvalidSpec", "Invalid chaos info: %v", err) {
+				glog.Errorf("Invalid chaos info of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+			a.reportState(&pod, report.PhaseInvalid, err.Error())
+			continue
+		}
+		candidates = append(candidates, pod)
+	}
+
+	// cap the pods of each workload, every agent lists the same pods so they all agree on the choice
+	selected, skipped := selection.NewLimiter(a.maxPerWorkload, workload.NewResolver(a.clientset)).Limit(candidates)
+	for _, s := range skipped {
+		if a.eventf(&s.Pod, selection.ReasonLimited, "Skipped chaos: %s", s.Reason) {
+			glog.Warningf("Skipped chaos of pod %s/%s: %s", s.Pod.Namespace, s.Pod.Name, s.Reason)
+		} else {
+			glog.V(4).Infof("Skipped chaos of pod %s/%s: %s", s.Pod.Namespace, s.Pod.Name, s.Reason)
+		}
+		a.reportState(&s.Pod, report.PhaseSkipped, s.Reason)
+	}
+	return selected, nil
+}
+
+// wantsChaos reports whether a pod has chaos of its own, inherited or of an Experiment, rather than
+// merely being listed.
+func wantsChaos(pod *v1.Pod) bool {
+	return flow.HasChaosAnnotations(pod.Annotations) || pod.Labels[v1alpha1.ExperimentLabel] != ""
+}
+
+// targets returns the chaos of the selected pods by interface, with their CIDRs, veths and peers
+// resolved.
+func (a *agent) targets(pods []v1.Pod) []target {
+	targets := []target{}
+	for _, pod := range pods {
+		ingressChaosInfo, egressChaosInfo, _ := flow.ExtractPodChaosInfo(pod.Annotations)
+		chaos, err := flow.SplitChaosInfo(ingressChaosInfo, egressChaosInfo)
+		if err != nil {
+			targets = append(targets, target{pod: pod, err: err})
+			continue
+		}
+		for _, c := range chaos {
+			targets = append(targets, target{pod: pod, iface: c.Interface, ingress: c.Ingress, egress: c.Egress})
+		}
+	}
+	a.resolveTargets(targets, peers.NewResolver(a.clientset))
+	return targets
+}
+
+// desired builds the chaos wanted on the node from the targets and the impairments added through
+// the agent API, whose pods are left alone until they expire. The caller holds apiLock until the
+// chaos is applied, an impairment added meanwhile would be removed as extra chaos.
+func (a *agent) desired(targets []target) (*flow.Desired, []target) {
+	desired := flow.NewDesired()
+	for _, e := range a.manual.List() {
+		if err := desired.Add(e.Interface, e.CIDR(), state.Owner{Source: "agent API"}, e.Egress, e.Ingress); err != nil {
+			glog.Errorf("Invalid impairment of %s: %v", e.IP, err)
+		}
+	}
+	manualIPs := a.manual.IPs()
+	resolved := []target{}
+	for _, t := range targets {
+		if manualIPs.Has(strings.TrimSuffix(t.cidr, "/32")) {
+			glog.V(4).Infof("%s of pod %s/%s is impaired through the agent API, skipping it", t.cidr, t.pod.Namespace, t.pod.Name)
+			continue
+		}
+		if t.cidr == "" {
+			// the CIDR of the interface is unknown, so is the veth
+			desired.Partial = true
+		} else if err := desired.Add(t.veth, t.cidr, state.Owner{UID: string(t.pod.UID), Namespace: t.pod.Namespace, Name: t.pod.Name, Source: chaosSource(&t.pod)}, t.egress, t.ingress); err != nil {
+			t.err = err
+		} else {
+			desired.SetPeers(t.cidr, "egress", t.egressPeers)
+			desired.SetPeers(t.cidr, "ingress", t.ingressPeers)
+		}
+		resolved = append(resolved, t)
+	}
+	return desired, resolved
+}
+
+// chaosSource says where the chaos of a pod came from, for the audit log.
+func chaosSource(pod *v1.Pod) string {
+	if source := pod.Annotations[workload.SourceAnnotation]; source != "" {
+		return source
+	}
+	if experiment := pod.Labels[v1alpha1.ExperimentLabel]; experiment != "" {
+		return "Experiment/" + experiment
+	}
+	return "annotation"
+}
+
+// resolveTargets finds the CIDR, the veth and the peers of each target, a.workers at a time so a
+// slow lookup only holds up its own worker. A failed lookup only fails its target.
+func (a *agent) resolveTargets(targets []target, services *peers.Resolver) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < a.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if targets[i].err == nil {
+					targets[i].err = a.resolve(&targets[i], services)
+				}
+			}
+		}()
+	}
+	for i := range targets {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// resolve sets the CIDR, the veth and the peers of a target. A panic is turned into the target's
+// error rather than the agent's crash.
+func (a *agent) resolve(t *target, services *peers.Resolver) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Panic looking up %s of pod %s/%s: %v", t.iface, t.pod.Namespace, t.pod.Name, r)
+			err = fmt.Errorf("failed to fetch the veth name: %v", r)
+		}
+	}()
+	err = a.resolveInterface(t)
+	// the peers are resolved even if the veth isn't, so the classes of the CIDR are kept
+	if peersErr := a.resolvePeers(t, services); err == nil {
+		err = peersErr
+	}
+	return err
+}
+
+// resolvePeers sets the peers of the Services and hosts the target's specs name.
+func (a *agent) resolvePeers(t *target, services *peers.Resolver) error {
+	for _, d := range []struct {
+		info  string
+		peers *[]flow.Peer
+	}{{t.egress, &t.egressPeers}, {t.ingress, &t.ingressPeers}} {
+		if d.info == "" {
+			continue
+		}
+		spec, err := flow.ParseChaosSpec(d.info)
+		if err != nil {
+			return err
+		}
+		if len(spec.Services) == 0 && len(spec.Hosts) == 0 {
+			continue
+		}
+		if *d.peers, err = services.Resolve(t.pod.Namespace, spec.Services); err != nil {
+			return err
+		}
+		hostPeers, err := a.hosts.Resolve(spec.Hosts)
+		if err != nil {
+			return err
+		}
+		*d.peers = append(*d.peers, hostPeers...)
+	}
+	return nil
+}
+
+// resolveInterface sets the CIDR and the veth of a target. The pod's default interface is looked up
+// in calico's etcd, the interfaces Multus attached through the veth routing to the IP it reports
+// for them.
+func (a *agent) resolveInterface(t *target) error {
+	if t.iface != flow.DefaultInterface {
+		statuses, err := multus.Statuses(t.pod.Annotations)
+		if err != nil {
+			return err
+		}
+		s, err := multus.Find(statuses, t.pod.Namespace, t.iface)
+		if err != nil {
+			return err
+		}
+		if !s.Default && s.Interface != flow.DefaultInterface {
+			ip, err := s.IPv4()
+			if err != nil {
+				return err
+			}
+			t.cidr = fmt.Sprintf("%s/32", ip)
+			if t.veth, err = flow.PeerInterfaceForIP(ip); err != nil {
+				return fmt.Errorf("%s: %v", t.iface, err)
+			}
+			return nil
+		}
+	}
+	t.cidr = fmt.Sprintf("%s/32", t.pod.Status.PodIP) //192.168.0.10/32
+	var err error
+	t.veth, err = a.vethName(&t.pod)
+	return err
+}
+
+var vethRE = regexp.MustCompile("cali[a-f0-9]{11}")
+
+// vethName fetches the pod's veth name from calico's etcd.
+func (a *agent) vethName(pod *v1.Pod) (string, error) {
+	e := a.exec
+	//data, err := e.Command("etcdctl", "--endpoint=http://10.96.232.136:6666", "get", "/calico/v1/host/"+pod.Status.HostIP+"/workload/k8s/"+pod.Namespace+"."+pod.Name+"/endpoint/eth0").CombinedOutput()
+
+	//curl -L 10.10.102.80:2379/v2/keys/calico/v1/host/10.10.102.80/workload/k8s/kube-system.nfs-controller-d6dw8/endpoint/eth0
+	ctx, cancel := context.WithTimeout(context.Background(), a.etcdTimeout)
+	defer cancel()
+	cmd := e.CommandContext(ctx, "curl", "-sS", "-L", a.endpoint+"/v2/keys/calico/v1/host/"+pod.Status.HostIP+"/workload/k8s/"+pod.Namespace+"."+pod.Name+"/endpoint/"+flow.DefaultInterface)
+	var stdout, stderr bytes.Buffer
+	cmd.SetStdout(&stdout)
+	cmd.SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("etcd didn't answer within %v", a.etcdTimeout)
+		} else if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		glog.Errorf("Failed fetch pod %s interface name: %v", pod.Name, err)
+		return "", fmt.Errorf("failed to fetch the veth name: %v", err)
+	}
+	data := stdout.Bytes()
+	//get the pod's calico vethname
+	vethName := string(vethRE.Find(data)) //cali67801d38217
+	glog.V(4).Infof("pod %s's vethname is %s", pod.Name, vethName)
+	if vethName == "" {
+		return "", fmt.Errorf("no veth name in calico's endpoint")
+	}
+	return vethName, nil
+}
+
+// sync makes the chaos tc applies on the node the chaos of the pods, and corrects any drift. With
+// out set, the plan is printed to it, and only applied if apply is set too.
+func (a *agent) sync(out io.Writer, apply bool) {
+	a.reported = sets.String{}
+	if a.enforceHalt() {
+		if apply {
+			a.reporter.Prune(a.reported)
+		}
+		return
+	}
+	pods, err := a.selectPods()
+	if err != nil {
+		// without the pods the chaos is left as it is, until the grace period is over
+		glog.Errorf("Failed to select pods: %v", err)
+		if apply {
+			a.checkGracePeriod()
+		}
+		return
+	}
+	a.listed = time.Now()
+	if a.degraded {
+		glog.Infof("Listed the pods again, applying their chaos")
+		a.setDegraded(false)
+	}
+	targets, failed, err := a.applyChaos(out, a.targets(pods), apply)
+	if err == errHalted {
+		glog.V(2).Infof("Chaos was halted during the sync, not applying it")
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to apply chaos: %v", err)
+		return
+	}
+
+	// the failures of all the interfaces of a pod are reported together
+	podNames := map[string]string{}
+	podFailures := map[string][]string{}
+	targetPods := []*v1.Pod{}
+	for i, t := range targets {
+		if t.cidr != "" {
+			podNames[strings.TrimSuffix(t.cidr, "/32")] = t.pod.Namespace + "/" + t.pod.Name
+		}
+		uid := string(t.pod.UID)
+		if _, found := podFailures[uid]; !found {
+			podFailures[uid] = []string{}
+			targetPods = append(targetPods, &targets[i].pod)
+		}
+		for _, err := range []error{t.err, failed[t.cidr], failed[t.veth]} {
+			if err == nil {
+				continue
+			}
+			if t.iface != "" && t.iface != flow.DefaultInterface {
+				podFailures[uid] = append(podFailures[uid], t.iface+": "+err.Error())
+			} else {
+				podFailures[uid] = append(podFailures[uid], err.Error())
+			}
+		}
+		if failed[t.cidr] == flow.ErrClassSpaceExhausted {
+			a.eventf(&targets[i].pod, "ChaosClassSpaceExhausted", "No tc class left for chaos on node %s", a.hostname)
+		}
+		if t.cidr != "" {
+			glog.V(4).Infof("reconcile cidr %s with egressChaosInfo %s and ingressChaosInfo %s ", t.cidr, t.egress, t.ingress)
+		}
+	}
+	for _, pod := range targetPods {
+		failures := podFailures[string(pod.UID)]
+		switch {
+		case len(failures) > 0:
+			glog.Errorf("Failed to apply chaos to pod %s/%s: %s", pod.Namespace, pod.Name, strings.Join(failures, "; "))
+			a.reportState(pod, report.PhaseFailed, strings.Join(failures, "; "))
+		case apply:
+			a.reportState(pod, report.PhaseApplied, "")
+		}
+	}
+	for target, err := range failed {
+		if strings.HasPrefix(target, "ifb") {
+			glog.Errorf("Failed to init %s: %v", target, err)
+		}
+	}
+	a.api.SetPods(podNames)
+	if apply {
+		a.reporter.Prune(a.reported)
+	}
+}
+
+// errHalted is returned for chaos that isn't applied because chaos is halted.
+var errHalted = errors.New("chaos is halted")
+
+// applyChaos builds the chaos wanted from the targets and the impairments of the agent API, and
+// applies the plan turning the chaos on the node into it if apply is set, printing the plan to out
+// if it isn't nil. It returns the targets with the chaos wanted and the failures by CIDR or
+// interface, or an error if the tc state can't be read or chaos was halted meanwhile.
+func (a *agent) applyChaos(out io.Writer, targets []target, apply bool) ([]target, map[string]error, error) {
+	// the impairments of the agent API can't change from reading them to applying the plan
+	a.apiLock.Lock()
+	defer a.apiLock.Unlock()
+	if apply {
+		a.applied = targets
+	}
+	return a.applyLocked(out, targets, apply)
+}
+
+// applyImpairments applies the chaos of the last sync with the impairments of the agent API, for
+// the API, which holds apiLock.
+func (a *agent) applyImpairments() (map[string]error, error) {
+	if a.applied == nil {
+		return nil, errors.New("the agent hasn't synced yet")
+	}
+	_, failed, err := a.applyLocked(nil, a.applied, true)
+	return failed, err
+}
+
+// applyLocked is applyChaos under apiLock.
+func (a *agent) applyLocked(out io.Writer, targets []target, apply bool) ([]target, map[string]error, error) {
+	desired, targets := a.desired(targets)
+	// the ifbs are locked from reading them to applying the plan, so their classes can't change
+	// in between, the plan's veths are locked while it is applied
+	unlock := flow.LockDevices("ifb0", "ifb1")
+	defer unlock()
+	// a halt enforced since the sync started removed the chaos this plan would put back
+	if atomic.LoadInt32(&a.halted) == 1 {
+		a.previous = nil
+		return nil, nil, errHalted
+	}
+	observed, err := flow.Observe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the tc state: %v", err)
+	}
+	plan := flow.Diff(desired, observed, a.previous)
+	if out != nil {
+		for _, op := range plan {
+			if op.Args != nil || op.Reason != "" {
+				fmt.Fprintln(out, op.String())
+			}
+		}
+	}
+	if drift := plan.Drift(); drift > 0 && !a.dryRun {
+		driftMetrics.Add("syncs", 1)
+		driftMetrics.Add("operations", int64(drift))
+		for _, op := range plan {
+			if op.Drift {
+				glog.Warningf("Correcting drift: %s", op)
+			}
+		}
+	}
+	failed := map[string]error{}
+	if apply {
+		veths := []string{}
+		for _, dev := range plan.Devices() {
+			if dev != "ifb0" && dev != "ifb1" {
+				veths = append(veths, dev)
+			}
+		}
+		unlockVeths := flow.LockDevices(veths...)
+		failed = plan.Apply()
+		unlockVeths()
+	}
+	if apply && len(failed) == 0 && !a.dryRun {
+		a.previous = desired
+	}
+	return targets, failed, nil
+}
+
+// setHalt is called with the halt ConfigMap whenever it changes, nil if it doesn't exist. A halt
+// removes all chaos at once, and refuses new chaos until it is lifted.
+func (a *agent) setHalt(cm *v1.ConfigMap) {
+	a.haltLock.Lock()
+	was := a.halt
+	if halt.Halted(cm) {
+		if was == nil {
+			glog.Warningf("Chaos is halted by ConfigMap %s/%s, removing all chaos", cm.Namespace, cm.Name)
+			a.complied = false
+		}
+		a.halt = cm
+		atomic.StoreInt32(&a.halted, 1)
+	} else {
+		if was != nil {
+			glog.Infof("Chaos halt lifted")
+			if a.recorder != nil {
+				// the next halt is reported again
+				a.recorder.Forget(was, "ChaosHalted")
+			}
+		}
+		a.halt = nil
+		atomic.StoreInt32(&a.halted, 0)
+	}
+	a.haltLock.Unlock()
+	a.refuseAPI()
+	a.enforceHalt()
+}
+
+// enforceHalt removes all chaos while chaos is halted, the same way as the extra chaos of a sync,
+// and reports once per halt that the node complied. It returns whether chaos is halted.
+func (a *agent) enforceHalt() bool {
+	a.haltLock.Lock()
+	defer a.haltLock.Unlock()
+	if a.halt == nil {
+		return false
+	}
+	if err := a.removeAllChaos(); err != nil {
+		glog.Errorf("Failed to remove all chaos for the halt: %v", err)
+		return true
+	}
+	if !a.complied {
+		a.complied = true
+		glog.Infof("Removed all chaos for the halt")
+		if a.recorder != nil {
+			a.recorder.Eventf(a.halt, v1.EventTypeNormal, "ChaosHalted", "Removed all chaos from node %s", a.hostname)
+		}
+	}
+	return true
+}
+
+// removeAllChaos removes the chaos of the node, the way the extra chaos of a sync is removed, and
+// the impairments of the agent API.
+func (a *agent) removeAllChaos() error {
+	// the agent API can't add chaos meanwhile
+	a.apiLock.Lock()
+	defer a.apiLock.Unlock()
+	for _, e := range a.manual.List() {
+		a.manual.Delete(e.IP)
+	}
+	// nor put back the chaos of the last sync
+	a.previous = nil
+	a.applied = nil
+	return flow.DeleteExtraChaos(nil, nil)
+}
+
+// checkGracePeriod removes all chaos and marks the agent degraded once it has failed to list the
+// pods for the grace period. Chaos nothing can remove, e.g. because the partition cutting the
+// agent off the API server is the chaos, must not outlive it.
+func (a *agent) checkGracePeriod() {
+	if a.gracePeriod <= 0 || time.Since(a.listed) < a.gracePeriod {
+		return
+	}
+	if !a.degraded {
+		glog.Errorf("Failed to list the pods for %s, removing all chaos", time.Since(a.listed).Round(time.Second))
+		a.setDegraded(true)
+	}
+	// until the pods are listed again, in case the chaos was applied before the last failures
+	if err := a.removeAllChaos(); err != nil {
+		glog.Errorf("Failed to remove all chaos: %v", err)
+	}
+}
+
+func (a *agent) setDegraded(degraded bool) {
+	a.haltLock.Lock()
+	a.degraded = degraded
+	a.haltLock.Unlock()
+	value := &expvar.Int{}
+	if degraded {
+		value.Set(1)
+	}
+	agentMetrics.Set("degraded", value)
+	a.refuseAPI()
+}
+
+// refuseAPI makes the agent API refuse impairments while chaos is halted or the agent is
+// degraded.
+func (a *agent) refuseAPI() {
+	a.haltLock.Lock()
+	defer a.haltLock.Unlock()
+	switch {
+	case a.halt != nil:
+		a.api.Refuse("chaos is halted cluster-wide")
+	case a.degraded:
+		a.api.Refuse("the agent can't reach the API server, it removed all chaos")
+	default:
+		a.api.Refuse("")
+	}
+}
+
+// serveHealthz fails while the agent is degraded.
+func (a *agent) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	a.haltLock.Lock()
+	degraded := a.degraded
+	a.haltLock.Unlock()
+	if degraded {
+		http.Error(w, "degraded: the agent can't reach the API server, it removed all chaos", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/agentapi"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/tcsim"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const veth = "cali67801d38217"
+
+func TestHaltDuringSync(t *testing.T) {
+	sim := tcsim.New()
+	sim.AddLink(veth, "veth")
+	flow.SetExec(sim)
+	defer flow.SetExec(exec.New())
+	if err := flow.InitIfbModule(); err != nil {
+		t.Fatal(err)
+	}
+	a := &agent{manual: agentapi.NewStore(), apiLock: &sync.Mutex{}, hostname: "node-1"}
+	a.api = agentapi.NewServer(a.manual, "", time.Hour, a.apiLock, a.applyImpairments)
+	targets := []target{{
+		pod:    v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"}},
+		veth:   veth,
+		cidr:   "192.168.0.10/32",
+		egress: "delay=100ms",
+	}}
+	netem := func() bool {
+		out, err := sim.Run("tc", "qdisc", "show", "dev", "ifb0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(string(out), "netem")
+	}
+	if _, failed, err := a.applyChaos(nil, targets, true); err != nil || len(failed) > 0 {
+		t.Fatalf("expected the chaos applied, got %v and %v", err, failed)
+	}
+	if !netem() {
+		t.Fatal("expected a netem qdisc")
+	}
+
+	// the sync has selected its pods when the halt arrives, whichever of them takes the locks first
+	// the chaos must be gone
+	a.apiLock.Lock()
+	synced := make(chan error)
+	go func() {
+		_, _, err := a.applyChaos(nil, targets, true)
+		synced <- err
+	}()
+	halted := make(chan struct{})
+	go func() {
+		a.setHalt(&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Namespace: "kube-system", Name: "kube-chaos-halt"},
+			Data:       map[string]string{"halt": "true"},
+		})
+		close(halted)
+	}()
+	for atomic.LoadInt32(&a.halted) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	a.apiLock.Unlock()
+	if err := <-synced; err != errHalted {
+		t.Errorf("expected the sync to not apply chaos during the halt, got %v", err)
+	}
+	<-halted
+	if netem() {
+		t.Errorf("expected no netem qdisc during the halt")
+	}
+	if !a.complied {
+		t.Errorf("expected the halt complied with")
+	}
+}
+
+func TestDryRunSyncs(t *testing.T) {
+	sim := tcsim.New()
+	sim.AddLink(veth, "veth")
+	d := exec.NewDryRun(sim)
+	flow.SetExec(d)
+	defer flow.SetExec(exec.New())
+	a := &agent{manual: agentapi.NewStore(), apiLock: &sync.Mutex{}, hostname: "node-1", exec: d, dryRun: true}
+	targets := []target{{
+		pod:    v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"}},
+		veth:   veth,
+		cidr:   "192.168.0.10/32",
+		egress: "delay=100ms",
+	}}
+	drift := func() string {
+		if v := driftMetrics.Get("operations"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	before := drift()
+	var first string
+	for i := 0; i < 3; i++ {
+		var out strings.Builder
+		if _, failed, err := a.applyChaos(&out, targets, true); err != nil || len(failed) > 0 {
+			t.Fatalf("sync %d: expected the chaos planned, got %v and %v", i, err, failed)
+		}
+		if i == 0 {
+			first = out.String()
+		} else if out.String() != first {
+			t.Errorf("sync %d: expected the same plan as the first sync, got %q instead of %q", i, out.String(), first)
+		}
+	}
+	if first == "" {
+		t.Errorf("expected the chaos planned")
+	}
+	if after := drift(); after != before {
+		t.Errorf("expected no drift counted, got %s operations instead of %s", after, before)
+	}
+	if a.previous != nil {
+		t.Errorf("expected no chaos recorded as applied")
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/client"
+	"github.com/huanwei/kube-chaos/pkg/experiment"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/record"
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func main() {
+	var (
+		kubeconfig   string
+		syncDuration int
+		allowNS      string
+		denyNS       string
+		profilesDir  string
+	)
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file, empty to use the in-cluster config")
+	flag.IntVar(&syncDuration, "syncDuration", 10, "sync duration(seconds)")
+	flag.StringVar(&allowNS, "allowNamespaces", "", "comma separated namespaces experiments may target, empty means all")
+	flag.StringVar(&denyNS, "denyNamespaces", "", "comma separated namespaces experiments must never target, in addition to "+strings.Join(safeguard.CriticalNamespaces, ","))
+	flag.StringVar(&profilesDir, "profilesDir", "", "directory of network profiles adding to the built-in ones, a ConfigMap mounted as a volume with a key per profile holding its chaos info, e.g. 3g-poor: delay=250ms,jitter=100ms,rate=400kbit, and a key per trace chaos can replay ending in .csv; the agent, the webhook and the controller need the same profiles")
+	flag.Parse()
+
+	if err := flow.LoadProfiles(profilesDir); err != nil {
+		glog.Fatalf("Invalid network profiles: %v", err)
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	chaosClient, err := client.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	hostname, _ := os.Hostname()
+	recorder := record.NewEventRecorder(kubeClient, "kube-chaos-controller", hostname)
+	policy := safeguard.NewPolicy(strings.Split(allowNS, ","), strings.Split(denyNS, ","), "", "")
+
+	glog.Infof("Starting experiment controller")
+	experiment.NewController(kubeClient, chaosClient, policy, recorder).Run(time.Duration(syncDuration)*time.Second, make(chan struct{}))
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	"github.com/huanwei/kube-chaos/pkg/webhook"
+)
+
+func main() {
+	var (
+		addr        string
+		certFile    string
+		keyFile     string
+		certDir     string
+		selfSigned  string
+		allowNS     string
+		denyNS      string
+		profilesDir string
+	)
+	flag.StringVar(&addr, "addr", ":8443", "address to serve the webhook on")
+	flag.StringVar(&certFile, "tlsCertFile", "", "serving certificate")
+	flag.StringVar(&keyFile, "tlsKeyFile", "", "serving key")
+	flag.StringVar(&certDir, "certDir", "/tmp/kube-chaos-webhook", "where to keep the self-signed certificate")
+	flag.StringVar(&selfSigned, "selfSignedHost", "", "generate a self-signed certificate for this host (and the comma separated names after it) when no certificate is given, for local testing, e.g. kube-chaos-webhook.kube-system.svc")
+	flag.StringVar(&allowNS, "allowNamespaces", "", "comma separated namespaces chaos may be applied in, empty means all")
+	flag.StringVar(&denyNS, "denyNamespaces", "", "comma separated namespaces chaos must never be applied in, in addition to "+strings.Join(safeguard.CriticalNamespaces, ","))
+	flag.StringVar(&profilesDir, "profilesDir", "", "directory of network profiles adding to the built-in ones, a ConfigMap mounted as a volume with a key per profile holding its chaos info, e.g. 3g-poor: delay=250ms,jitter=100ms,rate=400kbit, and a key per trace chaos can replay ending in .csv; the agent, the webhook and the controller need the same profiles")
+	flag.Parse()
+
+	if err := flow.LoadProfiles(profilesDir); err != nil {
+		glog.Fatalf("Invalid network profiles: %v", err)
+	}
+
+	if certFile == "" || keyFile == "" {
+		if selfSigned == "" {
+			glog.Fatalf("Either --tlsCertFile and --tlsKeyFile or --selfSignedHost is required")
+		}
+		names := strings.Split(selfSigned, ",")
+		var err error
+		certFile, keyFile, err = webhook.EnsureSelfSignedCert(certDir, names[0], names[1:])
+		if err != nil {
+			glog.Fatalf("Failed to generate a self-signed certificate: %v", err)
+		}
+	}
+
+	policy := safeguard.NewPolicy(strings.Split(allowNS, ","), strings.Split(denyNS, ","), "", "")
+	mux := http.NewServeMux()
+	mux.Handle("/validate", webhook.NewValidator(policy))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	glog.Infof("Serving the chaos validating webhook on %s", addr)
+	glog.Fatal(http.ListenAndServeTLS(addr, certFile, keyFile, mux))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+)
+
+// impairment holds the typed flags of the apply command.
+type impairment struct {
+	direction     string
+	delay         time.Duration
+	jitter        time.Duration
+	loss          float64
+	duplicate     float64
+	reorder       float64
+	reorderRelate float64
+	rate          string
+	ordinals      string
+}
+
+var applyFlags impairment
+
+func addApplyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&applyFlags.direction, "direction", "egress", "traffic to impair: egress, ingress or both")
+	fs.DurationVar(&applyFlags.delay, "delay", 0, "delay added to every packet, e.g. 100ms")
+	fs.DurationVar(&applyFlags.jitter, "jitter", 0, "random variation of the delay, e.g. 10ms")
+	fs.Float64Var(&applyFlags.loss, "loss", 0, "percentage of packets to drop")
+	fs.Float64Var(&applyFlags.duplicate, "duplicate", 0, "percentage of packets to duplicate")
+	fs.Float64Var(&applyFlags.reorder, "reorder", 0, "percentage of packets to send without delay, out of order")
+	fs.Float64Var(&applyFlags.reorderRelate, "reorder-relate", 0, "correlation of reordering with the previous packet, in percent")
+	fs.StringVar(&applyFlags.rate, "rate", "", "bandwidth limit, e.g. 1mbit")
+	fs.StringVar(&applyFlags.ordinals, "ordinals", "", "pods of StatefulSets to impair, e.g. 0,2-3, by default all of them")
+}
+
+// info returns the chaos info of the impairment, checked with the parser the agent uses.
+func (i *impairment) info() (string, error) {
+	spec := &flow.ChaosSpec{
+		Delay:         i.delay,
+		Jitter:        i.jitter,
+		Loss:          i.loss,
+		Duplicate:     i.duplicate,
+		Reorder:       i.reorder,
+		ReorderRelate: i.reorderRelate,
+		Rate:          i.rate,
+	}
+	info := spec.String()
+	if info == "" {
+		return "", fmt.Errorf("no impairment given, set at least one of --delay, --loss, --duplicate, --reorder or --rate")
+	}
+	if _, err := flow.ParseChaosSpec(info); err != nil {
+		return "", err
+	}
+	return info, nil
+}
+
+// annotations returns the annotations that apply the impairment to obj. The agent needs both
+// chaos annotations, so the direction that isn't impaired keeps its current info or gets none.
+func (i *impairment) annotations(obj object) (map[string]*string, error) {
+	info, err := i.info()
+	if err != nil {
+		return nil, err
+	}
+	egress, ingress := obj.Annotations[flow.EgressChaosAnnotation], obj.Annotations[flow.IngressChaosAnnotation]
+	switch i.direction {
+	case "egress":
+		egress = info
+	case "ingress":
+		ingress = info
+	case "both":
+		egress, ingress = info, info
+	default:
+		return nil, fmt.Errorf("unknown direction %q, expected egress, ingress or both", i.direction)
+	}
+	annotations := map[string]*string{
+		flow.EgressChaosAnnotation:  &egress,
+		flow.IngressChaosAnnotation: &ingress,
+	}
+	if i.ordinals != "" {
+		if obj.Kind != statefulSetKind.name {
+			return nil, fmt.Errorf("%s: --ordinals only applies to StatefulSets", obj.String())
+		}
+		if _, err := workload.ParseOrdinals(i.ordinals); err != nil {
+			return nil, err
+		}
+		annotations[workload.OrdinalsAnnotation] = &i.ordinals
+	}
+	return annotations, nil
+}
+
+// change is an object whose annotations are, or would be with --dry-run, patched.
+type change struct {
+	object
+	Annotations map[string]*string `json:"annotations"`
+}
+
+func runApply(o *options, args []string) error {
+	if len(args) == 0 && o.selector == "" {
+		return fmt.Errorf("give the objects to impair as TYPE/NAME, or a TYPE and a --selector")
+	}
+	objects, err := o.findObjects(args, []*kind{podKind})
+	if err != nil {
+		return err
+	}
+	changes := []change{}
+	for _, obj := range objects {
+		if experiment := obj.Labels[v1alpha1.ExperimentLabel]; obj.Kind == podKind.name && experiment != "" {
+			fmt.Fprintf(o.errOut, "warning: skipping %s, its chaos is managed by experiment %s\n", obj.String(), experiment)
+			continue
+		}
+		annotations, err := applyFlags.annotations(obj)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change{object: obj, Annotations: annotations})
+	}
+	return o.patchAll(changes)
+}
+
+// patchAll patches the changes, unless it's a dry run, and prints them.
+func (o *options) patchAll(changes []change) error {
+	if len(changes) == 0 && o.output == "" {
+		fmt.Fprintln(o.errOut, "No resources found.")
+		return nil
+	}
+	for _, c := range changes {
+		if !o.dryRun {
+			if err := o.patchAnnotations(c.object, c.Annotations); err != nil {
+				return fmt.Errorf("%s: %v", c.object.String(), err)
+			}
+		}
+		if o.output == "" {
+			suffix := ""
+			if o.dryRun {
+				suffix = " (dry run)"
+			}
+			fmt.Fprintf(o.out, "%s patched%s\n", c.object.String(), suffix)
+		}
+	}
+	_, err := o.print(changes)
+	return err
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+)
+
+func TestImpairmentAnnotations(t *testing.T) {
+	existing := object{Kind: "Pod", Name: "web-0", Annotations: map[string]string{
+		flow.EgressChaosAnnotation:  "loss=1%",
+		flow.IngressChaosAnnotation: "delay=10ms",
+	}}
+	tests := []struct {
+		name        string
+		impairment  impairment
+		obj         object
+		annotations map[string]string
+		err         bool
+	}{
+		{
+			name:        "egress on a pod without chaos",
+			impairment:  impairment{direction: "egress", delay: 100 * time.Millisecond, jitter: 10 * time.Millisecond},
+			obj:         object{Kind: "Pod", Name: "web-0"},
+			annotations: map[string]string{flow.EgressChaosAnnotation: "delay=100ms,jitter=10ms", flow.IngressChaosAnnotation: ""},
+		},
+		{
+			name:        "ingress keeps the egress chaos",
+			impairment:  impairment{direction: "ingress", loss: 2.5},
+			obj:         existing,
+			annotations: map[string]string{flow.EgressChaosAnnotation: "loss=1%", flow.IngressChaosAnnotation: "loss=2.5%"},
+		},
+		{
+			name:        "both",
+			impairment:  impairment{direction: "both", rate: "1mbit"},
+			obj:         existing,
+			annotations: map[string]string{flow.EgressChaosAnnotation: "rate=1mbit", flow.IngressChaosAnnotation: "rate=1mbit"},
+		},
+		{
+			name:       "ordinals",
+			impairment: impairment{direction: "egress", loss: 5, ordinals: "0,2"},
+			obj:        object{Kind: "StatefulSet", Name: "db"},
+			annotations: map[string]string{
+				flow.EgressChaosAnnotation:  "loss=5%",
+				flow.IngressChaosAnnotation: "",
+				workload.OrdinalsAnnotation: "0,2",
+			},
+		},
+		{
+			name:       "ordinals of a deployment",
+			impairment: impairment{direction: "egress", loss: 5, ordinals: "0"},
+			obj:        object{Kind: "Deployment", Name: "web"},
+			err:        true,
+		},
+		{
+			name:       "no impairment",
+			impairment: impairment{direction: "egress"},
+			obj:        existing,
+			err:        true,
+		},
+		{
+			name:       "jitter without delay",
+			impairment: impairment{direction: "egress", jitter: time.Millisecond},
+			obj:        existing,
+			err:        true,
+		},
+		{
+			name:       "loss over 100%",
+			impairment: impairment{direction: "egress", loss: 101},
+			obj:        existing,
+			err:        true,
+		},
+		{
+			name:       "unknown direction",
+			impairment: impairment{direction: "sideways", loss: 1},
+			obj:        existing,
+			err:        true,
+		},
+	}
+	for _, test := range tests {
+		annotations, err := test.impairment.annotations(test.obj)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(annotations) != len(test.annotations) {
+			t.Errorf("%s: expected %d annotations, got %d", test.name, len(test.annotations), len(annotations))
+		}
+		for key, expected := range test.annotations {
+			if value := annotations[key]; value == nil || *value != expected {
+				t.Errorf("%s: expected %s=%q, got %v", test.name, key, expected, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+)
+
+func runClear(o *options, args []string) error {
+	objects, err := o.findObjects(args, allKinds)
+	if err != nil {
+		return err
+	}
+	changes := []change{}
+	for _, obj := range objects {
+		if !hasChaos(obj) {
+			continue
+		}
+		if experiment := obj.Labels[v1alpha1.ExperimentLabel]; obj.Kind == podKind.name && experiment != "" {
+			fmt.Fprintf(o.errOut, "warning: skipping %s, its chaos is managed by experiment %s, delete the experiment to clear it\n", obj.String(), experiment)
+			continue
+		}
+		changes = append(changes, change{object: obj, Annotations: map[string]*string{
+			flow.EgressChaosAnnotation:  nil,
+			flow.IngressChaosAnnotation: nil,
+			workload.OrdinalsAnnotation: nil,
+		}})
+	}
+	return o.patchAll(changes)
+}
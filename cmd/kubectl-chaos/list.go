@@ -0,0 +1,112 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/report"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podChaos is a pod under chaos and the state its agent reported.
+type podChaos struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Node      string `json:"node,omitempty"`
+	Egress    string `json:"egress,omitempty"`
+	Ingress   string `json:"ingress,omitempty"`
+	// Source is where the chaos comes from, "Pod" for the pod's own annotations.
+	Source string        `json:"source,omitempty"`
+	State  *report.State `json:"state,omitempty"`
+}
+
+// phase is the phase the agent reported, or Pending if it hasn't yet.
+func (p *podChaos) phase() string {
+	if p.State == nil {
+		return "Pending"
+	}
+	return p.State.Phase
+}
+
+// listPodChaos returns the pods with chaos annotations, and the pods the agents reported a state
+// for, which includes the ones that inherit chaos from a workload or service.
+func (o *options) listPodChaos() ([]podChaos, error) {
+	pods, err := o.kube.CoreV1().Pods(o.listNamespace()).List(meta_v1.ListOptions{LabelSelector: o.selector})
+	if err != nil {
+		return nil, err
+	}
+	result := []podChaos{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		state := report.GetState(pod)
+		if state == nil && !flow.HasChaosAnnotations(pod.Annotations) {
+			continue
+		}
+		result = append(result, newPodChaos(pod, state))
+	}
+	return result, nil
+}
+
+func newPodChaos(pod *v1.Pod, state *report.State) podChaos {
+	p := podChaos{Namespace: pod.Namespace, Name: pod.Name, Node: pod.Spec.NodeName, State: state}
+	if flow.HasChaosAnnotations(pod.Annotations) {
+		p.Egress = pod.Annotations[flow.EgressChaosAnnotation]
+		p.Ingress = pod.Annotations[flow.IngressChaosAnnotation]
+		p.Source = "Pod"
+	} else if state != nil {
+		p.Egress, p.Ingress, p.Source = state.Egress, state.Ingress, state.Source
+	}
+	return p
+}
+
+func runList(o *options, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("list takes no arguments")
+	}
+	pods, err := o.listPodChaos()
+	if err != nil {
+		return err
+	}
+	if printed, err := o.print(pods); printed {
+		return err
+	}
+	if len(pods) == 0 {
+		fmt.Fprintln(o.errOut, "No pods under chaos.")
+		return nil
+	}
+	w := tabwriter.NewWriter(o.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tNODE\tEGRESS\tINGRESS\tSOURCE\tSTATE\tMESSAGE")
+	for _, p := range pods {
+		message := ""
+		if p.State != nil {
+			message = p.State.Message
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Namespace, p.Name, orNone(p.Node), orNone(p.Egress), orNone(p.Ingress), orNone(p.Source), p.phase(), message)
+	}
+	return w.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-chaos is a kubectl plugin to manage chaos, installed on the PATH it runs as
+// "kubectl chaos".
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/huanwei/kube-chaos/pkg/client"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const usage = `kubectl chaos manages the network chaos of pods and workloads.
+
+Usage:
+  kubectl chaos apply [TYPE[/NAME]...] [-l selector] --delay=100ms --loss=1 ...
+  kubectl chaos list [-A] [-o json|yaml]
+  kubectl chaos clear [TYPE[/NAME]...] [-l selector] [--dry-run]
+  kubectl chaos status [-A] [-o json|yaml]
+
+Run "kubectl chaos COMMAND -h" for the flags of a command.
+`
+
+type command struct {
+	run func(o *options, args []string) error
+	// addFlags registers the command's own flags, if it has any.
+	addFlags func(fs *flag.FlagSet)
+}
+
+var commands = map[string]command{
+	"apply":  {run: runApply, addFlags: addApplyFlags},
+	"list":   {run: runList},
+	"clear":  {run: runClear},
+	"status": {run: runStatus},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	cmd, found := commands[os.Args[1]]
+	if !found {
+		if os.Args[1] != "-h" && os.Args[1] != "--help" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "error: unknown command %q\n\n", os.Args[1])
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("kubectl chaos "+os.Args[1], flag.ExitOnError)
+	o := &options{out: os.Stdout, errOut: os.Stderr}
+	o.addFlags(fs)
+	if cmd.addFlags != nil {
+		cmd.addFlags(fs)
+	}
+	args, _ := parseInterspersed(fs, os.Args[2:])
+	if err := o.complete(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cmd.run(o, args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseInterspersed parses the flags of args wherever they are, like kubectl does, e.g.
+// "apply deploy/web --delay=100ms -n prod", and returns the other arguments. The flag package stops
+// at the first of them. Arguments after "--" are never flags.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// options are the flags shared by all commands, and the clients built from them.
+type options struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+	selector      string
+	output        string
+	dryRun        bool
+
+	kube   kubernetes.Interface
+	chaos  client.Interface
+	out    io.Writer
+	errOut io.Writer
+}
+
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "path to the kubeconfig file, by default the one kubectl uses")
+	fs.StringVar(&o.context, "context", "", "the kubeconfig context to use")
+	fs.StringVar(&o.namespace, "namespace", "", "the namespace, by default the one of the kubeconfig context")
+	fs.StringVar(&o.namespace, "n", "", "shorthand for --namespace")
+	fs.BoolVar(&o.allNamespaces, "all-namespaces", false, "work on all namespaces")
+	fs.BoolVar(&o.allNamespaces, "A", false, "shorthand for --all-namespaces")
+	fs.StringVar(&o.selector, "selector", "", "label selector of the objects, e.g. app=web")
+	fs.StringVar(&o.selector, "l", "", "shorthand for --selector")
+	fs.StringVar(&o.output, "output", "", "output format, json or yaml")
+	fs.StringVar(&o.output, "o", "", "shorthand for --output")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "only print what would change")
+}
+
+// complete validates the flags and builds the clients, the kubeconfig is loaded like kubectl does.
+func (o *options) complete() error {
+	if o.output != "" && o.output != "json" && o.output != "yaml" {
+		return fmt.Errorf("unknown output format %q, expected json or yaml", o.output)
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: o.context}
+	if o.namespace != "" {
+		overrides.Context.Namespace = o.namespace
+	}
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+	namespace, _, err := loader.Namespace()
+	if err != nil {
+		return err
+	}
+	o.namespace = namespace
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return err
+	}
+	if o.kube, err = kubernetes.NewForConfig(config); err != nil {
+		return err
+	}
+	o.chaos, err = client.NewForConfig(config)
+	return err
+}
+
+// listNamespace is the namespace to list objects in, empty for all of them.
+func (o *options) listNamespace() string {
+	if o.allNamespaces {
+		return ""
+	}
+	return o.namespace
+}
+
+// print writes obj in the -o format, it returns false if there is none so the caller prints a table.
+func (o *options) print(obj interface{}) (bool, error) {
+	var data []byte
+	var err error
+	switch o.output {
+	case "json":
+		data, err = json.MarshalIndent(obj, "", "    ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(obj)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	_, err = o.out.Write(data)
+	return true, err
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
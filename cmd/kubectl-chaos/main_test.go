@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	defer func() { applyFlags = impairment{} }()
+	tests := []struct {
+		args       []string
+		positional []string
+		namespace  string
+		dryRun     bool
+		delay      time.Duration
+	}{
+		{
+			args:       []string{"deploy/web", "--delay=100ms", "-n", "prod", "--dry-run"},
+			positional: []string{"deploy/web"},
+			namespace:  "prod",
+			dryRun:     true,
+			delay:      100 * time.Millisecond,
+		},
+		{
+			args:       []string{"-n", "prod", "deploy/web", "sts/db", "--delay", "50ms"},
+			positional: []string{"deploy/web", "sts/db"},
+			namespace:  "prod",
+			delay:      50 * time.Millisecond,
+		},
+		{
+			args:       []string{"pod/web-0", "--", "--dry-run"},
+			positional: []string{"pod/web-0", "--dry-run"},
+		},
+		{
+			args:       []string{},
+			positional: []string{},
+		},
+	}
+	for _, test := range tests {
+		applyFlags = impairment{}
+		o := &options{}
+		fs := flag.NewFlagSet("kubectl chaos apply", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		o.addFlags(fs)
+		addApplyFlags(fs)
+		positional, err := parseInterspersed(fs, test.args)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(positional, test.positional) {
+			t.Errorf("%v: expected arguments %v, got %v", test.args, test.positional, positional)
+		}
+		if o.namespace != test.namespace || o.dryRun != test.dryRun || applyFlags.delay != test.delay {
+			t.Errorf("%v: expected namespace %q, dry run %v and delay %v, got %q, %v and %v", test.args, test.namespace, test.dryRun, test.delay, o.namespace, o.dryRun, applyFlags.delay)
+		}
+	}
+
+	fs := flag.NewFlagSet("kubectl chaos apply", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	addApplyFlags(fs)
+	if _, err := parseInterspersed(fs, []string{"deploy/web", "--delay=soon"}); err == nil {
+		t.Errorf("expected an invalid flag after the arguments to fail")
+	}
+}
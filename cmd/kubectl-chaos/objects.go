@@ -0,0 +1,224 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// object is a pod, workload or service that can carry chaos annotations.
+type object struct {
+	Kind        string            `json:"kind"`
+	Namespace   string            `json:"namespace"`
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"-"`
+	Annotations map[string]string `json:"-"`
+}
+
+func (obj *object) String() string {
+	return strings.ToLower(obj.Kind) + "/" + obj.Name
+}
+
+// kind lists and patches the objects of one resource.
+type kind struct {
+	name  string
+	list  func(c kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]object, error)
+	patch func(c kubernetes.Interface, namespace, name string, data []byte) error
+}
+
+var (
+	podKind = &kind{
+		name: "Pod",
+		list: func(c kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]object, error) {
+			list, err := c.CoreV1().Pods(namespace).List(opts)
+			if err != nil {
+				return nil, err
+			}
+			objects := []object{}
+			for _, item := range list.Items {
+				objects = append(objects, newObject("Pod", item.ObjectMeta))
+			}
+			return objects, nil
+		},
+		patch: func(c kubernetes.Interface, namespace, name string, data []byte) error {
+			_, err := c.CoreV1().Pods(namespace).Patch(name, types.MergePatchType, data)
+			return err
+		},
+	}
+	deploymentKind = &kind{
+		name: "Deployment",
+		list: func(c kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]object, error) {
+			list, err := c.AppsV1().Deployments(namespace).List(opts)
+			if err != nil {
+				return nil, err
+			}
+			objects := []object{}
+			for _, item := range list.Items {
+				objects = append(objects, newObject("Deployment", item.ObjectMeta))
+			}
+			return objects, nil
+		},
+		patch: func(c kubernetes.Interface, namespace, name string, data []byte) error {
+			_, err := c.AppsV1().Deployments(namespace).Patch(name, types.MergePatchType, data)
+			return err
+		},
+	}
+	statefulSetKind = &kind{
+		name: "StatefulSet",
+		list: func(c kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]object, error) {
+			list, err := c.AppsV1().StatefulSets(namespace).List(opts)
+			if err != nil {
+				return nil, err
+			}
+			objects := []object{}
+			for _, item := range list.Items {
+				objects = append(objects, newObject("StatefulSet", item.ObjectMeta))
+			}
+			return objects, nil
+		},
+		patch: func(c kubernetes.Interface, namespace, name string, data []byte) error {
+			_, err := c.AppsV1().StatefulSets(namespace).Patch(name, types.MergePatchType, data)
+			return err
+		},
+	}
+	daemonSetKind = &kind{
+		name: "DaemonSet",
+		list: func(c kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]object, error) {
+			list, err := c.AppsV1().DaemonSets(namespace).List(opts)
+			if err != nil {
+				return nil, err
+			}
+			objects := []object{}
+			for _, item := range list.Items {
+				objects = append(objects, newObject("DaemonSet", item.ObjectMeta))
+			}
+			return objects, nil
+		},
+		patch: func(c kubernetes.Interface, namespace, name string, data []byte) error {
+			_, err := c.AppsV1().DaemonSets(namespace).Patch(name, types.MergePatchType, data)
+			return err
+		},
+	}
+	serviceKind = &kind{
+		name: "Service",
+		list: func(c kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]object, error) {
+			list, err := c.CoreV1().Services(namespace).List(opts)
+			if err != nil {
+				return nil, err
+			}
+			objects := []object{}
+			for _, item := range list.Items {
+				objects = append(objects, newObject("Service", item.ObjectMeta))
+			}
+			return objects, nil
+		},
+		patch: func(c kubernetes.Interface, namespace, name string, data []byte) error {
+			_, err := c.CoreV1().Services(namespace).Patch(name, types.MergePatchType, data)
+			return err
+		},
+	}
+
+	// allKinds are the kinds the agent expands chaos annotations of, in the order they are cleared.
+	allKinds = []*kind{deploymentKind, statefulSetKind, daemonSetKind, serviceKind, podKind}
+
+	kindNames = map[string]*kind{
+		"pod": podKind, "pods": podKind, "po": podKind,
+		"deployment": deploymentKind, "deployments": deploymentKind, "deploy": deploymentKind,
+		"statefulset": statefulSetKind, "statefulsets": statefulSetKind, "sts": statefulSetKind,
+		"daemonset": daemonSetKind, "daemonsets": daemonSetKind, "ds": daemonSetKind,
+		"service": serviceKind, "services": serviceKind, "svc": serviceKind,
+	}
+)
+
+func newObject(kind string, meta meta_v1.ObjectMeta) object {
+	return object{Kind: kind, Namespace: meta.Namespace, Name: meta.Name, Labels: meta.Labels, Annotations: meta.Annotations}
+}
+
+// findObjects returns the objects named by args, each one TYPE or TYPE/NAME, filtered by the
+// label selector. Without args it returns the objects of defaultKinds.
+func (o *options) findObjects(args []string, defaultKinds []*kind) ([]object, error) {
+	type query struct {
+		kind *kind
+		name string
+	}
+	queries := []query{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "/", 2)
+		k, found := kindNames[strings.ToLower(parts[0])]
+		if !found {
+			return nil, fmt.Errorf("unknown resource type %q, expected pod, deployment, statefulset, daemonset or service", parts[0])
+		}
+		q := query{kind: k}
+		if len(parts) == 2 {
+			if parts[1] == "" {
+				return nil, fmt.Errorf("%q has an empty name", arg)
+			}
+			q.name = parts[1]
+		}
+		queries = append(queries, q)
+	}
+	if len(queries) == 0 {
+		for _, k := range defaultKinds {
+			queries = append(queries, query{kind: k})
+		}
+	}
+
+	namespace := o.listNamespace()
+	objects := []object{}
+	for _, q := range queries {
+		opts := meta_v1.ListOptions{LabelSelector: o.selector}
+		if q.name != "" {
+			if namespace == "" {
+				return nil, fmt.Errorf("%s/%s: a name can't be used with --all-namespaces", strings.ToLower(q.kind.name), q.name)
+			}
+			opts.FieldSelector = "metadata.name=" + q.name
+		}
+		found, err := q.kind.list(o.kube, namespace, opts)
+		if err != nil {
+			return nil, err
+		}
+		if q.name != "" && len(found) == 0 {
+			return nil, fmt.Errorf("%s %q not found in namespace %q", q.kind.name, q.name, namespace)
+		}
+		objects = append(objects, found...)
+	}
+	return objects, nil
+}
+
+// patchAnnotations sets the annotations of an object, nil values remove them.
+func (o *options) patchAnnotations(obj object, annotations map[string]*string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	return kindNames[strings.ToLower(obj.Kind)].patch(o.kube, obj.Namespace, obj.Name, data)
+}
+
+// hasChaos reports whether an object carries chaos annotations of its own.
+func hasChaos(obj object) bool {
+	return flow.HasChaosAnnotations(obj.Annotations) || obj.Annotations[workload.OrdinalsAnnotation] != ""
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// experimentStatus summarises an experiment.
+type experimentStatus struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Phase       string `json:"phase,omitempty"`
+	TargetPods  int    `json:"targetPods"`
+	SkippedPods int    `json:"skippedPods"`
+}
+
+// status summarises the chaos of the cluster, or of a namespace.
+type status struct {
+	Experiments []experimentStatus `json:"experiments"`
+	// Phases counts the pods under chaos by the phase their agent reported.
+	Phases map[string]int `json:"phases"`
+	// Nodes counts the pods under chaos by node and phase.
+	Nodes map[string]map[string]int `json:"nodes"`
+}
+
+func runStatus(o *options, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("status takes no arguments")
+	}
+	s := status{Experiments: []experimentStatus{}, Phases: map[string]int{}, Nodes: map[string]map[string]int{}}
+
+	experiments, err := o.chaos.Experiments(o.listNamespace()).List(meta_v1.ListOptions{LabelSelector: o.selector})
+	if err != nil {
+		// chaos annotations work without the Experiment resource
+		fmt.Fprintf(o.errOut, "warning: failed to list experiments: %v\n", err)
+	} else {
+		for _, exp := range experiments.Items {
+			s.Experiments = append(s.Experiments, experimentStatus{
+				Namespace:   exp.Namespace,
+				Name:        exp.Name,
+				Phase:       string(exp.Status.Phase),
+				TargetPods:  len(exp.Status.TargetPods),
+				SkippedPods: len(exp.Status.SkippedPods),
+			})
+		}
+	}
+
+	pods, err := o.listPodChaos()
+	if err != nil {
+		return err
+	}
+	for _, p := range pods {
+		phase := p.phase()
+		s.Phases[phase]++
+		node := orNone(p.Node)
+		if s.Nodes[node] == nil {
+			s.Nodes[node] = map[string]int{}
+		}
+		s.Nodes[node][phase]++
+	}
+
+	if printed, err := o.print(s); printed {
+		return err
+	}
+	w := tabwriter.NewWriter(o.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "EXPERIMENT\tPHASE\tTARGETS\tSKIPPED")
+	for _, e := range s.Experiments {
+		fmt.Fprintf(w, "%s/%s\t%s\t%d\t%d\n", e.Namespace, e.Name, orNone(e.Phase), e.TargetPods, e.SkippedPods)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "PODS UNDER CHAOS\t%d\n", len(pods))
+	for _, phase := range sortedKeys(s.Phases) {
+		fmt.Fprintf(w, "  %s\t%d\n", phase, s.Phases[phase])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "NODE\tPODS\tPHASES")
+	nodes := []string{}
+	for node := range s.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		total, phases := 0, ""
+		for _, phase := range sortedKeys(s.Nodes[node]) {
+			total += s.Nodes[node][phase]
+			phases += fmt.Sprintf("%s=%d ", phase, s.Nodes[node][phase])
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", node, total, strings.TrimSpace(phases))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,11 @@
+#!/bin/bash
+# Builds the binaries of the image into the directory given, /bin by default. The Dockerfile runs
+# it, so a local run covers the image's build.
+set -e
+
+out=${1:-/bin}
+cd "$(dirname "$0")/.."
+# the agent is the whole main package, not just kube-chaos.go
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -v -o "$out/kube-chaos" .
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -v -o "$out/kube-chaos-controller" ./cmd/kube-chaos-controller
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -v -o "$out/kube-chaos-webhook" ./cmd/kube-chaos-webhook
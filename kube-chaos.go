@@ -18,14 +18,36 @@ limitations under the License.
 package main
 
 import (
+	_ "expvar"
 	"flag"
 	"fmt"
-	"regexp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/agentapi"
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/audit"
 	"github.com/huanwei/kube-chaos/pkg/exec"
 	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/halt"
+	"github.com/huanwei/kube-chaos/pkg/peers"
+	"github.com/huanwei/kube-chaos/pkg/record"
+	"github.com/huanwei/kube-chaos/pkg/report"
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	"github.com/huanwei/kube-chaos/pkg/selection"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/state"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	"k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -37,15 +59,122 @@ func main() {
 		endpoint      string
 		labelSelector string
 		syncDuration  int
+		allowNS       string
+		denyNS        string
+		podName       string
+		podNamespace  string
+		nodeName      string
+		blastRadius   string
+		apiAddr       string
+		apiTokenFile  string
+		apiMaxTTL     time.Duration
+		stateFile     string
+		metricsAddr   string
+		dryRun        bool
+		cmdTimeout    time.Duration
+		etcdTimeout   time.Duration
+		workers       int
+		hostRefresh   time.Duration
+		profilesDir   string
+		varyInterval  time.Duration
+		haltConfigMap string
+		gracePeriod   time.Duration
+		auditFile     string
+		auditStdout   bool
+		auditMaxSize  int
+		auditBackups  int
 	)
 	flag.StringVar(&kubeconfig, "kubeconfig", "/etc/kubernetes/kubelet.conf", "absolute path to the kubeconfig file")
 	flag.StringVar(&endpoint, "etcd-endpoint", "", "the calico etcd endpoint, e.g. http://10.96.232.136:6666")
 	flag.StringVar(&labelSelector, "labelSelector", "", "select pods to do chaos, e.g. chaos=on")
 	flag.IntVar(&syncDuration, "syncDuration", 10, "sync duration(seconds)")
+	flag.StringVar(&allowNS, "allowNamespaces", "", "comma separated namespaces chaos may be applied in, empty means all")
+	flag.StringVar(&denyNS, "denyNamespaces", "", "comma separated namespaces chaos must never be applied in, in addition to "+strings.Join(safeguard.CriticalNamespaces, ","))
+	flag.StringVar(&podName, "podName", os.Getenv("POD_NAME"), "name of the agent's own pod, which is never shaped")
+	flag.StringVar(&podNamespace, "podNamespace", os.Getenv("POD_NAMESPACE"), "namespace of the agent's own pod")
+	flag.StringVar(&nodeName, "nodeName", os.Getenv("NODE_NAME"), "name of the agent's node, chaos state is reported on the pods of this node")
+	flag.StringVar(&blastRadius, "maxPerWorkload", "", "max pods of any Deployment, StatefulSet or ReplicaSet to do chaos at once, a number or a percentage of its replicas rounded up, empty means no limit")
+	flag.StringVar(&apiAddr, "apiAddr", "", "address to serve the agent API on, e.g. :8090, empty to disable it")
+	flag.StringVar(&apiTokenFile, "apiTokenFile", "", "file holding the bearer token the agent API requires")
+	flag.DurationVar(&apiMaxTTL, "apiMaxTTL", time.Hour, "longest an impairment added through the agent API may last")
+	flag.StringVar(&stateFile, "stateFile", "/var/lib/kube-chaos/state.json", "file recording the tc classes created for each pod, on a hostPath so it survives restarts, empty to disable it")
+	flag.StringVar(&metricsAddr, "metricsAddr", "", "address to serve the agent's metrics on at /debug/vars, e.g. :8091, empty to disable them")
+	flag.BoolVar(&dryRun, "dry-run", false, "log the tc, ip and modprobe commands that change the node instead of running them, and leave the state file, Events and reported chaos state alone")
+	flag.DurationVar(&cmdTimeout, "commandTimeout", 10*time.Second, "longest a tc, ip or modprobe command may run before it is killed")
+	flag.DurationVar(&etcdTimeout, "etcdTimeout", 5*time.Second, "longest the lookup of a pod's veth in calico's etcd may take")
+	flag.IntVar(&workers, "workers", 4, "how many pods' veths are looked up, and how many devices are changed, at once")
+	flag.DurationVar(&hostRefresh, "hostRefresh", 30*time.Second, "how long the addresses of the hostnames chaos specs name as peers are used before they are resolved again")
+	flag.StringVar(&profilesDir, "profilesDir", "", "directory of network profiles adding to the built-in ones, a ConfigMap mounted as a volume with a key per profile holding its chaos info, e.g. 3g-poor: delay=250ms,jitter=100ms,rate=400kbit, and a key per trace chaos can replay ending in .csv; the agent, the webhook and the controller need the same profiles")
+	flag.DurationVar(&varyInterval, "varyInterval", time.Second, "how often the netem parameters of chaos varying with time are changed")
+	flag.StringVar(&haltConfigMap, "haltConfigMap", "kube-system/kube-chaos-halt", "namespace/name of the ConfigMap whose halt: \"true\" removes all chaos from every node until it is cleared, empty to not watch it")
+	flag.DurationVar(&gracePeriod, "apiServerGracePeriod", 2*time.Minute, "how long the agent may fail to list the pods from the API server before it removes all chaos from the node and reports itself degraded, 0 to keep the chaos")
+	flag.StringVar(&auditFile, "auditLog", "", "file the agent appends a JSON line to for every tc and ip command changing the network, with the pod, the source and the spec of its chaos, on a hostPath to keep it, empty to disable it")
+	flag.BoolVar(&auditStdout, "auditStdout", false, "also write the audit log to stdout")
+	flag.IntVar(&auditMaxSize, "auditMaxSize", 100, "size in megabytes the audit log is rotated at, 0 to never rotate it")
+	flag.IntVar(&auditBackups, "auditMaxBackups", 5, "how many rotated audit logs are kept, as --auditLog.1 to --auditLog.N")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [cleanup|diff [--dry-run]]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  cleanup\tremove all chaos from the node and exit, for when the agent has crashed\n")
+		fmt.Fprintf(os.Stderr, "  diff\t\tprint the tc operations turning the chaos on the node into the wanted one, apply them unless --dry-run, and exit\n\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+	diffDryRun := diffFlags.Bool("dry-run", false, "only print the tc operations, don't apply them")
+	flow.SetCommandTimeout(cmdTimeout)
+	if workers < 1 {
+		workers = 1
+	}
+	flow.SetWorkers(workers)
+	if err := flow.LoadProfiles(profilesDir); err != nil {
+		glog.Fatalf("Invalid network profiles: %v", err)
+	}
+	e := exec.New()
+	if dryRun {
+		glog.Infof("Dry run, the commands changing the node are only logged")
+		d := exec.NewDryRun(e)
+		e = d
+		flow.SetExec(d)
+		stateFile = ""
+	} else if auditFile != "" || auditStdout {
+		node := nodeName
+		if node == "" {
+			node, _ = os.Hostname()
+		}
+		var mirror io.Writer
+		if auditStdout {
+			mirror = os.Stdout
+		}
+		l, err := audit.NewLog(node, auditFile, int64(auditMaxSize)<<20, auditBackups, mirror)
+		if err != nil {
+			glog.Fatalf("Failed to open the audit log: %v", err)
+		}
+		flow.SetAuditLog(l)
+	}
+	switch flag.Arg(0) {
+	case "":
+	case "diff":
+		diffFlags.Parse(flag.Args()[1:])
+	case "cleanup":
+		if err := teardown(stateFile); err != nil {
+			glog.Errorf("Failed to remove all chaos: %v", err)
+			glog.Flush()
+			os.Exit(1)
+		}
+		glog.Infof("Removed all chaos")
+		glog.Flush()
+		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	maxPerWorkload, err := selection.ParseMax(blastRadius)
+	if err != nil {
+		panic(err.Error())
+	}
 	// uses the current context in kubeconfig
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	fmt.Println(err)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -54,75 +183,167 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
+	hostname, _ := os.Hostname()
+	agentNode := nodeName
+	if agentNode == "" {
+		agentNode = hostname
+	}
+	a := &agent{
+		clientset:      clientset,
+		endpoint:       endpoint,
+		labelSelector:  labelSelector,
+		maxPerWorkload: maxPerWorkload,
+		hostname:       hostname,
+		nodeName:       agentNode,
+		exec:           e,
+		dryRun:         dryRun,
+		etcdTimeout:    etcdTimeout,
+		workers:        workers,
+		policy:         safeguard.NewPolicy(strings.Split(allowNS, ","), strings.Split(denyNS, ","), podNamespace, podName),
+		expander:       workload.NewExpander(clientset),
+		manual:         agentapi.NewStore(),
+		hosts:          peers.NewHosts(net.DefaultResolver, hostRefresh, 5*time.Second),
+		apiLock:        &sync.Mutex{},
+		gracePeriod:    gracePeriod,
+		listed:         time.Now(),
+	}
+	if flag.Arg(0) == "diff" {
+		// a one-off sync, which leaves Events and the reported chaos state to the agent
+		a.reporter = report.NewReporter(clientset, "")
+		a.api = agentapi.NewServer(a.manual, "", apiMaxTTL, a.apiLock, a.applyImpairments)
+		if stateFile != "" {
+			store, err := state.Open(stateFile)
+			if err != nil {
+				panic(err.Error())
+			}
+			flow.SetStateStore(store)
+		}
+		a.sync(os.Stdout, !*diffDryRun)
+		glog.Flush()
+		os.Exit(0)
+	}
+	if dryRun {
+		a.reporter = report.NewReporter(clientset, "")
+	} else {
+		a.recorder = record.NewEventRecorder(clientset, "kube-chaos", hostname)
+		a.reporter = report.NewReporter(clientset, nodeName)
+	}
+	token := ""
+	if apiAddr != "" {
+		data, err := ioutil.ReadFile(apiTokenFile)
+		if err != nil {
+			panic(err.Error())
+		}
+		if token = strings.TrimSpace(string(data)); token == "" {
+			panic("the agent API requires a token in --apiTokenFile")
+		}
+	}
+	a.api = agentapi.NewServer(a.manual, token, apiMaxTTL, a.apiLock, a.applyImpairments)
+	if apiAddr != "" {
+		go a.api.Run(make(chan struct{}))
+		go func() {
+			glog.Infof("Serving the agent API on %s", apiAddr)
+			glog.Fatal(http.ListenAndServe(apiAddr, a.api))
+		}()
+	}
+	// remove all chaos when stopped, so pods aren't left with degraded networking nothing manages
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		glog.Infof("Received %s, removing all chaos", sig)
+		// wait for the tc changes in progress, and make sure none start
+		a.apiLock.Lock()
+		flow.LockDevices("ifb0", "ifb1")
+		if err := teardown(stateFile); err != nil {
+			glog.Errorf("Failed to remove all chaos: %v", err)
+			glog.Flush()
+			os.Exit(1)
+		}
+		glog.Flush()
+		os.Exit(0)
+	}()
+	if metricsAddr != "" {
+		http.HandleFunc("/healthz", a.serveHealthz)
+		go func() {
+			glog.Infof("Serving metrics on %s", metricsAddr)
+			glog.Fatal(http.ListenAndServe(metricsAddr, nil))
+		}()
+	}
 	// init ifb module
 	err = flow.InitIfbModule()
 	if err != nil {
 		glog.Errorf("Failed init ifb: %v", err)
 	}
-	//Synchronize pods and do chaos
-	for {
-		//pods, err := clientset.CoreV1().Pods("").List(meta_v1.ListOptions{FieldSelector: "spec.nodeName=10.10.103.182", LabelSelector: labelSelector})
-		pods, err := clientset.CoreV1().Pods("").List(meta_v1.ListOptions{LabelSelector: labelSelector})
+	// adopt the classes created before a restart, or garbage-collect them
+	if stateFile != "" {
+		store, err := state.Open(stateFile)
 		if err != nil {
-			glog.Errorf("Failed list pods: %v", err)
+			panic(err.Error())
 		}
-		glog.V(4).Infof("There are %d pods need to do chaos in the cluster\n", len(pods.Items))
-
-		//used for  checking which tc class isn't used, and del it
-		egressPodsCIDRs := []string{}
-		ingressPodsCIDRs := []string{}
-		for _, pod := range pods.Items {
-
-			// todo - fix
-
-			ingressChaosInfo, egressChaosInfo, err := flow.ExtractPodChaosInfo(pod.Annotations)
-			if err != nil {
-				glog.Errorf("Failed extract pod's chaos info: %v", err)
-			}
-			if ingressChaosInfo == "" && egressChaosInfo == "" {
-				glog.Warning("chaos is on, but the pod's chaos info was not set")
-				continue
-			}
-
-			cidr := fmt.Sprintf("%s/32", pod.Status.PodIP) //192.168.0.10/32
-			if egressChaosInfo != "" {
-				egressPodsCIDRs = append(egressPodsCIDRs, cidr)
-			}
-			if ingressChaosInfo != "" {
-				ingressPodsCIDRs = append(ingressPodsCIDRs, cidr)
-			}
-
-			//fetch pod's vethname from calico's etcd
-			e := exec.New()
-			//data, err := e.Command("etcdctl", "--endpoint=http://10.96.232.136:6666", "get", "/calico/v1/host/"+pod.Status.HostIP+"/workload/k8s/"+pod.Namespace+"."+pod.Name+"/endpoint/eth0").CombinedOutput()
-
-			//curl -L 10.10.102.80:2379/v2/keys/calico/v1/host/10.10.102.80/workload/k8s/kube-system.nfs-controller-d6dw8/endpoint/eth0
-			data, err := e.Command("curl", "-L", endpoint+"/v2/keys/calico/v1/host/"+pod.Status.HostIP+"/workload/k8s/"+pod.Namespace+"."+pod.Name+"/endpoint/eth0").CombinedOutput()
-			if err != nil {
-				glog.Errorf("Failed fetch pod %s interface name: %v", pod.Name, err)
+		if err := flow.RecoverState(store); err != nil {
+			glog.Errorf("Failed to recover tc state: %v", err)
+		}
+	}
+	if haltConfigMap != "" {
+		watcher, err := halt.NewWatcher(clientset, haltConfigMap, a.setHalt)
+		if err != nil {
+			panic(err.Error())
+		}
+		go watcher.Run(make(chan struct{}))
+	}
+	if varyInterval > 0 {
+		go func() {
+			for range time.Tick(varyInterval) {
+				flow.Vary()
 			}
-			//get the pod's calico vethname
-			re, _ := regexp.Compile("cali[a-f0-9]{11}")
-			vethName := string(re.Find(data)) //cali67801d38217
-			glog.V(4).Infof("pod %s's vethname is %s", pod.Name, vethName)
+		}()
+	}
+	//Synchronize pods and do chaos
+	for {
+		a.sync(nil, true)
+		time.Sleep(time.Duration(syncDuration) * time.Second)
+	}
 
-			//todo - fix
-			shaper := flow.NewTCShaper(vethName)
-			//config pod interface  qdisc, and mirror to ifb
-			if err := shaper.ReconcileInterface(egressChaosInfo, ingressChaosInfo); err != nil {
-				glog.Errorf("Failed to init veth(%s): %v", vethName, err)
-			}
+}
 
-			if err := shaper.ReconcileCIDR(cidr, egressChaosInfo, ingressChaosInfo); err != nil {
-				glog.Errorf("Failed to reconcile CIDR %s: %v", cidr, err)
-			}
-			glog.V(4).Infof("reconcile cidr %s with egressChaosInfo %s and ingressChaosInfo %s ", cidr, egressChaosInfo, ingressChaosInfo)
+// teardown removes all chaos from the node, and the records of the state file.
+func teardown(stateFile string) error {
+	if err := flow.Teardown(); err != nil {
+		return err
+	}
+	if stateFile == "" {
+		return nil
+	}
+	store, err := state.Open(stateFile)
+	if err != nil {
+		return err
+	}
+	return store.DeleteAll()
+}
 
+// listChaosPods lists the pods matching the label selector, and the pods targeted by experiments.
+func listChaosPods(clientset kubernetes.Interface, labelSelector string) ([]v1.Pod, error) {
+	pods, err := clientset.CoreV1().Pods("").List(meta_v1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, err
+	}
+	if labelSelector == "" {
+		return pods.Items, nil
+	}
+	experimentPods, err := clientset.CoreV1().Pods("").List(meta_v1.ListOptions{LabelSelector: v1alpha1.ExperimentLabel})
+	if err != nil {
+		return nil, err
+	}
+	result := pods.Items
+	seen := sets.String{}
+	for _, pod := range pods.Items {
+		seen.Insert(string(pod.UID))
+	}
+	for _, pod := range experimentPods.Items {
+		if !seen.Has(string(pod.UID)) {
+			result = append(result, pod)
 		}
-		if err := flow.DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs); err != nil {
-			glog.Errorf("Failed to delete extra chaos: %v", err)
-		}
-		time.Sleep(time.Duration(syncDuration) * time.Second)
 	}
-
+	return result, nil
 }
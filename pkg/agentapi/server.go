@@ -0,0 +1,300 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package agentapi serves the agent's HTTP API, which shows the chaos tc applies on the node and
+// lets test harnesses add temporary impairments to pod IPs without touching Kubernetes objects.
+//
+//	GET    /chaos       the chaos of every CIDR on the node, and the temporary impairments
+//	POST   /chaos/<ip>  impair a local pod IP, the body is {"egress": ..., "ingress": ..., "ttl": "5m"}
+//	DELETE /chaos/<ip>  remove the impairment of a pod IP before it expires
+//
+// Every request needs an "Authorization: Bearer <token>" header.
+package agentapi // import "github.com/huanwei/kube-chaos/pkg/agentapi"
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ImpairRequest is the body of a POST.
+type ImpairRequest struct {
+	Egress  string `json:"egress,omitempty"`
+	Ingress string `json:"ingress,omitempty"`
+	// TTL is how long the impairment lasts, e.g. "5m".
+	TTL string `json:"ttl"`
+}
+
+// PodChaos is the chaos of a CIDR, and the pod it belongs to if the agent knows it.
+type PodChaos struct {
+	flow.CIDRChaos
+	Pod string `json:"pod,omitempty"`
+	// Manual is true for impairments added through the API.
+	Manual bool `json:"manual"`
+}
+
+// State is the response of a GET.
+type State struct {
+	Chaos  []PodChaos `json:"chaos"`
+	Manual []Entry    `json:"manual"`
+}
+
+// ApplyFunc applies the chaos of the node with the impairments of the store, the way the sync loop
+// does, while the server holds its lock. It returns the failures by CIDR or interface, or an error if
+// nothing could be applied.
+type ApplyFunc func() (map[string]error, error)
+
+// Server serves the API.
+type Server struct {
+	store  *Store
+	token  string
+	maxTTL time.Duration
+	// lock serialises the API's tc changes with the sync loop's, which holds it from reading the
+	// store to applying its plan
+	lock  sync.Locker
+	apply ApplyFunc
+
+	// interfaceFor returns the pod veth routing to an IP, never the host's own interfaces
+	interfaceFor func(ip string) (string, error)
+	getChaos     func() ([]flow.CIDRChaos, error)
+	now          func() time.Time
+
+	podsLock sync.Mutex
+	pods     map[string]string
+	// refusal is why impairments are refused, empty when they aren't, guarded by podsLock
+	refusal string
+}
+
+// NewServer returns a server adding entries to store and applying them with apply. Requests must
+// carry token, and impairments can't last longer than maxTTL.
+func NewServer(store *Store, token string, maxTTL time.Duration, lock sync.Locker, apply ApplyFunc) *Server {
+	return &Server{
+		store:        store,
+		token:        token,
+		maxTTL:       maxTTL,
+		lock:         lock,
+		apply:        apply,
+		interfaceFor: flow.PeerInterfaceForIP,
+		getChaos:     flow.GetChaos,
+		now:          time.Now,
+		pods:         map[string]string{},
+	}
+}
+
+// Refuse makes the server refuse impairments with reason, e.g. while chaos is halted, until it is
+// called with an empty reason.
+func (s *Server) Refuse(reason string) {
+	s.podsLock.Lock()
+	defer s.podsLock.Unlock()
+	s.refusal = reason
+}
+
+func (s *Server) refused() string {
+	s.podsLock.Lock()
+	defer s.podsLock.Unlock()
+	return s.refusal
+}
+
+// SetPods sets the names, "namespace/name", of the pods by IP, to show in the state.
+func (s *Server) SetPods(pods map[string]string) {
+	s.podsLock.Lock()
+	defer s.podsLock.Unlock()
+	s.pods = pods
+}
+
+func (s *Server) podName(ip string) string {
+	s.podsLock.Lock()
+	defer s.podsLock.Unlock()
+	return s.pods[ip]
+}
+
+// Run removes the impairments as they expire, until stopCh is closed.
+func (s *Server) Run(stopCh <-chan struct{}) {
+	wait.Until(s.expire, time.Second, stopCh)
+}
+
+func (s *Server) expire() {
+	for _, e := range s.store.Expire(s.now()) {
+		glog.Infof("Impairment of %s expired", e.IP)
+		s.remove(e)
+	}
+}
+
+// remove applies the chaos without a deleted entry, its classes are deleted as extra chaos, or the
+// pod gets its annotated chaos back. The sync loop retries if it fails.
+func (s *Server) remove(e Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := failure(e, s.apply); err != nil {
+		glog.Errorf("Failed to remove impairment of %s from %s: %v", e.IP, e.Interface, err)
+	}
+}
+
+// failure applies the chaos with apply, and returns the error of an entry's CIDR, veth or the ifbs.
+func failure(e Entry, apply ApplyFunc) error {
+	failed, err := apply()
+	if err != nil {
+		return err
+	}
+	for _, target := range []string{e.CIDR(), e.Interface, "ifb0", "ifb1"} {
+		if err := failed[target]; err != nil {
+			return fmt.Errorf("%s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ip := strings.TrimPrefix(r.URL.Path, "/chaos/")
+	switch {
+	case r.URL.Path == "/chaos" && r.Method == http.MethodGet:
+		s.serveState(w)
+	case ip != r.URL.Path && ip != "" && r.Method == http.MethodPost:
+		s.serveImpair(w, r, ip)
+	case ip != r.URL.Path && ip != "" && r.Method == http.MethodDelete:
+		s.serveDelete(w, ip)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) serveState(w http.ResponseWriter) {
+	chaos, err := s.getChaos()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read tc state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	manual := s.store.IPs()
+	state := State{Chaos: []PodChaos{}, Manual: s.store.List()}
+	for _, c := range chaos {
+		ip := strings.TrimSuffix(c.CIDR, "/32")
+		state.Chaos = append(state.Chaos, PodChaos{CIDRChaos: c, Pod: s.podName(ip), Manual: manual.Has(ip)})
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (s *Server) serveImpair(w http.ResponseWriter, r *http.Request, ip string) {
+	req := ImpairRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+	entry, err := s.validate(ip, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	iface, err := s.interfaceFor(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.Interface = iface
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// checked under the lock, the agent removes all chaos holding it
+	if reason := s.refused(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	// the chaos is applied from the store, a failed impairment is taken back out of it
+	old, replaced := s.store.Get(ip)
+	s.store.Set(*entry)
+	if err := failure(*entry, s.apply); err != nil {
+		if replaced {
+			s.store.Set(old)
+		} else {
+			s.store.Delete(ip)
+		}
+		http.Error(w, fmt.Sprintf("failed to impair %s: %v", ip, err), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Impaired %s until %s with egress %q and ingress %q", ip, entry.Expires.Format(time.RFC3339), entry.Egress, entry.Ingress)
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+// validate checks a POST and returns its entry.
+func (s *Server) validate(ip string, req ImpairRequest) (*Entry, error) {
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 address", ip)
+	}
+	if req.Egress == "" && req.Ingress == "" {
+		return nil, fmt.Errorf("at least one of egress and ingress is required")
+	}
+	// an impairment is of a single IP, so of a single interface, the one routing to it
+	for _, info := range []string{req.Ingress, req.Egress} {
+		if info == "" {
+			continue
+		}
+		spec, err := flow.ParseChaosSpec(info)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Interface != "" {
+			return nil, fmt.Errorf("an impairment can't name an interface, it applies to the IP")
+		}
+		// the sync resolves the peers of pods only
+		if len(spec.Services) > 0 || len(spec.Hosts) > 0 {
+			return nil, fmt.Errorf("an impairment can't be limited to Services or hosts, it applies to all the traffic of the IP")
+		}
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ttl %q: %v", req.TTL, err)
+	}
+	if ttl <= 0 || ttl > s.maxTTL {
+		return nil, fmt.Errorf("ttl must be more than 0 and at most %s", s.maxTTL)
+	}
+	return &Entry{IP: ip, Egress: req.Egress, Ingress: req.Ingress, Expires: s.now().Add(ttl)}, nil
+}
+
+func (s *Server) serveDelete(w http.ResponseWriter, ip string) {
+	entry, found := s.store.Delete(ip)
+	if !found {
+		http.Error(w, fmt.Sprintf("%s has no impairment", ip), http.StatusNotFound)
+		return
+	}
+	s.remove(entry)
+	glog.Infof("Removed impairment of %s", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		glog.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+)
+
+// fakeApply records the impairments of the store each time the server applies the chaos, and fails
+// the targets in failed.
+type fakeApply struct {
+	store  *Store
+	calls  *[]string
+	failed map[string]error
+}
+
+func (f *fakeApply) apply() (map[string]error, error) {
+	ips := []string{}
+	for _, e := range f.store.List() {
+		ips = append(ips, fmt.Sprintf("%s %s %q %q", e.IP, e.Interface, e.Egress, e.Ingress))
+	}
+	*f.calls = append(*f.calls, "apply "+strings.Join(ips, ", "))
+	return f.failed, nil
+}
+
+func newTestServer(now *time.Time, calls *[]string) *Server {
+	store := NewStore()
+	s := NewServer(store, "secret", time.Hour, &sync.Mutex{}, (&fakeApply{store: store, calls: calls}).apply)
+	s.now = func() time.Time { return *now }
+	s.interfaceFor = func(ip string) (string, error) {
+		if ip == "10.0.0.1" {
+			return "", fmt.Errorf("%s is routed through eth0, which isn't the peer of a pod interface", ip)
+		}
+		return "cali0123456789a", nil
+	}
+	s.getChaos = func() ([]flow.CIDRChaos, error) {
+		return []flow.CIDRChaos{
+			{CIDR: "192.168.0.10/32", Direction: "egress", Class: "1:2", Netem: "limit 1000 delay 100.0ms"},
+			{CIDR: "192.168.0.11/32", Direction: "ingress", Class: "1:2", Netem: "limit 1000 loss 1%"},
+		}, nil
+	}
+	s.SetPods(map[string]string{"192.168.0.11": "default/web-0"})
+	return s
+}
+
+func do(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthorization(t *testing.T) {
+	now := time.Now()
+	s := newTestServer(&now, &[]string{})
+	for _, token := range []string{"", "wrong"} {
+		if w := do(s, http.MethodGet, "/chaos", token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected status 401, got %d", token, w.Code)
+		}
+	}
+	if w := do(s, http.MethodGet, "/chaos", "secret", ""); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestImpairAndExpire(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := []string{}
+	s := newTestServer(&now, &calls)
+
+	w := do(s, http.MethodPost, "/chaos/192.168.0.10", "secret", `{"egress":"delay=100ms","ttl":"5m"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	expected := []string{`apply 192.168.0.10 cali0123456789a "delay=100ms" ""`}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	egress, ingress := s.store.CIDRs()
+	if !reflect.DeepEqual(egress, []string{"192.168.0.10/32"}) || len(ingress) != 0 {
+		t.Errorf("expected the CIDR to be kept for egress only, got %v and %v", egress, ingress)
+	}
+
+	state := State{}
+	if err := json.Unmarshal(do(s, http.MethodGet, "/chaos", "secret", "").Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Chaos) != 2 || !state.Chaos[0].Manual || state.Chaos[1].Manual || state.Chaos[1].Pod != "default/web-0" {
+		t.Errorf("unexpected chaos %+v", state.Chaos)
+	}
+	if len(state.Manual) != 1 || state.Manual[0].Interface != "cali0123456789a" {
+		t.Errorf("unexpected manual entries %+v", state.Manual)
+	}
+
+	calls = calls[:0]
+	now = now.Add(4 * time.Minute)
+	s.expire()
+	if len(calls) != 0 || !s.store.Has("192.168.0.10") {
+		t.Errorf("expected the impairment to last 5m, got calls %v", calls)
+	}
+	now = now.Add(time.Minute)
+	s.expire()
+	if expected := []string{"apply "}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	if s.store.Has("192.168.0.10") {
+		t.Errorf("expected the impairment to expire")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	now := time.Now()
+	calls := []string{}
+	s := newTestServer(&now, &calls)
+	if w := do(s, http.MethodDelete, "/chaos/192.168.0.10", "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+	do(s, http.MethodPost, "/chaos/192.168.0.10", "secret", `{"ingress":"loss=1%","ttl":"1m"}`)
+	calls = calls[:0]
+	if w := do(s, http.MethodDelete, "/chaos/192.168.0.10", "secret", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if expected := []string{"apply "}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	if s.store.Has("192.168.0.10") {
+		t.Errorf("expected the impairment to be deleted")
+	}
+}
+
+func TestImpairErrors(t *testing.T) {
+	now := time.Now()
+	calls := []string{}
+	s := newTestServer(&now, &calls)
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/chaos/192.168.0.10", `{"ttl":"1m"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=fast","ttl":"1m"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms,interface=net1","ttl":"1m"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms;loss=1%,interface=net1","ttl":"1m"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms,service=payments","ttl":"1m"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms,host=api.example.com","ttl":"1m"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms","ttl":"2h"}`},
+		{"/chaos/192.168.0.10", `{"egress":"delay=1ms","ttl":"-1m"}`},
+		{"/chaos/192.168.0.10", `not json`},
+		{"/chaos/fe80::1", `{"egress":"delay=1ms","ttl":"1m"}`},
+		{"/chaos/10.0.0.1", `{"egress":"delay=1ms","ttl":"1m"}`},
+	}
+	for _, test := range tests {
+		if w := do(s, http.MethodPost, test.path, "secret", test.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected status 400, got %d", test.path, test.body, w.Code)
+		}
+	}
+	if len(calls) != 0 || len(s.store.List()) != 0 {
+		t.Errorf("expected invalid requests to change nothing, got calls %v", calls)
+	}
+}
+
+func TestImpairHalted(t *testing.T) {
+	now := time.Now()
+	calls := []string{}
+	s := newTestServer(&now, &calls)
+	s.Refuse("chaos is halted cluster-wide")
+	if w := do(s, http.MethodPost, "/chaos/192.168.0.10", "secret", `{"egress":"delay=1ms","ttl":"1m"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 while halted, got %d", w.Code)
+	}
+	if len(calls) != 0 || len(s.store.List()) != 0 {
+		t.Errorf("expected a halted server to change nothing, got calls %v", calls)
+	}
+	s.Refuse("")
+	if w := do(s, http.MethodPost, "/chaos/192.168.0.10", "secret", `{"egress":"delay=1ms","ttl":"1m"}`); w.Code != http.StatusCreated {
+		t.Errorf("expected status 201 once the halt is lifted, got %d", w.Code)
+	}
+}
+
+func TestImpairFailed(t *testing.T) {
+	now := time.Now()
+	calls := []string{}
+	s := newTestServer(&now, &calls)
+	do(s, http.MethodPost, "/chaos/192.168.0.10", "secret", `{"egress":"delay=1ms","ttl":"1m"}`)
+	s.apply = (&fakeApply{store: s.store, calls: &calls, failed: map[string]error{
+		"192.168.0.10/32": fmt.Errorf("no tc class left"),
+		"192.168.0.11/32": fmt.Errorf("no tc class left"),
+	}}).apply
+	if w := do(s, http.MethodPost, "/chaos/192.168.0.10", "secret", `{"egress":"delay=2ms","ttl":"1m"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+	if e, _ := s.store.Get("192.168.0.10"); e.Egress != "delay=1ms" {
+		t.Errorf("expected the failed impairment to leave the previous one, got %+v", e)
+	}
+	if w := do(s, http.MethodPost, "/chaos/192.168.0.11", "secret", `{"egress":"delay=2ms","ttl":"1m"}`); w.Code != http.StatusInternalServerError || s.store.Has("192.168.0.11") {
+		t.Errorf("expected the failed impairment taken out of the store, got status %d", w.Code)
+	}
+}
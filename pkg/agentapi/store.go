@@ -0,0 +1,131 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agentapi
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+)
+
+// Entry is a temporary impairment of a pod IP, added through the API.
+type Entry struct {
+	IP string `json:"ip"`
+	// Interface is the pod's veth on the host.
+	Interface string    `json:"interface"`
+	Egress    string    `json:"egress,omitempty"`
+	Ingress   string    `json:"ingress,omitempty"`
+	Expires   time.Time `json:"expires"`
+}
+
+// CIDR is the CIDR the entry's classes and filters match.
+func (e *Entry) CIDR() string {
+	return e.IP + "/32"
+}
+
+// Store holds the entries added through the API, by IP. It is shared with the sync loop, which
+// leaves the pods of the entries alone and keeps their CIDRs when deleting extra chaos.
+type Store struct {
+	lock    sync.Mutex
+	entries map[string]Entry
+}
+
+func NewStore() *Store {
+	return &Store{entries: map[string]Entry{}}
+}
+
+// Set adds or replaces the entry of an IP.
+func (s *Store) Set(e Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[e.IP] = e
+}
+
+// Get returns the entry of an IP.
+func (s *Store) Get(ip string) (Entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, found := s.entries[ip]
+	return e, found
+}
+
+// Delete removes the entry of an IP, and returns it if there was one.
+func (s *Store) Delete(ip string) (Entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, found := s.entries[ip]
+	delete(s.entries, ip)
+	return e, found
+}
+
+// Has reports whether the IP has an entry.
+func (s *Store) Has(ip string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, found := s.entries[ip]
+	return found
+}
+
+// List returns the entries, sorted by IP.
+func (s *Store) List() []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := []Entry{}
+	for _, e := range s.entries {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].IP < result[j].IP })
+	return result
+}
+
+// CIDRs returns the CIDRs with egress chaos and the ones with ingress chaos.
+func (s *Store) CIDRs() (egress, ingress []string) {
+	for _, e := range s.List() {
+		if e.Egress != "" {
+			egress = append(egress, e.CIDR())
+		}
+		if e.Ingress != "" {
+			ingress = append(ingress, e.CIDR())
+		}
+	}
+	return egress, ingress
+}
+
+// IPs returns the IPs with an entry.
+func (s *Store) IPs() sets.String {
+	ips := sets.String{}
+	for _, e := range s.List() {
+		ips.Insert(e.IP)
+	}
+	return ips
+}
+
+// Expire removes and returns the entries that expired at now.
+func (s *Store) Expire(now time.Time) []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expired := []Entry{}
+	for ip, e := range s.entries {
+		if !now.Before(e.Expires) {
+			expired = append(expired, e)
+			delete(s.entries, ip)
+		}
+	}
+	return expired
+}
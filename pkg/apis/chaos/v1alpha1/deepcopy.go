@@ -0,0 +1,140 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// DeepCopyInto copies the receiver into out. in must be non-nil.
+func (in *Experiment) DeepCopyInto(out *Experiment) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy copies the receiver, creating a new Experiment.
+func (in *Experiment) DeepCopy() *Experiment {
+	if in == nil {
+		return nil
+	}
+	out := new(Experiment)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *Experiment) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out. in must be non-nil.
+func (in *ExperimentList) DeepCopyInto(out *ExperimentList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		out.Items = make([]Experiment, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new ExperimentList.
+func (in *ExperimentList) DeepCopy() *ExperimentList {
+	if in == nil {
+		return nil
+	}
+	out := new(ExperimentList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *ExperimentList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out. in must be non-nil.
+func (in *ExperimentSpec) DeepCopyInto(out *ExperimentSpec) {
+	*out = *in
+	if in.Selector != nil {
+		out.Selector = in.Selector.DeepCopy()
+	}
+	if in.MaxPerWorkload != nil {
+		out.MaxPerWorkload = new(intstr.IntOrString)
+		*out.MaxPerWorkload = *in.MaxPerWorkload
+	}
+	if in.Selection != nil {
+		out.Selection = new(Selection)
+		*out.Selection = *in.Selection
+	}
+	if in.Probes != nil {
+		out.Probes = make([]Probe, len(in.Probes))
+		for i := range in.Probes {
+			in.Probes[i].DeepCopyInto(&out.Probes[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out. in must be non-nil.
+func (in *Probe) DeepCopyInto(out *Probe) {
+	*out = *in
+	if in.HTTP != nil {
+		out.HTTP = new(HTTPProbe)
+		*out.HTTP = *in.HTTP
+		if in.HTTP.StatusCodes != nil {
+			out.HTTP.StatusCodes = make([]int32, len(in.HTTP.StatusCodes))
+			copy(out.HTTP.StatusCodes, in.HTTP.StatusCodes)
+		}
+	}
+	if in.TCP != nil {
+		out.TCP = new(TCPProbe)
+		*out.TCP = *in.TCP
+	}
+	if in.Query != nil {
+		out.Query = new(QueryProbe)
+		*out.Query = *in.Query
+	}
+}
+
+// DeepCopyInto copies the receiver into out. in must be non-nil.
+func (in *ExperimentStatus) DeepCopyInto(out *ExperimentStatus) {
+	*out = *in
+	if in.TargetPods != nil {
+		out.TargetPods = make([]string, len(in.TargetPods))
+		copy(out.TargetPods, in.TargetPods)
+	}
+	if in.SkippedPods != nil {
+		out.SkippedPods = make([]SkippedPod, len(in.SkippedPods))
+		copy(out.SkippedPods, in.SkippedPods)
+	}
+	if in.Probes != nil {
+		out.Probes = make([]ProbeStatus, len(in.Probes))
+		copy(out.Probes, in.Probes)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ExperimentLabel is set by the experiment controller on every pod it targets, its value is the
+// experiment name. Agents always consider pods carrying it.
+const ExperimentLabel = "chaos.kube-chaos/experiment"
+
+// Experiment applies chaos to the pods matching its selector, in its own namespace.
+type Experiment struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ExperimentSpec   `json:"spec"`
+	Status ExperimentStatus `json:"status,omitempty"`
+}
+
+type ExperimentSpec struct {
+	// Selector selects the pods of the experiment's namespace to apply chaos to.
+	Selector *meta_v1.LabelSelector `json:"selector"`
+	// Egress is the chaos info applied to traffic leaving the pods, in the
+	// kubernetes.io/egress-chaos annotation format.
+	Egress string `json:"egress,omitempty"`
+	// Ingress is the chaos info applied to traffic entering the pods, in the
+	// kubernetes.io/ingress-chaos annotation format.
+	Ingress string `json:"ingress,omitempty"`
+	// MaxPerWorkload caps how many pods of any Deployment, StatefulSet or ReplicaSet are
+	// affected, either a number of pods or a percentage of the workload's replicas, rounded up.
+	MaxPerWorkload *intstr.IntOrString `json:"maxPerWorkload,omitempty"`
+	// Selection picks a subset of the matching pods, all of them if unset.
+	Selection *Selection `json:"selection,omitempty"`
+	// Probes check the steady state of the system while the experiment runs, the experiment is
+	// aborted when one of them fails its FailureThreshold checks in a row.
+	Probes []Probe `json:"probes,omitempty"`
+}
+
+// Probe is a check of the system's health, exactly one of HTTP, TCP and Query is set. Probes are
+// checked by the experiment controller on its syncs, at most once every Period.
+type Probe struct {
+	// Name identifies the probe in the experiment's status.
+	Name  string      `json:"name"`
+	HTTP  *HTTPProbe  `json:"http,omitempty"`
+	TCP   *TCPProbe   `json:"tcp,omitempty"`
+	Query *QueryProbe `json:"query,omitempty"`
+	// Period is how often the probe is checked, 10s if unset.
+	Period meta_v1.Duration `json:"period,omitempty"`
+	// Timeout is how long a check may take, 5s if unset.
+	Timeout meta_v1.Duration `json:"timeout,omitempty"`
+	// FailureThreshold is how many checks in a row must fail to abort the experiment, 3 if unset.
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+// HTTPProbe gets a URL, it fails on an unexpected status code or a slow response.
+type HTTPProbe struct {
+	URL string `json:"url"`
+	// StatusCodes are the healthy status codes, any 2xx or 3xx if empty.
+	StatusCodes []int32 `json:"statusCodes,omitempty"`
+	// MaxLatency is the longest the response may take, unlimited if unset.
+	MaxLatency meta_v1.Duration `json:"maxLatency,omitempty"`
+}
+
+// TCPProbe connects to an address, it fails if the connection can't be made.
+type TCPProbe struct {
+	// Address is a host and port, e.g. payments.shop.svc:5432.
+	Address string `json:"address"`
+}
+
+// QueryProbe runs an instant query against a Prometheus compatible API, it fails unless every
+// sample of the result compares to the Threshold with the Operator, e.g. an error rate "<" "0.05".
+type QueryProbe struct {
+	// Endpoint is the base URL of the API, e.g. http://prometheus.monitoring.svc:9090.
+	Endpoint string `json:"endpoint"`
+	Query    string `json:"query"`
+	// Operator is one of <, <=, >, >=, == and !=.
+	Operator  string `json:"operator"`
+	Threshold string `json:"threshold"`
+	// IgnoreEmpty makes a result without samples healthy, rather than failing the check.
+	IgnoreEmpty bool `json:"ignoreEmpty,omitempty"`
+}
+
+type SelectionMode string
+
+const (
+	// SelectAll targets every matching pod.
+	SelectAll SelectionMode = "All"
+	// SelectCount targets Value of the matching pods.
+	SelectCount SelectionMode = "Count"
+	// SelectPercent targets Value percent of the matching pods, rounded up.
+	SelectPercent SelectionMode = "Percent"
+	// SelectOnePerNode targets one matching pod on every node.
+	SelectOnePerNode SelectionMode = "OnePerNode"
+)
+
+// Selection chooses pods by a hash of the pod UID, the experiment and Seed, so an experiment
+// rerun with the same seed chooses the same pods.
+type Selection struct {
+	Mode  SelectionMode `json:"mode"`
+	Value int32         `json:"value,omitempty"`
+	Seed  int64         `json:"seed,omitempty"`
+}
+
+type ExperimentPhase string
+
+const (
+	ExperimentRunning ExperimentPhase = "Running"
+	// ExperimentAborted experiments failed a probe, their chaos is removed and stays removed until
+	// they are recreated.
+	ExperimentAborted ExperimentPhase = "Aborted"
+)
+
+type ExperimentStatus struct {
+	Phase ExperimentPhase `json:"phase,omitempty"`
+	// TargetPods are the names of the pods chaos is applied to.
+	TargetPods []string `json:"targetPods,omitempty"`
+	// SkippedPods matched the selector but were left alone.
+	SkippedPods []SkippedPod `json:"skippedPods,omitempty"`
+	// Probes are the results of the experiment's probes.
+	Probes []ProbeStatus `json:"probes,omitempty"`
+	// AbortReason says which probe aborted the experiment, and why.
+	AbortReason string `json:"abortReason,omitempty"`
+}
+
+// ProbeStatus is the result of a probe's last check.
+type ProbeStatus struct {
+	Name string `json:"name"`
+	// ConsecutiveFailures is how many checks in a row failed.
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+	// LastError is why the last check failed, empty if it passed.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// SkippedPod is a pod that matched an experiment's selector, and why it wasn't targeted.
+type SkippedPod struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// ExperimentList is a list of Experiments.
+type ExperimentList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Experiment `json:"items"`
+}
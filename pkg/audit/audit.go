@@ -0,0 +1,181 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit writes the audit log of the agent, a JSON line for every command that changes the
+// network of the node.
+package audit // import "github.com/huanwei/kube-chaos/pkg/audit"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Entry is a line of the audit log, a command that changed, or tried to change, the network of the
+// node.
+type Entry struct {
+	Time time.Time `json:"time"`
+	Node string    `json:"node,omitempty"`
+	// Namespace and Pod are the pod the chaos is for, empty for the impairments of the agent API
+	// and the setup and cleanup of the node.
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	// Source says where the chaos came from, e.g. the pod's annotations, an Experiment or a
+	// workload it inherits the chaos of.
+	Source string `json:"source,omitempty"`
+	// Target is the CIDR or the interface the command is for.
+	Target string `json:"target,omitempty"`
+	// Spec is the chaos wanted for the target, empty when the command removes chaos.
+	Spec       string `json:"spec,omitempty"`
+	Command    string `json:"command"`
+	ExitStatus int    `json:"exitStatus"`
+	Output     string `json:"output,omitempty"`
+}
+
+// Log appends the entries to a file, which is rotated once it would grow beyond maxSize: path is
+// renamed path.1, path.1 path.2 and so on, and the oldest of maxBackups is deleted. The entries can
+// be mirrored to another writer, e.g. os.Stdout.
+type Log struct {
+	node       string
+	path       string
+	maxSize    int64
+	maxBackups int
+	mirror     io.Writer
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewLog opens the audit log at path, appending to an existing file. The log only writes to mirror
+// when path is empty, mirror may be nil. maxSize 0 never rotates the file.
+func NewLog(node, path string, maxSize int64, maxBackups int, mirror io.Writer) (*Log, error) {
+	l := &Log{node: node, path: path, maxSize: maxSize, maxBackups: maxBackups, mirror: mirror}
+	if path == "" {
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends an entry, failures are only logged. The time and the node are filled in if unset.
+func (l *Log) Write(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Node == "" {
+		e.Node = l.node
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Failed to encode audit entry of %q: %v", e.Command, err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.mirror != nil {
+		if _, err := l.mirror.Write(data); err != nil {
+			glog.Errorf("Failed to mirror audit entry of %q: %v", e.Command, err)
+		}
+	}
+	if l.file == nil {
+		return
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			glog.Errorf("Failed to rotate audit log %s: %v", l.path, err)
+		}
+	}
+	if l.file == nil {
+		return
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("Failed to write audit entry of %q to %s: %v", e.Command, l.path, err)
+	}
+}
+
+// rotate moves the file to path.1 and the backups up by one, and opens a new file. With no backups
+// the file is truncated.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		glog.Errorf("Failed to close audit log %s: %v", l.path, err)
+	}
+	l.file = nil
+	if l.maxBackups < 1 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	if err := os.Remove(backup(l.path, l.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(l.path, i), backup(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, backup(l.path, 1)); err != nil {
+		// appending to the full file beats losing entries
+		if err := l.open(); err != nil {
+			return err
+		}
+		return err
+	}
+	return l.open()
+}
+
+func backup(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Close closes the file of the log.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
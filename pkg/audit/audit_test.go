@@ -0,0 +1,97 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		e := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	var mirror bytes.Buffer
+	l, err := NewLog("node-1", path, 1, 2, &mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []string{"tc qdisc add dev ifb0 root handle 1: htb", "tc class add dev ifb0 parent 1: classid 1:1 htb rate 100mbit", "tc qdisc del dev ifb0 root", "ip link set dev ifb0 down"}
+	for _, command := range commands {
+		l.Write(Entry{Namespace: "default", Pod: "web", Source: "annotation", Command: command})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// each entry is beyond maxSize, so it rotates the previous one
+	for path, command := range map[string]string{path: commands[3], path + ".1": commands[2], path + ".2": commands[1]} {
+		entries := readEntries(t, path)
+		if len(entries) != 1 || entries[0].Command != command {
+			t.Errorf("%s has %v, expected %q", filepath.Base(path), entries, command)
+			continue
+		}
+		if entries[0].Node != "node-1" || entries[0].Time.IsZero() {
+			t.Errorf("%s has node %q and time %v, expected them filled in", filepath.Base(path), entries[0].Node, entries[0].Time)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+	if lines := strings.Count(mirror.String(), "\n"); lines != len(commands) {
+		t.Errorf("expected %d mirrored entries, got %d", len(commands), lines)
+	}
+
+	// a new log appends to the file
+	l, err = NewLog("node-1", path, 0, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Entry{Command: "tc qdisc add dev ifb1 root handle 1: htb", ExitStatus: 2, Output: "RTNETLINK answers: File exists"})
+	l.Close()
+	entries := readEntries(t, path)
+	if len(entries) != 2 || entries[1].ExitStatus != 2 || entries[1].Output != "RTNETLINK answers: File exists" {
+		t.Errorf("expected the entry appended, got %v", entries)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package client is a typed client for the chaos.kube-chaos API group.
+package client // import "github.com/huanwei/kube-chaos/pkg/client"
+
+import (
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	// Scheme knows the chaos.kube-chaos types.
+	Scheme         = runtime.NewScheme()
+	Codecs         = serializer.NewCodecFactory(Scheme)
+	ParameterCodec = runtime.NewParameterCodec(Scheme)
+)
+
+func init() {
+	meta_v1.AddToGroupVersion(Scheme, schema.GroupVersion{Version: "v1"})
+	if err := v1alpha1.AddToScheme(Scheme); err != nil {
+		panic(err)
+	}
+}
+
+// Interface gives access to the chaos.kube-chaos resources.
+type Interface interface {
+	Experiments(namespace string) ExperimentInterface
+}
+
+// Clientset implements Interface with a REST client.
+type Clientset struct {
+	restClient rest.Interface
+}
+
+// NewForConfig creates a new Clientset for the given config.
+func NewForConfig(c *rest.Config) (*Clientset, error) {
+	config := *c
+	gv := v1alpha1.SchemeGroupVersion
+	config.GroupVersion = &gv
+	config.APIPath = "/apis"
+	config.ContentType = runtime.ContentTypeJSON
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: Codecs}
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	client, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &Clientset{restClient: client}, nil
+}
+
+func (c *Clientset) Experiments(namespace string) ExperimentInterface {
+	return &experiments{client: c.restClient, ns: namespace}
+}
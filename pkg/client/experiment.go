@@ -0,0 +1,99 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// ExperimentInterface has methods to work with Experiment resources.
+type ExperimentInterface interface {
+	Create(*v1alpha1.Experiment) (*v1alpha1.Experiment, error)
+	Update(*v1alpha1.Experiment) (*v1alpha1.Experiment, error)
+	Delete(name string, options *meta_v1.DeleteOptions) error
+	Get(name string, options meta_v1.GetOptions) (*v1alpha1.Experiment, error)
+	List(opts meta_v1.ListOptions) (*v1alpha1.ExperimentList, error)
+}
+
+// experiments implements ExperimentInterface
+type experiments struct {
+	client rest.Interface
+	ns     string
+}
+
+// Get takes name of the experiment, and returns the corresponding experiment object, and an error if there is any.
+func (c *experiments) Get(name string, options meta_v1.GetOptions) (result *v1alpha1.Experiment, err error) {
+	result = &v1alpha1.Experiment{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("experiments").
+		Name(name).
+		VersionedParams(&options, ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// List takes label and field selectors, and returns the list of Experiments that match those selectors.
+func (c *experiments) List(opts meta_v1.ListOptions) (result *v1alpha1.ExperimentList, err error) {
+	result = &v1alpha1.ExperimentList{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("experiments").
+		VersionedParams(&opts, ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// Create takes the representation of an experiment and creates it. Returns the server's representation of the experiment, and an error, if there is any.
+func (c *experiments) Create(experiment *v1alpha1.Experiment) (result *v1alpha1.Experiment, err error) {
+	result = &v1alpha1.Experiment{}
+	err = c.client.Post().
+		Namespace(c.ns).
+		Resource("experiments").
+		Body(experiment).
+		Do().
+		Into(result)
+	return
+}
+
+// Update takes the representation of an experiment and updates it. Returns the server's representation of the experiment, and an error, if there is any.
+func (c *experiments) Update(experiment *v1alpha1.Experiment) (result *v1alpha1.Experiment, err error) {
+	result = &v1alpha1.Experiment{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("experiments").
+		Name(experiment.Name).
+		Body(experiment).
+		Do().
+		Into(result)
+	return
+}
+
+// Delete takes name of the experiment and deletes it. Returns an error if one occurs.
+func (c *experiments) Delete(name string, options *meta_v1.DeleteOptions) error {
+	return c.client.Delete().
+		Namespace(c.ns).
+		Resource("experiments").
+		Name(name).
+		Body(options).
+		Do().
+		Error()
+}
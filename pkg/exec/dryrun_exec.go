@@ -0,0 +1,208 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// DryRunExec is an Interface that logs the commands that change the node instead of running them,
+// and records them if Record is set. Read-only commands, such as `tc qdisc show` or `ip route get`, return their
+// output in Outputs, or are run by Reads if it is set, or else return no output.
+type DryRunExec struct {
+	// Outputs are the canned outputs of read-only commands, by command line.
+	Outputs map[string]string
+	// Reads runs the read-only commands without canned output, it may be nil.
+	Reads Interface
+	// Record keeps the commands that weren't run for Commands, e.g. in tests. A long-running dry
+	// run leaves it unset, it logs the same commands on every sync.
+	Record bool
+
+	lock     sync.Mutex
+	commands []string
+}
+
+// NewDryRun returns a DryRunExec running the read-only commands without canned output with reads.
+func NewDryRun(reads Interface) *DryRunExec {
+	return &DryRunExec{Outputs: map[string]string{}, Reads: reads}
+}
+
+// Command is part of the Interface interface.
+func (d *DryRunExec) Command(cmd string, args ...string) Cmd {
+	return &dryRunCmd{exec: d, argv: append([]string{cmd}, args...)}
+}
+
+// CommandContext is part of the Interface interface, the context applies to the read-only
+// commands Reads runs.
+func (d *DryRunExec) CommandContext(ctx context.Context, cmd string, args ...string) Cmd {
+	return &dryRunCmd{exec: d, ctx: ctx, argv: append([]string{cmd}, args...)}
+}
+
+// LookPath is part of the Interface interface.
+func (d *DryRunExec) LookPath(file string) (string, error) {
+	if d.Reads != nil {
+		return d.Reads.LookPath(file)
+	}
+	return file, nil
+}
+
+// Commands returns the command lines of the commands that weren't run, in order, if Record is set.
+func (d *DryRunExec) Commands() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.commands...)
+}
+
+// ReadOnly reports whether a command only reads the state of the node.
+func ReadOnly(cmd string, args ...string) bool {
+	// skip options such as -s or -o
+	words := []string{}
+	for _, arg := range args {
+		if arg == "-batch" || arg == "-b" {
+			return false
+		}
+		if !strings.HasPrefix(arg, "-") {
+			words = append(words, arg)
+		}
+	}
+	verb := func(i int) string {
+		if i < len(words) {
+			return words[i]
+		}
+		return ""
+	}
+	switch cmd {
+	case "tc", "ip":
+		// e.g. tc qdisc show or ip route get, with an object but no verb they show too
+		if len(words) == 0 {
+			return false
+		}
+		switch verb(1) {
+		case "", "show", "list", "ls", "get":
+			return true
+		}
+	case "curl", "lsmod", "true":
+		return true
+	}
+	return false
+}
+
+type dryRunCmd struct {
+	exec   *DryRunExec
+	ctx    context.Context
+	argv   []string
+	dir    string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (cmd *dryRunCmd) SetDir(dir string) {
+	cmd.dir = dir
+}
+
+func (cmd *dryRunCmd) SetStdin(in io.Reader) {
+	cmd.stdin = in
+}
+
+func (cmd *dryRunCmd) SetStdout(out io.Writer) {
+	cmd.stdout = out
+}
+
+func (cmd *dryRunCmd) SetStderr(out io.Writer) {
+	cmd.stderr = out
+}
+
+// CombinedOutput is part of the Cmd interface.
+func (cmd *dryRunCmd) CombinedOutput() ([]byte, error) {
+	return cmd.run(func(c Cmd) ([]byte, error) { return c.CombinedOutput() })
+}
+
+func (cmd *dryRunCmd) Output() ([]byte, error) {
+	return cmd.run(func(c Cmd) ([]byte, error) { return c.Output() })
+}
+
+func (cmd *dryRunCmd) Run() error {
+	_, err := cmd.run(func(c Cmd) ([]byte, error) { return nil, c.Run() })
+	return err
+}
+
+func (cmd *dryRunCmd) run(output func(Cmd) ([]byte, error)) ([]byte, error) {
+	d := cmd.exec
+	line := strings.Join(cmd.argv, " ")
+	if ReadOnly(cmd.argv[0], cmd.argv[1:]...) {
+		if out, found := d.Outputs[line]; found {
+			return cmd.write([]byte(out))
+		}
+		if d.Reads == nil {
+			return nil, nil
+		}
+		var c Cmd
+		if cmd.ctx != nil {
+			c = d.Reads.CommandContext(cmd.ctx, cmd.argv[0], cmd.argv[1:]...)
+		} else {
+			c = d.Reads.Command(cmd.argv[0], cmd.argv[1:]...)
+		}
+		if cmd.dir != "" {
+			c.SetDir(cmd.dir)
+		}
+		if cmd.stdin != nil {
+			c.SetStdin(cmd.stdin)
+		}
+		if cmd.stdout != nil {
+			c.SetStdout(cmd.stdout)
+		}
+		if cmd.stderr != nil {
+			c.SetStderr(cmd.stderr)
+		}
+		return output(c)
+	}
+	if cmd.stdin != nil {
+		// e.g. the commands of tc -batch
+		var in bytes.Buffer
+		if _, err := in.ReadFrom(cmd.stdin); err != nil {
+			return nil, fmt.Errorf("failed to read the stdin of %q: %v", line, err)
+		}
+		if in.Len() > 0 {
+			line = fmt.Sprintf("%s <<EOF\n%sEOF", line, in.String())
+		}
+	}
+	glog.Infof("[dry-run] %s", line)
+	if d.Record {
+		d.lock.Lock()
+		d.commands = append(d.commands, line)
+		d.lock.Unlock()
+	}
+	return nil, nil
+}
+
+func (cmd *dryRunCmd) write(out []byte) ([]byte, error) {
+	if cmd.stdout != nil {
+		if _, err := cmd.stdout.Write(out); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return out, nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDryRunExec(t *testing.T) {
+	d := NewDryRun(nil)
+	d.Record = true
+	d.Outputs["tc qdisc show dev ifb0"] = "qdisc htb 1: root refcnt 2 r2q 10 default 30\n"
+
+	out, err := d.Command("tc", "qdisc", "show", "dev", "ifb0").CombinedOutput()
+	if err != nil || !strings.HasPrefix(string(out), "qdisc htb 1:") {
+		t.Errorf("expected the canned output, got %q, %v", out, err)
+	}
+	out, err = d.Command("tc", "class", "show", "dev", "ifb0").CombinedOutput()
+	if err != nil || len(out) != 0 {
+		t.Errorf("expected no output, got %q, %v", out, err)
+	}
+	for _, argv := range [][]string{
+		{"modprobe", "ifb"},
+		{"ip", "link", "set", "dev", "ifb0", "up"},
+		{"tc", "qdisc", "add", "dev", "ifb0", "root", "handle", "1:", "htb", "default", "30"},
+	} {
+		if _, err := d.Command(argv[0], argv[1:]...).CombinedOutput(); err != nil {
+			t.Errorf("%v: unexpected error %v", argv, err)
+		}
+	}
+	expected := []string{"modprobe ifb", "ip link set dev ifb0 up", "tc qdisc add dev ifb0 root handle 1: htb default 30"}
+	if got := d.Commands(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the commands %q, got %q", expected, got)
+	}
+
+	// without Record the commands are only logged
+	d = NewDryRun(nil)
+	d.Command("modprobe", "ifb").CombinedOutput()
+	if got := d.Commands(); len(got) != 0 {
+		t.Errorf("expected no recorded commands, got %q", got)
+	}
+}
+
+func TestDryRunExecReads(t *testing.T) {
+	d := NewDryRun(New())
+	d.Record = true
+	out, err := d.Command("ip", "-o", "link", "show", "lo").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "lo") {
+		t.Errorf("expected the read to run, got %q, %v", out, err)
+	}
+	if out, _ := d.Command("echo", "hello").CombinedOutput(); len(out) != 0 || len(d.Commands()) != 1 {
+		t.Errorf("expected echo not to run, got %q", out)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		argv     []string
+		expected bool
+	}{
+		{[]string{"tc", "qdisc", "show", "dev", "ifb0"}, true},
+		{[]string{"tc", "-s", "class", "show", "dev", "ifb0"}, true},
+		{[]string{"tc", "filter"}, true},
+		{[]string{"tc", "filter", "del", "dev", "ifb0"}, false},
+		{[]string{"tc", "-batch", "-"}, false},
+		{[]string{"ip", "-o", "link", "show"}, true},
+		{[]string{"ip", "route", "get", "10.0.0.1"}, true},
+		{[]string{"ip", "link", "set", "dev", "ifb0", "up"}, false},
+		{[]string{"modprobe", "ifb"}, false},
+	}
+	for _, test := range tests {
+		if got := ReadOnly(test.argv[0], test.argv[1:]...); got != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.argv, test.expected, got)
+		}
+	}
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package exec
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	osexec "os/exec"
 	"syscall"
@@ -32,6 +35,10 @@ type Interface interface {
 	// This follows the pattern of package os/exec.
 	Command(cmd string, args ...string) Cmd
 
+	// CommandContext returns a Cmd instance which kills the command, and any process it
+	// started, once ctx is done. Running it then returns ctx.Err().
+	CommandContext(ctx context.Context, cmd string, args ...string) Cmd
+
 	// LookPath wraps os/exec.LookPath
 	LookPath(file string) (string, error)
 }
@@ -45,9 +52,12 @@ type Cmd interface {
 	CombinedOutput() ([]byte, error)
 	// Output runs the command and returns standard output, but not standard err
 	Output() ([]byte, error)
+	// Run runs the command, its output goes to the writers set with SetStdout and SetStderr.
+	Run() error
 	SetDir(dir string)
 	SetStdin(in io.Reader)
 	SetStdout(out io.Writer)
+	SetStderr(out io.Writer)
 }
 
 // ExitError is an interface that presents an API similar to os.ProcessState, which is
@@ -70,7 +80,15 @@ func New() Interface {
 
 // Command is part of the Interface interface.
 func (executor *executor) Command(cmd string, args ...string) Cmd {
-	return (*cmdWrapper)(osexec.Command(cmd, args...))
+	return &cmdWrapper{Cmd: osexec.Command(cmd, args...)}
+}
+
+// CommandContext is part of the Interface interface.
+func (executor *executor) CommandContext(ctx context.Context, cmd string, args ...string) Cmd {
+	c := osexec.Command(cmd, args...)
+	// in its own process group, so its children are killed with it
+	setProcessGroup(c)
+	return &cmdWrapper{Cmd: c, ctx: ctx}
 }
 
 // LookPath is part of the Interface interface
@@ -78,8 +96,11 @@ func (executor *executor) LookPath(file string) (string, error) {
 	return osexec.LookPath(file)
 }
 
-// Wraps exec.Cmd so we can capture errors.
-type cmdWrapper osexec.Cmd
+// Wraps exec.Cmd so we can capture errors, and kill the command once its context is done.
+type cmdWrapper struct {
+	*osexec.Cmd
+	ctx context.Context
+}
 
 func (cmd *cmdWrapper) SetDir(dir string) {
 	cmd.Dir = dir
@@ -93,21 +114,68 @@ func (cmd *cmdWrapper) SetStdout(out io.Writer) {
 	cmd.Stdout = out
 }
 
+func (cmd *cmdWrapper) SetStderr(out io.Writer) {
+	cmd.Stderr = out
+}
+
 // CombinedOutput is part of the Cmd interface.
 func (cmd *cmdWrapper) CombinedOutput() ([]byte, error) {
-	out, err := (*osexec.Cmd)(cmd).CombinedOutput()
-	if err != nil {
-		return out, handleError(err)
+	if cmd.Stdout != nil || cmd.Stderr != nil {
+		return nil, errors.New("exec: Stdout or Stderr already set")
 	}
-	return out, nil
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	err := cmd.run()
+	return b.Bytes(), err
 }
 
 func (cmd *cmdWrapper) Output() ([]byte, error) {
-	out, err := (*osexec.Cmd)(cmd).Output()
-	if err != nil {
-		return out, handleError(err)
+	if cmd.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	captureErr := cmd.Stderr == nil
+	if captureErr {
+		cmd.Stderr = &stderr
+	}
+	err := cmd.run()
+	if ee, ok := err.(*ExitErrorWrapper); ok && captureErr {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// Run is part of the Cmd interface.
+func (cmd *cmdWrapper) Run() error {
+	return cmd.run()
+}
+
+func (cmd *cmdWrapper) run() error {
+	if cmd.ctx == nil {
+		return handleError(cmd.Cmd.Run())
+	}
+	if err := cmd.ctx.Err(); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return handleError(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-cmd.ctx.Done():
+			killProcessGroup(cmd.Process)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil && cmd.ctx.Err() != nil {
+		return cmd.ctx.Err()
 	}
-	return out, nil
+	return handleError(err)
 }
 
 func handleError(err error) error {
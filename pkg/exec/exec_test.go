@@ -17,8 +17,11 @@ limitations under the License.
 package exec
 
 import (
+	"bytes"
+	"context"
 	osexec "os/exec"
 	"testing"
+	"time"
 )
 
 func TestExecutorNoArgs(t *testing.T) {
@@ -101,3 +104,43 @@ func TestExecutableNotFound(t *testing.T) {
 		t.Errorf("Expected error ErrExecutableNotFound but got %v", err)
 	}
 }
+
+func TestCommandContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// the child holds the output open, Wait only returns once the whole group is killed
+	cmd := New().CommandContext(ctx, "/bin/sh", "-c", "sleep 10 & sleep 10")
+	if _, err := cmd.CombinedOutput(); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the command to be killed, it ran for %v", elapsed)
+	}
+
+	if _, err := New().CommandContext(ctx, "true").CombinedOutput(); err != context.DeadlineExceeded {
+		t.Errorf("expected a done context not to run the command, got %v", err)
+	}
+}
+
+func TestCommandContextStreams(t *testing.T) {
+	cmd := New().CommandContext(context.Background(), "/bin/sh", "-c", "echo stdout; echo stderr > /dev/stderr")
+	var stdout, stderr bytes.Buffer
+	cmd.SetStdout(&stdout)
+	cmd.SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if stdout.String() != "stdout\n" || stderr.String() != "stderr\n" {
+		t.Errorf("unexpected output: %q, %q", stdout.String(), stderr.String())
+	}
+
+	out, err := New().CommandContext(context.Background(), "/bin/sh", "-c", "echo stdout; echo stderr > /dev/stderr; exit 3").Output()
+	if string(out) != "stdout\n" {
+		t.Errorf("unexpected output: %q", string(out))
+	}
+	ee, ok := err.(*ExitErrorWrapper)
+	if !ok || ee.ExitStatus() != 3 || string(ee.Stderr) != "stderr\n" {
+		t.Errorf("expected exit status 3 with the stderr, got %+v", err)
+	}
+}
@@ -0,0 +1,31 @@
+// +build windows
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+)
+
+func setProcessGroup(cmd *osexec.Cmd) {}
+
+// killProcessGroup kills the process, windows has no process groups to kill its children with.
+func killProcessGroup(p *os.Process) {
+	p.Kill()
+}
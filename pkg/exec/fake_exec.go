@@ -17,6 +17,7 @@ limitations under the License.
 package exec
 
 import (
+	"context"
 	"fmt"
 	"io"
 )
@@ -39,6 +40,11 @@ func (fake *FakeExec) Command(cmd string, args ...string) Cmd {
 	return fake.CommandScript[i](cmd, args...)
 }
 
+// CommandContext runs the next action of the script, the context is ignored.
+func (fake *FakeExec) CommandContext(ctx context.Context, cmd string, args ...string) Cmd {
+	return fake.Command(cmd, args...)
+}
+
 func (fake *FakeExec) LookPath(file string) (string, error) {
 	return fake.LookPathFunc(file)
 }
@@ -52,6 +58,7 @@ type FakeCmd struct {
 	Dirs                 []string
 	Stdin                io.Reader
 	Stdout               io.Writer
+	Stderr               io.Writer
 }
 
 func InitFakeCmd(fake *FakeCmd, cmd string, args ...string) Cmd {
@@ -73,6 +80,10 @@ func (fake *FakeCmd) SetStdout(out io.Writer) {
 	fake.Stdout = out
 }
 
+func (fake *FakeCmd) SetStderr(out io.Writer) {
+	fake.Stderr = out
+}
+
 func (fake *FakeCmd) CombinedOutput() ([]byte, error) {
 	if fake.CombinedOutputCalls > len(fake.CombinedOutputScript)-1 {
 		panic("ran out of CombinedOutput() actions")
@@ -90,6 +101,15 @@ func (fake *FakeCmd) Output() ([]byte, error) {
 	return nil, fmt.Errorf("unimplemented")
 }
 
+// Run runs the next action of the CombinedOutput script, and writes its output to Stdout.
+func (fake *FakeCmd) Run() error {
+	out, err := fake.CombinedOutput()
+	if fake.Stdout != nil {
+		fake.Stdout.Write(out)
+	}
+	return err
+}
+
 // A simple fake ExitError type.
 type FakeExitError struct {
 	Status int
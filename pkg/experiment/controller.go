@@ -0,0 +1,250 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package experiment implements the controller that turns Experiments into pod chaos annotations.
+package experiment // import "github.com/huanwei/kube-chaos/pkg/experiment"
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/client"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/record"
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	"github.com/huanwei/kube-chaos/pkg/selection"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Controller selects the pods of every Experiment and labels and annotates them, the agents on
+// the nodes then apply the chaos. The chosen pods and the skipped ones are reported in the
+// Experiment's status. An Experiment failing its probes is aborted, its chaos removed.
+type Controller struct {
+	kubeClient  kubernetes.Interface
+	chaosClient client.Interface
+	policy      *safeguard.Policy
+	recorder    *record.EventRecorder
+	prober      *prober
+}
+
+func NewController(kubeClient kubernetes.Interface, chaosClient client.Interface, policy *safeguard.Policy, recorder *record.EventRecorder) *Controller {
+	return &Controller{
+		kubeClient:  kubeClient,
+		chaosClient: chaosClient,
+		policy:      policy,
+		recorder:    recorder,
+		prober:      newProber(),
+	}
+}
+
+// Run syncs all experiments every period until stopCh is closed.
+func (c *Controller) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(c.syncAll, period, stopCh)
+}
+
+func (c *Controller) syncAll() {
+	experiments, err := c.chaosClient.Experiments(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Failed list experiments: %v", err)
+		return
+	}
+	known := sets.String{}
+	for i := range experiments.Items {
+		exp := &experiments.Items[i]
+		known.Insert(exp.Namespace + "/" + exp.Name)
+		if err := c.syncExperiment(exp); err != nil {
+			glog.Errorf("Failed to sync experiment %s/%s: %v", exp.Namespace, exp.Name, err)
+		}
+	}
+	c.prober.retain(known)
+
+	// clear the chaos of experiments that have been deleted
+	pods, err := c.kubeClient.CoreV1().Pods(meta_v1.NamespaceAll).List(meta_v1.ListOptions{LabelSelector: v1alpha1.ExperimentLabel})
+	if err != nil {
+		glog.Errorf("Failed list experiment pods: %v", err)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if known.Has(pod.Namespace + "/" + pod.Labels[v1alpha1.ExperimentLabel]) {
+			continue
+		}
+		glog.V(2).Infof("Experiment %s/%s is gone, clearing chaos of pod %s", pod.Namespace, pod.Labels[v1alpha1.ExperimentLabel], pod.Name)
+		if err := c.clearPod(pod); err != nil {
+			glog.Errorf("Failed to clear chaos of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+}
+
+func (c *Controller) syncExperiment(exp *v1alpha1.Experiment) error {
+	if errs := Validate(exp); len(errs) > 0 {
+		return fmt.Errorf("invalid experiment: %v", errs)
+	}
+	selector, err := meta_v1.LabelSelectorAsSelector(exp.Spec.Selector)
+	if err != nil {
+		return err
+	}
+	if exp.Status.Phase == v1alpha1.ExperimentAborted {
+		// the pods may have been patched again while the experiment was being aborted
+		return c.clearExperiment(exp)
+	}
+	probes, abort := c.prober.checkAll(exp)
+	if abort != "" {
+		return c.abort(exp, probes, abort)
+	}
+	pods, err := c.kubeClient.CoreV1().Pods(exp.Namespace).List(meta_v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+
+	status := v1alpha1.ExperimentStatus{Phase: v1alpha1.ExperimentRunning, Probes: probes}
+	candidates := []v1.Pod{}
+	for _, pod := range pods.Items {
+		if other := pod.Labels[v1alpha1.ExperimentLabel]; other != "" && other != exp.Name {
+			status.SkippedPods = append(status.SkippedPods, v1alpha1.SkippedPod{Name: pod.Name, Reason: "targeted by experiment " + other})
+			continue
+		}
+		if refusal := c.policy.Check(&pod); refusal != nil {
+			c.recorder.Eventf(&pod, v1.EventTypeWarning, refusal.Reason, "Refused to apply experiment %s: %s", exp.Name, refusal.Message)
+			status.SkippedPods = append(status.SkippedPods, v1alpha1.SkippedPod{Name: pod.Name, Reason: refusal.Message})
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		candidates = append(candidates, pod)
+	}
+
+	chosen, notChosen := selection.Select(exp.Spec.Selection, exp.Namespace+"/"+exp.Name, candidates, sets.NewString(exp.Status.TargetPods...))
+	for _, s := range notChosen {
+		status.SkippedPods = append(status.SkippedPods, v1alpha1.SkippedPod{Name: s.Pod.Name, Reason: s.Reason})
+	}
+
+	// the agents enforce their own limit across all chaos sources, this one only counts the
+	// experiment's pods but lets the status say which pods were left out.
+	limiter := selection.NewLimiter(exp.Spec.MaxPerWorkload, workload.NewResolver(c.kubeClient))
+	selected, skipped := limiter.Limit(chosen)
+	for _, s := range skipped {
+		c.recorder.Eventf(&s.Pod, v1.EventTypeWarning, selection.ReasonLimited, "Experiment %s skipped the pod: %s", exp.Name, s.Reason)
+		status.SkippedPods = append(status.SkippedPods, v1alpha1.SkippedPod{Name: s.Pod.Name, Reason: s.Reason})
+	}
+
+	targets := sets.String{}
+	for i := range selected {
+		pod := &selected[i]
+		targets.Insert(pod.Name)
+		if err := c.targetPod(exp, pod); err != nil {
+			glog.Errorf("Failed to apply experiment %s/%s to pod %s: %v", exp.Namespace, exp.Name, pod.Name, err)
+		}
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Labels[v1alpha1.ExperimentLabel] == exp.Name && !targets.Has(pod.Name) {
+			if err := c.clearPod(pod); err != nil {
+				glog.Errorf("Failed to clear chaos of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			}
+		}
+	}
+
+	status.TargetPods = targets.List()
+	sort.Slice(status.SkippedPods, func(i, j int) bool { return status.SkippedPods[i].Name < status.SkippedPods[j].Name })
+	return c.updateStatus(exp, status)
+}
+
+// abort removes the chaos of an experiment that failed a probe, and marks it Aborted.
+func (c *Controller) abort(exp *v1alpha1.Experiment, probes []v1alpha1.ProbeStatus, reason string) error {
+	glog.Warningf("Aborting experiment %s/%s: %s", exp.Namespace, exp.Name, reason)
+	ref := exp.DeepCopy()
+	ref.TypeMeta = meta_v1.TypeMeta{Kind: "Experiment", APIVersion: v1alpha1.SchemeGroupVersion.String()}
+	c.recorder.Eventf(ref, v1.EventTypeWarning, "Aborted", "Removing the chaos, %s", reason)
+	if err := c.clearExperiment(exp); err != nil {
+		return err
+	}
+	return c.updateStatus(exp, v1alpha1.ExperimentStatus{Phase: v1alpha1.ExperimentAborted, Probes: probes, AbortReason: reason})
+}
+
+// clearExperiment removes the chaos label and annotations from the pods of an experiment.
+func (c *Controller) clearExperiment(exp *v1alpha1.Experiment) error {
+	pods, err := c.kubeClient.CoreV1().Pods(exp.Namespace).List(meta_v1.ListOptions{LabelSelector: v1alpha1.ExperimentLabel + "=" + exp.Name})
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		if err := c.clearPod(&pods.Items[i]); err != nil {
+			return fmt.Errorf("failed to clear chaos of pod %s: %v", pods.Items[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Controller) updateStatus(exp *v1alpha1.Experiment, status v1alpha1.ExperimentStatus) error {
+	if reflect.DeepEqual(exp.Status, status) {
+		return nil
+	}
+	exp = exp.DeepCopy()
+	exp.Status = status
+	_, err := c.chaosClient.Experiments(exp.Namespace).Update(exp)
+	return err
+}
+
+// targetPod labels and annotates a pod with the experiment's chaos, unless it already is.
+func (c *Controller) targetPod(exp *v1alpha1.Experiment, pod *v1.Pod) error {
+	if pod.Labels[v1alpha1.ExperimentLabel] == exp.Name &&
+		pod.Annotations[flow.EgressChaosAnnotation] == exp.Spec.Egress &&
+		pod.Annotations[flow.IngressChaosAnnotation] == exp.Spec.Ingress {
+		return nil
+	}
+	glog.V(2).Infof("Applying experiment %s/%s to pod %s", exp.Namespace, exp.Name, pod.Name)
+	egress, ingress := exp.Spec.Egress, exp.Spec.Ingress
+	return c.patchPod(pod, &exp.Name, &egress, &ingress)
+}
+
+// clearPod removes the chaos label and annotations from a pod.
+func (c *Controller) clearPod(pod *v1.Pod) error {
+	return c.patchPod(pod, nil, nil, nil)
+}
+
+// patchPod sets the experiment label and the chaos annotations of a pod, nil values remove them.
+func (c *Controller) patchPod(pod *v1.Pod, experiment, egress, ingress *string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]*string{
+				v1alpha1.ExperimentLabel: experiment,
+			},
+			"annotations": map[string]*string{
+				flow.EgressChaosAnnotation:  egress,
+				flow.IngressChaosAnnotation: ingress,
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, data)
+	return err
+}
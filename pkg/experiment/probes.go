@@ -0,0 +1,290 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package experiment
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultProbePeriod      = 10 * time.Second
+	defaultProbeTimeout     = 5 * time.Second
+	defaultFailureThreshold = 3
+)
+
+// prober checks the probes of the experiments when they are due, and counts their failures.
+type prober struct {
+	lock   sync.Mutex
+	probes map[string]*probeState
+	now    func() time.Time
+	// check runs a check of a probe, tests replace it.
+	check func(p *v1alpha1.Probe, timeout time.Duration) error
+}
+
+// probeState is the last check of a probe.
+type probeState struct {
+	probe   v1alpha1.Probe
+	checked time.Time
+	status  v1alpha1.ProbeStatus
+}
+
+func newProber() *prober {
+	return &prober{probes: map[string]*probeState{}, now: time.Now, check: check}
+}
+
+func probeKey(exp *v1alpha1.Experiment, name string) string {
+	return exp.Namespace + "/" + exp.Name + "/" + name
+}
+
+// checkAll checks the experiment's probes that are due, at once, and returns the status of all of
+// them. It also returns why the experiment must be aborted, if a probe failed its threshold.
+func (p *prober) checkAll(exp *v1alpha1.Experiment) ([]v1alpha1.ProbeStatus, string) {
+	var wg sync.WaitGroup
+	states := []*probeState{}
+	p.lock.Lock()
+	for i := range exp.Spec.Probes {
+		probe := exp.Spec.Probes[i]
+		key := probeKey(exp, probe.Name)
+		s, found := p.probes[key]
+		// a changed probe starts over
+		if !found || !reflect.DeepEqual(s.probe, probe) {
+			s = &probeState{probe: probe, status: v1alpha1.ProbeStatus{Name: probe.Name}}
+			p.probes[key] = s
+		}
+		states = append(states, s)
+		if period := durationOr(probe.Period, defaultProbePeriod); !s.checked.IsZero() && p.now().Sub(s.checked) < period {
+			continue
+		}
+		s.checked = p.now()
+		wg.Add(1)
+		go func(s *probeState) {
+			defer wg.Done()
+			err := p.check(&s.probe, durationOr(s.probe.Timeout, defaultProbeTimeout))
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			if err != nil {
+				s.status.ConsecutiveFailures++
+				s.status.LastError = err.Error()
+			} else {
+				s.status.ConsecutiveFailures = 0
+				s.status.LastError = ""
+			}
+		}(s)
+	}
+	p.lock.Unlock()
+	wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	statuses := []v1alpha1.ProbeStatus{}
+	abort := ""
+	for _, s := range states {
+		statuses = append(statuses, s.status)
+		threshold := s.probe.FailureThreshold
+		if threshold <= 0 {
+			threshold = defaultFailureThreshold
+		}
+		if abort == "" && s.status.ConsecutiveFailures >= threshold {
+			abort = fmt.Sprintf("probe %s failed %d checks in a row: %s", s.probe.Name, s.status.ConsecutiveFailures, s.status.LastError)
+		}
+	}
+	if len(statuses) == 0 {
+		statuses = nil
+	}
+	return statuses, abort
+}
+
+// retain forgets the probes of the experiments that aren't in known, by namespace/name.
+func (p *prober) retain(known sets.String) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key := range p.probes {
+		parts := strings.SplitN(key, "/", 3)
+		if !known.Has(parts[0] + "/" + parts[1]) {
+			delete(p.probes, key)
+		}
+	}
+}
+
+func durationOr(d meta_v1.Duration, fallback time.Duration) time.Duration {
+	if d.Duration <= 0 {
+		return fallback
+	}
+	return d.Duration
+}
+
+// check runs a check of a probe, it returns why the probe failed or nil.
+func check(probe *v1alpha1.Probe, timeout time.Duration) error {
+	switch {
+	case probe.HTTP != nil:
+		return checkHTTP(probe.HTTP, timeout)
+	case probe.TCP != nil:
+		conn, err := net.DialTimeout("tcp", probe.TCP.Address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case probe.Query != nil:
+		return checkQuery(probe.Query, timeout)
+	}
+	return fmt.Errorf("the probe has nothing to check")
+}
+
+func checkHTTP(h *v1alpha1.HTTPProbe, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err := client.Get(h.URL)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if !healthyStatus(h.StatusCodes, resp.StatusCode) {
+		return fmt.Errorf("%s returned status %d", h.URL, resp.StatusCode)
+	}
+	if h.MaxLatency.Duration > 0 && latency > h.MaxLatency.Duration {
+		return fmt.Errorf("%s took %s, longer than %s", h.URL, latency, h.MaxLatency.Duration)
+	}
+	return nil
+}
+
+func healthyStatus(codes []int32, code int) bool {
+	if len(codes) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, c := range codes {
+		if int(c) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// queryResponse is the response of the Prometheus instant query API.
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// sample is a value of a query result, and the labels of its series.
+type sample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+func checkQuery(q *v1alpha1.QueryProbe, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	u := strings.TrimSuffix(q.Endpoint, "/") + "/api/v1/query?" + url.Values{"query": {q.Query}}.Encode()
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	r := queryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("failed to decode the query response (status %d): %v", resp.StatusCode, err)
+	}
+	if r.Status != "success" {
+		return fmt.Errorf("query failed: %s", r.Error)
+	}
+	samples := []sample{}
+	switch r.Data.ResultType {
+	case "vector":
+		err = json.Unmarshal(r.Data.Result, &samples)
+	case "scalar":
+		s := sample{}
+		err = json.Unmarshal(r.Data.Result, &s.Value)
+		samples = append(samples, s)
+	default:
+		return fmt.Errorf("query returned a %s, expected a vector or a scalar", r.Data.ResultType)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode the query result: %v", err)
+	}
+	if len(samples) == 0 {
+		if q.IgnoreEmpty {
+			return nil
+		}
+		return fmt.Errorf("query returned no samples")
+	}
+	threshold, err := strconv.ParseFloat(q.Threshold, 64)
+	if err != nil {
+		return err
+	}
+	for _, s := range samples {
+		text, _ := s.Value[1].(string)
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("query returned the value %v: %v", s.Value[1], err)
+		}
+		if !compare(value, q.Operator, threshold) {
+			return fmt.Errorf("query value %s%s is not %s %s", text, formatLabels(s.Metric), q.Operator, q.Threshold)
+		}
+	}
+	return nil
+}
+
+// operators are the comparisons of query probes.
+var operators = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+func compare(value float64, operator string, threshold float64) bool {
+	op, found := operators[operator]
+	return found && op(value, threshold)
+}
+
+// formatLabels formats the labels of a series like PromQL, e.g. {code="500"}, sorted.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := sets.String{}
+	for name := range labels {
+		names.Insert(name)
+	}
+	items := []string{}
+	for _, name := range names.List() {
+		items = append(items, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(items, ",") + "}"
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package experiment
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProberCheckAll(t *testing.T) {
+	clock := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	healthy := map[string]bool{"web": true, "db": true}
+	// checkAll runs the checks concurrently
+	var checks int32
+	p := newProber()
+	p.now = func() time.Time { return clock }
+	p.check = func(probe *v1alpha1.Probe, timeout time.Duration) error {
+		atomic.AddInt32(&checks, 1)
+		if !healthy[probe.Name] {
+			return fmt.Errorf("%s is down", probe.Name)
+		}
+		return nil
+	}
+	exp := &v1alpha1.Experiment{ObjectMeta: meta_v1.ObjectMeta{Namespace: "shop", Name: "latency"}}
+	exp.Spec.Probes = []v1alpha1.Probe{
+		{Name: "web", TCP: &v1alpha1.TCPProbe{Address: "web:80"}, FailureThreshold: 2},
+		{Name: "db", TCP: &v1alpha1.TCPProbe{Address: "db:5432"}, Period: meta_v1.Duration{Duration: time.Minute}},
+	}
+
+	if _, abort := p.checkAll(exp); abort != "" || atomic.LoadInt32(&checks) != 2 {
+		t.Errorf("expected both probes checked and passing, got %d checks and %q", checks, abort)
+	}
+	healthy["web"] = false
+	clock = clock.Add(10 * time.Second)
+	statuses, abort := p.checkAll(exp)
+	if abort != "" || atomic.LoadInt32(&checks) != 3 || statuses[0].ConsecutiveFailures != 1 {
+		t.Errorf("expected only web checked and failing once, got %d checks, %+v and %q", checks, statuses, abort)
+	}
+	// not due yet
+	if p.checkAll(exp); atomic.LoadInt32(&checks) != 3 {
+		t.Errorf("expected no checks before the period, got %d", checks)
+	}
+	clock = clock.Add(10 * time.Second)
+	if _, abort := p.checkAll(exp); abort != "probe web failed 2 checks in a row: web is down" {
+		t.Errorf("expected web to abort the experiment, got %q", abort)
+	}
+
+	// a changed probe starts over
+	exp.Spec.Probes[0].FailureThreshold = 5
+	clock = clock.Add(10 * time.Second)
+	if statuses, abort := p.checkAll(exp); abort != "" || statuses[0].ConsecutiveFailures != 1 {
+		t.Errorf("expected the changed probe to start over, got %+v and %q", statuses, abort)
+	}
+	p.retain(sets.String{})
+	if len(p.probes) != 0 {
+		t.Errorf("expected the probes of deleted experiments forgotten, got %v", p.probes)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte("ok"))
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/api/v1/query":
+			result := map[string]string{
+				"errors":  `{"resultType":"vector","result":[{"metric":{"code":"200"},"value":[1528000000,"0.01"]},{"metric":{"code":"500"},"value":[1528000000,"0.2"]}]}`,
+				"none":    `{"resultType":"vector","result":[]}`,
+				"scalar":  `{"resultType":"scalar","result":[1528000000,"3"]}`,
+				"invalid": ``,
+			}[r.URL.Query().Get("query")]
+			if result == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+				return
+			}
+			w.Write([]byte(`{"status":"success","data":` + result + `}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := listener.Addr().String()
+	listener.Close()
+
+	query := func(q, operator, threshold string, ignoreEmpty bool) v1alpha1.Probe {
+		return v1alpha1.Probe{Query: &v1alpha1.QueryProbe{Endpoint: server.URL + "/", Query: q, Operator: operator, Threshold: threshold, IgnoreEmpty: ignoreEmpty}}
+	}
+	tests := []struct {
+		probe v1alpha1.Probe
+		err   string
+	}{
+		{v1alpha1.Probe{HTTP: &v1alpha1.HTTPProbe{URL: server.URL + "/healthz"}}, ""},
+		{v1alpha1.Probe{HTTP: &v1alpha1.HTTPProbe{URL: server.URL + "/missing"}}, "returned status 404"},
+		{v1alpha1.Probe{HTTP: &v1alpha1.HTTPProbe{URL: server.URL + "/missing", StatusCodes: []int32{404}}}, ""},
+		{v1alpha1.Probe{HTTP: &v1alpha1.HTTPProbe{URL: server.URL + "/slow", MaxLatency: meta_v1.Duration{Duration: time.Millisecond}}}, "longer than 1ms"},
+		{v1alpha1.Probe{TCP: &v1alpha1.TCPProbe{Address: server.Listener.Addr().String()}}, ""},
+		{v1alpha1.Probe{TCP: &v1alpha1.TCPProbe{Address: open}}, "refused"},
+		{query("errors", "<", "0.5", false), ""},
+		{query("errors", "<", "0.05", false), `query value 0.2{code="500"} is not < 0.05`},
+		{query("none", "<", "0.05", false), "no samples"},
+		{query("none", "<", "0.05", true), ""},
+		{query("scalar", ">=", "3", false), ""},
+		{query("invalid", "<", "1", false), "query failed: parse error"},
+	}
+	for i, test := range tests {
+		err := check(&test.probe, time.Second)
+		if test.err == "" && err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%d: expected an error containing %q, got %v", i, test.err, err)
+		}
+	}
+}
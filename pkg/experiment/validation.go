@@ -0,0 +1,128 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package experiment
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/selection"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Validate returns everything wrong with an experiment's spec, or nothing if it is valid.
+func Validate(exp *v1alpha1.Experiment) []error {
+	errs := []error{}
+	if exp.Spec.Selector == nil {
+		errs = append(errs, fmt.Errorf("spec.selector is required"))
+	} else if _, err := meta_v1.LabelSelectorAsSelector(exp.Spec.Selector); err != nil {
+		errs = append(errs, fmt.Errorf("spec.selector: %v", err))
+	}
+	if exp.Spec.Egress == "" && exp.Spec.Ingress == "" {
+		errs = append(errs, fmt.Errorf("at least one of spec.egress and spec.ingress is required"))
+	}
+	if exp.Spec.Egress != "" {
+		if _, err := flow.ParseChaosSpecs(exp.Spec.Egress); err != nil {
+			errs = append(errs, fmt.Errorf("spec.egress: %v", err))
+		}
+	}
+	if exp.Spec.Ingress != "" {
+		if _, err := flow.ParseChaosSpecs(exp.Spec.Ingress); err != nil {
+			errs = append(errs, fmt.Errorf("spec.ingress: %v", err))
+		}
+	}
+	if err := selection.ValidateMax(exp.Spec.MaxPerWorkload); err != nil {
+		errs = append(errs, fmt.Errorf("spec.maxPerWorkload: %v", err))
+	}
+	if err := selection.ValidateSelection(exp.Spec.Selection); err != nil {
+		errs = append(errs, fmt.Errorf("spec.selection: %v", err))
+	}
+	names := sets.String{}
+	for i, probe := range exp.Spec.Probes {
+		if names.Has(probe.Name) {
+			errs = append(errs, fmt.Errorf("spec.probes[%d]: name %q is repeated", i, probe.Name))
+		}
+		names.Insert(probe.Name)
+		if err := validateProbe(&probe); err != nil {
+			errs = append(errs, fmt.Errorf("spec.probes[%d]: %v", i, err))
+		}
+	}
+	return errs
+}
+
+func validateProbe(probe *v1alpha1.Probe) error {
+	if probe.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	kinds := 0
+	for _, set := range []bool{probe.HTTP != nil, probe.TCP != nil, probe.Query != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("exactly one of http, tcp and query is required")
+	}
+	if probe.Period.Duration < 0 || probe.Timeout.Duration < 0 || probe.FailureThreshold < 0 {
+		return fmt.Errorf("period, timeout and failureThreshold must not be negative")
+	}
+	switch {
+	case probe.HTTP != nil:
+		if err := validateURL(probe.HTTP.URL); err != nil {
+			return fmt.Errorf("http.url: %v", err)
+		}
+		for _, code := range probe.HTTP.StatusCodes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("http.statusCodes: %d isn't a status code", code)
+			}
+		}
+	case probe.TCP != nil:
+		if _, port, err := net.SplitHostPort(probe.TCP.Address); err != nil || port == "" {
+			return fmt.Errorf("tcp.address must be a host and port, e.g. payments:5432")
+		}
+	case probe.Query != nil:
+		if err := validateURL(probe.Query.Endpoint); err != nil {
+			return fmt.Errorf("query.endpoint: %v", err)
+		}
+		if probe.Query.Query == "" {
+			return fmt.Errorf("query.query is required")
+		}
+		if _, found := operators[probe.Query.Operator]; !found {
+			return fmt.Errorf("query.operator must be one of <, <=, >, >=, == and !=")
+		}
+		if _, err := strconv.ParseFloat(probe.Query.Threshold, 64); err != nil {
+			return fmt.Errorf("query.threshold must be a number")
+		}
+	}
+	return nil
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be an http or https URL", value)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package experiment
+
+import (
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestValidate(t *testing.T) {
+	max := intstr.FromString("150%")
+	tests := []struct {
+		name string
+		spec v1alpha1.ExperimentSpec
+		errs int
+	}{
+		{
+			name: "valid",
+			spec: v1alpha1.ExperimentSpec{
+				Selector:  &meta_v1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Egress:    "delay=100ms",
+				Selection: &v1alpha1.Selection{Mode: v1alpha1.SelectCount, Value: 2},
+			},
+		},
+		{
+			name: "no selector and no chaos",
+			spec: v1alpha1.ExperimentSpec{},
+			errs: 2,
+		},
+		{
+			name: "everything wrong",
+			spec: v1alpha1.ExperimentSpec{
+				Selector: &meta_v1.LabelSelector{MatchExpressions: []meta_v1.LabelSelectorRequirement{{Key: "app", Operator: "Near"}}},
+				Egress:   "delay=fast",
+				Ingress:  "loss=200%",
+
+				MaxPerWorkload: &max,
+				Selection:      &v1alpha1.Selection{Mode: "Random"},
+			},
+			errs: 5,
+		},
+		{
+			name: "probes",
+			spec: v1alpha1.ExperimentSpec{
+				Selector: &meta_v1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Egress:   "delay=100ms",
+				Probes: []v1alpha1.Probe{
+					{Name: "web", HTTP: &v1alpha1.HTTPProbe{URL: "http://web.shop.svc/healthz", StatusCodes: []int32{200}}},
+					{Name: "db", TCP: &v1alpha1.TCPProbe{Address: "db.shop.svc:5432"}},
+					{Name: "errors", Query: &v1alpha1.QueryProbe{Endpoint: "http://prometheus:9090", Query: "sum(rate(errors[1m]))", Operator: "<", Threshold: "0.05"}},
+				},
+			},
+		},
+		{
+			name: "invalid probes",
+			spec: v1alpha1.ExperimentSpec{
+				Selector: &meta_v1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Egress:   "delay=100ms",
+				Probes: []v1alpha1.Probe{
+					{Name: "web", HTTP: &v1alpha1.HTTPProbe{URL: "web/healthz"}},
+					{Name: "web", TCP: &v1alpha1.TCPProbe{Address: "db.shop.svc:5432"}},
+					{Name: "db", TCP: &v1alpha1.TCPProbe{Address: "db.shop.svc"}},
+					{Name: "both", TCP: &v1alpha1.TCPProbe{Address: "db:1"}, HTTP: &v1alpha1.HTTPProbe{URL: "http://web"}},
+					{Name: "errors", Query: &v1alpha1.QueryProbe{Endpoint: "http://prometheus:9090", Query: "errors", Operator: "~", Threshold: "0.05"}},
+				},
+			},
+			errs: 5,
+		},
+	}
+	for _, test := range tests {
+		errs := Validate(&v1alpha1.Experiment{Spec: test.spec})
+		if len(errs) != test.errs {
+			t.Errorf("%s: expected %d errors, got %v", test.name, test.errs, errs)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"errors"
+	"expvar"
+	"hash/fnv"
+	"sync"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+)
+
+const (
+	// MinClassID and MaxClassID bound the minor of the chaos classes 1:N on an ifb. The netem qdisc
+	// of class 1:N has the handle N:, so 1 is left to the root htb 1: and 0xffff is never used.
+	MinClassID = 0x2
+	MaxClassID = 0xfffe
+	// DefaultClassID is the minor of the ifb's default class for unmatched traffic.
+	DefaultClassID = 0x30
+)
+
+// ErrClassSpaceExhausted is returned when every class ID of an ifb is in use.
+var ErrClassSpaceExhausted = errors.New("exhausted the class space of the ifb")
+
+var (
+	// classMetrics counts, per ifb, the classes allocated and the allocations that failed
+	// because the class space was exhausted, once the classes are added or their targets fail.
+	// Planned classes aren't counted, a dry run or a diff plans them on every sync. They are
+	// served with the other expvars.
+	classMetrics = expvar.NewMap("kube_chaos_classes")
+)
+
+// classAllocator hands out the class IDs of the ifbs. The ID of a key, a pod UID or a CIDR, is
+// derived from its hash so it is the same on every sync and after a restart, collisions are
+// resolved by probing the following IDs.
+type classAllocator struct {
+	lock sync.Mutex
+	// reserved are the IDs handed out whose classes may not exist yet, by ifb
+	reserved map[string]sets.Int
+}
+
+var allocator = &classAllocator{reserved: map[string]sets.Int{}}
+
+// allocate returns a free class ID for key on ifb, used are the IDs of the ifb's classes. The ID
+// is reserved until it is released, once its class exists or failed to be created.
+func (a *classAllocator) allocate(ifb, key string, used sets.Int) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	reserved := a.reserved[ifb]
+	if reserved == nil {
+		reserved = sets.Int{}
+		a.reserved[ifb] = reserved
+	}
+	size := MaxClassID - MinClassID + 1
+	start := int(hash(key) % uint32(size))
+	for i := 0; i < size; i++ {
+		id := MinClassID + (start+i)%size
+		if id == DefaultClassID || used.Has(id) || reserved.Has(id) {
+			continue
+		}
+		reserved.Insert(id)
+		return id, nil
+	}
+	return -1, ErrClassSpaceExhausted
+}
+
+// release drops the reservation of an ID.
+func (a *classAllocator) release(ifb string, id int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if reserved := a.reserved[ifb]; reserved != nil {
+		reserved.Delete(id)
+	}
+}
+
+// countClass counts a class added on ifb, or its allocation failing with err.
+func countClass(ifb string, err error) {
+	switch {
+	case err == nil:
+		classMetrics.Add(ifb+"_allocated", 1)
+	case err == ErrClassSpaceExhausted:
+		classMetrics.Add(ifb+"_exhausted", 1)
+	}
+}
+
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
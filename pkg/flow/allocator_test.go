@@ -0,0 +1,83 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+)
+
+func TestClassAllocator(t *testing.T) {
+	a := &classAllocator{reserved: map[string]sets.Int{}}
+	first, err := a.allocate("ifb0", "uid-1", sets.Int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first < MinClassID || first > MaxClassID || first == DefaultClassID {
+		t.Errorf("unexpected class ID %x", first)
+	}
+	a.release("ifb0", first)
+	if again, _ := a.allocate("ifb0", "uid-1", sets.Int{}); again != first {
+		t.Errorf("expected the same key to get %x again, got %x", first, again)
+	}
+
+	// the ID is reserved until released, and taken once its class exists
+	if next, _ := a.allocate("ifb0", "uid-1", sets.Int{}); next == first {
+		t.Errorf("expected a reserved ID not to be handed out twice")
+	}
+	a.release("ifb0", first)
+	if next, _ := a.allocate("ifb0", "uid-1", sets.NewInt(first)); next == first {
+		t.Errorf("expected a used ID not to be handed out")
+	}
+
+	// each ifb has its own reservations
+	if other, _ := a.allocate("ifb1", "uid-1", sets.Int{}); other != first {
+		t.Errorf("expected %x on ifb1, got %x", first, other)
+	}
+}
+
+func TestClassAllocatorExhausted(t *testing.T) {
+	a := &classAllocator{reserved: map[string]sets.Int{}}
+	used := sets.Int{}
+	for id := MinClassID; id <= MaxClassID; id++ {
+		used.Insert(id)
+	}
+	used.Delete(DefaultClassID, MaxClassID)
+	id, err := a.allocate("ifb0", "uid-1", used)
+	if err != nil || id != MaxClassID {
+		t.Errorf("expected the last free ID %x, got %x, %v", MaxClassID, id, err)
+	}
+	if _, err := a.allocate("ifb0", "uid-2", used); err != ErrClassSpaceExhausted {
+		t.Errorf("expected ErrClassSpaceExhausted, got %v", err)
+	}
+}
+
+func TestHashTable(t *testing.T) {
+	tests := map[string][]string{
+		"192.168.0.10/32": {"ht", "2:a:"},
+		"10.1.2.255/32":   {"ht", "2:ff:"},
+		"10.1.2.0/24":     nil,
+		"invalid":         nil,
+	}
+	for cidr, expected := range tests {
+		got := hashTable(cidr)
+		if len(got) != len(expected) || (len(got) == 2 && (got[0] != expected[0] || got[1] != expected[1])) {
+			t.Errorf("%s: expected %v, got %v", cidr, expected, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/audit"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/state"
+)
+
+// auditLog gets an entry for every tc and ip command that changes the network, nil to not audit
+// them.
+var auditLog *audit.Log
+
+// SetAuditLog makes the package write its commands changing the network to l.
+func SetAuditLog(l *audit.Log) {
+	auditLog = l
+}
+
+// mutatingVerbs are the tc and ip verbs that change the network, e.g. tc qdisc add or ip link set.
+var mutatingVerbs = map[string]bool{
+	"add": true, "change": true, "replace": true, "del": true, "delete": true, "set": true, "flush": true,
+}
+
+// mutating reports whether a tc or ip command changes the network rather than shows it.
+func mutating(cmd string, args []string) bool {
+	if cmd != "tc" && cmd != "ip" {
+		return false
+	}
+	// the verb follows the object, after the options
+	words := []string{}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			words = append(words, arg)
+		}
+	}
+	return len(words) > 1 && mutatingVerbs[words[1]]
+}
+
+// exitStatus returns the exit status of a command that failed with err, -1 if it didn't exit, e.g.
+// because it timed out.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(exec.ExitError); ok && exitErr.Exited() {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
+
+// auditCommand writes a command run for owner to the audit log, spec is the chaos wanted for the
+// target of the command.
+func auditCommand(owner state.Owner, target, spec, command string, status int, out string) {
+	if auditLog == nil {
+		return
+	}
+	auditLog.Write(audit.Entry{
+		Namespace:  owner.Namespace,
+		Pod:        owner.Name,
+		Source:     owner.Source,
+		Target:     target,
+		Spec:       spec,
+		Command:    command,
+		ExitStatus: status,
+		Output:     strings.TrimSpace(out),
+	})
+}
+
+// auditOp writes a line of a tc -batch stream to the audit log. The owner and the spec are the
+// ones the plan records for the target, or else the ones of the state store, e.g. for the
+// operations removing a class.
+func auditOp(op Op, recorded map[string]Op, status int, out string) {
+	if auditLog == nil {
+		return
+	}
+	owner, spec := state.Owner{}, ""
+	if r, found := recorded[op.Target]; found {
+		owner, spec = r.record.Owner, r.spec.String()
+	} else if dev := op.device(); strings.HasPrefix(dev, "ifb") && stateStore != nil {
+		if r, found := stateStore.Get(ifbDirection(dev), op.Target); found {
+			owner = r.Owner
+		}
+	}
+	if spec == "" && op.spec != nil {
+		spec = op.spec.String()
+	}
+	auditCommand(owner, op.Target, spec, "tc "+strings.Join(op.Args, " "), status, out)
+}
@@ -0,0 +1,197 @@
+// +build linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Apply runs the operations of the plan through tc -batch, a stream for each device rather than a
+// tc process for each operation. The devices are changed concurrently, at most SetWorkers of them at
+// once, under the locks of Plan.Devices the caller holds. The operations of a target after a failed
+// one on the same device are skipped, since they build on it, the others carry on. It returns the
+// errors by target.
+func (p Plan) Apply() map[string]error {
+	return p.apply(executor)
+}
+
+func (p Plan) apply(e exec.Interface) map[string]error {
+	failed := map[string]error{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	for _, ops := range p.byDevice() {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(ops Plan) {
+			defer wg.Done()
+			deviceFailed := ops.applyDevice(e)
+			<-slots
+			lock.Lock()
+			defer lock.Unlock()
+			for target, err := range deviceFailed {
+				if _, found := failed[target]; !found {
+					failed[target] = err
+				}
+			}
+		}(ops)
+	}
+	wg.Wait()
+	return failed
+}
+
+// applyDevice runs the operations of a single device in order.
+func (p Plan) applyDevice(e exec.Interface) map[string]error {
+	// a dry run adds no classes
+	_, dryRun := e.(*exec.DryRunExec)
+	failed := map[string]error{}
+	remaining := p
+	for len(remaining) > 0 {
+		ops := Plan{}
+		for _, op := range remaining {
+			if _, skip := failed[op.Target]; skip {
+				continue
+			}
+			if op.err != nil {
+				if op.allocated != "" && !dryRun {
+					countClass(op.allocated, op.err)
+				}
+				failed[op.Target] = op.err
+				continue
+			}
+			ops = append(ops, op)
+		}
+		// tc stops at the first failed line, the operations before it are applied, the ones after
+		// it go in the next batch unless they build on it
+		line, err := batch(e, ops)
+		remaining = nil
+		for i, op := range ops {
+			if op.Args != nil {
+				line--
+			}
+			if line == 0 && op.Args != nil {
+				failed[op.Target] = err
+				remaining = ops[i+1:]
+				break
+			}
+			if line < 0 && err != nil {
+				// no line failed, the whole batch did
+				failed[op.Target] = err
+				continue
+			}
+			if op.allocated != "" && !dryRun {
+				countClass(op.allocated, nil)
+			}
+			op.done()
+		}
+	}
+	return failed
+}
+
+// done applies the record or forget of an operation to the state store, and to the classes Vary
+// follows.
+func (op Op) done() {
+	if op.record != nil {
+		record(*op.record)
+		track(*op.record, op.spec)
+	}
+	if op.forget != nil {
+		untrack(ifbForDirection(op.forget.Direction), op.forget.CIDR)
+	}
+	if op.forget != nil && stateStore != nil {
+		if err := stateStore.Delete(op.forget.Direction, op.forget.CIDR); err != nil {
+			glog.Errorf("Failed to forget %s: %v", op.forget, err)
+		}
+	}
+}
+
+// failedLineRE matches the line tc -batch reports a failed command with, e.g. "Command failed -:3".
+var failedLineRE = regexp.MustCompile(`(?m)^Command failed -:([0-9]+)$`)
+
+// batch runs the operations with Args as the lines of a tc -batch stream. It returns 0 if they all
+// succeed, the number of the failed line and its error if one fails, or -1 and the error if tc
+// fails otherwise.
+func batch(e exec.Interface, ops Plan) (int, error) {
+	var in bytes.Buffer
+	lines := []string{}
+	ran := Plan{}
+	recorded := map[string]Op{}
+	for _, op := range ops {
+		if op.Args != nil {
+			lines = append(lines, strings.Join(op.Args, " "))
+			fmt.Fprintln(&in, lines[len(lines)-1])
+			ran = append(ran, op)
+		}
+		if op.record != nil && op.spec != nil {
+			recorded[op.Target] = op
+		}
+	}
+	// audit the lines tc ran, with the status and output of the failed one
+	audited := func(failed int, status int, out string) {
+		for i, op := range ran {
+			switch {
+			case failed == 0 || i+1 < failed:
+				auditOp(op, recorded, 0, "")
+			case failed < 0 || i+1 == failed:
+				auditOp(op, recorded, status, out)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return 0, nil
+	}
+	glog.V(4).Infof("Running: tc -batch -\n%s", in.String())
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := e.CommandContext(ctx, "tc", "-batch", "-")
+	cmd.SetStdin(&in)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		audited(0, 0, "")
+		return 0, nil
+	}
+	if err == context.DeadlineExceeded {
+		audited(-1, -1, "timed out")
+		return -1, fmt.Errorf("tc -batch: timed out after %v", commandTimeout)
+	}
+	// expected tc output:
+	// RTNETLINK answers: File exists
+	// Command failed -:3
+	m := failedLineRE.FindSubmatchIndex(out)
+	if m == nil {
+		audited(-1, exitStatus(err), string(out))
+		return -1, fmt.Errorf("tc -batch: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	line, _ := strconv.Atoi(string(out[m[2]:m[3]]))
+	if line < 1 || line > len(lines) {
+		audited(-1, exitStatus(err), string(out))
+		return -1, fmt.Errorf("tc -batch: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	audited(line, exitStatus(err), string(out[:m[0]]))
+	return line, fmt.Errorf("tc %s: %s", lines[line-1], strings.TrimSpace(string(out[:m[0]])))
+}
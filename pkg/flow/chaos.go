@@ -0,0 +1,426 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRate is the htb rate of a chaos class whose spec doesn't limit the rate.
+const DefaultRate = "10gbit"
+
+// ChaosSpec is the parsed form of the chaos info in the kubernetes.io/egress-chaos and
+// kubernetes.io/ingress-chaos annotations, a comma separated list of key=value pairs, e.g.
+// "delay=100ms,jitter=10ms,loss=1%,rate=1mbit", or a profile with overrides, e.g.
+// "profile=3g-poor,delay=500ms".
+type ChaosSpec struct {
+	// Interface is the pod interface, e.g. net1, or the network-attachment, e.g. macvlan-conf,
+	// the chaos is applied to. Empty means the pod's DefaultInterface.
+	Interface string
+	// Services are the peers the chaos is limited to, as name or namespace/name, a name is in the
+	// pod's namespace.
+	Services []string
+	// Hosts are hostnames the chaos is limited to, e.g. api.stripe.com. Without Services and Hosts
+	// the chaos applies to all the traffic of the pod.
+	Hosts []string
+	// Delay and Jitter are added to every packet.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Distribution is the netem table the jitter follows, normal, pareto or paretonormal, empty
+	// means uniform.
+	Distribution string
+	// Loss, Duplicate and Reorder are percentages of packets.
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	// LossCorrelation is the correlation of a loss with the previous one, in percent.
+	LossCorrelation float64
+	// GEModel is a Gilbert-Elliott loss model, losing packets in bursts, instead of Loss.
+	GEModel *GEModel
+	// ReorderRelate is the correlation of reordering with the previous packet, in percent.
+	ReorderRelate float64
+	// Rate limits the bandwidth, in tc units, e.g. "1mbit".
+	Rate string
+	// Variations vary netem parameters with time, sorted by parameter.
+	Variations []Variation
+	// Trace is the name of a trace the netem parameters replay.
+	Trace string
+}
+
+// GEModel is the Gilbert-Elliott loss model, the percentages are P the chance of going from the
+// good state to the bad one, R of going back, OneMinusH of losing a packet in the bad state, and
+// OneMinusK of losing one in the good state.
+type GEModel struct {
+	P, R, OneMinusH, OneMinusK float64
+}
+
+var chaosKeys = map[string]func(s *ChaosSpec, value string) error{
+	"delay":           func(s *ChaosSpec, v string) error { return parseDuration(v, &s.Delay) },
+	"jitter":          func(s *ChaosSpec, v string) error { return parseDuration(v, &s.Jitter) },
+	"distribution":    parseDistribution,
+	"loss":            parseLoss,
+	"lossCorrelation": func(s *ChaosSpec, v string) error { return parsePercentage(v, &s.LossCorrelation) },
+	"gemodel":         parseGEModel,
+	"duplicate":       func(s *ChaosSpec, v string) error { return parsePercentage(v, &s.Duplicate) },
+	"reorder":         func(s *ChaosSpec, v string) error { return parsePercentage(v, &s.Reorder) },
+	"reorderRelate":   func(s *ChaosSpec, v string) error { return parsePercentage(v, &s.ReorderRelate) },
+	"rate":            parseRate,
+	"interface":       parseInterface,
+	"service":         parseServices,
+	"host":            parseHosts,
+	"ramp":            parseVariations("ramp"),
+	"steps":           parseVariations("steps"),
+	"wave":            parseVariations("wave"),
+	"trace":           parseTrace,
+}
+
+// profileKeys are the keys a profile may set, the others depend on the pod the spec is for.
+var profileKeys = map[string]bool{
+	"delay": true, "jitter": true, "distribution": true, "loss": true, "lossCorrelation": true, "gemodel": true,
+	"duplicate": true, "reorder": true, "reorderRelate": true, "rate": true,
+}
+
+// ChaosKeys returns the keys understood in chaos info, sorted.
+func ChaosKeys() []string {
+	keys := []string{"profile"}
+	for k := range chaosKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ParseChaosSpec parses and validates chaos info. The agent, the admission webhook and the
+// experiment controller all use it, so what is accepted at admission is what the agent applies. A
+// profile is the base the other keys override, wherever it is in the info.
+func ParseChaosSpec(info string) (*ChaosSpec, error) {
+	if strings.TrimSpace(info) == "" {
+		return nil, fmt.Errorf("empty chaos spec")
+	}
+	items := [][2]string{}
+	seen := map[string]bool{}
+	spec := &ChaosSpec{}
+	for _, item := range strings.Split(info, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid chaos spec item %q: expected key=value", item)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if _, found := chaosKeys[key]; !found && key != "profile" {
+			return nil, fmt.Errorf("unknown chaos spec key %q, expected one of %s", key, strings.Join(ChaosKeys(), ", "))
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("chaos spec key %q is set more than once", key)
+		}
+		seen[key] = true
+		if key == "profile" {
+			base, err := profileSpec(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid profile: %v", err)
+			}
+			*spec = *base
+			continue
+		}
+		items = append(items, [2]string{key, value})
+	}
+	if seen["loss"] && seen["gemodel"] {
+		return nil, fmt.Errorf("loss and gemodel are different loss models, set only one of them")
+	}
+	for _, kv := range items {
+		if err := chaosKeys[kv[0]](spec, kv[1]); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", kv[0], err)
+		}
+	}
+	if err := spec.validateVariations(seen); err != nil {
+		return nil, err
+	}
+	// a varied parameter replaces the value of the profile
+	for _, name := range spec.varied() {
+		variedParams[name].set(spec, 0)
+	}
+	sort.SliceStable(spec.Variations, func(i, j int) bool { return spec.Variations[i].Param < spec.Variations[j].Param })
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// Validate checks the combination of parameters is one netem accepts.
+func (s *ChaosSpec) Validate() error {
+	// the parameters are checked at the values they vary to
+	s = s.peak()
+	if s.Jitter > 0 && s.Delay == 0 {
+		return fmt.Errorf("jitter requires a delay")
+	}
+	if s.Reorder > 0 && s.Delay == 0 {
+		return fmt.Errorf("reorder requires a delay, reordered packets are the ones sent without it")
+	}
+	if s.ReorderRelate > 0 && s.Reorder == 0 {
+		return fmt.Errorf("reorderRelate requires reorder")
+	}
+	if s.Distribution != "" && s.Jitter == 0 {
+		return fmt.Errorf("distribution requires a jitter")
+	}
+	if s.LossCorrelation > 0 && s.Loss == 0 {
+		return fmt.Errorf("lossCorrelation requires loss")
+	}
+	if s.GEModel != nil && s.Loss > 0 {
+		return fmt.Errorf("loss and gemodel are different loss models, set only one of them")
+	}
+	return nil
+}
+
+// NetemArgs returns the netem qdisc parameters of the spec.
+func (s *ChaosSpec) NetemArgs() []string {
+	args := []string{}
+	if s.Delay > 0 {
+		args = append(args, "delay", formatDuration(s.Delay))
+		if s.Jitter > 0 {
+			args = append(args, formatDuration(s.Jitter))
+		}
+		// a varied jitter may be zero
+		if s.Distribution != "" && s.Jitter > 0 {
+			args = append(args, "distribution", s.Distribution)
+		}
+	}
+	if s.Loss > 0 {
+		args = append(args, "loss", formatPercentage(s.Loss))
+		if s.LossCorrelation > 0 {
+			args = append(args, formatPercentage(s.LossCorrelation))
+		}
+	}
+	if m := s.GEModel; m != nil {
+		args = append(args, "loss", "gemodel", formatPercentage(m.P), formatPercentage(m.R), formatPercentage(m.OneMinusH), formatPercentage(m.OneMinusK))
+	}
+	if s.Duplicate > 0 {
+		args = append(args, "duplicate", formatPercentage(s.Duplicate))
+	}
+	// netem can't reorder without a delay, which may be varied to zero
+	if s.Reorder > 0 && s.Delay > 0 {
+		args = append(args, "reorder", formatPercentage(s.Reorder))
+		if s.ReorderRelate > 0 {
+			args = append(args, formatPercentage(s.ReorderRelate))
+		}
+	}
+	return args
+}
+
+// String formats the spec as chaos info, keys in a fixed order and zero values left out, so
+// ParseChaosSpec(s.String()) gives back the same spec.
+func (s *ChaosSpec) String() string {
+	items := []string{}
+	if s.Delay > 0 {
+		items = append(items, "delay="+s.Delay.String())
+	}
+	if s.Jitter > 0 {
+		items = append(items, "jitter="+s.Jitter.String())
+	}
+	if s.Distribution != "" {
+		items = append(items, "distribution="+s.Distribution)
+	}
+	if s.Loss > 0 {
+		items = append(items, "loss="+formatPercentage(s.Loss))
+	}
+	if s.LossCorrelation > 0 {
+		items = append(items, "lossCorrelation="+formatPercentage(s.LossCorrelation))
+	}
+	if m := s.GEModel; m != nil {
+		items = append(items, "gemodel="+strings.Join([]string{formatPercentage(m.P), formatPercentage(m.R), formatPercentage(m.OneMinusH), formatPercentage(m.OneMinusK)}, "/"))
+	}
+	if s.Duplicate > 0 {
+		items = append(items, "duplicate="+formatPercentage(s.Duplicate))
+	}
+	if s.Reorder > 0 {
+		items = append(items, "reorder="+formatPercentage(s.Reorder))
+	}
+	if s.ReorderRelate > 0 {
+		items = append(items, "reorderRelate="+formatPercentage(s.ReorderRelate))
+	}
+	if s.Rate != "" {
+		items = append(items, "rate="+s.Rate)
+	}
+	if s.Interface != "" {
+		items = append(items, "interface="+s.Interface)
+	}
+	if len(s.Services) > 0 {
+		items = append(items, "service="+strings.Join(s.Services, "+"))
+	}
+	if len(s.Hosts) > 0 {
+		items = append(items, "host="+strings.Join(s.Hosts, "+"))
+	}
+	for _, kind := range []string{"ramp", "steps", "wave"} {
+		variations := []string{}
+		for _, v := range s.Variations {
+			if v.Kind == kind {
+				variations = append(variations, v.String())
+			}
+		}
+		if len(variations) > 0 {
+			items = append(items, kind+"="+strings.Join(variations, "+"))
+		}
+	}
+	if s.Trace != "" {
+		items = append(items, "trace="+s.Trace)
+	}
+	return strings.Join(items, ",")
+}
+
+// HTBRate returns the rate of the spec's htb class.
+func (s *ChaosSpec) HTBRate() string {
+	if s.Rate == "" {
+		return DefaultRate
+	}
+	return s.Rate
+}
+
+func parseDuration(value string, d *time.Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("%s must not be negative", value)
+	}
+	*d = parsed
+	return nil
+}
+
+func parsePercentage(value string, p *float64) error {
+	if !strings.HasSuffix(value, "%") {
+		return fmt.Errorf("%s must be a percentage, e.g. 10%%", value)
+	}
+	parsed, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || parsed < 0 || parsed > 100 {
+		return fmt.Errorf("%s must be a percentage between 0%% and 100%%", value)
+	}
+	*p = parsed
+	return nil
+}
+
+var distributions = map[string]bool{"normal": true, "pareto": true, "paretonormal": true}
+
+func parseDistribution(s *ChaosSpec, value string) error {
+	if !distributions[value] {
+		return fmt.Errorf("%s must be one of normal, pareto or paretonormal", value)
+	}
+	s.Distribution = value
+	return nil
+}
+
+// parseLoss sets random loss, replacing the loss model of a profile.
+func parseLoss(s *ChaosSpec, value string) error {
+	if err := parsePercentage(value, &s.Loss); err != nil {
+		return err
+	}
+	s.GEModel = nil
+	return nil
+}
+
+// parseGEModel parses the percentages of a Gilbert-Elliott model separated by /, e.g.
+// "1%/10%/70%/0.1%", replacing the random loss of a profile.
+func parseGEModel(s *ChaosSpec, value string) error {
+	parts := strings.Split(value, "/")
+	if len(parts) != 4 {
+		return fmt.Errorf("%s must be the percentages p/r/1-h/1-k, e.g. 1%%/10%%/70%%/0.1%%", value)
+	}
+	m := &GEModel{}
+	for i, p := range []*float64{&m.P, &m.R, &m.OneMinusH, &m.OneMinusK} {
+		if err := parsePercentage(parts[i], p); err != nil {
+			return err
+		}
+	}
+	s.GEModel = m
+	s.Loss, s.LossCorrelation = 0, 0
+	return nil
+}
+
+var rateRE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(bit|kbit|mbit|gbit|bps|kbps|mbps|gbps)$`)
+
+func parseRate(s *ChaosSpec, value string) error {
+	value = strings.ToLower(value)
+	if !rateRE.MatchString(value) {
+		return fmt.Errorf("%s must be a tc rate, e.g. 512kbit or 1mbit", value)
+	}
+	if n, _ := strconv.ParseFloat(strings.TrimRight(value, "bitkmgps"), 64); n == 0 {
+		return fmt.Errorf("%s must be more than zero", value)
+	}
+	s.Rate = value
+	return nil
+}
+
+var interfaceRE = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+(/[a-zA-Z0-9_.\-]+)?$`)
+
+func parseInterface(s *ChaosSpec, value string) error {
+	if !interfaceRE.MatchString(value) {
+		return fmt.Errorf("%s must be an interface name, e.g. net1, or a network-attachment, e.g. default/macvlan-conf", value)
+	}
+	s.Interface = value
+	return nil
+}
+
+var serviceRE = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?/)?[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// parseServices parses Services separated by +, e.g. "payments+billing/ledger".
+func parseServices(s *ChaosSpec, value string) error {
+	seen := map[string]bool{}
+	for _, service := range strings.Split(value, "+") {
+		if !serviceRE.MatchString(service) {
+			return fmt.Errorf("%s must be a Service, as name or namespace/name, e.g. payments", service)
+		}
+		if seen[service] {
+			return fmt.Errorf("Service %s is named more than once", service)
+		}
+		seen[service] = true
+		s.Services = append(s.Services, service)
+	}
+	return nil
+}
+
+var hostRE = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// parseHosts parses hostnames separated by +, e.g. "api.stripe.com+hooks.slack.com".
+func parseHosts(s *ChaosSpec, value string) error {
+	seen := map[string]bool{}
+	for _, host := range strings.Split(strings.ToLower(value), "+") {
+		if !hostRE.MatchString(host) {
+			return fmt.Errorf("%s must be a hostname, e.g. api.stripe.com", host)
+		}
+		if seen[host] {
+			return fmt.Errorf("host %s is named more than once", host)
+		}
+		seen[host] = true
+		s.Hosts = append(s.Hosts, host)
+	}
+	return nil
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%dus", d/time.Microsecond)
+}
+
+func formatPercentage(p float64) string {
+	return strconv.FormatFloat(p, 'f', -1, 64) + "%"
+}
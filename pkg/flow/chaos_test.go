@@ -0,0 +1,215 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaosSpec(t *testing.T) {
+	tests := []struct {
+		info  string
+		spec  ChaosSpec
+		netem []string
+	}{
+		{
+			info:  "delay=100ms",
+			spec:  ChaosSpec{Delay: 100 * time.Millisecond},
+			netem: []string{"delay", "100000us"},
+		},
+		{
+			info:  " delay=1.5s, jitter=10ms ,loss=0.5%,duplicate=1%,reorder=25%,reorderRelate=50%,rate=1Mbit",
+			spec:  ChaosSpec{Delay: 1500 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.5, Duplicate: 1, Reorder: 25, ReorderRelate: 50, Rate: "1mbit"},
+			netem: []string{"delay", "1500000us", "10000us", "loss", "0.5%", "duplicate", "1%", "reorder", "25%", "50%"},
+		},
+		{
+			info:  "rate=512kbit",
+			spec:  ChaosSpec{Rate: "512kbit"},
+			netem: []string{},
+		},
+		{
+			info:  "loss=5%,interface=telco/macvlan-conf",
+			spec:  ChaosSpec{Loss: 5, Interface: "telco/macvlan-conf"},
+			netem: []string{"loss", "5%"},
+		},
+		{
+			info:  "delay=300ms,service=payments+billing/ledger",
+			spec:  ChaosSpec{Delay: 300 * time.Millisecond, Services: []string{"payments", "billing/ledger"}},
+			netem: []string{"delay", "300000us"},
+		},
+		{
+			info:  "loss=10%,host=API.stripe.com+203.0.113.7",
+			spec:  ChaosSpec{Loss: 10, Hosts: []string{"api.stripe.com", "203.0.113.7"}},
+			netem: []string{"loss", "10%"},
+		},
+		{
+			info:  "delay=100ms,jitter=20ms,distribution=pareto,loss=2%,lossCorrelation=25%",
+			spec:  ChaosSpec{Delay: 100 * time.Millisecond, Jitter: 20 * time.Millisecond, Distribution: "pareto", Loss: 2, LossCorrelation: 25},
+			netem: []string{"delay", "100000us", "20000us", "distribution", "pareto", "loss", "2%", "25%"},
+		},
+		{
+			info:  "gemodel=1%/10%/70%/0.1%",
+			spec:  ChaosSpec{GEModel: &GEModel{P: 1, R: 10, OneMinusH: 70, OneMinusK: 0.1}},
+			netem: []string{"loss", "gemodel", "1%", "10%", "70%", "0.1%"},
+		},
+		{
+			info:  "profile=3g-poor",
+			spec:  ChaosSpec{Delay: 250 * time.Millisecond, Jitter: 100 * time.Millisecond, Distribution: "paretonormal", GEModel: &GEModel{P: 2, R: 20, OneMinusH: 60, OneMinusK: 0.5}, Rate: "400kbit", Reorder: 1},
+			netem: []string{"delay", "250000us", "100000us", "distribution", "paretonormal", "loss", "gemodel", "2%", "20%", "60%", "0.5%", "reorder", "1%"},
+		},
+		{
+			// the overrides win wherever the profile is, and loss replaces the gemodel
+			info:  "delay=500ms,loss=3%,profile=3g-poor,service=payments",
+			spec:  ChaosSpec{Delay: 500 * time.Millisecond, Jitter: 100 * time.Millisecond, Distribution: "paretonormal", Loss: 3, Rate: "400kbit", Reorder: 1, Services: []string{"payments"}},
+			netem: []string{"delay", "500000us", "100000us", "distribution", "paretonormal", "loss", "3%", "reorder", "1%"},
+		},
+		{
+			// netem starts without the delay, the jitter and the reorder that need it
+			info: "wave=loss:0%..10%/2m,jitter=5ms,reorder=1%,ramp=delay:0s..500ms/5m",
+			spec: ChaosSpec{Jitter: 5 * time.Millisecond, Reorder: 1, Variations: []Variation{
+				{Param: "delay", Kind: "ramp", To: float64(500 * time.Millisecond), Period: 5 * time.Minute},
+				{Param: "loss", Kind: "wave", To: 10, Period: 2 * time.Minute},
+			}},
+			netem: []string{},
+		},
+		{
+			// the profile's loss is replaced by the steps
+			info: "profile=lte,steps=loss:1%@1m>5%@30s",
+			spec: ChaosSpec{Delay: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Distribution: "normal", LossCorrelation: 25, Rate: "20mbit", Reorder: 0.2,
+				Variations: []Variation{{Param: "loss", Kind: "steps", Steps: []Step{{1, time.Minute}, {5, 30 * time.Second}}}}},
+			netem: []string{"delay", "50000us", "10000us", "distribution", "normal", "reorder", "0.2%"},
+		},
+	}
+	for _, test := range tests {
+		spec, err := ParseChaosSpec(test.info)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.info, err)
+			continue
+		}
+		if !reflect.DeepEqual(*spec, test.spec) {
+			t.Errorf("%q: expected %+v, got %+v", test.info, test.spec, *spec)
+		}
+		if !reflect.DeepEqual(spec.NetemArgs(), test.netem) {
+			t.Errorf("%q: expected netem args %v, got %v", test.info, test.netem, spec.NetemArgs())
+		}
+		if again, err := ParseChaosSpec(spec.String()); err != nil || !reflect.DeepEqual(again, spec) {
+			t.Errorf("%q: %q doesn't parse back to the same spec: %+v, %v", test.info, spec.String(), again, err)
+		}
+	}
+}
+
+func TestParseChaosSpecErrors(t *testing.T) {
+	tests := []struct {
+		info string
+		err  string
+	}{
+		{"", "empty"},
+		{"delay", "expected key=value"},
+		{"latency=100ms", "unknown chaos spec key \"latency\""},
+		{"delay=100ms,delay=200ms", "more than once"},
+		{"delay=-1s", "must not be negative"},
+		{"delay=100", "invalid delay"},
+		{"loss=10", "must be a percentage"},
+		{"loss=101%", "between 0% and 100%"},
+		{"rate=fast", "must be a tc rate"},
+		{"rate=0kbit", "more than zero"},
+		{"jitter=10ms", "jitter requires a delay"},
+		{"reorder=10%", "reorder requires a delay"},
+		{"delay=10ms,reorderRelate=10%", "reorderRelate requires reorder"},
+		{"delay=10ms,interface=a/b/c", "must be an interface name"},
+		{"delay=10ms,service=Payments", "must be a Service"},
+		{"delay=10ms,service=payments+payments", "more than once"},
+		{"delay=10ms,host=https://api.stripe.com", "must be a hostname"},
+		{"delay=10ms,distribution=pareto", "distribution requires a jitter"},
+		{"delay=10ms,jitter=1ms,distribution=gaussian", "must be one of normal"},
+		{"lossCorrelation=25%", "lossCorrelation requires loss"},
+		{"gemodel=1%/10%", "p/r/1-h/1-k"},
+		{"loss=1%,gemodel=1%/10%/70%/0.1%", "set only one of them"},
+		{"profile=5g", "unknown profile \"5g\""},
+		{"profile=lte,profile=satellite", "more than once"},
+		{"delay=10ms,ramp=delay:0s..100ms/1m", "delay is set and varied"},
+		{"ramp=loss:0%..5%/1m,wave=loss:1%..2%/1m", "loss varies more than once"},
+		{"ramp=rate:1mbit..2mbit/1m", "the parameter one of delay"},
+		{"ramp=loss:0%..5%", "from..to/period"},
+		{"wave=delay:0s..1s/0s", "longer than zero"},
+		{"steps=loss:1%>5%@1m", "only the last step can be held for good"},
+		{"ramp=jitter:0s..10ms/1m", "jitter requires a delay"},
+		{"trace=unknown", "unknown trace"},
+	}
+	for _, test := range tests {
+		_, err := ParseChaosSpec(test.info)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.info)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.info, test.err, err)
+		}
+	}
+}
+
+func TestSplitChaosInfo(t *testing.T) {
+	chaos, err := SplitChaosInfo("delay=100ms", "loss=5%,interface=net1;rate=1Mbit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []InterfaceChaos{
+		{Interface: "eth0", Ingress: "delay=100ms", Egress: "rate=1mbit"},
+		{Interface: "net1", Egress: "loss=5%,interface=net1"},
+	}
+	if !reflect.DeepEqual(chaos, expected) {
+		t.Errorf("expected %+v, got %+v", expected, chaos)
+	}
+
+	for _, info := range []string{"delay=100ms;loss=5%", "delay=100ms,interface=net1;loss=5%,interface=net1", "delay=100ms;"} {
+		if _, err := SplitChaosInfo(info, ""); err == nil {
+			t.Errorf("%q: expected an error", info)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	if err := ValidateProfiles(); err != nil {
+		t.Errorf("unexpected error in the built-in profiles: %v", err)
+	}
+	tests := []struct {
+		add map[string]string
+		err string
+	}{
+		{map[string]string{"edge": "delay=80ms,jitter=20ms,distribution=normal,rate=1mbit"}, ""},
+		{map[string]string{"Edge": "delay=80ms"}, "invalid profile name"},
+		{map[string]string{"edge": "delay=80ms,service=payments"}, "depends on the pod"},
+		{map[string]string{"edge": "profile=lte"}, "depends on the pod"},
+		{map[string]string{"edge": "jitter=10ms"}, "jitter requires a delay"},
+	}
+	for _, test := range tests {
+		err := AddProfiles(test.add)
+		if test.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.add, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: expected an error containing %q, got %v", test.add, test.err, err)
+		}
+	}
+	spec, err := ParseChaosSpec("profile=edge,delay=100ms")
+	if err != nil || spec.String() != "delay=100ms,jitter=20ms,distribution=normal,rate=1mbit" {
+		t.Errorf("expected the added profile with the delay overridden, got %v, %v", spec, err)
+	}
+}
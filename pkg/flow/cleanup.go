@@ -0,0 +1,148 @@
+// +build linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Teardown removes everything kube-chaos created on the node: the qdiscs and mirred filters of the
+// pod veths that redirect to ifb0 or ifb1, and the classes, filters and netem qdiscs of the ifbs.
+// Qdiscs without a redirect to the ifbs aren't kube-chaos's and are left alone. It carries on past
+// errors, so it removes as much as it can, and returns them all. The caller holds the locks of ifb0
+// and ifb1 if syncs may still run, see LockDevices.
+func Teardown() error {
+	return teardown(executor)
+}
+
+func teardown(e exec.Interface) error {
+	untrack("", "")
+	links, err := listLinks(e)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, link := range links {
+		if link == "ifb0" || link == "ifb1" {
+			continue
+		}
+		if err := unmirror(e, link); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", link, err))
+		}
+	}
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		if err := resetIfb(e, ifb); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", ifb, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// listLinks returns the names of the network interfaces.
+func listLinks(e exec.Interface) ([]string, error) {
+	data, err := combinedOutput(e, "ip", "-o", "link", "show")
+	if err != nil {
+		return nil, err
+	}
+	links := []string{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		// expected ip line:
+		// 5: cali67801d38217@if3: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP ...
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		links = append(links, strings.SplitN(strings.TrimSuffix(parts[1], ":"), "@", 2)[0])
+	}
+	return links, nil
+}
+
+// unmirror deletes the veth qdiscs whose filters redirect to the ifbs.
+func unmirror(e exec.Interface, link string) error {
+	t := &tcShaper{e: e, iface: link}
+	rootQdisc, ingressQdisc, err := t.qdiscExists(link)
+	if err != nil {
+		return err
+	}
+	if ingressQdisc {
+		redirects, err := redirectsTo(e, link, "ffff:", "ifb0")
+		if err != nil {
+			return err
+		}
+		if redirects {
+			glog.Infof("Removing the mirroring of %s to ifb0", link)
+			if err := t.execAndLog("tc", "qdisc", "del", "dev", link, "ingress"); err != nil {
+				return err
+			}
+		}
+	}
+	if rootQdisc {
+		redirects, err := redirectsTo(e, link, "1:", "ifb1")
+		if err != nil {
+			return err
+		}
+		if redirects {
+			glog.Infof("Removing the mirroring of %s to ifb1", link)
+			if err := t.deleteInterface("1:", link); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// redirectsTo reports whether a filter of the qdisc redirects to ifb.
+func redirectsTo(e exec.Interface, link, parent, ifb string) (bool, error) {
+	data, err := combinedOutput(e, "tc", "filter", "show", "dev", link, "parent", parent)
+	if err != nil {
+		return false, err
+	}
+	// expected tc line:
+	// action order 1: mirred (Egress Redirect to device ifb0) stolen
+	return strings.Contains(string(data), "Redirect to device "+ifb+")"), nil
+}
+
+// resetIfb deletes the root qdisc of an ifb, with all its classes, filters and netem qdiscs, and
+// takes the ifb down.
+func resetIfb(e exec.Interface, ifb string) error {
+	data, err := combinedOutput(e, "tc", "qdisc", "show", "dev", ifb)
+	if err != nil {
+		// the ifb module was never loaded, so there is nothing to remove
+		glog.V(4).Infof("Skipping %s: %v: %s", ifb, err, strings.TrimSpace(string(data)))
+		return nil
+	}
+	if strings.Contains(string(data), "htb 1: root") {
+		glog.Infof("Removing the chaos classes of %s", ifb)
+		if out, err := combinedOutput(e, "tc", "qdisc", "del", "dev", ifb, "root"); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if out, err := combinedOutput(e, "ip", "link", "set", "dev", ifb, "down"); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
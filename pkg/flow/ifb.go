@@ -19,19 +19,77 @@ package flow
 import (
 	"bufio"
 	"bytes"
-	"github.com/huanwei/kube-chaos/pkg/exec"
+	"context"
+	"fmt"
+	"net"
 	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/state"
 )
 
+// hashTableHandle is the handle of the u32 hash table of the ifbs, its 256 buckets hold the
+// filters of single addresses by their last byte.
+const hashTableHandle = "2"
+
+// executor runs the tc, ip and modprobe commands of the package.
+var executor exec.Interface = exec.New()
+
+// SetExec makes the package run its commands with e, e.g. an exec.DryRunExec.
+func SetExec(e exec.Interface) {
+	executor = e
+}
+
+// commandTimeout bounds each command of the package, so a hung tc can't block the sync forever.
+var commandTimeout = 10 * time.Second
+
+// SetCommandTimeout sets how long a command may run before it is killed.
+func SetCommandTimeout(timeout time.Duration) {
+	commandTimeout = timeout
+}
+
+// combinedOutput runs a command with e, and kills it once it runs longer than commandTimeout. The
+// commands changing the network are audited as the node's.
+func combinedOutput(e exec.Interface, cmd string, args ...string) ([]byte, error) {
+	out, err := run(e, cmd, args...)
+	if mutating(cmd, args) {
+		auditCommand(state.Owner{}, Op{Args: args}.device(), "", cmd+" "+strings.Join(args, " "), exitStatus(err), string(out))
+	}
+	return out, err
+}
+
+// run runs a command with e, and kills it once it runs longer than commandTimeout.
+func run(e exec.Interface, cmd string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	out, err := e.CommandContext(ctx, cmd, args...).CombinedOutput()
+	if err == context.DeadlineExceeded {
+		return out, fmt.Errorf("%s %s: timed out after %v", cmd, strings.Join(args, " "), commandTimeout)
+	}
+	return out, err
+}
+
+// workers bounds how many devices a plan changes at once.
+var workers = 4
+
+// SetWorkers sets how many devices a plan may change at once.
+func SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	workers = n
+}
+
 func InitIfbModule() error {
-	e := exec.New()
-	if _, err := e.Command("modprobe", "ifb").CombinedOutput(); err != nil {
+	e := executor
+	if _, err := combinedOutput(e, "modprobe", "ifb"); err != nil {
 		return err
 	}
-	if _, err := e.Command("ip", "link", "set", "dev", "ifb0", "up").CombinedOutput(); err != nil {
+	if _, err := combinedOutput(e, "ip", "link", "set", "dev", "ifb0", "up"); err != nil {
 		return err
 	}
-	if _, err := e.Command("ip", "link", "set", "dev", "ifb1", "up").CombinedOutput(); err != nil {
+	if _, err := combinedOutput(e, "ip", "link", "set", "dev", "ifb1", "up"); err != nil {
 		return err
 	}
 	if err := initIfb("ifb0"); err != nil {
@@ -44,24 +102,76 @@ func InitIfbModule() error {
 }
 
 func initIfb(ifb string) error {
-	e := exec.New()
-	data, err := e.Command("tc", "qdisc", "show", "dev", ifb).CombinedOutput()
+	e := executor
+	data, err := combinedOutput(e, "tc", "qdisc", "show", "dev", ifb)
 	if err != nil {
 		return err
 	}
 	scanner := bufio.NewScanner(bytes.NewBuffer(data))
 	spec := "htb 1:"
+	found := false
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if len(line) == 0 {
 			continue
 		}
 		if strings.Contains(line, spec) {
-			return nil
+			found = true
+			break
 		}
 	}
-	if _, err := e.Command("tc", "qdisc", "add", "dev", ifb, "root", "handle", "1:", "htb", "default", "30").CombinedOutput(); err != nil {
+	if !found {
+		if _, err := combinedOutput(e, "tc", "qdisc", "add", "dev", ifb, "root", "handle", "1:", "htb", "default", "30"); err != nil {
+			return err
+		}
+	}
+	return initHashTable(e, ifb)
+}
+
+// initHashTable adds the u32 hash table of an ifb, and the filter linking its traffic to the bucket
+// of the last byte of the address chaos is matched on, the source on ifb0 and the destination on ifb1.
+func initHashTable(e exec.Interface, ifb string) error {
+	data, err := combinedOutput(e, "tc", "filter", "show", "dev", ifb)
+	if err != nil {
+		return err
+	}
+	// expected tc line:
+	// filter parent 1: protocol ip pref 1 u32 chain 0 fh 2: ht divisor 256
+	if strings.Contains(string(data), "fh "+hashTableHandle+": ht divisor 256") {
+		return nil
+	}
+	match, offset := "src", "12"
+	if ifb == "ifb1" {
+		match, offset = "dst", "16"
+	}
+	if _, err := combinedOutput(e, "tc", "filter", "add", "dev", ifb,
+		"parent", "1:0", "prio", "1",
+		"handle", hashTableHandle+":",
+		"protocol", "ip", "u32", "divisor", "256"); err != nil {
+		return err
+	}
+	if _, err := combinedOutput(e, "tc", "filter", "add", "dev", ifb,
+		"parent", "1:0", "prio", "1",
+		"protocol", "ip", "u32", "ht", "800::",
+		"match", "ip", match, "0.0.0.0/0",
+		"hashkey", "mask", "0x000000ff", "at", offset,
+		"link", hashTableHandle+":"); err != nil {
 		return err
 	}
 	return nil
 }
+
+// hashTable returns the u32 arguments putting the filter of a CIDR in the bucket of the ifb's hash
+// table for its last byte, see initIfb. A u32 table holds at most 4095 filters per bucket, the hash
+// table spreads them over 256 buckets and saves matching every packet against every filter. CIDRs
+// wider than a single address can't be hashed on their last byte and go in the root table.
+func hashTable(cidr string) []string {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != 32 {
+		return nil
+	}
+	return []string{"ht", fmt.Sprintf("%s:%x:", hashTableHandle, ip.To4()[3])}
+}
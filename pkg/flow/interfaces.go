@@ -30,3 +30,15 @@ type Shaper interface {
 
 	Reorder(percentage, relate string) error
 }
+
+// CIDRChaos is the chaos tc applies to the traffic of a CIDR.
+type CIDRChaos struct {
+	CIDR string `json:"cidr"`
+	// Direction is egress for traffic from the CIDR, shaped on ifb0, and ingress for traffic to it,
+	// shaped on ifb1.
+	Direction string `json:"direction"`
+	Class     string `json:"class"`
+	Rate      string `json:"rate,omitempty"`
+	// Netem holds the parameters of the class's netem qdisc as tc shows them.
+	Netem string `json:"netem,omitempty"`
+}
@@ -24,10 +24,14 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/huanwei/kube-chaos/pkg/exec"
 	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/state"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 
 	"github.com/golang/glog"
 )
@@ -38,72 +42,109 @@ import (
 type tcShaper struct {
 	e     exec.Interface
 	iface string
+	// owner is the pod the classes are created for
+	owner state.Owner
 }
 
 func NewTCShaper(iface string) Shaper {
 	shaper := &tcShaper{
-		e:     exec.New(),
+		e:     executor,
 		iface: iface,
 	}
 	return shaper
 }
 
+// NewTCShaperFor returns a shaper for the veth of a pod, the classes it creates are recorded as
+// the pod's.
+func NewTCShaperFor(iface string, owner state.Owner) Shaper {
+	return &tcShaper{
+		e:     executor,
+		iface: iface,
+		owner: owner,
+	}
+}
+
+// stateStore records the classes the shapers create, once RecoverState or SetStateStore sets it.
+var stateStore *state.Store
+
+// SetStateStore makes the shapers and plans record their classes in store, without reconciling
+// the classes on the ifbs with it as RecoverState does.
+func SetStateStore(store *state.Store) {
+	stateStore = store
+}
+
+// record writes a record to the state store, failures are only logged since the classes exist
+// either way and the next sync records them again.
+func record(r state.Record) {
+	if stateStore == nil {
+		return
+	}
+	old, found := stateStore.Get(r.Direction, r.CIDR)
+	if found && old.SpecHash == r.SpecHash && old.Since != 0 {
+		r.Since = old.Since
+	} else {
+		r.Since = now().Unix()
+	}
+	if found && old == r {
+		return
+	}
+	if err := stateStore.Set(r); err != nil {
+		glog.Errorf("Failed to record %s: %v", r, err)
+	}
+}
+
+// forget deletes the record of a CIDR's class on an ifb.
+func forget(cidr, ifb string) {
+	untrack(ifb, cidr)
+	if stateStore == nil {
+		return
+	}
+	if err := stateStore.Delete(ifbDirection(ifb), cidr); err != nil {
+		glog.Errorf("Failed to forget %s class of %s: %v", ifbDirection(ifb), cidr, err)
+	}
+}
+
 func (t *tcShaper) execAndLog(cmdStr string, args ...string) error {
 	glog.V(4).Infof("Running: %s %s", cmdStr, strings.Join(args, " "))
-	cmd := t.e.Command(cmdStr, args...)
-	out, err := cmd.CombinedOutput()
+	out, err := run(t.e, cmdStr, args...)
 	glog.V(4).Infof("Output from tc: %s", string(out))
+	auditCommand(t.owner, Op{Args: args}.device(), "", cmdStr+" "+strings.Join(args, " "), exitStatus(err), string(out))
 	return err
 }
 
-func (t *tcShaper) nextClassID(ifb string) (int, error) {
-	data, err := t.e.Command("tc", "class", "show", "dev", ifb).CombinedOutput()
+// nextClassID reserves a free class ID on ifb for key, see classAllocator. The caller releases it
+// once the class exists.
+func (t *tcShaper) nextClassID(ifb, key string) (int, error) {
+	data, err := combinedOutput(t.e, "tc", "class", "show", "dev", ifb)
 	if err != nil {
 		return -1, err
 	}
 
 	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	classes := sets.String{}
+	classes := sets.Int{}
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		// skip empty lines
 		if len(line) == 0 {
 			continue
 		}
-		parts := strings.Split(line, " ")
-		// todo - fix
+		parts := strings.Fields(line)
 		// expected tc line:
-		// class htb 1:1 root prio 0 rate 1000Kbit ceil 1000Kbit burst 1600b cburst 1600b
-		if len(parts) != 14 {
+		// class htb 1:1 root leaf 1: prio 0 rate 1000Kbit ceil 1000Kbit burst 1600b cburst 1600b
+		if len(parts) < 3 || parts[0] != "class" {
 			return -1, fmt.Errorf("unexpected output from tc: %s (%v)", scanner.Text(), parts)
 		}
-		classes.Insert(parts[2])
-	}
-
-	// Make sure it doesn't go forever
-	for nextClass := 1; nextClass < 10000; nextClass++ {
-		if !classes.Has(fmt.Sprintf("1:%d", nextClass)) {
-			return nextClass, nil
+		id, err := strconv.ParseUint(strings.TrimPrefix(parts[2], "1:"), 16, 16)
+		if err != nil {
+			return -1, fmt.Errorf("unexpected class from tc: %s", parts[2])
 		}
+		classes.Insert(int(id))
 	}
-	// This should really never happen
-	return -1, fmt.Errorf("exhausted class space, please try again")
+	return allocator.allocate(ifb, key, classes)
 }
 
-// Convert a CIDR from text to a hex representation
-// Strips any masked parts of the IP, so 1.2.3.4/16 becomes hex(1.2.0.0)/ffffffff
-func hexCIDR(cidr string) (string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return "", err
-	}
-	ip = ip.Mask(ipnet.Mask)
-	hexIP := hex.EncodeToString([]byte(ip.To4()))
-	hexMask := ipnet.Mask.String()
-	return hexIP + "/" + hexMask, nil
-}
-
-// Convert a CIDR from hex representation to text, opposite of the above.
+// Convert a CIDR from the hex representation tc shows to text, e.g. c0a8000a/ffffffff to
+// 192.168.0.10/32.
 func asciiCIDR(cidr string) (string, error) {
 	parts := strings.Split(cidr, "/")
 	if len(parts) != 2 {
@@ -123,62 +164,52 @@ func asciiCIDR(cidr string) (string, error) {
 }
 
 func findCIDRClass(cidr, ifb string) (class, handle string, found bool, err error) {
-	e := exec.New()
-	data, err := e.Command("tc", "filter", "show", "dev", ifb).CombinedOutput()
+	filters, err := listFilters(executor, ifb)
 	if err != nil {
 		return "", "", false, err
 	}
-
-	hex, err := hexCIDR(cidr)
-	if err != nil {
-		return "", "", false, err
+	f, found := filters[cidr]
+	if !found {
+		return "", "", false, nil
 	}
-	spec := fmt.Sprintf("match %s", hex)
+	return f.class, f.recordHandle(), true, nil
+}
 
-	scanner := bufio.NewScanner(bytes.NewBuffer(data))
-	filter := ""
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 {
-			continue
-		}
-		if strings.HasPrefix(line, "filter") {
-			filter = line
-			continue
-		}
-		if strings.Contains(line, spec) {
-			parts := strings.Split(filter, " ")
-			//todo - fix
-			// expected tc line:
-			// filter parent 1: protocol ip pref 1 u32 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1:1
-			if len(parts) != 19 {
-				return "", "", false, fmt.Errorf("unexpected output from tc: %s %d (%v)", filter, len(parts), parts)
-			}
-			return parts[18], parts[9], true, nil
+// filterField returns the value following key in a tc filter line, or "" if there's none.
+func filterField(line, key string) string {
+	parts := strings.Fields(line)
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == key {
+			return parts[i+1]
 		}
 	}
-	return "", "", false, nil
+	return ""
 }
 
-func (t *tcShaper) makeNewClass(rate, ifb string) (int, error) {
-	class, err := t.nextClassID(ifb)
+func (t *tcShaper) makeNewClass(rate, ifb, key string) (int, error) {
+	class, err := t.nextClassID(ifb, key)
 	if err != nil {
+		if err == ErrClassSpaceExhausted {
+			countClass(ifb, err)
+		}
 		return -1, err
 	}
+	defer allocator.release(ifb, class)
 	if err := t.execAndLog("tc", "class", "add",
 		"dev", ifb,
 		"parent", "1:",
-		"classid", fmt.Sprintf("1:%d", class),
+		"classid", classID(class),
 		"htb", "rate", rate); err != nil {
 		return -1, err
 	}
+	countClass(ifb, nil)
 	return class, nil
 }
 
 // tests to see if an interface exists, if it does, return true and the status line for the interface
 // returns false, "", <err> if an error occurs.
 func (t *tcShaper) qdiscExists(vethName string) (bool, bool, error) {
-	data, err := t.e.Command("tc", "qdisc", "show", "dev", vethName).CombinedOutput()
+	data, err := combinedOutput(t.e, "tc", "qdisc", "show", "dev", vethName)
 	if err != nil {
 		return false, false, err
 	}
@@ -202,15 +233,149 @@ func (t *tcShaper) qdiscExists(vethName string) (bool, bool, error) {
 	return rootQdisc, ingressQdisc, nil
 }
 
+// ReconcileCIDR gives the CIDR a class with a netem qdisc on ifb0 for egress chaos and on ifb1 for
+// ingress chaos, and a filter sending its traffic there. Directions without chaos info are left
+// alone, DeleteExtraChaos removes their classes.
 func (t *tcShaper) ReconcileCIDR(cidr, egressChaosInfo, ingressChaosInfo string) error {
 	glog.V(4).Infof("Shaper CIDR %s with egressChaosInfo %s, ingressChaosInfo %s", cidr, egressChaosInfo, ingressChaosInfo)
+	if egressChaosInfo != "" {
+		// traffic leaving the pod is matched on its source address
+		if err := t.reconcileCIDRClass(cidr, "ifb0", "src", egressChaosInfo); err != nil {
+			return err
+		}
+	}
+	if ingressChaosInfo != "" {
+		if err := t.reconcileCIDRClass(cidr, "ifb1", "dst", ingressChaosInfo); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (t *tcShaper) reconcileCIDRClass(cidr, ifb, match, chaosInfo string) error {
+	spec, err := ParseChaosSpec(chaosInfo)
+	if err != nil {
+		return err
+	}
+	// the class ID is picked from the classes of the ifb, which must not change until it's added
+	defer LockDevices(ifb)()
+	r := state.Record{Owner: t.owner, CIDR: cidr, Direction: ifbDirection(ifb), SpecHash: state.Hash(spec.String())}
+	class, handle, found, err := findCIDRClass(cidr, ifb)
+	if err != nil {
+		return err
+	}
+	if found {
+		r.Class, r.Handle = class, handle
+		if stateStore != nil {
+			old, recorded := stateStore.Get(r.Direction, cidr)
+			if recorded && old.SpecHash == r.SpecHash {
+				r.Since = old.Since
+			}
+			if recorded && old == r {
+				glog.V(4).Infof("%s already applies %s", r, chaosInfo)
+				return nil
+			}
+		}
+		if err := t.execAndLog("tc", "class", "change",
+			"dev", ifb,
+			"parent", "1:",
+			"classid", class,
+			"htb", "rate", spec.HTBRate()); err != nil {
+			return err
+		}
+		if err := t.execAndLog("tc", append([]string{"qdisc", "change",
+			"dev", ifb,
+			"parent", class,
+			"handle", netemHandle(class),
+			"netem"}, spec.NetemArgs()...)...); err != nil {
+			return err
+		}
+		record(r)
+		return nil
+	}
+
+	// the pod's classes keep their IDs when it is recreated after a restart
+	key := t.owner.UID
+	if key == "" {
+		key = cidr
+	}
+	id, err := t.makeNewClass(spec.HTBRate(), ifb, key)
+	if err != nil {
+		return err
+	}
+	class = classID(id)
+	if err := t.execAndLog("tc", append([]string{"qdisc", "add",
+		"dev", ifb,
+		"parent", class,
+		"handle", netemHandle(class),
+		"netem"}, spec.NetemArgs()...)...); err != nil {
+		return err
+	}
+	if err := t.execAndLog("tc", append(append([]string{"filter", "add",
+		"dev", ifb,
+		"protocol", "ip",
+		"parent", "1:0",
+		"prio", "1", "u32"}, hashTable(cidr)...),
+		"match", "ip", match, cidr,
+		"flowid", class)...); err != nil {
+		return err
+	}
+	if _, r.Handle, _, err = findCIDRClass(cidr, ifb); err != nil {
+		return err
+	}
+	r.Class = class
+	record(r)
+	return nil
+}
+
+// ReconcileInterface mirrors the pod's traffic to the ifbs. Traffic leaving the pod enters the host
+// through the ingress of its veth and is redirected to ifb0, traffic to the pod leaves through the
+// root of the veth and is redirected to ifb1.
 func (t *tcShaper) ReconcileInterface(egressChaosInfo, ingressChaosInfo string) error {
+	defer LockDevices(t.iface)()
+	rootQdisc, ingressQdisc, err := t.qdiscExists(t.iface)
+	if err != nil {
+		return err
+	}
+	if egressChaosInfo != "" && !ingressQdisc {
+		if err := t.execAndLog("tc", "qdisc", "add", "dev", t.iface, "ingress"); err != nil {
+			return err
+		}
+		if err := t.mirror("ffff:", "ifb0"); err != nil {
+			return err
+		}
+	}
+	if egressChaosInfo == "" && ingressQdisc {
+		if err := t.execAndLog("tc", "qdisc", "del", "dev", t.iface, "ingress"); err != nil {
+			return err
+		}
+	}
+	if ingressChaosInfo != "" && !rootQdisc {
+		if err := t.execAndLog("tc", "qdisc", "add", "dev", t.iface, "root", "handle", "1:", "htb"); err != nil {
+			return err
+		}
+		if err := t.mirror("1:", "ifb1"); err != nil {
+			return err
+		}
+	}
+	if ingressChaosInfo == "" && rootQdisc {
+		if err := t.deleteInterface("1:", t.iface); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// mirror redirects all ip traffic through the veth qdisc with the given handle to ifb.
+func (t *tcShaper) mirror(parent, ifb string) error {
+	return t.execAndLog("tc", "filter", "add",
+		"dev", t.iface,
+		"parent", parent,
+		"protocol", "ip", "u32",
+		"match", "u32", "0", "0",
+		"action", "mirred", "egress", "redirect", "dev", ifb)
+}
+
 
 func (t *tcShaper) Loss(percentage string) error {
 	return nil
@@ -228,95 +393,345 @@ func (t *tcShaper) Reorder(percentage, relate string) error {
 	return nil
 }
 
-// Remove a bandwidth limit for a particular CIDR on a particular network interface
-func reset(cidr, ifb string) error {
-	e := exec.New()
-	class, handle, found, err := findCIDRClass(cidr, ifb)
+func (t *tcShaper) deleteInterface(class, ifb string) error {
+	return t.execAndLog("tc", "qdisc", "delete", "dev", ifb, "root", "handle", class)
+}
+
+func getCIDRs(ifb string) ([]string, error) {
+	filters, err := listFilters(executor, ifb)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !found {
-		return fmt.Errorf("Failed to find cidr: %s on interface: %s", cidr, ifb)
+	result := []string{}
+	for cidr := range filters {
+		result = append(result, cidr)
 	}
-	glog.V(4).Infof("Delete  filter of %s on ifb0", cidr)
-	if _, err := e.Command("tc", "filter", "del",
-		"dev", ifb,
-		"parent", "1:",
-		"proto", "ip",
-		"prio", "1",
-		"handle", handle, "u32").CombinedOutput(); err != nil {
-		return err
+	sort.Strings(result)
+	return result, nil
+}
+
+// GetChaos returns the chaos of every CIDR that has a class on ifb0 or ifb1.
+func GetChaos() ([]CIDRChaos, error) {
+	result := []CIDRChaos{}
+	for _, d := range []struct{ ifb, direction string }{{"ifb0", "egress"}, {"ifb1", "ingress"}} {
+		filters, err := listFilters(executor, d.ifb)
+		if err != nil {
+			return nil, err
+		}
+		rates, err := readClassRates(executor, d.ifb)
+		if err != nil {
+			return nil, err
+		}
+		netems, err := netemParams(d.ifb)
+		if err != nil {
+			return nil, err
+		}
+		for _, cidr := range sortedCIDRs(filters) {
+			class := filters[cidr].class
+			result = append(result, CIDRChaos{
+				CIDR:      cidr,
+				Direction: d.direction,
+				Class:     class,
+				Rate:      rates[class],
+				Netem:     netems[class],
+			})
+		}
 	}
-	glog.V(4).Infof("Delete  class of %s on ifb0", cidr)
-	if _, err := e.Command("tc", "class", "del", "dev", ifb, "parent", "1:", "classid", class).CombinedOutput(); err != nil {
-		return err
+	return result, nil
+}
+
+// netemParams returns the parameters of the netem qdiscs on ifb, by parent class.
+func netemParams(ifb string) (map[string]string, error) {
+	data, err := combinedOutput(executor, "tc", "qdisc", "show", "dev", ifb)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		// expected tc line:
+		// qdisc netem 2: parent 1:2 limit 1000 delay 100.0ms  10.0ms loss 1%
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 5 || parts[0] != "qdisc" || parts[1] != "netem" || parts[3] != "parent" {
+			continue
+		}
+		params[parts[4]] = strings.Join(parts[5:], " ")
+	}
+	return params, nil
+}
+
+// InterfaceForIP returns the host interface routing to a local pod IP, its veth.
+func InterfaceForIP(ip string) (string, error) {
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("invalid IP %q", ip)
+	}
+	data, err := combinedOutput(executor, "ip", "route", "get", ip)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the route to %s: %v: %s", ip, err, strings.TrimSpace(string(data)))
+	}
+	// expected ip line:
+	// 192.168.0.10 dev cali67801d38217 src 10.10.103.182 uid 0
+	iface := filterField(strings.SplitN(string(data), "\n", 2)[0], "dev")
+	if iface == "" {
+		return "", fmt.Errorf("unexpected output from ip: %s", string(data))
+	}
+	return iface, nil
+}
+
+// PeerInterfaceForIP returns the host-side peer of the pod interface holding a local IP, the veth
+// routing to it. IPs routed through any other interface, e.g. a bridge shared by several pods or
+// the parent of a macvlan, are refused since chaos on it would shape other traffic too.
+func PeerInterfaceForIP(ip string) (string, error) {
+	iface, err := InterfaceForIP(ip)
+	if err != nil {
+		return "", err
+	}
+	data, err := combinedOutput(executor, "ip", "-o", "link", "show", "dev", iface)
+	if err != nil {
+		return "", fmt.Errorf("failed to show %s: %v: %s", iface, err, strings.TrimSpace(string(data)))
+	}
+	// expected ip line, the peer of a veth is in another namespace:
+	// 5: veth1a2b3c4d@if3: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP ...
+	parts := strings.Fields(string(data))
+	if len(parts) < 2 || !strings.Contains(parts[1], "@if") {
+		return "", fmt.Errorf("%s is routed through %s, which isn't the peer of a pod interface", ip, iface)
+	}
+	return iface, nil
+}
+
+// RecoverState makes the shapers record their classes in store, and reconciles the classes on the
+// ifbs with its records, after a restart or a crash. Filters with a record of their class are
+// adopted, classes no filter sends traffic to are deleted, and so are filters without a record,
+// unless the store was just created and the agent never had the chance to record them.
+func RecoverState(store *state.Store) error {
+	SetStateStore(store)
+	e := executor
+	defer LockDevices("ifb0", "ifb1")()
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		if err := recoverIfb(e, store, ifb); err != nil {
+			return fmt.Errorf("%s: %v", ifb, err)
+		}
 	}
 	return nil
 }
 
-func (t *tcShaper) deleteInterface(class, ifb string) error {
-	return t.execAndLog("tc", "qdisc", "delete", "dev", ifb, "root", "handle", class)
+func recoverIfb(e exec.Interface, store *state.Store, ifb string) error {
+	direction := ifbDirection(ifb)
+	filters, err := listFilters(e, ifb)
+	if err != nil {
+		return err
+	}
+	referenced := sets.String{}
+	for cidr, f := range filters {
+		r, recorded := store.Get(direction, cidr)
+		switch {
+		case recorded && r.Class == f.class:
+			referenced.Insert(f.class)
+			if r.Handle != f.handle {
+				r.Handle = f.handle
+				record(r)
+			}
+			glog.Infof("Adopted %s", r)
+		case !store.Loaded():
+			referenced.Insert(f.class)
+			record(state.Record{CIDR: cidr, Direction: direction, Class: f.class, Handle: f.handle})
+			glog.Infof("Adopted unrecorded %s class %s of %s", direction, f.class, cidr)
+		default:
+			glog.Infof("Deleting unrecorded %s class %s of %s", direction, f.class, cidr)
+			if failed := Plan(deleteCIDR(ifb, cidr, f)).apply(e); failed[cidr] != nil {
+				return failed[cidr]
+			}
+		}
+	}
+	for _, r := range store.Records() {
+		if _, found := filters[r.CIDR]; r.Direction == direction && !found {
+			glog.Infof("Forgetting %s, its filter is gone", r)
+			forget(r.CIDR, ifb)
+		}
+	}
+
+	classes, err := listClasses(e, ifb)
+	if err != nil {
+		return err
+	}
+	for _, class := range classes.List() {
+		if referenced.Has(class) {
+			continue
+		}
+		glog.Infof("Deleting %s class %s, no filter sends traffic to it", direction, class)
+		if out, err := combinedOutput(e, "tc", "class", "del", "dev", ifb, "parent", "1:", "classid", class); err != nil {
+			return fmt.Errorf("failed to delete class %s: %v: %s", class, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
 }
 
-func getCIDRs(ifb string) ([]string, error) {
-	e := exec.New()
-	data, err := e.Command("tc", "filter", "show", "dev", ifb).CombinedOutput()
+// listFilters returns the filters on an ifb by the CIDR they match.
+func listFilters(e exec.Interface, ifb string) (map[string]cidrFilter, error) {
+	data, err := combinedOutput(e, "tc", "filter", "show", "dev", ifb)
 	if err != nil {
 		return nil, err
 	}
+	return parseFilters(data)
+}
 
-	result := []string{}
+// parseFilters parses the output of tc filter show.
+func parseFilters(data []byte) (map[string]cidrFilter, error) {
+	filters := map[string]cidrFilter{}
+	filter, matches := "", []string{}
+	// add adds the filter read so far, its first match is the CIDR and the others its peer's
+	add := func() error {
+		if filter == "" || len(matches) == 0 || filterField(filter, "link") != "" {
+			// the filter linking to the hash table matches all addresses
+			return nil
+		}
+		parts := strings.Fields(matches[0])
+		if len(parts) != 4 {
+			return fmt.Errorf("unexpected output from tc: %s", matches[0])
+		}
+		cidr, err := asciiCIDR(parts[1])
+		if err != nil {
+			return err
+		}
+		class, handle := filterField(filter, "flowid"), filterField(filter, "fh")
+		if class == "" || handle == "" {
+			return fmt.Errorf("unexpected output from tc: %s", filter)
+		}
+		f := filters[cidr]
+		f.class = class
+		if len(matches) == 1 {
+			f.handle = handle
+		} else {
+			peer, err := parsePeer(matches[1:])
+			if err != nil {
+				return err
+			}
+			if f.peers == nil {
+				f.peers = map[string]string{}
+			}
+			f.peers[peer.String()] = handle
+		}
+		filters[cidr] = f
+		return nil
+	}
 	scanner := bufio.NewScanner(bytes.NewBuffer(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 {
+		if strings.HasPrefix(line, "filter") {
+			if err := add(); err != nil {
+				return nil, err
+			}
+			filter, matches = line, nil
 			continue
 		}
-		if strings.Contains(line, "match") {
-			parts := strings.Split(line, " ")
-			// expected tc line:
-			// match <cidr> at <number>
-			if len(parts) != 4 {
-				return nil, fmt.Errorf("unexpected output: %v", parts)
-			}
+		// expected tc lines:
+		// filter parent 1: protocol ip pref 1 u32 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1:2
+		//   match c0a8000a/ffffffff at 12
+		if strings.HasPrefix(line, "match ") {
+			matches = append(matches, line)
+		}
+	}
+	if err := add(); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// parsePeer reads a peer back from the matches tc shows for its filter after the match of the
+// CIDR, the peer address at 16 or 12, the protocol at 8 and the ports at 20, e.g.
+//   match 0a60000a/ffffffff at 16
+//   match 00060000/00ff0000 at 8
+//   match 00000050/0000ffff at 20
+func parsePeer(matches []string) (Peer, error) {
+	p := Peer{}
+	for _, m := range matches {
+		parts := strings.Fields(m)
+		if len(parts) != 4 || parts[0] != "match" || parts[2] != "at" {
+			return Peer{}, fmt.Errorf("unexpected match from tc: %s", m)
+		}
+		kv := strings.SplitN(parts[1], "/", 2)
+		if len(kv) != 2 {
+			return Peer{}, fmt.Errorf("unexpected match from tc: %s", m)
+		}
+		value, err := strconv.ParseUint(kv[0], 16, 32)
+		if err != nil {
+			return Peer{}, fmt.Errorf("unexpected match from tc: %s", m)
+		}
+		switch mask := kv[1]; {
+		case parts[3] == "12" || parts[3] == "16":
 			cidr, err := asciiCIDR(parts[1])
 			if err != nil {
-				return nil, err
+				return Peer{}, err
+			}
+			p.IP = strings.TrimSuffix(cidr, "/32")
+		case parts[3] == "8" && mask == "00ff0000":
+			for name, n := range protocolNumbers {
+				if uint64(n) == value>>16 {
+					p.Protocol = name
+				}
 			}
-			result = append(result, cidr)
+		case parts[3] == "20" && mask == "0000ffff":
+			p.Port = int(value)
+		case parts[3] == "20" && mask == "ffff0000":
+			p.Port = int(value >> 16)
+		default:
+			return Peer{}, fmt.Errorf("unexpected match from tc: %s", m)
 		}
 	}
-	return result, nil
+	if p.IP == "" {
+		return Peer{}, fmt.Errorf("no peer address in %v", matches)
+	}
+	return p, nil
 }
 
-func DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs []string) error {
-	//delete extra chaos of egress
-	egressCIDRsets := sliceToSets(egressPodsCIDRs)
-	ifb0CIDRs, err := getCIDRs("ifb0")
+// listClasses returns the htb classes on an ifb.
+func listClasses(e exec.Interface, ifb string) (sets.String, error) {
+	data, err := combinedOutput(e, "tc", "class", "show", "dev", ifb)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, ifb0CIDR := range ifb0CIDRs {
-		if !egressCIDRsets.Has(ifb0CIDR) {
-			if err := reset(ifb0CIDR, "ifb0"); err != nil {
-				return err
-			}
+	classes := sets.String{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		// expected tc line:
+		// class htb 1:2 root leaf 2: prio 0 rate 1Mbit ceil 1Mbit burst 1600b cburst 1600b
+		parts := strings.Fields(scanner.Text())
+		if len(parts) >= 3 && parts[0] == "class" && parts[1] == "htb" {
+			classes.Insert(parts[2])
 		}
 	}
-	//delete extra chaos of ingress
-	ingressCIDRsets := sliceToSets(ingressPodsCIDRs)
-	ifb1CIDRs, err := getCIDRs("ifb1")
-	if err != nil {
-		return err
-	}
-	for _, ifb1CIDR := range ifb1CIDRs {
-		if !ingressCIDRsets.Has(ifb1CIDR) {
-			if err := reset(ifb1CIDR, "ifb1"); err != nil {
-				return err
+	return classes, nil
+}
+
+// DeleteExtraChaos deletes the filters and classes of the CIDRs without chaos. It reads each ifb
+// once, and deletes them all through one tc -batch stream.
+func DeleteExtraChaos(egressPodsCIDRs, ingressPodsCIDRs []string) error {
+	defer LockDevices("ifb0", "ifb1")()
+	plan := Plan{}
+	for _, d := range []struct {
+		ifb   string
+		cidrs []string
+	}{{"ifb0", egressPodsCIDRs}, {"ifb1", ingressPodsCIDRs}} {
+		filters, err := listFilters(executor, d.ifb)
+		if err != nil {
+			return err
+		}
+		wanted := sliceToSets(d.cidrs)
+		for _, cidr := range sortedCIDRs(filters) {
+			if !wanted.Has(cidr) {
+				plan = append(plan, deleteCIDR(d.ifb, cidr, filters[cidr])...)
 			}
 		}
 	}
-	return nil
+	failed := plan.Apply()
+	errs := []error{}
+	for _, op := range plan {
+		if err, found := failed[op.Target]; found {
+			errs = append(errs, err)
+			delete(failed, op.Target)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
 }
 
 func sliceToSets(slice []string) sets.String {
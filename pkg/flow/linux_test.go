@@ -0,0 +1,473 @@
+// +build linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/audit"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/state"
+	"github.com/huanwei/kube-chaos/pkg/tcsim"
+)
+
+const veth = "cali67801d38217"
+
+// newSim makes the package run its commands against a simulated node with a pod veth, and the
+// ifbs initialised.
+func newSim(t *testing.T) *tcsim.Sim {
+	sim := tcsim.New()
+	sim.AddLink(veth, "veth")
+	old := executor
+	SetExec(sim)
+	t.Cleanup(func() { SetExec(old) })
+	if err := InitIfbModule(); err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func show(t *testing.T, sim *tcsim.Sim, args ...string) string {
+	out, err := sim.Run("tc", args...)
+	if err != nil {
+		t.Fatalf("tc %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func TestInitIfbModule(t *testing.T) {
+	sim := newSim(t)
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		if out := show(t, sim, "qdisc", "show", "dev", ifb); !strings.Contains(out, "htb 1: root") {
+			t.Errorf("%s: expected the root htb, got:\n%s", ifb, out)
+		}
+		if out := show(t, sim, "filter", "show", "dev", ifb); !strings.Contains(out, "fh 2: ht divisor 256") || !strings.Contains(out, "link 2:") {
+			t.Errorf("%s: expected the hash table and its link, got:\n%s", ifb, out)
+		}
+	}
+	if out := show(t, sim, "filter", "show", "dev", "ifb1"); !strings.Contains(out, "hash mask 000000ff at 16") {
+		t.Errorf("expected ifb1 to hash the destination, got:\n%s", out)
+	}
+
+	commands := len(sim.Commands())
+	if err := InitIfbModule(); err != nil {
+		t.Fatal(err)
+	}
+	// modprobe and ip link set run again, tc finds the ifbs initialised
+	if again := sim.Commands()[commands:]; len(again) != 3 {
+		t.Errorf("expected only modprobe and ip link set to run again, got %q", again)
+	}
+}
+
+func TestReconcileCIDR(t *testing.T) {
+	sim := newSim(t)
+	shaper := NewTCShaperFor(veth, state.Owner{UID: "uid-1"})
+	cidr := "192.168.0.10/32"
+	if err := shaper.ReconcileInterface("delay=100ms", "loss=1%"); err != nil {
+		t.Fatal(err)
+	}
+	if err := shaper.ReconcileCIDR(cidr, "delay=100ms,rate=1mbit", "loss=1%"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		cidrs, err := getCIDRs(ifb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cidrs, []string{cidr}) {
+			t.Errorf("%s: expected %v, got %v", ifb, []string{cidr}, cidrs)
+		}
+	}
+	class, handle, found, err := findCIDRClass(cidr, "ifb0")
+	if err != nil || !found {
+		t.Fatalf("expected the class of %s, got %v", cidr, err)
+	}
+	if !strings.HasPrefix(handle, "2:a:") {
+		t.Errorf("expected the filter in the bucket of the last byte, got %s", handle)
+	}
+	if out := show(t, sim, "filter", "show", "dev", veth, "parent", "ffff:"); !strings.Contains(out, "Redirect to device ifb0)") {
+		t.Errorf("expected the veth mirrored to ifb0, got:\n%s", out)
+	}
+
+	// a changed spec changes the class and its netem qdisc in place
+	if err := shaper.ReconcileCIDR(cidr, "delay=50ms,loss=2%", "loss=1%"); err != nil {
+		t.Fatal(err)
+	}
+	chaos, err := GetChaos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CIDRChaos{
+		{CIDR: cidr, Direction: "egress", Class: class, Rate: "10Gbit", Netem: "limit 1000 delay 50.0ms loss 2%"},
+	}
+	if len(chaos) != 2 || chaos[0] != expected[0] || chaos[1].Direction != "ingress" || chaos[1].Netem != "limit 1000 loss 1%" {
+		t.Errorf("expected %+v and the ingress chaos, got %+v", expected, chaos)
+	}
+}
+
+func TestDeleteExtraChaos(t *testing.T) {
+	sim := newSim(t)
+	kept, extra := "192.168.0.10/32", "10.1.0.0/16"
+	for _, cidr := range []string{kept, extra} {
+		if err := NewTCShaper(veth).ReconcileCIDR(cidr, "delay=100ms", "delay=10ms"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteExtraChaos([]string{kept, "10.9.9.9/32"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cidrs, _ := getCIDRs("ifb0"); !reflect.DeepEqual(cidrs, []string{kept}) {
+		t.Errorf("expected only %s on ifb0, got %v", kept, cidrs)
+	}
+	if cidrs, _ := getCIDRs("ifb1"); len(cidrs) != 0 {
+		t.Errorf("expected no CIDRs on ifb1, got %v", cidrs)
+	}
+	for ifb, count := range map[string]int{"ifb0": 1, "ifb1": 0} {
+		if out := show(t, sim, "class", "show", "dev", ifb); strings.Count(out, "class htb") != count {
+			t.Errorf("%s: expected %d classes, got:\n%s", ifb, count, out)
+		}
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	sim := newSim(t)
+	desired := NewDesired()
+	desired.Add(veth, "192.168.0.10/32", state.Owner{UID: "uid-1"}, "delay=100ms,jitter=10ms,rate=1mbit", "loss=1%")
+	desired.Add(veth, "10.1.0.0/16", state.Owner{}, "reorder=25%,reorderRelate=50%,delay=10ms", "")
+	desired.Add(veth, "10.2.0.0/16", state.Owner{}, "profile=3g-poor", "profile=lte")
+
+	apply := func() {
+		observed, err := Observe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed := Diff(desired, observed, nil).Apply(); len(failed) > 0 {
+			t.Fatalf("unexpected failures %v", failed)
+		}
+	}
+	apply()
+	observed, err := Observe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := Diff(desired, observed, desired); len(commands(plan)) != 0 {
+		t.Errorf("expected the applied chaos to need no changes, got %v", commands(plan))
+	}
+
+	// drift is put back
+	show(t, sim, "qdisc", "del", "dev", veth, "ingress")
+	observed, _ = Observe()
+	if plan := Diff(desired, observed, desired); plan.Drift() != 2 {
+		t.Errorf("expected 2 operations correcting drift, got %v", commands(plan))
+	}
+	apply()
+
+	// and the chaos removed
+	desired = NewDesired()
+	apply()
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		if cidrs, _ := getCIDRs(ifb); len(cidrs) != 0 {
+			t.Errorf("%s: expected no CIDRs, got %v", ifb, cidrs)
+		}
+	}
+	if out := show(t, sim, "qdisc", "show", "dev", veth); strings.Contains(out, "ingress") || strings.Contains(out, "htb") {
+		t.Errorf("expected the veth not mirrored, got:\n%s", out)
+	}
+}
+
+func TestClassMetrics(t *testing.T) {
+	sim := newSim(t)
+	desired := NewDesired()
+	desired.Add(veth, "192.168.0.10/32", state.Owner{UID: "uid-1"}, "delay=100ms", "loss=1%")
+	desired.Add(veth, "10.1.0.0/16", state.Owner{}, "delay=10ms", "")
+	allocated := func(ifb string) int64 {
+		if v, ok := classMetrics.Get(ifb + "_allocated").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := map[string]int64{"ifb0": allocated("ifb0"), "ifb1": allocated("ifb1")}
+	plan := func() Plan {
+		observed, err := Observe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Diff(desired, observed, nil)
+	}
+
+	// neither planning nor a dry run adds classes
+	plan()
+	SetExec(exec.NewDryRun(sim))
+	if failed := plan().Apply(); len(failed) > 0 {
+		t.Fatalf("unexpected failures %v", failed)
+	}
+	SetExec(sim)
+	for ifb, n := range before {
+		if allocated(ifb) != n {
+			t.Errorf("%s: expected no classes counted before they are applied, got %d instead of %d", ifb, allocated(ifb), n)
+		}
+	}
+
+	if failed := plan().Apply(); len(failed) > 0 {
+		t.Fatalf("unexpected failures %v", failed)
+	}
+	plan().Apply()
+	for ifb, added := range map[string]int64{"ifb0": 2, "ifb1": 1} {
+		if classes := int64(strings.Count(show(t, sim, "class", "show", "dev", ifb), "leaf")); classes != added {
+			t.Errorf("%s: expected %d classes, got %d", ifb, added, classes)
+		}
+		if counted := allocated(ifb) - before[ifb]; counted != added {
+			t.Errorf("%s: expected %d classes counted, got %d", ifb, added, counted)
+		}
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	sim := newSim(t)
+	if err := NewTCShaper(veth).ReconcileInterface("delay=100ms", "delay=100ms"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewTCShaper(veth).ReconcileCIDR("192.168.0.10/32", "delay=100ms", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	if out := show(t, sim, "qdisc", "show"); strings.Contains(out, "htb") || strings.Contains(out, "ingress") || strings.Contains(out, "netem") {
+		t.Errorf("expected no chaos left, got:\n%s", out)
+	}
+}
+
+func TestPlanApplyBatch(t *testing.T) {
+	sim := newSim(t)
+	commands := len(sim.Commands())
+	plan := Plan{
+		{Target: "a", Args: []string{"class", "add", "dev", "ifb0", "parent", "1:", "classid", "1:2", "htb", "rate", "1mbit"}},
+		{Target: "b", Args: []string{"class", "del", "dev", "ifb0", "parent", "1:", "classid", "1:3"}},
+		{Target: "b", Args: []string{"class", "add", "dev", "ifb0", "parent", "1:", "classid", "1:4", "htb", "rate", "1mbit"}},
+		{Target: "c", Args: []string{"class", "add", "dev", "ifb0", "parent", "1:", "classid", "1:5", "htb", "rate", "1mbit"}},
+		{Target: "c", Args: []string{"qdisc", "add", "dev", "ifb0", "parent", "1:5", "handle", "5:", "netem", "delay", "10ms"}},
+	}
+	failed := plan.Apply()
+	if len(failed) != 1 || failed["b"] == nil {
+		t.Fatalf("expected only b to fail, got %v", failed)
+	}
+	expected := "tc class del dev ifb0 parent 1: classid 1:3: RTNETLINK answers: No such file or directory"
+	if failed["b"].Error() != expected {
+		t.Errorf("expected the error %q, got %q", expected, failed["b"].Error())
+	}
+	if out := show(t, sim, "class", "show", "dev", "ifb0"); !strings.Contains(out, "1:2 ") || strings.Contains(out, "1:4 ") || !strings.Contains(out, "leaf 5:") {
+		t.Errorf("expected the classes of a and c, got:\n%s", out)
+	}
+	// a batch up to the failed line, and one for the rest
+	if applied := sim.Commands()[commands:]; len(applied) != 3 {
+		t.Errorf("expected 3 applied commands, got %q", applied)
+	}
+}
+
+func TestPeerInterfaceForIP(t *testing.T) {
+	sim := newSim(t)
+	sim.AddLink("br-telco", "bridge")
+	sim.AddRoute("10.1.1.5", veth)
+	sim.AddRoute("10.2.2.5", "br-telco")
+
+	if iface, err := PeerInterfaceForIP("10.1.1.5"); err != nil || iface != veth {
+		t.Errorf("expected %s, got %q, %v", veth, iface, err)
+	}
+	if iface, err := PeerInterfaceForIP("10.2.2.5"); err == nil {
+		t.Errorf("expected the bridge to be refused, got %s", iface)
+	}
+}
+
+func TestPlanApplyPeers(t *testing.T) {
+	sim := newSim(t)
+	cidr := "192.168.0.10/32"
+	svc := Peer{IP: "10.96.0.10", Port: 80, Protocol: "tcp"}
+	endpoint := Peer{IP: "192.168.0.20", Port: 8080, Protocol: "tcp"}
+	desiredWith := func(egress string, peers ...Peer) *Desired {
+		desired := NewDesired()
+		desired.Add(veth, cidr, state.Owner{UID: "uid-1"}, egress, "")
+		desired.SetPeers(cidr, "egress", peers)
+		return desired
+	}
+	apply := func(desired *Desired) {
+		observed, err := Observe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed := Diff(desired, observed, nil).Apply(); len(failed) > 0 {
+			t.Fatalf("unexpected failures %v", failed)
+		}
+		observed, _ = Observe()
+		if plan := Diff(desired, observed, desired); len(commands(plan)) != 0 {
+			t.Errorf("expected the applied chaos to need no changes, got %v", commands(plan))
+		}
+	}
+
+	apply(desiredWith("delay=300ms,service=payments", svc, endpoint))
+	filters, _ := listFilters(executor, "ifb0")
+	if f := filters[cidr]; f.handle != "" || len(f.peers) != 2 {
+		t.Errorf("expected only filters for the 2 peers, got %+v", f)
+	}
+	if out := show(t, sim, "filter", "show", "dev", "ifb0"); !strings.Contains(out, "match 0a60000a/ffffffff at 16") || !strings.Contains(out, "match 00000050/0000ffff at 20") {
+		t.Errorf("expected a filter matching the ClusterIP and its port, got:\n%s", out)
+	}
+
+	// the endpoint moves
+	moved := Peer{IP: "192.168.0.30", Port: 8080, Protocol: "tcp"}
+	apply(desiredWith("delay=300ms,service=payments", svc, moved))
+	filters, _ = listFilters(executor, "ifb0")
+	if _, found := filters[cidr].peers[endpoint.String()]; found {
+		t.Errorf("expected the filter of %s deleted, got %+v", endpoint, filters[cidr])
+	}
+
+	// all the traffic
+	apply(desiredWith("delay=300ms"))
+	filters, _ = listFilters(executor, "ifb0")
+	if f := filters[cidr]; f.handle == "" || len(f.peers) != 0 {
+		t.Errorf("expected a single filter for all the traffic, got %+v", f)
+	}
+
+	// no peers left, no chaos
+	apply(desiredWith("delay=300ms,service=payments"))
+	if cidrs, _ := getCIDRs("ifb0"); len(cidrs) != 0 {
+		t.Errorf("expected no CIDRs, got %v", cidrs)
+	}
+}
+
+func TestVary(t *testing.T) {
+	sim := newSim(t)
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := start
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+	cidr := "192.168.0.10/32"
+	desired := NewDesired()
+	desired.Add(veth, cidr, state.Owner{UID: "uid-1"}, "jitter=10ms,ramp=delay:0s..100ms/1m,steps=loss:1%@30s>5%", "")
+	apply := func() {
+		observed, err := Observe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed := Diff(desired, observed, desired).Apply(); len(failed) > 0 {
+			t.Fatalf("unexpected failures %v", failed)
+		}
+	}
+	netem := func() string {
+		netems, _ := netemParams("ifb0")
+		for _, params := range netems {
+			return params
+		}
+		return ""
+	}
+	apply()
+	if params := netem(); params != "limit 1000 loss 1%" {
+		t.Errorf("expected the chaos at its start, got %q", params)
+	}
+
+	clock = start.Add(45 * time.Second)
+	Vary()
+	if params := netem(); params != "limit 1000 delay 75.0ms 10.0ms loss 5%" {
+		t.Errorf("expected the chaos 45s in, got %q", params)
+	}
+	// the syncs leave the varied parameters alone
+	observed, _ := Observe()
+	clock = start.Add(50 * time.Second)
+	if plan := Diff(desired, observed, desired); len(commands(plan)) != 0 {
+		t.Errorf("expected the varied chaos to need no changes, got %v", commands(plan))
+	}
+	// and the varied classes are forgotten with their chaos
+	desired = NewDesired()
+	apply()
+	Vary()
+	if len(varying.classes) != 0 {
+		t.Errorf("expected no varied classes, got %v", varying.classes)
+	}
+	if out := show(t, sim, "qdisc", "show", "dev", "ifb0"); strings.Contains(out, "netem") {
+		t.Errorf("expected no netem qdiscs, got:\n%s", out)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	sim := newSim(t)
+	var out bytes.Buffer
+	l, err := audit.NewLog("node-1", "", 0, 0, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAuditLog(l)
+	defer SetAuditLog(nil)
+	entries := func() []audit.Entry {
+		result := []audit.Entry{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			e := audit.Entry{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			result = append(result, e)
+		}
+		out.Reset()
+		return result
+	}
+
+	cidr := "192.168.0.10/32"
+	owner := state.Owner{UID: "uid-1", Namespace: "default", Name: "web", Source: "Experiment/latency"}
+	desired := NewDesired()
+	desired.Add(veth, cidr, owner, "delay=100ms", "")
+	observed, err := Observe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := Diff(desired, observed, desired).Apply(); len(failed) > 0 {
+		t.Fatalf("unexpected failures %v", failed)
+	}
+	netem := false
+	for _, e := range entries() {
+		if e.Node != "node-1" || e.ExitStatus != 0 || !strings.HasPrefix(e.Command, "tc ") {
+			t.Errorf("unexpected entry %+v", e)
+		}
+		if e.Target == cidr {
+			if e.Pod != "web" || e.Namespace != "default" || e.Source != "Experiment/latency" || e.Spec != "delay=100ms" {
+				t.Errorf("expected the entry for the pod's chaos, got %+v", e)
+			}
+			netem = netem || strings.Contains(e.Command, "netem")
+		}
+	}
+	if !netem {
+		t.Errorf("expected the netem qdisc audited")
+	}
+
+	// a failed command is audited with its status and output
+	sim.Run("tc", "qdisc", "add", "dev", "ifb0", "root", "handle", "1:", "htb")
+	if _, err := combinedOutput(executor, "tc", "qdisc", "add", "dev", "ifb0", "root", "handle", "1:", "htb"); err == nil {
+		t.Fatal("expected the qdisc to exist")
+	}
+	if _, err := combinedOutput(executor, "tc", "qdisc", "show", "dev", "ifb0"); err != nil {
+		t.Fatal(err)
+	}
+	if e := entries(); len(e) != 1 || e[0].ExitStatus == 0 || e[0].Output == "" || e[0].Target != "ifb0" {
+		t.Errorf("expected only the failed qdisc add audited, got %+v", e)
+	}
+}
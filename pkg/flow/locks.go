@@ -0,0 +1,64 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"sort"
+	"sync"
+)
+
+// devices holds a lock for each network device, the changes of a device's classes, filters and
+// qdiscs are made under its lock, so two syncs can't race on the class IDs of an ifb.
+var devices = &deviceLocks{locks: map[string]*sync.Mutex{}}
+
+type deviceLocks struct {
+	lock  sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (d *deviceLocks) get(name string) *sync.Mutex {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	l, found := d.locks[name]
+	if !found {
+		l = &sync.Mutex{}
+		d.locks[name] = l
+	}
+	return l
+}
+
+// LockDevices locks the devices and returns the function unlocking them. They are locked in order,
+// so callers locking several devices at once can't deadlock. A caller holding the locks of the ifbs
+// may lock veths, but not the other way round.
+func LockDevices(names ...string) func() {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	locks := []*sync.Mutex{}
+	for i, name := range sorted {
+		if i > 0 && name == sorted[i-1] {
+			continue
+		}
+		l := devices.get(name)
+		l.Lock()
+		locks = append(locks, l)
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockDevices(t *testing.T) {
+	unlock := LockDevices("ifb1", "ifb0", "ifb0")
+	locked := make(chan struct{})
+	go func() {
+		defer LockDevices("ifb0")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected ifb0 to stay locked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// other devices aren't held up
+	LockDevices("cali67801d38217")()
+	unlock()
+	<-locked
+}
@@ -0,0 +1,154 @@
+// +build linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Observe reads the chaos tc has on the node: the qdiscs of all interfaces, the mirroring of the
+// veths with an ingress qdisc or a root htb, and the classes, netem qdiscs and filters of the ifbs.
+func Observe() (*Observed, error) {
+	return observe(executor)
+}
+
+func observe(e exec.Interface) (*Observed, error) {
+	o := &Observed{Interfaces: map[string]InterfaceState{}, Ifbs: map[string]*IfbState{}}
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		o.Ifbs[ifb] = &IfbState{Classes: map[string]ClassState{}, Filters: map[string]cidrFilter{}}
+	}
+	data, err := combinedOutput(e, "tc", "qdisc", "show")
+	if err != nil {
+		return nil, fmt.Errorf("failed to show qdiscs: %v: %s", err, strings.TrimSpace(string(data)))
+	}
+	netems := map[string]map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		// expected tc lines:
+		// qdisc ingress ffff: dev cali67801d38217 parent ffff:fff1 ----------------
+		// qdisc htb 1: dev cali67801d38217 root refcnt 2 r2q 10 default 0 direct_packets_stat 0
+		// qdisc netem 2: dev ifb0 parent 1:2 limit 1000 delay 100.0ms
+		line := scanner.Text()
+		parts := strings.Fields(line)
+		if len(parts) < 3 || parts[0] != "qdisc" {
+			continue
+		}
+		kind, handle, dev := parts[1], parts[2], filterField(line, "dev")
+		root := strings.Contains(line, " root ")
+		if ifb := o.Ifbs[dev]; ifb != nil {
+			switch {
+			case kind == "htb" && handle == "1:" && root:
+				ifb.RootQdisc = true
+			case kind == "netem":
+				parent := filterField(line, "parent")
+				if netems[dev] == nil {
+					netems[dev] = map[string]string{}
+				}
+				netems[dev][parent] = strings.TrimSpace(line[strings.Index(line, "parent "+parent)+len("parent "+parent):])
+			}
+			continue
+		}
+		s := o.Interfaces[dev]
+		switch {
+		case kind == "ingress" && handle == "ffff:":
+			s.IngressQdisc = true
+		case kind == "htb" && handle == "1:" && root:
+			s.RootQdisc = true
+		default:
+			continue
+		}
+		o.Interfaces[dev] = s
+	}
+
+	for iface, s := range o.Interfaces {
+		if s.IngressQdisc {
+			if s.Mirror.Egress, err = redirectsTo(e, iface, "ffff:", "ifb0"); err != nil {
+				return nil, fmt.Errorf("%s: %v", iface, err)
+			}
+		}
+		if s.RootQdisc {
+			if s.Mirror.Ingress, err = redirectsTo(e, iface, "1:", "ifb1"); err != nil {
+				return nil, fmt.Errorf("%s: %v", iface, err)
+			}
+		}
+		o.Interfaces[iface] = s
+	}
+
+	for name, ifb := range o.Ifbs {
+		if !ifb.RootQdisc {
+			continue
+		}
+		if ifb.Filters, ifb.HashTable, err = readFilters(e, name); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		rates, err := readClassRates(e, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		for class, rate := range rates {
+			c := ClassState{Rate: rate}
+			if params, found := netems[name][class]; found {
+				c.Netem = &params
+			}
+			ifb.Classes[class] = c
+		}
+	}
+	return o, nil
+}
+
+// readFilters returns the filters of an ifb by the CIDR they match, and whether it has its hash
+// table.
+func readFilters(e exec.Interface, ifb string) (map[string]cidrFilter, bool, error) {
+	data, err := combinedOutput(e, "tc", "filter", "show", "dev", ifb)
+	if err != nil {
+		return nil, false, err
+	}
+	filters, err := parseFilters(data)
+	if err != nil {
+		return nil, false, err
+	}
+	// expected tc line:
+	// filter parent 1: protocol ip pref 1 u32 chain 0 fh 2: ht divisor 256
+	return filters, strings.Contains(string(data), "fh "+hashTableHandle+": ht divisor 256"), nil
+}
+
+// readClassRates returns the rate of each htb class of an ifb.
+func readClassRates(e exec.Interface, ifb string) (map[string]string, error) {
+	data, err := combinedOutput(e, "tc", "class", "show", "dev", ifb)
+	if err != nil {
+		return nil, err
+	}
+	rates := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+	for scanner.Scan() {
+		// expected tc line:
+		// class htb 1:2 root leaf 2: prio 0 rate 1Mbit ceil 1Mbit burst 1600b cburst 1600b
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 3 || parts[0] != "class" {
+			continue
+		}
+		rates[parts[2]] = filterField(scanner.Text(), "rate")
+	}
+	return rates, nil
+}
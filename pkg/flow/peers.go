@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Peer is an address chaos is limited to: the traffic of a CIDR to it for egress chaos, and from it
+// for ingress chaos. Port and Protocol are optional, a Port needs a Protocol.
+type Peer struct {
+	IP string
+	// Port is the port of the peer, the destination port of egress traffic and the source port of
+	// ingress traffic.
+	Port int
+	// Protocol is tcp, udp or sctp.
+	Protocol string
+}
+
+var protocolNumbers = map[string]int{"tcp": 6, "udp": 17, "sctp": 132}
+
+// String formats the peer, e.g. "10.96.0.10:80/tcp", peers with the same String match the same
+// traffic.
+func (p Peer) String() string {
+	s := p.IP
+	if p.Port != 0 {
+		s += ":" + strconv.Itoa(p.Port)
+	}
+	if p.Protocol != "" {
+		s += "/" + p.Protocol
+	}
+	return s
+}
+
+// matchArgs returns the u32 matches of the peer's traffic on an ifb, after the match of the CIDR.
+func (p Peer) matchArgs(ifb string) []string {
+	match, port := "dst", "dport"
+	if ifb == "ifb1" {
+		match, port = "src", "sport"
+	}
+	args := []string{"match", "ip", match, p.IP + "/32"}
+	if n, found := protocolNumbers[p.Protocol]; found {
+		args = append(args, "match", "ip", "protocol", strconv.Itoa(n), "0xff")
+	}
+	if p.Port != 0 {
+		args = append(args, "match", "ip", port, strconv.Itoa(p.Port), "0xffff")
+	}
+	return args
+}
+
+// sortPeers sorts peers by String and drops the duplicates.
+func sortPeers(peers []Peer) []Peer {
+	byString := map[string]Peer{}
+	for _, p := range peers {
+		byString[p.String()] = p
+	}
+	sorted := []Peer{}
+	for _, p := range byString {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+	return sorted
+}
@@ -0,0 +1,738 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/state"
+)
+
+// Mirror is which traffic of a pod veth is redirected to the ifbs.
+type Mirror struct {
+	// Egress is traffic leaving the pod, redirected from the veth's ingress qdisc to ifb0.
+	Egress bool
+	// Ingress is traffic to the pod, redirected from the veth's root htb to ifb1.
+	Ingress bool
+}
+
+// CIDRSpec is the chaos wanted for the traffic of a CIDR in one direction.
+type CIDRSpec struct {
+	Owner state.Owner
+	Info  string
+	Spec  *ChaosSpec
+	// Peers limit the chaos to the traffic with the peers, when the spec names Services or hosts.
+	Peers []Peer
+}
+
+// peered reports whether the chaos is limited to the traffic with the peers.
+func (c CIDRSpec) peered() bool {
+	return len(c.Spec.Services) > 0 || len(c.Spec.Hosts) > 0
+}
+
+// samePeers reports whether two specs limit the chaos to the same peers.
+func samePeers(a, b CIDRSpec) bool {
+	if a.peered() != b.peered() || len(a.Peers) != len(b.Peers) {
+		return false
+	}
+	for i := range a.Peers {
+		if a.Peers[i] != b.Peers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Desired is the chaos the agent wants on the node.
+type Desired struct {
+	// Interfaces are the pod veths by name.
+	Interfaces map[string]Mirror
+	// Egress and Ingress are the chaos of the CIDRs, on ifb0 and ifb1.
+	Egress  map[string]CIDRSpec
+	Ingress map[string]CIDRSpec
+	// Partial is set when the veth of some pod is unknown, the mirroring of veths that aren't
+	// wanted is then left alone, in case it is the unknown one.
+	Partial bool
+}
+
+func NewDesired() *Desired {
+	return &Desired{Interfaces: map[string]Mirror{}, Egress: map[string]CIDRSpec{}, Ingress: map[string]CIDRSpec{}}
+}
+
+// Add adds the chaos of a pod, iface is its veth, or empty if it is unknown.
+func (d *Desired) Add(iface, cidr string, owner state.Owner, egressChaosInfo, ingressChaosInfo string) error {
+	if egressChaosInfo != "" {
+		spec, err := ParseChaosSpec(egressChaosInfo)
+		if err != nil {
+			return fmt.Errorf("%s: %v", EgressChaosAnnotation, err)
+		}
+		d.Egress[cidr] = CIDRSpec{Owner: owner, Info: egressChaosInfo, Spec: spec}
+	}
+	if ingressChaosInfo != "" {
+		spec, err := ParseChaosSpec(ingressChaosInfo)
+		if err != nil {
+			return fmt.Errorf("%s: %v", IngressChaosAnnotation, err)
+		}
+		d.Ingress[cidr] = CIDRSpec{Owner: owner, Info: ingressChaosInfo, Spec: spec}
+	}
+	if iface == "" {
+		d.Partial = true
+		return nil
+	}
+	m := d.Interfaces[iface]
+	m.Egress = m.Egress || egressChaosInfo != ""
+	m.Ingress = m.Ingress || ingressChaosInfo != ""
+	d.Interfaces[iface] = m
+	return nil
+}
+
+// SetPeers limits the chaos of a CIDR in a direction, egress or ingress, to the traffic with the
+// peers its spec's Services and hosts resolve to.
+func (d *Desired) SetPeers(cidr, direction string, peers []Peer) {
+	cidrs := d.Egress
+	if direction == "ingress" {
+		cidrs = d.Ingress
+	}
+	if c, found := cidrs[cidr]; found {
+		c.Peers = sortPeers(peers)
+		cidrs[cidr] = c
+	}
+}
+
+// cidrs returns the chaos of the CIDRs shaped on an ifb.
+func (d *Desired) cidrs(ifb string) map[string]CIDRSpec {
+	if ifb == "ifb1" {
+		return d.Ingress
+	}
+	return d.Egress
+}
+
+// InterfaceState is what tc has on a pod veth.
+type InterfaceState struct {
+	// IngressQdisc and RootQdisc are set if the veth has an ingress qdisc and a root htb 1:.
+	IngressQdisc bool
+	RootQdisc    bool
+	// Mirror is set for the qdiscs with a filter redirecting to the ifbs.
+	Mirror Mirror
+}
+
+// ClassState is what tc has for a class of an ifb.
+type ClassState struct {
+	Rate string
+	// Netem holds the parameters of the class's netem qdisc, Netem is nil if it has none.
+	Netem *string
+}
+
+// IfbState is what tc has on an ifb.
+type IfbState struct {
+	// RootQdisc and HashTable are set once the ifb is initialised, see InitIfbModule.
+	RootQdisc bool
+	HashTable bool
+	Classes   map[string]ClassState
+	Filters   map[string]cidrFilter
+}
+
+// Observed is the chaos tc has on the node.
+type Observed struct {
+	// Interfaces are the veths with an ingress qdisc or a root htb, by name.
+	Interfaces map[string]InterfaceState
+	Ifbs       map[string]*IfbState
+}
+
+// Op is an operation of a plan, a tc command.
+type Op struct {
+	// Target is the CIDR or the interface the operation is for, the operations of a target
+	// after a failed one are skipped.
+	Target string
+	// Reason says why the operation is needed.
+	Reason string
+	Args   []string
+	// Drift is set if the operation corrects a change of tc rather than of the desired chaos.
+	Drift bool
+
+	// record and forget are applied to the state store after the operation succeeds, operations
+	// without Args only update the state store.
+	record *state.Record
+	forget *state.Record
+	// spec is the chaos of the class recorded, which Vary changes if it varies with time, and the
+	// audit log names.
+	spec *ChaosSpec
+	// err is set when the operation can't be planned, it fails its target.
+	err error
+	// allocated is the ifb of the operation adding a class the planner allocated, or failing to.
+	allocated string
+}
+
+func (op Op) String() string {
+	if op.Args == nil {
+		return "# " + op.Reason
+	}
+	return fmt.Sprintf("tc %s  # %s", strings.Join(op.Args, " "), op.Reason)
+}
+
+// Plan is the operations turning the observed chaos into the desired one, in order.
+type Plan []Op
+
+// Drift counts the operations correcting drift.
+func (p Plan) Drift() int {
+	n := 0
+	for _, op := range p {
+		if op.Drift {
+			n++
+		}
+	}
+	return n
+}
+
+// device returns the device an operation changes, or "" if it has no Args.
+func (op Op) device() string {
+	for i := 0; i+1 < len(op.Args); i++ {
+		if op.Args[i] == "dev" {
+			return op.Args[i+1]
+		}
+	}
+	return ""
+}
+
+// byDevice splits the plan by the device its operations change, keeping their order. Operations
+// without Args go with the previous operation of their target.
+func (p Plan) byDevice() []Plan {
+	plans := []Plan{}
+	index := map[string]int{}
+	last := map[string]string{}
+	for _, op := range p {
+		dev := op.device()
+		if op.Args == nil {
+			dev = last[op.Target]
+		}
+		last[op.Target] = dev
+		i, found := index[dev]
+		if !found {
+			i = len(plans)
+			index[dev] = i
+			plans = append(plans, Plan{})
+		}
+		plans[i] = append(plans[i], op)
+	}
+	return plans
+}
+
+// Devices returns the devices the plan changes, sorted, whose locks Apply must be called with.
+func (p Plan) Devices() []string {
+	devices := sets.String{}
+	for _, op := range p {
+		if dev := op.device(); dev != "" {
+			devices.Insert(dev)
+		}
+	}
+	return devices.List()
+}
+
+// Diff plans the operations turning observed into desired. Operations on the items that were
+// wanted the same way in previous correct drift, previous is nil if unknown.
+func Diff(desired *Desired, observed *Observed, previous *Desired) Plan {
+	p := &planner{desired: desired, observed: observed, previous: previous}
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		p.initIfb(ifb)
+	}
+	p.unmirror()
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		p.deleteExtra(ifb)
+	}
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		p.reconcileCIDRs(ifb)
+	}
+	p.mirror()
+	return p.plan
+}
+
+type planner struct {
+	desired  *Desired
+	observed *Observed
+	previous *Desired
+	plan     Plan
+}
+
+func (p *planner) add(op Op) {
+	p.plan = append(p.plan, op)
+}
+
+func (p *planner) ifb(ifb string) *IfbState {
+	if s := p.observed.Ifbs[ifb]; s != nil {
+		return s
+	}
+	return &IfbState{Classes: map[string]ClassState{}, Filters: map[string]cidrFilter{}}
+}
+
+func (p *planner) initIfb(ifb string) {
+	s := p.ifb(ifb)
+	if !s.RootQdisc {
+		p.add(Op{Target: ifb, Reason: ifb + " has no root htb", Drift: p.previous != nil,
+			Args: []string{"qdisc", "add", "dev", ifb, "root", "handle", "1:", "htb", "default", "30"}})
+	}
+	if !s.HashTable {
+		match, offset := "src", "12"
+		if ifb == "ifb1" {
+			match, offset = "dst", "16"
+		}
+		p.add(Op{Target: ifb, Reason: ifb + " has no hash table", Drift: p.previous != nil,
+			Args: []string{"filter", "add", "dev", ifb, "parent", "1:0", "prio", "1", "handle", hashTableHandle + ":", "protocol", "ip", "u32", "divisor", "256"}})
+		p.add(Op{Target: ifb, Reason: ifb + " has no hash table", Drift: p.previous != nil,
+			Args: []string{"filter", "add", "dev", ifb, "parent", "1:0", "prio", "1", "protocol", "ip", "u32", "ht", "800::",
+				"match", "ip", match, "0.0.0.0/0", "hashkey", "mask", "0x000000ff", "at", offset, "link", hashTableHandle + ":"}})
+	}
+}
+
+// interfaces returns the names of the desired and the observed veths, sorted.
+func (p *planner) interfaces() []string {
+	names := sets.String{}
+	for name := range p.desired.Interfaces {
+		names.Insert(name)
+	}
+	for name := range p.observed.Interfaces {
+		names.Insert(name)
+	}
+	return names.List()
+}
+
+func (p *planner) wasWanted(iface string) (Mirror, bool) {
+	if p.previous == nil {
+		return Mirror{}, false
+	}
+	m, found := p.previous.Interfaces[iface]
+	return m, found
+}
+
+// unmirror removes the mirroring that isn't wanted.
+func (p *planner) unmirror() {
+	for _, iface := range p.interfaces() {
+		want, wanted := p.desired.Interfaces[iface]
+		if !wanted && p.desired.Partial {
+			continue
+		}
+		have := p.observed.Interfaces[iface]
+		before, known := p.wasWanted(iface)
+		if have.Mirror.Egress && !want.Egress {
+			p.add(Op{Target: iface, Reason: "no egress chaos", Drift: known && before.Egress == want.Egress && !wanted,
+				Args: []string{"qdisc", "del", "dev", iface, "ingress"}})
+		}
+		if have.Mirror.Ingress && !want.Ingress {
+			p.add(Op{Target: iface, Reason: "no ingress chaos", Drift: known && before.Ingress == want.Ingress && !wanted,
+				Args: []string{"qdisc", "del", "dev", iface, "root", "handle", "1:"}})
+		}
+	}
+}
+
+// mirror adds the mirroring that is missing.
+func (p *planner) mirror() {
+	for _, iface := range p.interfaces() {
+		want := p.desired.Interfaces[iface]
+		have := p.observed.Interfaces[iface]
+		before, known := p.wasWanted(iface)
+		if want.Egress && !have.Mirror.Egress {
+			drift := known && before.Egress
+			if !have.IngressQdisc {
+				p.add(Op{Target: iface, Reason: "egress chaos without an ingress qdisc", Drift: drift,
+					Args: []string{"qdisc", "add", "dev", iface, "ingress"}})
+			}
+			p.add(Op{Target: iface, Reason: "egress chaos without mirroring to ifb0", Drift: drift,
+				Args: mirrorArgs(iface, "ffff:", "ifb0")})
+		}
+		if want.Ingress && !have.Mirror.Ingress {
+			drift := known && before.Ingress
+			if !have.RootQdisc {
+				p.add(Op{Target: iface, Reason: "ingress chaos without a root htb", Drift: drift,
+					Args: []string{"qdisc", "add", "dev", iface, "root", "handle", "1:", "htb"}})
+			}
+			p.add(Op{Target: iface, Reason: "ingress chaos without mirroring to ifb1", Drift: drift,
+				Args: mirrorArgs(iface, "1:", "ifb1")})
+		}
+	}
+}
+
+func mirrorArgs(iface, parent, ifb string) []string {
+	return []string{"filter", "add", "dev", iface, "parent", parent, "protocol", "ip", "u32",
+		"match", "u32", "0", "0", "action", "mirred", "egress", "redirect", "dev", ifb}
+}
+
+// deleteExtra deletes the filters of CIDRs without chaos, and the classes without filters.
+func (p *planner) deleteExtra(ifb string) {
+	s := p.ifb(ifb)
+	desired := p.desired.cidrs(ifb)
+	referenced := sets.String{}
+	for _, cidr := range sortedCIDRs(s.Filters) {
+		f := s.Filters[cidr]
+		if _, wanted := desired[cidr]; wanted {
+			referenced.Insert(f.class)
+			continue
+		}
+		p.plan = append(p.plan, deleteCIDR(ifb, cidr, f)...)
+	}
+	classes := []string{}
+	for class := range s.Classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		if !referenced.Has(class) && !s.filtered(class) {
+			p.add(Op{Target: ifb, Reason: fmt.Sprintf("no filter sends traffic to class %s", class), Drift: p.previous != nil,
+				Args: []string{"class", "del", "dev", ifb, "parent", "1:", "classid", class}})
+		}
+	}
+}
+
+// deleteCIDR returns the operations deleting the filters of a CIDR and its class.
+func deleteCIDR(ifb, cidr string, f cidrFilter) []Op {
+	reason := fmt.Sprintf("%s has no %s chaos", cidr, ifbDirection(ifb))
+	ops := []Op{}
+	for _, handle := range f.handles() {
+		ops = append(ops, Op{Target: cidr, Reason: reason, Args: deleteFilterArgs(ifb, handle)})
+	}
+	return append(ops, Op{Target: cidr, Reason: reason, forget: &state.Record{CIDR: cidr, Direction: ifbDirection(ifb)},
+		Args: []string{"class", "del", "dev", ifb, "parent", "1:", "classid", f.class}})
+}
+
+func deleteFilterArgs(ifb, handle string) []string {
+	return []string{"filter", "del", "dev", ifb, "parent", "1:", "protocol", "ip", "prio", "1", "handle", handle, "u32"}
+}
+
+// filterArgs returns the arguments adding the filter sending the traffic of a CIDR, with a peer if
+// it isn't nil, to class.
+func filterArgs(ifb, cidr string, peer *Peer, class string) []string {
+	match := "src"
+	if ifb == "ifb1" {
+		match = "dst"
+	}
+	args := append(append([]string{"filter", "add", "dev", ifb, "protocol", "ip", "parent", "1:0", "prio", "1", "u32"}, hashTable(cidr)...),
+		"match", "ip", match, cidr)
+	if peer != nil {
+		args = append(args, peer.matchArgs(ifb)...)
+	}
+	return append(args, "flowid", class)
+}
+
+// filtered reports whether a filter sends traffic to class.
+func (s *IfbState) filtered(class string) bool {
+	for _, f := range s.Filters {
+		if f.class == class {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileCIDRs adds or changes the classes of the CIDRs with chaos.
+func (p *planner) reconcileCIDRs(ifb string) {
+	s := p.ifb(ifb)
+	direction := ifbDirection(ifb)
+	desired := p.desired.cidrs(ifb)
+	// the classes planned don't exist yet, they are reserved in an allocator of the plan seeded
+	// with the classes of the ifb
+	used := sets.Int{}
+	for class := range s.Classes {
+		if id, err := strconv.ParseUint(strings.TrimPrefix(class, "1:"), 16, 16); err == nil {
+			used.Insert(int(id))
+		}
+	}
+	alloc := &classAllocator{reserved: map[string]sets.Int{ifb: used}}
+	cidrs := []string{}
+	for cidr := range desired {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		want := desired[cidr]
+		r := &state.Record{Owner: want.Owner, CIDR: cidr, Direction: direction, SpecHash: state.Hash(want.Spec.String())}
+		drift, peersDrift := false, false
+		if p.previous != nil {
+			if before, found := p.previous.cidrs(ifb)[cidr]; found && before.Spec.String() == want.Spec.String() {
+				drift = true
+				peersDrift = samePeers(before, want)
+			}
+		}
+		// the netem parameters varying with time are planned at their current values, and left to
+		// Vary afterwards
+		spec := want.Spec.At(elapsed(ifb, cidr, r.SpecHash))
+		f, found := s.Filters[cidr]
+		if want.peered() && len(want.Peers) == 0 {
+			// no traffic to impair, e.g. the Services have neither a ClusterIP nor endpoints
+			if found {
+				p.plan = append(p.plan, deleteCIDR(ifb, cidr, f)...)
+			}
+			continue
+		}
+		if !found {
+			key := want.Owner.UID
+			if key == "" {
+				key = cidr
+			}
+			id, err := alloc.allocate(ifb, key, nil)
+			if err != nil {
+				p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s: %v", cidr, err), err: err, allocated: ifb})
+				continue
+			}
+			class := classID(id)
+			r.Class = class
+			reason := fmt.Sprintf("%s has no %s class", cidr, direction)
+			p.add(Op{Target: cidr, Reason: reason, Drift: drift, allocated: ifb,
+				Args: []string{"class", "add", "dev", ifb, "parent", "1:", "classid", class, "htb", "rate", want.Spec.HTBRate()}})
+			p.add(Op{Target: cidr, Reason: reason, Drift: drift,
+				Args: append([]string{"qdisc", "add", "dev", ifb, "parent", class, "handle", netemHandle(class), "netem"}, spec.NetemArgs()...)})
+			p.reconcileFilters(ifb, cidr, class, cidrFilter{}, want, drift)
+			p.add(Op{Target: cidr, record: r, spec: want.Spec})
+			continue
+		}
+
+		r.Class, r.Handle = f.class, f.recordHandle()
+		class := s.Classes[f.class]
+		if !sameRate(class.Rate, want.Spec.HTBRate()) {
+			p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s class %s has rate %q instead of %q", cidr, f.class, class.Rate, want.Spec.HTBRate()), Drift: drift,
+				Args: []string{"class", "change", "dev", ifb, "parent", "1:", "classid", f.class, "htb", "rate", want.Spec.HTBRate()}})
+		}
+		netem := append([]string{"dev", ifb, "parent", f.class, "handle", netemHandle(f.class), "netem"}, spec.NetemArgs()...)
+		switch {
+		case class.Netem == nil:
+			p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s class %s has no netem qdisc", cidr, f.class), Drift: drift,
+				Args: append([]string{"qdisc", "add"}, netem...)})
+		case !sameNetem(*class.Netem, spec):
+			p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s class %s has netem %q instead of %q", cidr, f.class, *class.Netem, want.Info), Drift: drift,
+				Args: append([]string{"qdisc", "change"}, netem...)})
+		}
+		p.reconcileFilters(ifb, cidr, f.class, f, want, peersDrift)
+		p.add(Op{Target: cidr, record: r, spec: want.Spec})
+	}
+}
+
+// reconcileFilters adds the filters a CIDR is missing, a single one for all its traffic or one for
+// each peer, and deletes the ones it has but doesn't want.
+func (p *planner) reconcileFilters(ifb, cidr, class string, have cidrFilter, want CIDRSpec, drift bool) {
+	if !want.peered() {
+		if have.handle == "" {
+			p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s has no %s filter", cidr, ifbDirection(ifb)), Drift: drift,
+				Args: filterArgs(ifb, cidr, nil, class)})
+		}
+	} else {
+		for i, peer := range want.Peers {
+			if _, found := have.peers[peer.String()]; !found {
+				p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s has no %s filter for peer %s", cidr, ifbDirection(ifb), peer), Drift: drift,
+					Args: filterArgs(ifb, cidr, &want.Peers[i], class)})
+			}
+		}
+	}
+	if have.handle != "" && want.peered() {
+		p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s chaos is limited to its peers", cidr),
+			Args: deleteFilterArgs(ifb, have.handle)})
+	}
+	wanted := sets.String{}
+	if want.peered() {
+		for _, peer := range want.Peers {
+			wanted.Insert(peer.String())
+		}
+	}
+	for _, peer := range sets.StringKeySet(have.peers).List() {
+		if !wanted.Has(peer) {
+			p.add(Op{Target: cidr, Reason: fmt.Sprintf("%s has no chaos for peer %s", cidr, peer), Drift: drift,
+				Args: deleteFilterArgs(ifb, have.peers[peer])})
+		}
+	}
+}
+
+func sortedCIDRs(filters map[string]cidrFilter) []string {
+	cidrs := []string{}
+	for cidr := range filters {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// sameNetem reports whether the netem parameters tc shows apply spec.
+func sameNetem(params string, spec *ChaosSpec) bool {
+	observed, err := parseNetem(params)
+	if err != nil {
+		return false
+	}
+	// the varied parameters change between the syncs
+	for _, name := range spec.varied() {
+		variedParams[name].set(observed, variedParams[name].get(spec))
+	}
+	// tc doesn't show the distribution of the jitter
+	if observed.Jitter > 0 {
+		observed.Distribution = spec.Distribution
+	}
+	return strings.Join(observed.NetemArgs(), " ") == strings.Join(spec.NetemArgs(), " ")
+}
+
+// parseNetem parses the netem parameters tc shows, e.g. "limit 1000 delay 100.0ms  10.0ms loss 1%"
+// or "limit 1000 loss gemodel p 1% r 10% 1-h 70% 1-k 0.1%".
+func parseNetem(params string) (*ChaosSpec, error) {
+	spec := &ChaosSpec{}
+	fields := strings.Fields(params)
+	// value returns the field after i, if it is a value of the key at i rather than the next key
+	value := func(i int, suffix string) (string, bool) {
+		if i+1 < len(fields) && strings.HasSuffix(fields[i+1], suffix) && strings.IndexAny(fields[i+1][:1], "0123456789") == 0 {
+			return fields[i+1], true
+		}
+		return "", false
+	}
+	for i := 0; i < len(fields); i++ {
+		var err error
+		switch fields[i] {
+		case "delay":
+			d, ok := value(i, "s")
+			if !ok {
+				return nil, fmt.Errorf("delay without a time in %q", params)
+			}
+			if spec.Delay, err = time.ParseDuration(d); err != nil {
+				return nil, err
+			}
+			i++
+			if j, ok := value(i, "s"); ok {
+				if spec.Jitter, err = time.ParseDuration(j); err != nil {
+					return nil, err
+				}
+				i++
+			}
+		case "loss", "duplicate", "reorder":
+			if fields[i] == "loss" && i+1 < len(fields) && fields[i+1] == "gemodel" {
+				if spec.GEModel, err = parseGEModelFields(fields[i+2:]); err != nil {
+					return nil, fmt.Errorf("%v in %q", err, params)
+				}
+				i += 9
+				continue
+			}
+			p, ok := value(i, "%")
+			if !ok {
+				continue
+			}
+			target := map[string]*float64{"loss": &spec.Loss, "duplicate": &spec.Duplicate, "reorder": &spec.Reorder}[fields[i]]
+			if err := parsePercentage(p, target); err != nil {
+				return nil, err
+			}
+			i++
+			correlation := map[string]*float64{"loss": &spec.LossCorrelation, "reorder": &spec.ReorderRelate}[fields[i-1]]
+			if correlation == nil {
+				continue
+			}
+			if r, ok := value(i, "%"); ok {
+				if err := parsePercentage(r, correlation); err != nil {
+					return nil, err
+				}
+				i++
+			}
+		}
+	}
+	return spec, nil
+}
+
+// parseGEModelFields parses the "p 1% r 10% 1-h 70% 1-k 0.1%" tc shows after "loss gemodel".
+func parseGEModelFields(fields []string) (*GEModel, error) {
+	m := &GEModel{}
+	for i, key := range []string{"p", "r", "1-h", "1-k"} {
+		if 2*i+1 >= len(fields) || fields[2*i] != key {
+			return nil, fmt.Errorf("gemodel without %s", key)
+		}
+		if err := parsePercentage(fields[2*i+1], []*float64{&m.P, &m.R, &m.OneMinusH, &m.OneMinusK}[i]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// sameRate reports whether two tc rates are the same, e.g. "1Mbit" and "1mbit" or "125kbps".
+func sameRate(a, b string) bool {
+	ra, errA := rateBits(a)
+	rb, errB := rateBits(b)
+	return errA == nil && errB == nil && ra == rb
+}
+
+// rateBits returns a tc rate in bits per second.
+func rateBits(rate string) (float64, error) {
+	rate = strings.ToLower(rate)
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+		{"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(rate, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(rate, u.suffix), 64)
+			if err != nil {
+				return 0, err
+			}
+			return n * u.factor, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate %q", rate)
+}
+
+// classID formats the class 1:N, tc reads the minor N as hex.
+func classID(id int) string {
+	return fmt.Sprintf("1:%x", id)
+}
+
+// ifbDirection returns the direction of the chaos shaped on an ifb.
+func ifbDirection(ifb string) string {
+	if ifb == "ifb1" {
+		return "ingress"
+	}
+	return "egress"
+}
+
+// netemHandle returns the handle of the netem qdisc of class 1:N, which is N:.
+func netemHandle(class string) string {
+	return strings.TrimPrefix(class, "1:") + ":"
+}
+
+// cidrFilter is the u32 filters sending the traffic of a CIDR to its class, a single one for all
+// its traffic, or one for each peer its chaos is limited to.
+type cidrFilter struct {
+	class string
+	// handle is the handle of the filter for all the traffic, empty if there is none.
+	handle string
+	// peers are the handles of the filters for the peers, by Peer.String.
+	peers map[string]string
+}
+
+// handles returns the handles of all the filters, sorted.
+func (f cidrFilter) handles() []string {
+	handles := []string{}
+	if f.handle != "" {
+		handles = append(handles, f.handle)
+	}
+	for _, handle := range f.peers {
+		handles = append(handles, handle)
+	}
+	sort.Strings(handles)
+	return handles
+}
+
+// recordHandle returns the handle recorded in the state store, the filter for all the traffic's, or
+// the first peer filter's.
+func (f cidrFilter) recordHandle() string {
+	if handles := f.handles(); f.handle == "" && len(handles) > 0 {
+		return handles[0]
+	}
+	return f.handle
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/state"
+)
+
+func commands(p Plan) []string {
+	cmds := []string{}
+	for _, op := range p {
+		if op.Args != nil {
+			cmds = append(cmds, strings.Join(op.Args, " "))
+		}
+	}
+	return cmds
+}
+
+func initialisedIfbs() map[string]*IfbState {
+	ifbs := map[string]*IfbState{}
+	for _, ifb := range []string{"ifb0", "ifb1"} {
+		ifbs[ifb] = &IfbState{RootQdisc: true, HashTable: true, Classes: map[string]ClassState{}, Filters: map[string]cidrFilter{}}
+	}
+	return ifbs
+}
+
+func TestDiff(t *testing.T) {
+	owner := state.Owner{UID: "uid-1", Namespace: "default", Name: "pod-1"}
+	desired := NewDesired()
+	if err := desired.Add("cali67801d38217", "10.0.0.1/32", owner, "delay=100ms,rate=1mbit", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing on the node yet
+	empty := &Observed{Interfaces: map[string]InterfaceState{}, Ifbs: map[string]*IfbState{}}
+	plan := Diff(desired, empty, nil)
+	if plan.Drift() != 0 {
+		t.Errorf("expected no drift without a previous desired chaos, got %d", plan.Drift())
+	}
+	cmds := strings.Join(commands(plan), "\n")
+	for _, expected := range []string{
+		"qdisc add dev ifb0 root handle 1: htb default 30",
+		"filter add dev ifb1 parent 1:0 prio 1 handle 2: protocol ip u32 divisor 256",
+		"htb rate 1mbit",
+		"netem delay 100000us",
+		"u32 ht 2:1: match ip src 10.0.0.1/32 flowid 1:",
+		"qdisc add dev cali67801d38217 ingress",
+		"filter add dev cali67801d38217 parent ffff: protocol ip u32 match u32 0 0 action mirred egress redirect dev ifb0",
+	} {
+		if !strings.Contains(cmds, expected) {
+			t.Errorf("expected the plan to contain %q, got:\n%s", expected, cmds)
+		}
+	}
+	if strings.Contains(cmds, "dev cali67801d38217 root") {
+		t.Errorf("expected no root htb on the veth without ingress chaos, got:\n%s", cmds)
+	}
+
+	// the same chaos already applied
+	netem := "limit 1000 delay 100.0ms"
+	applied := &Observed{
+		Interfaces: map[string]InterfaceState{"cali67801d38217": {IngressQdisc: true, Mirror: Mirror{Egress: true}}},
+		Ifbs:       initialisedIfbs(),
+	}
+	applied.Ifbs["ifb0"].Classes["1:1f"] = ClassState{Rate: "1Mbit", Netem: &netem}
+	applied.Ifbs["ifb0"].Filters["10.0.0.1/32"] = cidrFilter{class: "1:1f", handle: "2:1:800"}
+	if cmds := commands(Diff(desired, applied, desired)); len(cmds) != 0 {
+		t.Errorf("expected no operations, got %v", cmds)
+	}
+
+	// someone deleted the netem qdisc and the mirroring by hand
+	applied.Ifbs["ifb0"].Classes["1:1f"] = ClassState{Rate: "1Mbit"}
+	applied.Interfaces["cali67801d38217"] = InterfaceState{IngressQdisc: true}
+	plan = Diff(desired, applied, desired)
+	if cmds := commands(plan); len(cmds) != 2 || plan.Drift() != 2 {
+		t.Errorf("expected 2 operations correcting drift, got %d: %v", plan.Drift(), cmds)
+	}
+
+	// the chaos was removed
+	applied.Interfaces["cali67801d38217"] = InterfaceState{IngressQdisc: true, Mirror: Mirror{Egress: true}}
+	plan = Diff(NewDesired(), applied, desired)
+	cmds = strings.Join(commands(plan), "\n")
+	for _, expected := range []string{
+		"filter del dev ifb0 parent 1: protocol ip prio 1 handle 2:1:800 u32",
+		"class del dev ifb0 parent 1: classid 1:1f",
+		"qdisc del dev cali67801d38217 ingress",
+	} {
+		if !strings.Contains(cmds, expected) {
+			t.Errorf("expected the plan to contain %q, got:\n%s", expected, cmds)
+		}
+	}
+	if plan.Drift() != 0 {
+		t.Errorf("expected removing chaos not to be drift, got %d", plan.Drift())
+	}
+}
+
+func TestDiffPartial(t *testing.T) {
+	desired := NewDesired()
+	desired.Add("", "10.0.0.1/32", state.Owner{}, "loss=1%", "")
+	observed := &Observed{
+		Interfaces: map[string]InterfaceState{"cali67801d38217": {IngressQdisc: true, Mirror: Mirror{Egress: true}}},
+		Ifbs:       initialisedIfbs(),
+	}
+	// the veth may be the one of the pod whose veth is unknown
+	for _, cmd := range commands(Diff(desired, observed, nil)) {
+		if strings.Contains(cmd, "cali67801d38217") {
+			t.Errorf("expected the veth to be left alone, got %q", cmd)
+		}
+	}
+}
+
+func TestParseNetem(t *testing.T) {
+	tests := map[string]ChaosSpec{
+		"limit 1000 delay 100.0ms":                                {Delay: 100 * time.Millisecond},
+		"limit 1000 delay 100.0ms  10.0ms loss 1% duplicate 2.5%": {Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 1, Duplicate: 2.5},
+		"limit 1000 delay 1.0s reorder 25% 50% gap 1":             {Delay: time.Second, Reorder: 25, ReorderRelate: 50},
+		"limit 1000 loss 3% seed 123":                             {Loss: 3},
+		"limit 1000 delay 500us":                                  {Delay: 500 * time.Microsecond},
+		"limit 1000 loss 1% 25%":                                  {Loss: 1, LossCorrelation: 25},
+		"limit 1000 delay 250.0ms  100.0ms loss gemodel p 2% r 20% 1-h 60% 1-k 0.5% reorder 1%": {
+			Delay: 250 * time.Millisecond, Jitter: 100 * time.Millisecond, GEModel: &GEModel{P: 2, R: 20, OneMinusH: 60, OneMinusK: 0.5}, Reorder: 1,
+		},
+	}
+	for params, expected := range tests {
+		spec, err := parseNetem(params)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", params, err)
+			continue
+		}
+		if !reflect.DeepEqual(*spec, expected) {
+			t.Errorf("%q: expected %+v, got %+v", params, expected, *spec)
+		}
+	}
+}
+
+func TestSameRate(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"1Mbit", "1mbit", true},
+		{"1Mbit", "125kbps", true},
+		{"10Gbit", DefaultRate, true},
+		{"512Kbit", "1mbit", false},
+		{"", "1mbit", false},
+	}
+	for _, test := range tests {
+		if got := sameRate(test.a, test.b); got != test.expected {
+			t.Errorf("sameRate(%q, %q): expected %v, got %v", test.a, test.b, test.expected, got)
+		}
+	}
+}
+
+func TestByDevice(t *testing.T) {
+	owner := state.Owner{UID: "uid-1", Namespace: "default", Name: "pod-1"}
+	desired := NewDesired()
+	if err := desired.Add("cali67801d38217", "10.0.0.1/32", owner, "delay=100ms", "loss=10%"); err != nil {
+		t.Fatal(err)
+	}
+	empty := &Observed{Interfaces: map[string]InterfaceState{}, Ifbs: map[string]*IfbState{}}
+	plan := Diff(desired, empty, nil)
+
+	expected := []string{"cali67801d38217", "ifb0", "ifb1"}
+	if got := plan.Devices(); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected devices %v, got %v", expected, got)
+	}
+	n := 0
+	for _, ops := range plan.byDevice() {
+		dev := ops[0].device()
+		for _, op := range ops {
+			if op.Args != nil && op.device() != dev {
+				t.Errorf("%s: expected only operations on %s", op, dev)
+			}
+		}
+		n += len(ops)
+	}
+	if n != len(plan) {
+		t.Errorf("expected %d operations split by device, got %d", len(plan), n)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// builtinProfiles approximate common networks, each is chaos info limited to the profileKeys.
+var builtinProfiles = map[string]string{
+	"3g-good":          "delay=100ms,jitter=20ms,distribution=normal,loss=0.5%,lossCorrelation=25%,rate=2mbit,reorder=0.5%",
+	"3g-poor":          "delay=250ms,jitter=100ms,distribution=paretonormal,gemodel=2%/20%/60%/0.5%,rate=400kbit,reorder=1%",
+	"lte":              "delay=50ms,jitter=10ms,distribution=normal,loss=0.2%,lossCorrelation=25%,rate=20mbit,reorder=0.2%",
+	"satellite":        "delay=600ms,jitter=30ms,distribution=normal,loss=0.5%,lossCorrelation=50%,rate=5mbit,reorder=0.1%",
+	"wifi-lossy":       "delay=20ms,jitter=15ms,distribution=pareto,gemodel=5%/30%/80%/0.5%,rate=10mbit,reorder=2%",
+	"intercontinental": "delay=150ms,jitter=10ms,distribution=normal,loss=0.1%,rate=100mbit,reorder=0.1%",
+}
+
+var profiles = struct {
+	lock    sync.RWMutex
+	entries map[string]string
+}{entries: builtinProfiles}
+
+var profileNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9.\-]*[a-z0-9])?$`)
+
+// Profiles returns the chaos info of every profile by name.
+func Profiles() map[string]string {
+	profiles.lock.RLock()
+	defer profiles.lock.RUnlock()
+	all := map[string]string{}
+	for name, info := range profiles.entries {
+		all[name] = info
+	}
+	return all
+}
+
+// AddProfiles adds profiles to the catalogue, replacing the ones with the same name. Nothing is
+// added if any of them is invalid.
+func AddProfiles(add map[string]string) error {
+	names := []string{}
+	for name := range add {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := validateProfile(name, add[name]); err != nil {
+			return err
+		}
+	}
+	profiles.lock.Lock()
+	defer profiles.lock.Unlock()
+	entries := map[string]string{}
+	for name, info := range profiles.entries {
+		entries[name] = info
+	}
+	for name, info := range add {
+		entries[name] = strings.TrimSpace(info)
+	}
+	profiles.entries = entries
+	return nil
+}
+
+// LoadProfiles adds a profile for every file in dir, named after the file, which holds its chaos
+// info, and validates the catalogue. Files named *.csv are traces instead, see ParseTrace, which
+// specs replay with trace= and the file name without .csv. It is how a ConfigMap mounted as a
+// volume extends the catalogue, the hidden files the kubelet keeps there are skipped. An empty dir
+// only validates the built-in profiles.
+func LoadProfiles(dir string) error {
+	if dir == "" {
+		return ValidateProfiles()
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	add := map[string]string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		// the keys of a ConfigMap volume are symlinks
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if name := strings.TrimSuffix(f.Name(), ".csv"); name != f.Name() {
+			t, err := ParseTrace(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("trace %s: %v", name, err)
+			}
+			if err := AddTrace(name, t); err != nil {
+				return err
+			}
+			continue
+		}
+		add[f.Name()] = string(data)
+	}
+	if err := AddProfiles(add); err != nil {
+		return err
+	}
+	return ValidateProfiles()
+}
+
+// ValidateProfiles validates every profile in the catalogue.
+func ValidateProfiles() error {
+	all := Profiles()
+	names := []string{}
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := validateProfile(name, all[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateProfile(name, info string) error {
+	if !profileNameRE.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q, expected lower case letters, digits, '.' and '-'", name)
+	}
+	for _, item := range strings.Split(info, ",") {
+		key := strings.TrimSpace(strings.SplitN(item, "=", 2)[0])
+		if key != "" && !profileKeys[key] {
+			return fmt.Errorf("profile %s: %q can't be set in a profile, it depends on the pod", name, key)
+		}
+	}
+	if _, err := ParseChaosSpec(info); err != nil {
+		return fmt.Errorf("profile %s: %v", name, err)
+	}
+	return nil
+}
+
+// profileSpec returns the parsed chaos info of a profile.
+func profileSpec(name string) (*ChaosSpec, error) {
+	profiles.lock.RLock()
+	info, found := profiles.entries[name]
+	profiles.lock.RUnlock()
+	if !found {
+		names := []string{}
+		for n := range Profiles() {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return ParseChaosSpec(info)
+}
@@ -16,17 +16,132 @@ limitations under the License.
 
 package flow
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// IngressChaosAnnotation holds the chaos info applied to traffic entering a pod.
+	IngressChaosAnnotation = "kubernetes.io/ingress-chaos"
+	// EgressChaosAnnotation holds the chaos info applied to traffic leaving a pod.
+	EgressChaosAnnotation = "kubernetes.io/egress-chaos"
+
+	// DefaultInterface is the pod interface of chaos specs that don't name one.
+	DefaultInterface = "eth0"
+)
+
 func ExtractPodChaosInfo(podAnnotations map[string]string) (ingressChaosInfo, egressChaosInfo string, err error) {
 
-	ingressChaosInfo, found := podAnnotations["kubernetes.io/ingress-chaos"]
+	ingressChaosInfo, found := podAnnotations[IngressChaosAnnotation]
 	if !found {
 		return "", "", err
 
 	}
 
-	egressChaosInfo, found = podAnnotations["kubernetes.io/egress-chaos"]
+	egressChaosInfo, found = podAnnotations[EgressChaosAnnotation]
 	if !found {
 		return "", "", err
 	}
 	return ingressChaosInfo, egressChaosInfo, nil
 }
+
+// ParseChaosSpecs parses chaos info holding a spec for each pod interface, separated by
+// semicolons, e.g. "delay=100ms;interface=net1,loss=5%". No two specs may name the same interface.
+func ParseChaosSpecs(info string) ([]*ChaosSpec, error) {
+	specs := []*ChaosSpec{}
+	seen := map[string]bool{}
+	for _, item := range strings.Split(info, ";") {
+		spec, err := ParseChaosSpec(item)
+		if err != nil {
+			return nil, err
+		}
+		iface := spec.Interface
+		if iface == "" {
+			iface = DefaultInterface
+		}
+		if seen[iface] {
+			return nil, fmt.Errorf("interface %s has more than one chaos spec", iface)
+		}
+		seen[iface] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// ValidateChaosInfo parses the chaos info of both directions, empty info means no chaos in that
+// direction.
+func ValidateChaosInfo(ingressChaosInfo, egressChaosInfo string) error {
+	if ingressChaosInfo != "" {
+		if _, err := ParseChaosSpecs(ingressChaosInfo); err != nil {
+			return fmt.Errorf("%s: %v", IngressChaosAnnotation, err)
+		}
+	}
+	if egressChaosInfo != "" {
+		if _, err := ParseChaosSpecs(egressChaosInfo); err != nil {
+			return fmt.Errorf("%s: %v", EgressChaosAnnotation, err)
+		}
+	}
+	return nil
+}
+
+// InterfaceChaos is the chaos info of a single pod interface.
+type InterfaceChaos struct {
+	// Interface is the pod interface or the network-attachment the specs name.
+	Interface string
+	Ingress   string
+	Egress    string
+}
+
+// SplitChaosInfo splits the chaos info of both directions by the interface its specs name, so the
+// chaos of each interface is reconciled on its own. The interfaces are sorted, the default first.
+func SplitChaosInfo(ingressChaosInfo, egressChaosInfo string) ([]InterfaceChaos, error) {
+	byInterface := map[string]*InterfaceChaos{}
+	for _, d := range []struct {
+		annotation, info string
+		ingress          bool
+	}{{IngressChaosAnnotation, ingressChaosInfo, true}, {EgressChaosAnnotation, egressChaosInfo, false}} {
+		if d.info == "" {
+			continue
+		}
+		specs, err := ParseChaosSpecs(d.info)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", d.annotation, err)
+		}
+		for _, spec := range specs {
+			iface := spec.Interface
+			if iface == "" {
+				iface = DefaultInterface
+			}
+			c := byInterface[iface]
+			if c == nil {
+				c = &InterfaceChaos{Interface: iface}
+				byInterface[iface] = c
+			}
+			if d.ingress {
+				c.Ingress = spec.String()
+			} else {
+				c.Egress = spec.String()
+			}
+		}
+	}
+	chaos := []InterfaceChaos{}
+	for _, c := range byInterface {
+		chaos = append(chaos, *c)
+	}
+	sort.Slice(chaos, func(i, j int) bool {
+		if (chaos[i].Interface == DefaultInterface) != (chaos[j].Interface == DefaultInterface) {
+			return chaos[i].Interface == DefaultInterface
+		}
+		return chaos[i].Interface < chaos[j].Interface
+	})
+	return chaos, nil
+}
+
+// HasChaosAnnotations reports whether either chaos annotation is present.
+func HasChaosAnnotations(annotations map[string]string) bool {
+	_, ingress := annotations[IngressChaosAnnotation]
+	_, egress := annotations[EgressChaosAnnotation]
+	return ingress || egress
+}
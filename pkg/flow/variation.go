@@ -0,0 +1,431 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Variation varies a netem parameter with the time since the chaos was applied.
+type Variation struct {
+	// Param is delay, jitter, loss, duplicate or reorder.
+	Param string
+	// Kind is ramp, from From to To over Period then staying at To, wave, going from From to To
+	// and back every Period, or steps.
+	Kind   string
+	From   float64
+	To     float64
+	Period time.Duration
+	Steps  []Step
+}
+
+// Step is a value of a steps variation held for Hold, a last step without a Hold is held for
+// good, otherwise the steps repeat.
+type Step struct {
+	Value float64
+	Hold  time.Duration
+}
+
+// param is a netem parameter that can vary, the values of delays are in nanoseconds and the
+// others in percent.
+type param struct {
+	duration bool
+	get      func(s *ChaosSpec) float64
+	set      func(s *ChaosSpec, v float64)
+}
+
+var variedParams = map[string]param{
+	"delay": {true, func(s *ChaosSpec) float64 { return float64(s.Delay) },
+		func(s *ChaosSpec, v float64) { s.Delay = time.Duration(v).Round(time.Microsecond) }},
+	"jitter": {true, func(s *ChaosSpec) float64 { return float64(s.Jitter) },
+		func(s *ChaosSpec, v float64) { s.Jitter = time.Duration(v).Round(time.Microsecond) }},
+	"loss":      {false, func(s *ChaosSpec) float64 { return s.Loss }, func(s *ChaosSpec, v float64) { s.Loss = roundPercentage(v) }},
+	"duplicate": {false, func(s *ChaosSpec) float64 { return s.Duplicate }, func(s *ChaosSpec, v float64) { s.Duplicate = roundPercentage(v) }},
+	"reorder":   {false, func(s *ChaosSpec) float64 { return s.Reorder }, func(s *ChaosSpec, v float64) { s.Reorder = roundPercentage(v) }},
+}
+
+func roundPercentage(p float64) float64 {
+	return math.Round(p*100) / 100
+}
+
+func paramNames() string {
+	return "delay, jitter, loss, duplicate or reorder"
+}
+
+func (p param) parse(value string) (float64, error) {
+	if p.duration {
+		var d time.Duration
+		err := parseDuration(value, &d)
+		return float64(d), err
+	}
+	var v float64
+	err := parsePercentage(value, &v)
+	return v, err
+}
+
+func (p param) format(v float64) string {
+	if p.duration {
+		return time.Duration(v).String()
+	}
+	return formatPercentage(v)
+}
+
+// value returns the value of the parameter elapsed after the chaos was applied.
+func (v Variation) value(elapsed time.Duration) float64 {
+	switch v.Kind {
+	case "ramp":
+		if elapsed >= v.Period {
+			return v.To
+		}
+		return v.From + (v.To-v.From)*float64(elapsed)/float64(v.Period)
+	case "wave":
+		phase := 2 * math.Pi * float64(elapsed%v.Period) / float64(v.Period)
+		return v.From + (v.To-v.From)*(1-math.Cos(phase))/2
+	}
+	// steps
+	var total time.Duration
+	for _, s := range v.Steps {
+		total += s.Hold
+	}
+	if last := v.Steps[len(v.Steps)-1]; last.Hold > 0 {
+		elapsed %= total
+	}
+	for _, s := range v.Steps {
+		if s.Hold == 0 || elapsed < s.Hold {
+			return s.Value
+		}
+		elapsed -= s.Hold
+	}
+	return v.Steps[len(v.Steps)-1].Value
+}
+
+// String formats the variation like chaos info, without the key of its kind.
+func (v Variation) String() string {
+	p := variedParams[v.Param]
+	if v.Kind != "steps" {
+		return fmt.Sprintf("%s:%s..%s/%s", v.Param, p.format(v.From), p.format(v.To), v.Period)
+	}
+	steps := []string{}
+	for _, s := range v.Steps {
+		step := p.format(s.Value)
+		if s.Hold > 0 {
+			step += "@" + s.Hold.String()
+		}
+		steps = append(steps, step)
+	}
+	return v.Param + ":" + strings.Join(steps, ">")
+}
+
+// parseVariations returns the parser of the variations of a kind, separated by +, e.g.
+// "delay:0s..500ms/5m+loss:0%..5%/5m" for ramps and waves, or "loss:1%@1m>5%@30s>20%" for steps.
+func parseVariations(kind string) func(s *ChaosSpec, value string) error {
+	return func(s *ChaosSpec, value string) error {
+		for _, item := range strings.Split(value, "+") {
+			v, err := parseVariation(kind, item)
+			if err != nil {
+				return err
+			}
+			s.Variations = append(s.Variations, v)
+		}
+		return nil
+	}
+}
+
+func parseVariation(kind, item string) (Variation, error) {
+	parts := strings.SplitN(item, ":", 2)
+	p, found := variedParams[parts[0]]
+	if len(parts) != 2 || !found {
+		return Variation{}, fmt.Errorf("%s must be a parameter and its values, the parameter one of %s", item, paramNames())
+	}
+	v := Variation{Param: parts[0], Kind: kind}
+	if kind == "steps" {
+		steps := strings.Split(parts[1], ">")
+		for i, step := range steps {
+			valueHold := strings.SplitN(step, "@", 2)
+			s := Step{}
+			var err error
+			if s.Value, err = p.parse(valueHold[0]); err != nil {
+				return v, err
+			}
+			if len(valueHold) == 2 {
+				if s.Hold, err = time.ParseDuration(valueHold[1]); err != nil || s.Hold <= 0 {
+					return v, fmt.Errorf("%s must be a value and how long it is held, e.g. 5%%@1m", step)
+				}
+			} else if i < len(steps)-1 {
+				return v, fmt.Errorf("%s must say how long it is held, e.g. 5%%@1m, only the last step can be held for good", step)
+			}
+			v.Steps = append(v.Steps, s)
+		}
+		return v, nil
+	}
+	rangePeriod := strings.SplitN(parts[1], "/", 2)
+	fromTo := strings.SplitN(rangePeriod[0], "..", 2)
+	if len(rangePeriod) != 2 || len(fromTo) != 2 {
+		return v, fmt.Errorf("%s must be from..to/period, e.g. %s:0%%..5%%/5m", parts[1], v.Param)
+	}
+	var err error
+	if v.From, err = p.parse(fromTo[0]); err != nil {
+		return v, err
+	}
+	if v.To, err = p.parse(fromTo[1]); err != nil {
+		return v, err
+	}
+	if v.Period, err = time.ParseDuration(rangePeriod[1]); err != nil || v.Period <= 0 {
+		return v, fmt.Errorf("%s must be a period longer than zero", rangePeriod[1])
+	}
+	return v, nil
+}
+
+func parseTrace(s *ChaosSpec, value string) error {
+	if _, found := getTrace(value); !found {
+		return fmt.Errorf("unknown trace %q", value)
+	}
+	s.Trace = value
+	return nil
+}
+
+// Varies reports whether the spec varies with time.
+func (s *ChaosSpec) Varies() bool {
+	return len(s.Variations) > 0 || s.Trace != ""
+}
+
+// varied returns the parameters the spec varies, sorted.
+func (s *ChaosSpec) varied() []string {
+	names := []string{}
+	for _, v := range s.Variations {
+		names = append(names, v.Param)
+	}
+	if t, found := getTrace(s.Trace); found {
+		names = append(names, t.Params...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// At returns the spec with its parameters at their values elapsed after the chaos was applied.
+func (s *ChaosSpec) At(elapsed time.Duration) *ChaosSpec {
+	at := *s
+	for _, v := range s.Variations {
+		variedParams[v.Param].set(&at, v.value(elapsed))
+	}
+	if t, found := getTrace(s.Trace); found {
+		for i, value := range t.at(elapsed) {
+			variedParams[t.Params[i]].set(&at, value)
+		}
+	}
+	return &at
+}
+
+// peak returns the spec with every varied parameter at the highest value it takes.
+func (s *ChaosSpec) peak() *ChaosSpec {
+	at := *s
+	highest := func(name string, value float64) {
+		if p := variedParams[name]; value > p.get(&at) {
+			p.set(&at, value)
+		}
+	}
+	for _, v := range s.Variations {
+		highest(v.Param, math.Max(v.From, v.To))
+		for _, step := range v.Steps {
+			highest(v.Param, step.Value)
+		}
+	}
+	if t, found := getTrace(s.Trace); found {
+		for _, sample := range t.Values {
+			for i, value := range sample {
+				highest(t.Params[i], value)
+			}
+		}
+	}
+	return &at
+}
+
+// validateVariations checks each parameter varies at most once, and isn't also set in the spec,
+// the set keys of which are in explicit.
+func (s *ChaosSpec) validateVariations(explicit map[string]bool) error {
+	varied := s.varied()
+	for i, name := range varied {
+		if i > 0 && varied[i-1] == name {
+			return fmt.Errorf("%s varies more than once", name)
+		}
+		if explicit[name] {
+			return fmt.Errorf("%s is set and varied, set only one of them", name)
+		}
+	}
+	return nil
+}
+
+// Trace is a recording of netem parameters replayed by chaos specs, each sample is held until
+// the next one, and the trace repeats after its last sample is held as long as the one before.
+type Trace struct {
+	// Params are the parameters of the samples' values, in order.
+	Params  []string
+	Offsets []time.Duration
+	Values  [][]float64
+}
+
+// ParseTrace reads a trace from CSV, with a header naming an offset column and the parameters,
+// e.g. "offset,delay,loss". Offsets are seconds or durations, delays are milliseconds or
+// durations, and the other parameters percentages, with or without %.
+func ParseTrace(r io.Reader) (*Trace, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("a trace needs a header and at least one sample")
+	}
+	header := rows[0]
+	if name := strings.TrimSpace(header[0]); name != "offset" && name != "time" {
+		return nil, fmt.Errorf("the first column of a trace must be its offset, not %q", name)
+	}
+	t := &Trace{}
+	for _, name := range header[1:] {
+		name = strings.TrimSpace(name)
+		if _, found := variedParams[name]; !found {
+			return nil, fmt.Errorf("unknown trace column %q, expected %s", name, paramNames())
+		}
+		for _, seen := range t.Params {
+			if seen == name {
+				return nil, fmt.Errorf("trace column %q is repeated", name)
+			}
+		}
+		t.Params = append(t.Params, name)
+	}
+	if len(t.Params) == 0 {
+		return nil, fmt.Errorf("a trace needs a column besides its offset")
+	}
+	for i, row := range rows[1:] {
+		line := i + 2
+		offset, err := parseTraceOffset(strings.TrimSpace(row[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if n := len(t.Offsets); n > 0 && offset <= t.Offsets[n-1] || n == 0 && offset != 0 {
+			return nil, fmt.Errorf("line %d: offsets must start at 0 and increase", line)
+		}
+		values := []float64{}
+		for j, field := range row[1:] {
+			value, err := parseTraceValue(variedParams[t.Params[j]], strings.TrimSpace(field))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s: %v", line, t.Params[j], err)
+			}
+			values = append(values, value)
+		}
+		t.Offsets = append(t.Offsets, offset)
+		t.Values = append(t.Values, values)
+	}
+	return t, nil
+}
+
+func parseTraceOffset(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	var d time.Duration
+	err := parseDuration(value, &d)
+	return d, err
+}
+
+func parseTraceValue(p param, value string) (float64, error) {
+	if p.duration {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms >= 0 {
+			return ms * float64(time.Millisecond), nil
+		}
+	} else if !strings.HasSuffix(value, "%") {
+		value += "%"
+	}
+	return p.parse(value)
+}
+
+// at returns the values of the sample held elapsed after the trace started.
+func (t *Trace) at(elapsed time.Duration) []float64 {
+	n := len(t.Offsets)
+	if n == 1 {
+		return t.Values[0]
+	}
+	length := 2*t.Offsets[n-1] - t.Offsets[n-2]
+	elapsed %= length
+	i := sort.Search(n, func(i int) bool { return t.Offsets[i] > elapsed })
+	return t.Values[i-1]
+}
+
+var traces = struct {
+	lock    sync.RWMutex
+	entries map[string]*Trace
+}{entries: map[string]*Trace{}}
+
+// AddTrace adds a trace chaos specs can replay with trace=name.
+func AddTrace(name string, t *Trace) error {
+	if !profileNameRE.MatchString(name) {
+		return fmt.Errorf("invalid trace name %q, expected lower case letters, digits, '.' and '-'", name)
+	}
+	traces.lock.Lock()
+	defer traces.lock.Unlock()
+	traces.entries[name] = t
+	return nil
+}
+
+func getTrace(name string) (*Trace, bool) {
+	if name == "" {
+		return nil, false
+	}
+	traces.lock.RLock()
+	defer traces.lock.RUnlock()
+	t, found := traces.entries[name]
+	return t, found
+}
+
+// variedClass is a class the agent applied chaos varying with time to.
+type variedClass struct {
+	ifb   string
+	cidr  string
+	class string
+	hash  string
+	spec  *ChaosSpec
+	since time.Time
+	// applied are the netem parameters last changed to
+	applied string
+}
+
+// varying holds the varied classes by ifb and CIDR.
+var varying = struct {
+	lock    sync.Mutex
+	classes map[string]*variedClass
+}{classes: map[string]*variedClass{}}
+
+// now is the clock the variations follow.
+var now = time.Now
+
+// elapsed returns how long ago chaos with the spec hash was applied to the class of a CIDR, zero
+// if it wasn't.
+func elapsed(ifb, cidr, hash string) time.Duration {
+	varying.lock.Lock()
+	defer varying.lock.Unlock()
+	if v, found := varying.classes[ifb+"/"+cidr]; found && v.hash == hash {
+		return now().Sub(v.since)
+	}
+	return 0
+}
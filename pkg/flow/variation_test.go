@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVariationValue(t *testing.T) {
+	ramp := Variation{Param: "loss", Kind: "ramp", From: 10, To: 20, Period: time.Minute}
+	wave := Variation{Param: "loss", Kind: "wave", From: 10, To: 20, Period: time.Minute}
+	steps := Variation{Param: "loss", Kind: "steps", Steps: []Step{{1, time.Minute}, {5, time.Minute}}}
+	held := Variation{Param: "loss", Kind: "steps", Steps: []Step{{1, time.Minute}, {5, 0}}}
+	tests := []struct {
+		v        Variation
+		elapsed  time.Duration
+		expected float64
+	}{
+		{ramp, 0, 10},
+		{ramp, 15 * time.Second, 12.5},
+		{ramp, time.Hour, 20},
+		{wave, 0, 10},
+		{wave, 30 * time.Second, 20},
+		{wave, 90 * time.Second, 20},
+		{steps, 30 * time.Second, 1},
+		{steps, 90 * time.Second, 5},
+		{steps, 150 * time.Second, 1},
+		{held, time.Hour, 5},
+	}
+	for _, test := range tests {
+		if value := test.v.value(test.elapsed); value != test.expected {
+			t.Errorf("%s %s after %s: expected %v, got %v", test.v.Kind, test.v, test.elapsed, test.expected, value)
+		}
+	}
+}
+
+func TestParseTrace(t *testing.T) {
+	trace, err := ParseTrace(strings.NewReader("offset,delay,loss\n0,120,0.5\n10s,250ms,2%\n20,80,0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddTrace("eu-west", trace); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := ParseChaosSpec("jitter=10ms,trace=eu-west")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[time.Duration][]string{
+		5 * time.Second:  {"delay", "120000us", "10000us", "loss", "0.5%"},
+		15 * time.Second: {"delay", "250000us", "10000us", "loss", "2%"},
+		25 * time.Second: {"delay", "80000us", "10000us"},
+		// it repeats after the last sample is held 10s
+		35 * time.Second: {"delay", "120000us", "10000us", "loss", "0.5%"},
+	}
+	for elapsed, expected := range tests {
+		if args := spec.At(elapsed).NetemArgs(); !reflect.DeepEqual(args, expected) {
+			t.Errorf("after %s: expected %v, got %v", elapsed, expected, args)
+		}
+	}
+
+	for csv, expected := range map[string]string{
+		"offset,delay\n":               "at least one sample",
+		"delay,loss\n0,1\n":            "must be its offset",
+		"offset,rate\n0,1mbit\n":       "unknown trace column",
+		"offset,loss\n5,1\n":           "start at 0",
+		"offset,loss\n0,1\n0,2\n":      "increase",
+		"offset,loss\n0,1\n1,200\n":    "line 3: loss",
+		"offset,loss,loss\n0,1,1\n":    "repeated",
+		"offset,delay\n0,1\n1,-5ms\n":  "must not be negative",
+		"offset,delay\n0,1,2\n1,2,3\n": "wrong number of fields",
+	} {
+		if _, err := ParseTrace(strings.NewReader(csv)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", csv, expected, err)
+		}
+	}
+}
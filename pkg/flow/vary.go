@@ -0,0 +1,114 @@
+// +build linux
+
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/exec"
+	"github.com/huanwei/kube-chaos/pkg/state"
+)
+
+// track follows the class of a record applied with spec, if it varies with time, from when the
+// spec was first applied.
+func track(r state.Record, spec *ChaosSpec) {
+	key := ifbForDirection(r.Direction) + "/" + r.CIDR
+	varying.lock.Lock()
+	defer varying.lock.Unlock()
+	if spec == nil || !spec.Varies() {
+		delete(varying.classes, key)
+		return
+	}
+	if v, found := varying.classes[key]; found && v.hash == r.SpecHash && v.class == r.Class {
+		return
+	}
+	since := now()
+	// a restarted agent carries on where it was
+	if stateStore != nil {
+		if old, found := stateStore.Get(r.Direction, r.CIDR); found && old.SpecHash == r.SpecHash && old.Since != 0 {
+			since = time.Unix(old.Since, 0)
+		}
+	}
+	varying.classes[key] = &variedClass{ifb: ifbForDirection(r.Direction), cidr: r.CIDR, class: r.Class, hash: r.SpecHash, spec: spec, since: since}
+}
+
+// untrack stops following the class of a CIDR on an ifb, or every class if ifb is empty.
+func untrack(ifb, cidr string) {
+	varying.lock.Lock()
+	defer varying.lock.Unlock()
+	if ifb == "" {
+		varying.classes = map[string]*variedClass{}
+		return
+	}
+	delete(varying.classes, ifb+"/"+cidr)
+}
+
+// Vary changes the netem qdiscs of the chaos varying with time to their current parameters, with a
+// tc -batch per ifb under its lock. Failures are only logged, the next sync puts back the classes
+// that are gone.
+func Vary() {
+	vary(executor)
+}
+
+func vary(e exec.Interface) {
+	varying.lock.Lock()
+	byIfb := map[string][]*variedClass{}
+	plans := map[string]Plan{}
+	for _, v := range varying.classes {
+		args := append([]string{"qdisc", "change", "dev", v.ifb, "parent", v.class, "handle", netemHandle(v.class), "netem"},
+			v.spec.At(now().Sub(v.since)).NetemArgs()...)
+		if strings.Join(args, " ") == v.applied {
+			continue
+		}
+		byIfb[v.ifb] = append(byIfb[v.ifb], v)
+		plans[v.ifb] = append(plans[v.ifb], Op{Target: v.cidr, Reason: v.cidr + " varies with time", Args: args, spec: v.spec})
+	}
+	varying.lock.Unlock()
+
+	ifbs := []string{}
+	for ifb := range plans {
+		ifbs = append(ifbs, ifb)
+	}
+	sort.Strings(ifbs)
+	for _, ifb := range ifbs {
+		unlock := LockDevices(ifb)
+		failed := plans[ifb].applyDevice(e)
+		unlock()
+		varying.lock.Lock()
+		for i, v := range byIfb[ifb] {
+			if err, found := failed[v.cidr]; found {
+				glog.V(2).Infof("Failed to vary %s class %s of %s: %v", ifbDirection(ifb), v.class, v.cidr, err)
+				continue
+			}
+			v.applied = strings.Join(plans[ifb][i].Args, " ")
+		}
+		varying.lock.Unlock()
+	}
+}
+
+// ifbForDirection returns the ifb shaping the chaos of a direction.
+func ifbForDirection(direction string) string {
+	if direction == "ingress" {
+		return "ifb1"
+	}
+	return "ifb0"
+}
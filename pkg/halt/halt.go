@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package halt watches the ConfigMap that stops all chaos in the cluster during an incident.
+package halt // import "github.com/huanwei/kube-chaos/pkg/halt"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Key is the key of the ConfigMap's data that halts all chaos when it is true.
+const Key = "halt"
+
+// Halted reports whether a ConfigMap halts all chaos. A value that isn't a boolean halts it too,
+// an emergency stop shouldn't depend on spelling.
+func Halted(cm *v1.ConfigMap) bool {
+	if cm == nil {
+		return false
+	}
+	value := strings.TrimSpace(cm.Data[Key])
+	if value == "" {
+		return false
+	}
+	halted, err := strconv.ParseBool(value)
+	if err != nil {
+		glog.Warningf("ConfigMap %s/%s has %s=%q, which isn't a boolean, halting chaos", cm.Namespace, cm.Name, Key, value)
+		return true
+	}
+	return halted
+}
+
+// Watcher calls its handler with the ConfigMap whenever it changes, nil if it doesn't exist.
+type Watcher struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	handler   func(cm *v1.ConfigMap)
+}
+
+// NewWatcher watches the ConfigMap namespace/name.
+func NewWatcher(client kubernetes.Interface, namespacedName string, handler func(cm *v1.ConfigMap)) (*Watcher, error) {
+	parts := strings.Split(namespacedName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("%q must be a namespace and a name, e.g. kube-system/kube-chaos-halt", namespacedName)
+	}
+	return &Watcher{client: client, namespace: parts[0], name: parts[1], handler: handler}, nil
+}
+
+// Run gets the ConfigMap then watches it until stopCh is closed, starting over when the watch
+// ends or fails.
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	for {
+		if err := w.watch(stopCh); err != nil {
+			glog.Errorf("Failed to watch ConfigMap %s/%s: %v", w.namespace, w.name, err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (w *Watcher) watch(stopCh <-chan struct{}) error {
+	configMaps := w.client.CoreV1().ConfigMaps(w.namespace)
+	cm, err := configMaps.Get(w.name, meta_v1.GetOptions{})
+	resourceVersion := ""
+	switch {
+	case errors.IsNotFound(err):
+		w.handler(nil)
+	case err != nil:
+		return err
+	default:
+		resourceVersion = cm.ResourceVersion
+		w.handler(cm)
+	}
+	watcher, err := configMaps.Watch(meta_v1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", w.name).String(),
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if cm, ok := event.Object.(*v1.ConfigMap); ok {
+					w.handler(cm)
+				}
+			case watch.Deleted:
+				w.handler(nil)
+			case watch.Error:
+				return errors.FromObject(event.Object)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package halt
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestHalted(t *testing.T) {
+	tests := []struct {
+		cm     *v1.ConfigMap
+		halted bool
+	}{
+		{nil, false},
+		{&v1.ConfigMap{}, false},
+		{&v1.ConfigMap{Data: map[string]string{"halt": "false"}}, false},
+		{&v1.ConfigMap{Data: map[string]string{"halt": "true"}}, true},
+		{&v1.ConfigMap{Data: map[string]string{"halt": " True\n"}}, true},
+		{&v1.ConfigMap{Data: map[string]string{"halt": "yes please"}}, true},
+	}
+	for _, test := range tests {
+		if halted := Halted(test.cm); halted != test.halted {
+			t.Errorf("%+v: expected %v, got %v", test.cm, test.halted, halted)
+		}
+	}
+}
+
+func TestNewWatcher(t *testing.T) {
+	for name, valid := range map[string]bool{"kube-system/kube-chaos-halt": true, "kube-chaos-halt": false, "/halt": false, "a/b/c": false} {
+		if _, err := NewWatcher(nil, name, nil); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", name, valid, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package multus finds the extra interfaces Multus attaches to pods, from the network status it
+// annotates them with.
+package multus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// NetworkStatusAnnotation holds the status of the pod's networks, set by Multus.
+	NetworkStatusAnnotation = "k8s.v1.cni.cncf.io/network-status"
+	// OldNetworkStatusAnnotation is the name older Multus versions set it under.
+	OldNetworkStatusAnnotation = "k8s.v1.cni.cncf.io/networks-status"
+)
+
+// NetworkStatus is the status of one network of a pod.
+type NetworkStatus struct {
+	// Name is the network-attachment, as namespace/name, or the name of the default network.
+	Name      string   `json:"name"`
+	Interface string   `json:"interface,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Default   bool     `json:"default,omitempty"`
+}
+
+// Statuses returns the status of the pod's networks, none if it has no annotation.
+func Statuses(annotations map[string]string) ([]NetworkStatus, error) {
+	data, found := annotations[NetworkStatusAnnotation]
+	if !found {
+		data, found = annotations[OldNetworkStatusAnnotation]
+	}
+	if !found {
+		return nil, nil
+	}
+	statuses := []NetworkStatus{}
+	if err := json.Unmarshal([]byte(data), &statuses); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", NetworkStatusAnnotation, err)
+	}
+	return statuses, nil
+}
+
+// Find returns the status of the pod's network whose interface is name, or whose
+// network-attachment is name, as namespace/name or as a name in the pod's namespace.
+func Find(statuses []NetworkStatus, namespace, name string) (*NetworkStatus, error) {
+	for i, s := range statuses {
+		if s.Interface == name || s.Name == name || s.Name == namespace+"/"+name {
+			return &statuses[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the pod has no interface or network-attachment %s", name)
+}
+
+// IPv4 returns the first IPv4 address of the network.
+func (s *NetworkStatus) IPv4() (string, error) {
+	for _, ip := range s.IPs {
+		if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil && parsed.To4() != nil {
+			return parsed.String(), nil
+		}
+	}
+	return "", fmt.Errorf("network %s has no IPv4 address", s.Name)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multus
+
+import "testing"
+
+const status = `[{
+    "name": "k8s-pod-network",
+    "interface": "eth0",
+    "ips": ["192.168.0.10"],
+    "default": true
+},{
+    "name": "telco/macvlan-conf",
+    "interface": "net1",
+    "ips": ["fd00::5", "10.1.1.5"]
+}]`
+
+func TestFind(t *testing.T) {
+	statuses, err := Statuses(map[string]string{OldNetworkStatusAnnotation: status})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		expectedIP string
+		expectErr  bool
+	}{
+		{"net1", "10.1.1.5", false},
+		{"macvlan-conf", "10.1.1.5", false},
+		{"telco/macvlan-conf", "10.1.1.5", false},
+		{"eth0", "192.168.0.10", false},
+		{"other/macvlan-conf", "", true},
+		{"net2", "", true},
+	}
+	for _, test := range tests {
+		s, err := Find(statuses, "telco", test.name)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, s.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if ip, err := s.IPv4(); err != nil || ip != test.expectedIP {
+			t.Errorf("%s: expected %s, got %q, %v", test.name, test.expectedIP, ip, err)
+		}
+	}
+
+	if statuses, err := Statuses(map[string]string{}); err != nil || len(statuses) != 0 {
+		t.Errorf("expected no statuses without the annotation, got %v, %v", statuses, err)
+	}
+	if _, err := Statuses(map[string]string{NetworkStatusAnnotation: "{"}); err == nil {
+		t.Errorf("expected an error for an invalid annotation")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package peers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+)
+
+// HostResolver looks up the addresses of a hostname, net.DefaultResolver is one.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Hosts resolves the hostnames chaos specs name, e.g. api.stripe.com, to their IPv4 addresses. The
+// addresses are kept across syncs and resolved again once they are older than the refresh period,
+// the resolver doesn't tell the TTLs of the records. It is safe for concurrent use.
+type Hosts struct {
+	resolver HostResolver
+	refresh  time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]hostEntry
+}
+
+type hostEntry struct {
+	ips      []string
+	resolved time.Time
+}
+
+// NewHosts returns Hosts resolving hostnames with resolver every refresh, each lookup bounded by
+// timeout.
+func NewHosts(resolver HostResolver, refresh, timeout time.Duration) *Hosts {
+	return &Hosts{
+		resolver: resolver,
+		refresh:  refresh,
+		timeout:  timeout,
+		now:      time.Now,
+		entries:  map[string]hostEntry{},
+	}
+}
+
+// Resolve returns a peer for each address of the hosts, with any port and protocol. A host that
+// fails to resolve again keeps its last addresses, so a flaky resolver doesn't lift the chaos.
+func (h *Hosts) Resolve(hosts []string) ([]flow.Peer, error) {
+	peers := []flow.Peer{}
+	for _, host := range hosts {
+		ips, err := h.lookup(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			peers = append(peers, flow.Peer{IP: ip})
+		}
+	}
+	return peers, nil
+}
+
+func (h *Hosts) lookup(host string) ([]string, error) {
+	h.lock.Lock()
+	entry, found := h.entries[host]
+	h.lock.Unlock()
+	if found && h.now().Sub(entry.resolved) < h.refresh {
+		return entry.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	addrs, err := h.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(ipv4s(addrs)) == 0 {
+		err = fmt.Errorf("no IPv4 address")
+	}
+	if err != nil {
+		if found {
+			glog.Warningf("Failed to resolve %s again, keeping %v: %v", host, entry.ips, err)
+			return entry.ips, nil
+		}
+		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	ips := ipv4s(addrs)
+	if found && fmt.Sprint(ips) != fmt.Sprint(entry.ips) {
+		glog.Infof("%s resolves to %v instead of %v", host, ips, entry.ips)
+	}
+	h.lock.Lock()
+	h.entries[host] = hostEntry{ips: ips, resolved: h.now()}
+	h.lock.Unlock()
+	return ips, nil
+}
+
+// ipv4s returns the IPv4 addresses, sorted.
+func ipv4s(addrs []net.IPAddr) []string {
+	ips := []string{}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
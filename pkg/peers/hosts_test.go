@@ -0,0 +1,89 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package peers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+)
+
+// fakeResolver is a local resolver stand-in, answering from a map and counting the lookups.
+type fakeResolver struct {
+	addrs   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	ips, found := r.addrs[host]
+	if !found {
+		return nil, fmt.Errorf("lookup %s: no such host", host)
+	}
+	addrs := []net.IPAddr{}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestHosts(t *testing.T) {
+	resolver := &fakeResolver{addrs: map[string][]string{"api.stripe.com": {"203.0.113.8", "2001:db8::1", "203.0.113.7"}}}
+	now := time.Unix(0, 0)
+	hosts := NewHosts(resolver, time.Minute, time.Second)
+	hosts.now = func() time.Time { return now }
+
+	resolve := func(expected ...string) {
+		t.Helper()
+		peers, err := hosts.Resolve([]string{"api.stripe.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []flow.Peer{}
+		for _, ip := range expected {
+			want = append(want, flow.Peer{IP: ip})
+		}
+		if !reflect.DeepEqual(peers, want) {
+			t.Errorf("expected %v, got %v", want, peers)
+		}
+	}
+	resolve("203.0.113.7", "203.0.113.8")
+
+	// the addresses are kept until they are older than the refresh period
+	resolver.addrs["api.stripe.com"] = []string{"203.0.113.9"}
+	now = now.Add(30 * time.Second)
+	resolve("203.0.113.7", "203.0.113.8")
+	if resolver.lookups != 1 {
+		t.Errorf("expected a single lookup, got %d", resolver.lookups)
+	}
+	now = now.Add(time.Minute)
+	resolve("203.0.113.9")
+
+	// a failed lookup keeps the last addresses
+	delete(resolver.addrs, "api.stripe.com")
+	now = now.Add(time.Minute)
+	resolve("203.0.113.9")
+
+	if _, err := hosts.Resolve([]string{"unknown.example.com"}); err == nil {
+		t.Errorf("expected an error for a host that never resolved")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package peers resolves the Services and the hostnames chaos specs name to the addresses their
+// traffic is sent to.
+package peers // import "github.com/huanwei/kube-chaos/pkg/peers"
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Resolver resolves Services against the api server. Lookups are cached for the life of the
+// resolver, so create one per sync, which keeps the peers up to date with the Endpoints. It is
+// safe for concurrent use.
+type Resolver struct {
+	client kubernetes.Interface
+
+	lock  sync.Mutex
+	cache map[string][]flow.Peer
+}
+
+// NewResolver returns a Resolver that looks Services up in the api server.
+func NewResolver(client kubernetes.Interface) *Resolver {
+	return &Resolver{client: client, cache: map[string][]flow.Peer{}}
+}
+
+// Resolve returns the peers of the Services, a Service named without a namespace is in namespace.
+func (r *Resolver) Resolve(namespace string, services []string) ([]flow.Peer, error) {
+	all := []flow.Peer{}
+	for _, service := range services {
+		if !strings.Contains(service, "/") {
+			service = namespace + "/" + service
+		}
+		peers, err := r.service(service)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, peers...)
+	}
+	return all, nil
+}
+
+func (r *Resolver) service(key string) ([]flow.Peer, error) {
+	r.lock.Lock()
+	peers, found := r.cache[key]
+	r.lock.Unlock()
+	if found {
+		return peers, nil
+	}
+	parts := strings.SplitN(key, "/", 2)
+	svc, err := r.client.CoreV1().Services(parts[0]).Get(parts[1], meta_v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Service %s: %v", key, err)
+	}
+	endpoints, err := r.client.CoreV1().Endpoints(parts[0]).Get(parts[1], meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		endpoints = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get the Endpoints of %s: %v", key, err)
+	}
+	peers = ServicePeers(svc, endpoints)
+	r.lock.Lock()
+	r.cache[key] = peers
+	r.lock.Unlock()
+	return peers, nil
+}
+
+// ServicePeers returns the peers of a Service: its ClusterIP on each of its ports, since traffic
+// leaves a pod addressed to it and kube-proxy only translates it afterwards, and the ready
+// addresses of its endpoints on theirs, which pods may call directly, e.g. through a headless
+// Service. endpoints is nil if the Service has none.
+func ServicePeers(svc *v1.Service, endpoints *v1.Endpoints) []flow.Peer {
+	peers := []flow.Peer{}
+	if ip := svc.Spec.ClusterIP; ip != "" && ip != v1.ClusterIPNone {
+		for _, port := range svc.Spec.Ports {
+			peers = append(peers, flow.Peer{IP: ip, Port: int(port.Port), Protocol: protocol(port.Protocol)})
+		}
+	}
+	if endpoints == nil {
+		return peers
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if len(subset.Ports) == 0 {
+				// a headless Service without ports, all the traffic to the address
+				peers = append(peers, flow.Peer{IP: address.IP})
+			}
+			for _, port := range subset.Ports {
+				peers = append(peers, flow.Peer{IP: address.IP, Port: int(port.Port), Protocol: protocol(port.Protocol)})
+			}
+		}
+	}
+	return peers
+}
+
+// protocol returns the protocol of a port as a Peer's, ports default to TCP.
+func protocol(p v1.Protocol) string {
+	if p == "" {
+		return "tcp"
+	}
+	return strings.ToLower(string(p))
+}
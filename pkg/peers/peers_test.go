@@ -0,0 +1,71 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package peers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+)
+
+func TestServicePeers(t *testing.T) {
+	svc := &v1.Service{Spec: v1.ServiceSpec{
+		ClusterIP: "10.96.0.10",
+		Ports:     []v1.ServicePort{{Port: 80}, {Port: 53, Protocol: v1.ProtocolUDP}},
+	}}
+	endpoints := &v1.Endpoints{Subsets: []v1.EndpointSubset{{
+		Addresses:         []v1.EndpointAddress{{IP: "192.168.0.10"}, {IP: "192.168.1.10"}},
+		NotReadyAddresses: []v1.EndpointAddress{{IP: "192.168.2.10"}},
+		Ports:             []v1.EndpointPort{{Port: 8080, Protocol: v1.ProtocolTCP}},
+	}}}
+	tests := []struct {
+		name      string
+		svc       *v1.Service
+		endpoints *v1.Endpoints
+		expected  []flow.Peer
+	}{
+		{
+			name:      "ClusterIP and endpoints",
+			svc:       svc,
+			endpoints: endpoints,
+			expected: []flow.Peer{
+				{IP: "10.96.0.10", Port: 80, Protocol: "tcp"},
+				{IP: "10.96.0.10", Port: 53, Protocol: "udp"},
+				{IP: "192.168.0.10", Port: 8080, Protocol: "tcp"},
+				{IP: "192.168.1.10", Port: 8080, Protocol: "tcp"},
+			},
+		},
+		{
+			name:     "no endpoints",
+			svc:      svc,
+			expected: []flow.Peer{{IP: "10.96.0.10", Port: 80, Protocol: "tcp"}, {IP: "10.96.0.10", Port: 53, Protocol: "udp"}},
+		},
+		{
+			name:      "headless without ports",
+			svc:       &v1.Service{Spec: v1.ServiceSpec{ClusterIP: v1.ClusterIPNone}},
+			endpoints: &v1.Endpoints{Subsets: []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "192.168.0.10"}}}}},
+			expected:  []flow.Peer{{IP: "192.168.0.10"}},
+		},
+	}
+	for _, test := range tests {
+		if got := ServicePeers(test.svc, test.endpoints); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package record records kube-chaos decisions as Kubernetes events.
+package record // import "github.com/huanwei/kube-chaos/pkg/record"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// EventRecorder creates events in the api server. The sync loop makes the same decision about an
+// object every few seconds, so an event is only created the first time a reason is seen for an object.
+type EventRecorder struct {
+	client kubernetes.Interface
+	source v1.EventSource
+
+	lock     sync.Mutex
+	recorded map[eventKey]bool
+}
+
+// eventKey is an object and a reason an event was recorded for.
+type eventKey struct {
+	kind, namespace, name string
+	uid                   types.UID
+	reason                string
+}
+
+func keyOf(ref *v1.ObjectReference, reason string) eventKey {
+	return eventKey{kind: ref.Kind, namespace: ref.Namespace, name: ref.Name, uid: ref.UID, reason: reason}
+}
+
+func NewEventRecorder(client kubernetes.Interface, component, host string) *EventRecorder {
+	return &EventRecorder{
+		client:   client,
+		source:   v1.EventSource{Component: component, Host: host},
+		recorded: map[eventKey]bool{},
+	}
+}
+
+// Eventf records an event about obj. It returns false if the same reason has already been
+// recorded for obj, in which case no new event is created.
+func (r *EventRecorder) Eventf(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) bool {
+	ref, err := getReference(obj)
+	if err != nil {
+		glog.Errorf("Could not construct reference to %#v: %v", obj, err)
+		return false
+	}
+	key := keyOf(ref, reason)
+	r.lock.Lock()
+	if r.recorded[key] {
+		r.lock.Unlock()
+		return false
+	}
+	r.recorded[key] = true
+	r.lock.Unlock()
+
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = meta_v1.NamespaceDefault
+	}
+	now := meta_v1.Now()
+	event := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", ref.Name, time.Now().UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Source:         r.source,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventtype,
+	}
+	if _, err := r.client.CoreV1().Events(namespace).Create(event); err != nil {
+		glog.Errorf("Failed to record event %s for %s/%s: %v", reason, ref.Namespace, ref.Name, err)
+	}
+	return true
+}
+
+// Forget lets the next Event with reason about obj be recorded again.
+func (r *EventRecorder) Forget(obj runtime.Object, reason string) {
+	ref, err := getReference(obj)
+	if err != nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.recorded, keyOf(ref, reason))
+}
+
+// Retain forgets the events recorded for the objects of a kind whose uids aren't in uids, e.g. pods
+// that no longer exist, so the recorded events don't grow with every pod ever seen.
+func (r *EventRecorder) Retain(kind string, uids sets.String) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key := range r.recorded {
+		if key.kind == kind && !uids.Has(string(key.uid)) {
+			delete(r.recorded, key)
+		}
+	}
+}
+
+// getReference builds a reference to obj. Unlike reference.GetReference it takes the api version
+// from the scheme, objects returned by List don't carry their TypeMeta or a selfLink.
+func getReference(obj runtime.Object) (*v1.ObjectReference, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	if gvk.Kind == "" {
+		gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+		if err != nil {
+			return nil, err
+		}
+		gvk = gvks[0]
+	}
+	return &v1.ObjectReference{
+		Kind:            gvk.Kind,
+		APIVersion:      gvk.GroupVersion().String(),
+		Name:            accessor.GetName(),
+		Namespace:       accessor.GetNamespace(),
+		UID:             accessor.GetUID(),
+		ResourceVersion: accessor.GetResourceVersion(),
+	}, nil
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+)
+
+func TestRetain(t *testing.T) {
+	r := NewEventRecorder(nil, "kube-chaos", "node-1")
+	keys := []eventKey{
+		{kind: "Pod", namespace: "default", name: "web-1", uid: "uid-1", reason: "ChaosRefused"},
+		{kind: "Pod", namespace: "default", name: "web-2", uid: "uid-2", reason: "ChaosRefused"},
+		{kind: "Pod", namespace: "default", name: "web-2", uid: "uid-2", reason: "ChaosInvalidSpec"},
+		{kind: "ConfigMap", namespace: "kube-system", name: "kube-chaos-halt", uid: "uid-3", reason: "ChaosHalted"},
+	}
+	for _, key := range keys {
+		r.recorded[key] = true
+	}
+	r.Retain("Pod", sets.NewString("uid-2"))
+	for i, expected := range []bool{false, true, true, true} {
+		if r.recorded[keys[i]] != expected {
+			t.Errorf("%v: expected recorded %v, got %v", keys[i], expected, r.recorded[keys[i]])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package report publishes the chaos state the agent reached for each pod on the pod itself.
+package report // import "github.com/huanwei/kube-chaos/pkg/report"
+
+import (
+	"encoding/json"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// StateAnnotation holds the JSON encoded State of a pod.
+	StateAnnotation = "chaos.kube-chaos/state"
+	// NodeLabel names the node whose agent reported the state, so it can find its reports again.
+	NodeLabel = "chaos.kube-chaos/reported-by"
+)
+
+// Phases of a pod's chaos.
+const (
+	PhaseApplied = "Applied"
+	PhaseFailed  = "Failed"
+	PhaseRefused = "Refused"
+	PhaseSkipped = "Skipped"
+	PhaseInvalid = "Invalid"
+)
+
+// State is the chaos state of a pod, as reported by the agent of its node.
+type State struct {
+	Node    string       `json:"node"`
+	Phase   string       `json:"phase"`
+	Egress  string       `json:"egress,omitempty"`
+	Ingress string       `json:"ingress,omitempty"`
+	Source  string       `json:"source,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Time    meta_v1.Time `json:"time"`
+}
+
+// GetState decodes the state reported on a pod, or returns nil if there is none.
+func GetState(pod *v1.Pod) *State {
+	data, found := pod.Annotations[StateAnnotation]
+	if !found {
+		return nil
+	}
+	state := &State{}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil
+	}
+	return state
+}
+
+// Reporter writes the state of the pods on one node. Pods are only patched when their state changes.
+type Reporter struct {
+	client kubernetes.Interface
+	node   string
+}
+
+// NewReporter returns a Reporter for the node, it does nothing if node is empty.
+func NewReporter(client kubernetes.Interface, node string) *Reporter {
+	if node == "" {
+		glog.Warningf("No node name given, chaos state won't be reported on pods")
+	}
+	return &Reporter{client: client, node: node}
+}
+
+// Report records the state of a pod, if it runs on the reporter's node.
+func (r *Reporter) Report(pod *v1.Pod, state State) {
+	if r.node == "" || pod.Spec.NodeName != r.node {
+		return
+	}
+	state.Node = r.node
+	if old := GetState(pod); old != nil {
+		state.Time = old.Time
+		if *old == state {
+			return
+		}
+	}
+	state.Time = meta_v1.Now()
+	data, err := json.Marshal(state)
+	if err != nil {
+		glog.Errorf("Failed to encode chaos state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	value := string(data)
+	if err := r.patch(pod, &r.node, &value); err != nil {
+		glog.Errorf("Failed to report chaos state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// Prune removes the state of the pods on the reporter's node that aren't in active, a set of pod
+// UIDs, because they are no longer under chaos.
+func (r *Reporter) Prune(active sets.String) {
+	if r.node == "" {
+		return
+	}
+	pods, err := r.client.CoreV1().Pods(meta_v1.NamespaceAll).List(meta_v1.ListOptions{LabelSelector: NodeLabel + "=" + r.node})
+	if err != nil {
+		glog.Errorf("Failed list pods with reported chaos state: %v", err)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if active.Has(string(pod.UID)) {
+			continue
+		}
+		if err := r.patch(pod, nil, nil); err != nil {
+			glog.Errorf("Failed to remove chaos state of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+}
+
+// patch sets the node label and state annotation of a pod, nil values remove them.
+func (r *Reporter) patch(pod *v1.Pod, node, state *string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]*string{NodeLabel: node},
+			"annotations": map[string]*string{StateAnnotation: state},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, data)
+	return err
+}
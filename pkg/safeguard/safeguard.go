@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package safeguard decides which pods kube-chaos must never touch.
+package safeguard // import "github.com/huanwei/kube-chaos/pkg/safeguard"
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+)
+
+// ProtectedLabel opts a pod out of chaos when set to "true".
+const ProtectedLabel = "chaos.kube-chaos/protected"
+
+// CriticalNamespaces are denied regardless of the configured allow list.
+var CriticalNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// Reasons a pod is refused, also used as event reasons.
+const (
+	ReasonNamespaceNotAllowed = "ChaosNamespaceNotAllowed"
+	ReasonNamespaceDenied     = "ChaosNamespaceDenied"
+	ReasonProtected           = "ChaosProtectedPod"
+	ReasonSelf                = "ChaosSelfPod"
+	ReasonHostNetwork         = "ChaosHostNetworkPod"
+)
+
+// Refusal explains why a pod must not be shaped.
+type Refusal struct {
+	Reason  string
+	Message string
+}
+
+// Policy holds the namespace allow and deny lists, and the identity of the agent's own pod.
+type Policy struct {
+	// allowed namespaces, empty means every namespace that isn't denied
+	allowed sets.String
+	denied  sets.String
+
+	selfNamespace string
+	selfName      string
+}
+
+// NewPolicy returns a Policy. The critical namespaces are always added to the deny list.
+func NewPolicy(allowed, denied []string, selfNamespace, selfName string) *Policy {
+	p := &Policy{
+		allowed:       sets.NewString(),
+		denied:        sets.NewString(CriticalNamespaces...),
+		selfNamespace: selfNamespace,
+		selfName:      selfName,
+	}
+	for _, ns := range allowed {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			p.allowed.Insert(ns)
+		}
+	}
+	for _, ns := range denied {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			p.denied.Insert(ns)
+		}
+	}
+	return p
+}
+
+// NamespaceAllowed reports whether chaos may be applied in the namespace, and if not, why.
+func (p *Policy) NamespaceAllowed(namespace string) *Refusal {
+	if p.denied.Has(namespace) {
+		return &Refusal{
+			Reason:  ReasonNamespaceDenied,
+			Message: fmt.Sprintf("namespace %s is on the chaos deny list", namespace),
+		}
+	}
+	if p.allowed.Len() > 0 && !p.allowed.Has(namespace) {
+		return &Refusal{
+			Reason:  ReasonNamespaceNotAllowed,
+			Message: fmt.Sprintf("namespace %s is not on the chaos allow list", namespace),
+		}
+	}
+	return nil
+}
+
+// Check returns nil if chaos may be applied to the pod, or the reason it must be left alone.
+func (p *Policy) Check(pod *v1.Pod) *Refusal {
+	if pod.Namespace == p.selfNamespace && pod.Name == p.selfName {
+		return &Refusal{
+			Reason:  ReasonSelf,
+			Message: "refusing to apply chaos to the kube-chaos agent itself",
+		}
+	}
+	if pod.Spec.HostNetwork {
+		return &Refusal{
+			Reason:  ReasonHostNetwork,
+			Message: "refusing to apply chaos to a hostNetwork pod, it would shape the node's own traffic",
+		}
+	}
+	if refusal := p.NamespaceAllowed(pod.Namespace); refusal != nil {
+		return refusal
+	}
+	if pod.Labels[ProtectedLabel] == "true" {
+		return &Refusal{
+			Reason:  ReasonProtected,
+			Message: fmt.Sprintf("pod is labelled %s=true", ProtectedLabel),
+		}
+	}
+	return nil
+}
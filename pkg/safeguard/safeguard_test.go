@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package safeguard
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPod(namespace, name string, labels map[string]string, hostNetwork bool) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec:       v1.PodSpec{HostNetwork: hostNetwork},
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		pod     *v1.Pod
+		reason  string
+	}{
+		{
+			name: "plain pod",
+			pod:  newPod("default", "web-1", nil, false),
+		},
+		{
+			name:   "critical namespace",
+			pod:    newPod("kube-system", "calico-node-x", nil, false),
+			reason: ReasonNamespaceDenied,
+		},
+		{
+			name:    "critical namespace can't be allowed",
+			allowed: []string{"kube-system"},
+			pod:     newPod("kube-system", "kube-dns-1", nil, false),
+			reason:  ReasonNamespaceDenied,
+		},
+		{
+			name:   "configured deny list",
+			denied: []string{"prod", " "},
+			pod:    newPod("prod", "web-1", nil, false),
+			reason: ReasonNamespaceDenied,
+		},
+		{
+			name:    "not on the allow list",
+			allowed: []string{"staging"},
+			pod:     newPod("default", "web-1", nil, false),
+			reason:  ReasonNamespaceNotAllowed,
+		},
+		{
+			name:    "on the allow list",
+			allowed: []string{"staging"},
+			pod:     newPod("staging", "web-1", nil, false),
+		},
+		{
+			name:   "protected label",
+			pod:    newPod("default", "db-0", map[string]string{ProtectedLabel: "true"}, false),
+			reason: ReasonProtected,
+		},
+		{
+			name: "protected label not true",
+			pod:  newPod("default", "db-0", map[string]string{ProtectedLabel: "false"}, false),
+		},
+		{
+			name:   "host network",
+			pod:    newPod("default", "node-exporter-1", nil, true),
+			reason: ReasonHostNetwork,
+		},
+		{
+			name:   "agent itself",
+			pod:    newPod("chaos", "kube-chaos-abcde", nil, false),
+			reason: ReasonSelf,
+		},
+	}
+	for _, test := range tests {
+		p := NewPolicy(test.allowed, test.denied, "chaos", "kube-chaos-abcde")
+		refusal := p.Check(test.pod)
+		if test.reason == "" {
+			if refusal != nil {
+				t.Errorf("%s: expected pod to be allowed, got %v", test.name, refusal)
+			}
+			continue
+		}
+		if refusal == nil {
+			t.Errorf("%s: expected refusal %s, pod was allowed", test.name, test.reason)
+			continue
+		}
+		if refusal.Reason != test.reason {
+			t.Errorf("%s: expected refusal %s, got %s", test.name, test.reason, refusal.Reason)
+		}
+	}
+}
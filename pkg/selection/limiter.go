@@ -0,0 +1,151 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package selection decides which of the pods matching a chaos selector are affected.
+package selection // import "github.com/huanwei/kube-chaos/pkg/selection"
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ReasonLimited is the event reason for pods left out by the blast radius limit.
+const ReasonLimited = "ChaosBlastRadiusLimited"
+
+// Skipped is a pod that was left out of a selection, and why.
+type Skipped struct {
+	Pod    v1.Pod
+	Reason string
+}
+
+// ParseMax parses a blast radius limit, either a number of pods ("3") or a percentage of the
+// workload's replicas ("30%"). An empty string means no limit and returns nil.
+func ParseMax(s string) (*intstr.IntOrString, error) {
+	if s == "" {
+		return nil, nil
+	}
+	max := intstr.Parse(s)
+	if err := ValidateMax(&max); err != nil {
+		return nil, err
+	}
+	return &max, nil
+}
+
+// ValidateMax checks a blast radius limit is a non-negative count or a percentage between 0 and 100.
+func ValidateMax(max *intstr.IntOrString) error {
+	if max == nil {
+		return nil
+	}
+	if max.Type == intstr.Int {
+		if max.IntVal < 0 {
+			return fmt.Errorf("invalid blast radius limit %d: must not be negative", max.IntVal)
+		}
+		return nil
+	}
+	if !strings.HasSuffix(max.StrVal, "%") {
+		return fmt.Errorf("invalid blast radius limit %q: must be a number or a percentage", max.StrVal)
+	}
+	v, err := strconv.Atoi(strings.TrimSuffix(max.StrVal, "%"))
+	if err != nil || v < 0 || v > 100 {
+		return fmt.Errorf("invalid blast radius limit %q: must be a percentage between 0%% and 100%%", max.StrVal)
+	}
+	return nil
+}
+
+// Limiter caps how many pods of each Deployment, StatefulSet or ReplicaSet are selected.
+type Limiter struct {
+	max      *intstr.IntOrString
+	resolver workload.Resolver
+}
+
+// NewLimiter returns a Limiter, a nil max doesn't limit anything.
+func NewLimiter(max *intstr.IntOrString, resolver workload.Resolver) *Limiter {
+	return &Limiter{max: max, resolver: resolver}
+}
+
+// Limit splits pods into the ones chaos may be applied to and the ones over their workload's limit.
+// Pods of a workload are ranked by name and the first ones are kept, so every agent and every sync
+// makes the same choice. Pods whose owner can't be resolved are skipped, better no chaos than an
+// unbounded one.
+func (l *Limiter) Limit(pods []v1.Pod) (selected []v1.Pod, skipped []Skipped) {
+	if l.max == nil {
+		return pods, nil
+	}
+	owners := make([]*workload.Workload, len(pods))
+	failures := make([]error, len(pods))
+	members := map[workload.Ref][]string{}
+	for i := range pods {
+		w, err := l.resolver.Owner(&pods[i])
+		if err != nil {
+			failures[i] = err
+			continue
+		}
+		if w != nil {
+			owners[i] = w
+			members[w.Ref] = append(members[w.Ref], pods[i].Name)
+		}
+	}
+
+	allowed := sets.String{}
+	for _, w := range owners {
+		if w == nil {
+			continue
+		}
+		names, found := members[w.Ref]
+		if !found {
+			continue
+		}
+		delete(members, w.Ref)
+		n := l.limitOf(w)
+		sort.Strings(names)
+		for j := 0; j < n && j < len(names); j++ {
+			allowed.Insert(w.Namespace + "/" + names[j])
+		}
+	}
+
+	for i := range pods {
+		switch {
+		case failures[i] != nil:
+			skipped = append(skipped, Skipped{Pod: pods[i], Reason: fmt.Sprintf("failed to resolve owner: %v", failures[i])})
+		case owners[i] == nil || allowed.Has(pods[i].Namespace+"/"+pods[i].Name):
+			selected = append(selected, pods[i])
+		default:
+			reason := fmt.Sprintf("blast radius limit of %s pods reached for %s", l.max.String(), owners[i])
+			if l.max.Type == intstr.String {
+				reason = fmt.Sprintf("blast radius limit of %s of %d replicas, %d pods, reached for %s", l.max.StrVal, owners[i].Replicas, l.limitOf(owners[i]), owners[i])
+			}
+			skipped = append(skipped, Skipped{Pod: pods[i], Reason: reason})
+		}
+	}
+	return selected, skipped
+}
+
+// limitOf returns how many pods of a workload may be selected. A percentage rounds up, so any
+// non-zero percentage allows at least a pod, e.g. 30% of 3 replicas is 1 pod rather than none.
+func (l *Limiter) limitOf(w *workload.Workload) int {
+	n, err := intstr.GetValueFromIntOrPercent(l.max, w.Replicas, true)
+	if err != nil {
+		return 0
+	}
+	return n
+}
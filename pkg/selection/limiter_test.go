@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selection
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// fakeResolver maps pod names to workloads.
+type fakeResolver map[string]*workload.Workload
+
+func (f fakeResolver) Owner(pod *v1.Pod) (*workload.Workload, error) {
+	if pod.Name == "broken" {
+		return nil, fmt.Errorf("owner lookup failed")
+	}
+	return f[pod.Name], nil
+}
+
+func podNames(pods []v1.Pod) []string {
+	names := []string{}
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	return names
+}
+
+func TestLimit(t *testing.T) {
+	web := &workload.Workload{Ref: workload.Ref{Kind: "Deployment", Namespace: "default", Name: "web"}, Replicas: 4}
+	db := &workload.Workload{Ref: workload.Ref{Kind: "StatefulSet", Namespace: "default", Name: "db"}, Replicas: 3}
+	resolver := fakeResolver{
+		"web-d": web, "web-b": web, "web-a": web, "web-c": web,
+		"db-0": db, "db-1": db, "db-2": db,
+	}
+	pods := []v1.Pod{}
+	for _, name := range []string{"web-d", "db-2", "web-b", "bare", "web-a", "db-0", "broken", "web-c", "db-1"} {
+		pods = append(pods, v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: name}})
+	}
+
+	tests := []struct {
+		max      string
+		selected []string
+		skipped  []string
+	}{
+		{
+			max:      "",
+			selected: []string{"web-d", "db-2", "web-b", "bare", "web-a", "db-0", "broken", "web-c", "db-1"},
+		},
+		{
+			max:      "1",
+			selected: []string{"bare", "web-a", "db-0"},
+			skipped:  []string{"web-d", "db-2", "web-b", "broken", "web-c", "db-1"},
+		},
+		{
+			max:      "50%",
+			selected: []string{"web-b", "bare", "web-a", "db-0", "db-1"},
+			skipped:  []string{"web-d", "db-2", "broken", "web-c"},
+		},
+		{
+			// percentages round up, 30% of 3 replicas is a pod
+			max:      "30%",
+			selected: []string{"web-b", "bare", "web-a", "db-0"},
+			skipped:  []string{"web-d", "db-2", "broken", "web-c", "db-1"},
+		},
+		{
+			max:      "1%",
+			selected: []string{"bare", "web-a", "db-0"},
+			skipped:  []string{"web-d", "db-2", "web-b", "broken", "web-c", "db-1"},
+		},
+		{
+			max:      "0%",
+			selected: []string{"bare"},
+			skipped:  []string{"web-d", "db-2", "web-b", "web-a", "db-0", "broken", "web-c", "db-1"},
+		},
+		{
+			max:      "0",
+			selected: []string{"bare"},
+			skipped:  []string{"web-d", "db-2", "web-b", "web-a", "db-0", "broken", "web-c", "db-1"},
+		},
+	}
+	for _, test := range tests {
+		max, err := ParseMax(test.max)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", test.max, err)
+		}
+		selected, skipped := NewLimiter(max, resolver).Limit(pods)
+		if !reflect.DeepEqual(podNames(selected), test.selected) {
+			t.Errorf("max %q: expected selected %v, got %v", test.max, test.selected, podNames(selected))
+		}
+		skippedNames := []string{}
+		for _, s := range skipped {
+			skippedNames = append(skippedNames, s.Pod.Name)
+		}
+		if test.skipped == nil {
+			test.skipped = []string{}
+		}
+		if !reflect.DeepEqual(skippedNames, test.skipped) {
+			t.Errorf("max %q: expected skipped %v, got %v", test.max, test.skipped, skippedNames)
+		}
+	}
+}
+
+func TestParseMax(t *testing.T) {
+	for _, valid := range []string{"", "0", "3", "0%", "30%", "100%"} {
+		if _, err := ParseMax(valid); err != nil {
+			t.Errorf("expected %q to be valid, got %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"-1", "101%", "abc", "3.5%"} {
+		if _, err := ParseMax(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+	if max, _ := ParseMax("5"); max.Type != intstr.Int || max.IntVal != 5 {
+		t.Errorf("expected 5 to parse as an int, got %v", max)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+)
+
+// ValidateSelection checks the mode and value of a selection, nil selects all pods.
+func ValidateSelection(sel *v1alpha1.Selection) error {
+	if sel == nil {
+		return nil
+	}
+	switch sel.Mode {
+	case v1alpha1.SelectAll, v1alpha1.SelectOnePerNode:
+	case v1alpha1.SelectCount:
+		if sel.Value < 0 {
+			return fmt.Errorf("invalid selection value %d: must not be negative", sel.Value)
+		}
+	case v1alpha1.SelectPercent:
+		if sel.Value < 0 || sel.Value > 100 {
+			return fmt.Errorf("invalid selection value %d: must be a percentage between 0 and 100", sel.Value)
+		}
+	default:
+		return fmt.Errorf("unknown selection mode %q", sel.Mode)
+	}
+	return nil
+}
+
+// score ranks a pod for an experiment. It only depends on the seed, the experiment and the pod
+// UID, so the same experiment rerun with the same seed ranks pods the same way.
+func score(seed int64, experimentID string, pod *v1.Pod) uint64 {
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(seed))
+	h.Write(b)
+	h.Write([]byte(experimentID))
+	h.Write([]byte{0})
+	h.Write([]byte(pod.UID))
+	return h.Sum64()
+}
+
+type rankedPod struct {
+	pod      *v1.Pod
+	score    uint64
+	previous bool
+}
+
+// rank orders pods so that the previously chosen ones come first, then by score.
+func rank(seed int64, experimentID string, pods []*v1.Pod, previous sets.String) []rankedPod {
+	ranked := make([]rankedPod, 0, len(pods))
+	for _, pod := range pods {
+		ranked = append(ranked, rankedPod{pod: pod, score: score(seed, experimentID, pod), previous: previous.Has(pod.Name)})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].previous != ranked[j].previous {
+			return ranked[i].previous
+		}
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score < ranked[j].score
+		}
+		return ranked[i].pod.Name < ranked[j].pod.Name
+	})
+	return ranked
+}
+
+// Select chooses the pods of an experiment. previous holds the names of the pods chosen by the last
+// sync, they are kept while they still match so that the chosen set doesn't move between syncs when
+// pods come and go. The order of pods is kept in the result.
+func Select(sel *v1alpha1.Selection, experimentID string, pods []v1.Pod, previous sets.String) (selected []v1.Pod, skipped []Skipped) {
+	if sel == nil || sel.Mode == v1alpha1.SelectAll {
+		return pods, nil
+	}
+	chosen := sets.String{}
+	switch sel.Mode {
+	case v1alpha1.SelectCount, v1alpha1.SelectPercent:
+		n := int(sel.Value)
+		if sel.Mode == v1alpha1.SelectPercent {
+			// rounded up like the blast radius limit, a non-zero percentage targets a pod at least
+			n = (len(pods)*int(sel.Value) + 99) / 100
+		}
+		all := make([]*v1.Pod, len(pods))
+		for i := range pods {
+			all[i] = &pods[i]
+		}
+		for i, r := range rank(sel.Seed, experimentID, all, previous) {
+			if i >= n {
+				break
+			}
+			chosen.Insert(r.pod.Name)
+		}
+	case v1alpha1.SelectOnePerNode:
+		nodes := map[string][]*v1.Pod{}
+		for i := range pods {
+			if node := pods[i].Spec.NodeName; node != "" {
+				nodes[node] = append(nodes[node], &pods[i])
+			}
+		}
+		for _, nodePods := range nodes {
+			chosen.Insert(rank(sel.Seed, experimentID, nodePods, previous)[0].pod.Name)
+		}
+	}
+
+	for _, pod := range pods {
+		if chosen.Has(pod.Name) {
+			selected = append(selected, pod)
+		} else {
+			skipped = append(skipped, Skipped{Pod: pod, Reason: fmt.Sprintf("not chosen by the %s selection", sel.Mode)})
+		}
+	}
+	return selected, skipped
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selection
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newPods(n int, nodes int) []v1.Pod {
+	pods := []v1.Pod{}
+	for i := 0; i < n; i++ {
+		pods = append(pods, v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace: "default",
+				Name:      fmt.Sprintf("web-%d", i),
+				UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+			},
+			Spec: v1.PodSpec{NodeName: fmt.Sprintf("node-%d", i%nodes)},
+		})
+	}
+	return pods
+}
+
+func sortedNames(pods []v1.Pod) []string {
+	names := podNames(pods)
+	sort.Strings(names)
+	return names
+}
+
+func TestSelectCount(t *testing.T) {
+	pods := newPods(10, 3)
+	sel := &v1alpha1.Selection{Mode: v1alpha1.SelectCount, Value: 3, Seed: 42}
+
+	selected, skipped := Select(sel, "default/latency", pods, sets.String{})
+	if len(selected) != 3 || len(skipped) != 7 {
+		t.Fatalf("expected 3 selected and 7 skipped pods, got %d and %d", len(selected), len(skipped))
+	}
+	again, _ := Select(sel, "default/latency", pods, sets.String{})
+	if !reflect.DeepEqual(sortedNames(selected), sortedNames(again)) {
+		t.Errorf("expected the same seed to choose the same pods, got %v and %v", podNames(selected), podNames(again))
+	}
+
+	differs := false
+	for seed := int64(0); seed < 10 && !differs; seed++ {
+		other, _ := Select(&v1alpha1.Selection{Mode: v1alpha1.SelectCount, Value: 3, Seed: seed}, "default/latency", pods, sets.String{})
+		differs = !reflect.DeepEqual(sortedNames(selected), sortedNames(other))
+	}
+	if !differs {
+		t.Errorf("expected other seeds to choose other pods")
+	}
+
+	// new pods don't displace the pods chosen by the last sync
+	previous := sets.NewString(sortedNames(selected)...)
+	grown := append(newPods(10, 3), newPods(30, 3)[10:]...)
+	stable, _ := Select(sel, "default/latency", grown, previous)
+	if !reflect.DeepEqual(sortedNames(stable), previous.List()) {
+		t.Errorf("expected the chosen pods to stay %v, got %v", previous.List(), sortedNames(stable))
+	}
+}
+
+func TestSelectPercent(t *testing.T) {
+	for _, test := range []struct {
+		pods     int
+		percent  int32
+		expected int
+	}{
+		{10, 0, 0},
+		{10, 30, 3},
+		{10, 35, 4},
+		{10, 100, 10},
+		{3, 30, 1},
+		{3, 1, 1},
+		{3, 34, 2},
+		{1, 50, 1},
+		{0, 50, 0},
+	} {
+		pods := newPods(test.pods, 3)
+		selected, _ := Select(&v1alpha1.Selection{Mode: v1alpha1.SelectPercent, Value: test.percent}, "default/loss", pods, sets.String{})
+		if len(selected) != test.expected {
+			t.Errorf("%d%% of %d pods: expected %d pods, got %d", test.percent, test.pods, test.expected, len(selected))
+		}
+	}
+}
+
+func TestSelectOnePerNode(t *testing.T) {
+	pods := newPods(10, 3)
+	pods[9].Spec.NodeName = ""
+	selected, _ := Select(&v1alpha1.Selection{Mode: v1alpha1.SelectOnePerNode, Seed: 7}, "default/loss", pods, sets.String{})
+	nodes := sets.String{}
+	for _, pod := range selected {
+		if nodes.Has(pod.Spec.NodeName) {
+			t.Errorf("expected one pod per node, got a second pod on %s", pod.Spec.NodeName)
+		}
+		nodes.Insert(pod.Spec.NodeName)
+	}
+	if nodes.Len() != 3 {
+		t.Errorf("expected a pod on each of the 3 nodes, got %v", nodes.List())
+	}
+}
+
+func TestSelectAll(t *testing.T) {
+	pods := newPods(4, 2)
+	for _, sel := range []*v1alpha1.Selection{nil, {Mode: v1alpha1.SelectAll}} {
+		selected, skipped := Select(sel, "default/all", pods, sets.String{})
+		if len(selected) != 4 || len(skipped) != 0 {
+			t.Errorf("expected all pods to be selected, got %v", podNames(selected))
+		}
+	}
+}
+
+func TestValidateSelection(t *testing.T) {
+	for _, valid := range []*v1alpha1.Selection{
+		nil,
+		{Mode: v1alpha1.SelectAll},
+		{Mode: v1alpha1.SelectCount, Value: 3},
+		{Mode: v1alpha1.SelectPercent, Value: 30},
+		{Mode: v1alpha1.SelectOnePerNode},
+	} {
+		if err := ValidateSelection(valid); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", valid, err)
+		}
+	}
+	for _, invalid := range []*v1alpha1.Selection{
+		{Mode: "Random"},
+		{Mode: v1alpha1.SelectCount, Value: -1},
+		{Mode: v1alpha1.SelectPercent, Value: 101},
+	} {
+		if err := ValidateSelection(invalid); err == nil {
+			t.Errorf("expected %+v to be invalid", invalid)
+		}
+	}
+}
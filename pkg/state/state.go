@@ -0,0 +1,216 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package state keeps the agent's record of the tc classes it created on disk, so a restarted
+// agent knows which classes belong to which pod and which ones it was in the middle of creating.
+package state // import "github.com/huanwei/kube-chaos/pkg/state"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// version of the state file format.
+const version = 1
+
+// Owner is the pod a class was created for, and where its chaos came from.
+type Owner struct {
+	UID       string `json:"uid,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// Source says where the chaos came from, e.g. "annotation", "Experiment/name" or
+	// "agent API".
+	Source string `json:"source,omitempty"`
+}
+
+// Record is a class the agent created for the traffic of a CIDR in one direction.
+type Record struct {
+	Owner
+	CIDR string `json:"cidr"`
+	// Direction is egress, shaped on ifb0, or ingress, shaped on ifb1.
+	Direction string `json:"direction"`
+	Class     string `json:"class"`
+	// Handle is the handle of the filter matching the CIDR, it is empty while the class is being
+	// created.
+	Handle string `json:"handle,omitempty"`
+	// SpecHash is the Hash of the chaos spec applied to the class.
+	SpecHash string `json:"specHash,omitempty"`
+	// Since is when the spec was first applied, in Unix seconds, chaos varying with time follows
+	// it across restarts.
+	Since int64 `json:"since,omitempty"`
+}
+
+type file struct {
+	Version int      `json:"version"`
+	Records []Record `json:"records"`
+}
+
+// Store holds the records, and writes them to its file on every change.
+type Store struct {
+	path    string
+	lock    sync.Mutex
+	records map[string]Record
+	// loaded is true if the records were loaded from an existing file
+	loaded bool
+}
+
+func key(direction, cidr string) string {
+	return direction + "/" + cidr
+}
+
+// Open loads the records of the file at path, a missing file has none. A file that can't be
+// decoded is moved aside to path.corrupt, and the store starts without records.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, records: map[string]Record{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := file{}
+	if err := json.Unmarshal(data, &f); err != nil || f.Version != version {
+		glog.Errorf("Failed to decode state file %s (version %d): %v, moving it aside", path, f.Version, err)
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	for _, r := range f.Records {
+		s.records[key(r.Direction, r.CIDR)] = r
+	}
+	s.loaded = true
+	return s, nil
+}
+
+// Loaded reports whether the records were loaded from an existing file. If not, the agent never
+// recorded its classes on this node, or lost its records.
+func (s *Store) Loaded() bool {
+	return s.loaded
+}
+
+// Get returns the record of a CIDR's class in a direction.
+func (s *Store) Get(direction, cidr string) (Record, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, found := s.records[key(direction, cidr)]
+	return r, found
+}
+
+// Records returns all the records, sorted by direction and CIDR.
+func (s *Store) Records() []Record {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.list()
+}
+
+func (s *Store) list() []Record {
+	result := []Record{}
+	for _, r := range s.records {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return key(result[i].Direction, result[i].CIDR) < key(result[j].Direction, result[j].CIDR)
+	})
+	return result
+}
+
+// Set adds or replaces a record and writes the file.
+func (s *Store) Set(r Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records[key(r.Direction, r.CIDR)] = r
+	return s.save()
+}
+
+// Delete removes a record and writes the file.
+func (s *Store) Delete(direction, cidr string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	k := key(direction, cidr)
+	if _, found := s.records[k]; !found {
+		return nil
+	}
+	delete(s.records, k)
+	return s.save()
+}
+
+// DeleteAll removes all the records and writes the file.
+func (s *Store) DeleteAll() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records = map[string]Record{}
+	return s.save()
+}
+
+// save writes the records to a temporary file next to the store's and renames it over it, so a
+// crash leaves either the old or the new file, never a partial one.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(file{Version: version, Records: s.list()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Hash returns a short hash of a chaos spec, to tell whether a class applies it already.
+func Hash(spec string) string {
+	sum := sha256.Sum256([]byte(spec))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s %s class %s", r.Direction, r.CIDR, r.Class)
+}
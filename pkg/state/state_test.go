@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "state.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Records()) != 0 {
+		t.Errorf("expected no records without a file, got %v", s.Records())
+	}
+	egress := Record{Owner: Owner{UID: "uid-1", Namespace: "default", Name: "web-0"}, CIDR: "192.168.0.10/32", Direction: "egress", Class: "1:2", Handle: "800::800", SpecHash: Hash("delay=100ms")}
+	ingress := Record{CIDR: "192.168.0.10/32", Direction: "ingress", Class: "1:2"}
+	if err := s.Set(egress); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ingress); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Record{egress, ingress}; !reflect.DeepEqual(reopened.Records(), expected) {
+		t.Errorf("expected %v, got %v", expected, reopened.Records())
+	}
+	if r, found := reopened.Get("egress", "192.168.0.10/32"); !found || r != egress {
+		t.Errorf("expected %v, got %v", egress, r)
+	}
+
+	if err := reopened.Delete("egress", "192.168.0.10/32"); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ = Open(path)
+	if expected := []Record{ingress}; !reflect.DeepEqual(reopened.Records(), expected) {
+		t.Errorf("expected %v, got %v", expected, reopened.Records())
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Errorf("expected only the state file to be left, got %d files", len(files))
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 1, "records": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Records()) != 0 {
+		t.Errorf("expected no records, got %v", s.Records())
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("expected the corrupt file to be moved aside: %v", err)
+	}
+}
@@ -0,0 +1,430 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tcsim simulates the tc and ip commands kube-chaos runs, for tests. A Sim keeps a model of
+// the links, qdiscs, htb classes and u32 filters of a node, changes it as the commands would change
+// the kernel's, and shows it in the format of iproute2.
+package tcsim // import "github.com/huanwei/kube-chaos/pkg/tcsim"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+// Sim is an exec.Interface running tc, ip and modprobe against a simulated node.
+type Sim struct {
+	lock      sync.Mutex
+	links     map[string]*link
+	nextIndex int
+	// routes are the interfaces routing to local addresses, see AddRoute
+	routes   map[string]string
+	commands []string
+}
+
+// New returns a Sim of a node with only a loopback interface.
+func New() *Sim {
+	s := &Sim{links: map[string]*link{}, routes: map[string]string{}, nextIndex: 1}
+	s.addLink("lo", "loopback")
+	s.links["lo"].up = true
+	return s
+}
+
+// AddLink adds a network interface, kind is e.g. veth or ifb.
+func (s *Sim) AddLink(name, kind string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addLink(name, kind)
+	s.links[name].up = true
+}
+
+// AddRoute makes ip route get return dev as the interface routing to ip.
+func (s *Sim) AddRoute(ip, dev string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.routes[ip] = dev
+}
+
+// Commands returns the command lines that changed the node, in order.
+func (s *Sim) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Run runs a command line against the node, it returns the output of the command, and an
+// exec.ExitError if it fails.
+func (s *Sim) Run(cmd string, args ...string) ([]byte, error) {
+	return s.run(nil, cmd, args)
+}
+
+func (s *Sim) run(stdin io.Reader, cmd string, args []string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var out bytes.Buffer
+	var err error
+	switch {
+	case cmd == "tc" && batchFlag(args) != "":
+		err = s.batch(&out, stdin, args)
+	case cmd == "tc":
+		err = s.tc(&out, args)
+	case cmd == "ip":
+		err = s.ip(&out, args)
+	case cmd == "modprobe":
+		err = s.modprobe(args)
+	default:
+		return nil, exec.ErrExecutableNotFound
+	}
+	if err != nil {
+		if err != errBatchFailed {
+			fmt.Fprintln(&out, err.Error())
+		}
+		code := 2
+		if ce, ok := err.(exitError); ok {
+			code = ce.code
+		}
+		return out.Bytes(), exec.CodeExitError{Err: fmt.Errorf("exit status %d", code), Code: code}
+	}
+	return out.Bytes(), nil
+}
+
+// exitError is an error of a command exiting with a status other than 2, iproute2's status for
+// errors from the kernel.
+type exitError struct {
+	error
+	code int
+}
+
+// errBatchFailed is the error of a batch with failed commands, whose errors are in its output.
+var errBatchFailed = exitError{fmt.Errorf("tc -batch failed"), 1}
+
+// batchFlag returns the -batch flag of tc's arguments, if any.
+func batchFlag(args []string) string {
+	for _, arg := range args {
+		if arg == "-batch" || arg == "-b" {
+			return arg
+		}
+	}
+	return ""
+}
+
+// batch runs the commands of tc -batch -, one per line of stdin. Like tc, it stops at the first
+// failed command unless -force is set, and reports each failed command with its line number.
+func (s *Sim) batch(out io.Writer, stdin io.Reader, args []string) error {
+	force := false
+	for i, arg := range args {
+		switch {
+		case arg == "-force" || arg == "-f":
+			force = true
+		case arg == "-batch" || arg == "-b":
+			if i+1 >= len(args) || args[i+1] != "-" {
+				return exitError{fmt.Errorf("the simulator only reads tc -batch from stdin"), 1}
+			}
+		}
+	}
+	if stdin == nil {
+		return nil
+	}
+	scanner := bufio.NewScanner(stdin)
+	failed := false
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.tc(out, strings.Fields(line)); err != nil {
+			fmt.Fprintf(out, "%s\nCommand failed -:%d\n", err, n)
+			failed = true
+			if !force {
+				break
+			}
+		}
+	}
+	if failed {
+		return errBatchFailed
+	}
+	return nil
+}
+
+func (s *Sim) logCommand(cmd string, args []string) {
+	s.commands = append(s.commands, strings.Join(append([]string{cmd}, args...), " "))
+}
+
+func (s *Sim) link(name string) (*link, error) {
+	l, found := s.links[name]
+	if !found {
+		return nil, exitError{fmt.Errorf("Cannot find device %q", name), 1}
+	}
+	return l, nil
+}
+
+func (s *Sim) addLink(name, kind string) {
+	s.links[name] = newLink(s.nextIndex, name, kind)
+	s.nextIndex++
+}
+
+// sortedLinks returns the links by index, the order ip and tc show them in.
+func (s *Sim) sortedLinks() []*link {
+	links := []*link{}
+	for _, l := range s.links {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].index < links[j].index })
+	return links
+}
+
+func (s *Sim) modprobe(args []string) error {
+	if len(args) != 1 {
+		return exitError{fmt.Errorf("modprobe: invalid arguments %q", strings.Join(args, " ")), 1}
+	}
+	switch args[0] {
+	case "ifb":
+		// the module creates two ifbs, down
+		for _, name := range []string{"ifb0", "ifb1"} {
+			if _, found := s.links[name]; !found {
+				s.addLink(name, "ifb")
+			}
+		}
+		s.logCommand("modprobe", args)
+		return nil
+	}
+	return exitError{fmt.Errorf("modprobe: FATAL: Module %s not found.", args[0]), 1}
+}
+
+func (s *Sim) ip(out io.Writer, args []string) error {
+	oneline := false
+	words := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "-o" || arg == "-oneline":
+			oneline = true
+		case strings.HasPrefix(arg, "-"):
+			return exitError{fmt.Errorf("Option %q is unknown, try \"ip -help\".", arg), 255}
+		default:
+			words = append(words, arg)
+		}
+	}
+	if len(words) == 0 {
+		return exitError{fmt.Errorf("Usage: ip [ OPTIONS ] OBJECT { COMMAND | help }"), 255}
+	}
+	object, verb, rest := words[0], "show", []string{}
+	if len(words) > 1 {
+		verb, rest = words[1], words[2:]
+	}
+	switch object {
+	case "link", "l":
+		switch verb {
+		case "show", "list", "ls":
+			return s.ipLinkShow(out, rest, oneline)
+		case "set":
+			return s.ipLinkSet(args, rest)
+		case "add":
+			return s.ipLinkAdd(args, rest)
+		case "del", "delete":
+			return s.ipLinkDel(args, rest)
+		}
+	case "route", "r":
+		if verb == "get" && len(rest) == 1 {
+			dev, found := s.routes[rest[0]]
+			if !found {
+				return exitError{fmt.Errorf("RTNETLINK answers: Network is unreachable"), 2}
+			}
+			fmt.Fprintf(out, "%s dev %s src 10.0.0.1 uid 0 \n    cache \n", rest[0], dev)
+			return nil
+		}
+	}
+	return exitError{fmt.Errorf("Command \"%s\" is unknown, try \"ip %s help\".", verb, object), 255}
+}
+
+func (s *Sim) ipLinkShow(out io.Writer, args []string, oneline bool) error {
+	links := s.sortedLinks()
+	if len(args) > 0 {
+		name := args[len(args)-1]
+		l, err := s.link(name)
+		if err != nil {
+			return err
+		}
+		links = []*link{l}
+	}
+	for _, l := range links {
+		flags := "BROADCAST,MULTICAST"
+		if l.kind == "loopback" {
+			flags = "LOOPBACK"
+		}
+		state := "DOWN"
+		if l.up {
+			flags += ",UP,LOWER_UP"
+			state = "UNKNOWN"
+		}
+		name := l.name
+		if l.kind == "veth" {
+			name += "@if3"
+		}
+		qdisc := "noqueue"
+		if l.root != nil {
+			qdisc = l.root.kind
+		}
+		sep := "\n   "
+		if oneline {
+			sep = "\\    "
+		}
+		fmt.Fprintf(out, "%d: %s: <%s> mtu 1500 qdisc %s state %s mode DEFAULT group default qlen 1000%slink/ether ee:ee:ee:ee:ee:%02x brd ff:ff:ff:ff:ff:ff\n",
+			l.index, name, flags, qdisc, state, sep, l.index)
+	}
+	return nil
+}
+
+func (s *Sim) ipLinkSet(args, rest []string) error {
+	if len(rest) > 0 && rest[0] == "dev" {
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return exitError{fmt.Errorf("Not enough information: \"dev\" argument is required."), 255}
+	}
+	l, err := s.link(rest[0])
+	if err != nil {
+		return err
+	}
+	for _, arg := range rest[1:] {
+		switch arg {
+		case "up":
+			l.up = true
+		case "down":
+			l.up = false
+		default:
+			return exitError{fmt.Errorf("Error: either \"dev\" is duplicate, or %q is a garbage.", arg), 255}
+		}
+	}
+	s.logCommand("ip", args)
+	return nil
+}
+
+func (s *Sim) ipLinkAdd(args, rest []string) error {
+	// ip link add NAME type KIND [peer name PEER]
+	if len(rest) < 3 || rest[1] != "type" {
+		return exitError{fmt.Errorf("Not enough information: \"type\" argument is required."), 2}
+	}
+	if _, found := s.links[rest[0]]; found {
+		return fmt.Errorf("RTNETLINK answers: File exists")
+	}
+	s.addLink(rest[0], rest[2])
+	if len(rest) == 6 && rest[3] == "peer" && rest[4] == "name" {
+		s.addLink(rest[5], rest[2])
+	}
+	s.logCommand("ip", args)
+	return nil
+}
+
+func (s *Sim) ipLinkDel(args, rest []string) error {
+	if len(rest) > 0 && rest[0] == "dev" {
+		rest = rest[1:]
+	}
+	if len(rest) != 1 {
+		return exitError{fmt.Errorf("Not enough information: \"dev\" argument is required."), 255}
+	}
+	if _, err := s.link(rest[0]); err != nil {
+		return err
+	}
+	delete(s.links, rest[0])
+	s.logCommand("ip", args)
+	return nil
+}
+
+// Command is part of the exec.Interface interface.
+func (s *Sim) Command(cmd string, args ...string) exec.Cmd {
+	return &simCmd{sim: s, argv: append([]string{cmd}, args...)}
+}
+
+// CommandContext is part of the exec.Interface interface, simulated commands don't hang so the
+// context only matters if it is done already.
+func (s *Sim) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	return &simCmd{sim: s, ctx: ctx, argv: append([]string{cmd}, args...)}
+}
+
+// LookPath is part of the exec.Interface interface.
+func (s *Sim) LookPath(file string) (string, error) {
+	switch file {
+	case "tc", "ip":
+		return "/sbin/" + file, nil
+	case "modprobe":
+		return "/sbin/modprobe", nil
+	}
+	return "", exec.ErrExecutableNotFound
+}
+
+type simCmd struct {
+	sim    *Sim
+	ctx    context.Context
+	argv   []string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (cmd *simCmd) SetDir(dir string) {}
+
+func (cmd *simCmd) SetStdin(in io.Reader) {
+	cmd.stdin = in
+}
+
+func (cmd *simCmd) SetStdout(out io.Writer) {
+	cmd.stdout = out
+}
+
+func (cmd *simCmd) SetStderr(out io.Writer) {
+	cmd.stderr = out
+}
+
+func (cmd *simCmd) run() ([]byte, error) {
+	if cmd.ctx != nil && cmd.ctx.Err() != nil {
+		return nil, cmd.ctx.Err()
+	}
+	return cmd.sim.run(cmd.stdin, cmd.argv[0], cmd.argv[1:])
+}
+
+// CombinedOutput is part of the exec.Cmd interface, the output of failed commands is their error.
+func (cmd *simCmd) CombinedOutput() ([]byte, error) {
+	return cmd.run()
+}
+
+// Output is part of the exec.Cmd interface.
+func (cmd *simCmd) Output() ([]byte, error) {
+	out, err := cmd.run()
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Run is part of the exec.Cmd interface.
+func (cmd *simCmd) Run() error {
+	out, err := cmd.run()
+	w := cmd.stdout
+	if err != nil {
+		w = cmd.stderr
+	}
+	if w != nil {
+		w.Write(out)
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcsim
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/exec"
+)
+
+func run(t *testing.T, s *Sim, line string) string {
+	args := strings.Fields(line)
+	out, err := s.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v: %s", line, err, out)
+	}
+	return string(out)
+}
+
+func TestSim(t *testing.T) {
+	s := New()
+	s.AddLink("cali67801d38217", "veth")
+	for _, line := range []string{
+		"modprobe ifb",
+		"ip link set dev ifb0 up",
+		"tc qdisc add dev ifb0 root handle 1: htb default 30",
+		"tc filter add dev ifb0 parent 1:0 prio 1 handle 2: protocol ip u32 divisor 256",
+		"tc filter add dev ifb0 parent 1:0 prio 1 protocol ip u32 ht 800:: match ip src 0.0.0.0/0 hashkey mask 0x000000ff at 12 link 2:",
+		"tc class add dev ifb0 parent 1: classid 1:2 htb rate 1500kbit",
+		"tc qdisc add dev ifb0 parent 1:2 handle 2: netem delay 100000us 10ms loss 1%",
+		"tc filter add dev ifb0 protocol ip parent 1:0 prio 1 u32 ht 2:a: match ip src 192.168.0.10/32 flowid 1:2",
+		"tc qdisc add dev cali67801d38217 ingress",
+		"tc filter add dev cali67801d38217 parent ffff: protocol ip u32 match u32 0 0 action mirred egress redirect dev ifb0",
+	} {
+		run(t, s, line)
+	}
+
+	expected := `qdisc htb 1: root refcnt 2 r2q 10 default 0x30 direct_packets_stat 0 direct_qlen 1000
+qdisc netem 2: parent 1:2 limit 1000 delay 100.0ms  10.0ms loss 1%
+`
+	if out := run(t, s, "tc qdisc show dev ifb0"); out != expected {
+		t.Errorf("expected qdiscs:\n%s\ngot:\n%s", expected, out)
+	}
+	if out := run(t, s, "tc qdisc show"); !strings.Contains(out, "qdisc ingress ffff: dev cali67801d38217 parent ffff:fff1 ----------------\n") {
+		t.Errorf("expected the ingress qdisc of the veth, got:\n%s", out)
+	}
+	expected = "class htb 1:2 root leaf 2: prio 0 rate 1500Kbit ceil 1500Kbit burst 1600b cburst 1600b \n"
+	if out := run(t, s, "tc class show dev ifb0"); out != expected {
+		t.Errorf("expected classes:\n%s\ngot:\n%s", expected, out)
+	}
+	expected = `filter parent 1: protocol ip pref 1 u32 chain 0 
+filter parent 1: protocol ip pref 1 u32 chain 0 fh 2: ht divisor 256 
+filter parent 1: protocol ip pref 1 u32 chain 0 fh 2:a:800 order 2048 key ht 2 bkt a flowid 1:2 not_in_hw 
+  match c0a8000a/ffffffff at 12
+filter parent 1: protocol ip pref 1 u32 chain 0 fh 800: ht divisor 1 
+filter parent 1: protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 link 2: not_in_hw 
+  match 00000000/00000000 at 12
+    hash mask 000000ff at 12 
+`
+	if out := run(t, s, "tc filter show dev ifb0"); out != expected {
+		t.Errorf("expected filters:\n%s\ngot:\n%s", expected, out)
+	}
+	if out := run(t, s, "tc filter show dev cali67801d38217 parent ffff:"); !strings.Contains(out, "mirred (Egress Redirect to device ifb0)") {
+		t.Errorf("expected the mirred filter, got:\n%s", out)
+	}
+
+	// htb refuses to delete a class filters send traffic to
+	out, err := s.Command("tc", "class", "del", "dev", "ifb0", "parent", "1:", "classid", "1:2").CombinedOutput()
+	if ee, ok := err.(exec.ExitError); !ok || ee.ExitStatus() != 2 || !strings.Contains(string(out), "Device or resource busy") {
+		t.Errorf("expected the class to be busy, got %v: %s", err, out)
+	}
+	run(t, s, "tc filter del dev ifb0 parent 1: protocol ip prio 1 handle 2:a:800 u32")
+	run(t, s, "tc class del dev ifb0 parent 1: classid 1:2")
+	if out := run(t, s, "tc qdisc show dev ifb0"); strings.Contains(out, "netem") {
+		t.Errorf("expected the netem qdisc to go with its class, got:\n%s", out)
+	}
+
+	if _, err := s.Command("tc", "qdisc", "show", "dev", "eth9").CombinedOutput(); err == nil {
+		t.Errorf("expected an error for a missing device")
+	}
+	if commands := s.Commands(); len(commands) != 12 || commands[0] != "modprobe ifb" {
+		t.Errorf("expected the 12 commands changing the node, got %q", commands)
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := map[string]string{
+		"1mbit":    "1Mbit",
+		"1500kbit": "1500Kbit",
+		"125kbps":  "1Mbit",
+		"10gbit":   "10Gbit",
+		"100bit":   "100bit",
+	}
+	for rate, expected := range tests {
+		bits, err := parseRate(rate)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", rate, err)
+			continue
+		}
+		if got := formatRate(bits); got != expected {
+			t.Errorf("%s: expected %s, got %s", rate, expected, got)
+		}
+	}
+}
@@ -0,0 +1,1164 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcsim
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// link is a network interface and its tc state.
+type link struct {
+	index int
+	name  string
+	kind  string
+	up    bool
+
+	root    *qdisc
+	ingress *qdisc
+	// leaves are the qdiscs of the classes of the root htb, by class
+	leaves map[string]*qdisc
+	// classes are the htb classes of the root htb, by minor
+	classes map[uint32]*class
+	// filters are the u32 filters of the qdiscs, by qdisc major
+	filters map[uint32][]*tp
+}
+
+func newLink(index int, name, kind string) *link {
+	return &link{
+		index:   index,
+		name:    name,
+		kind:    kind,
+		leaves:  map[string]*qdisc{},
+		classes: map[uint32]*class{},
+		filters: map[uint32][]*tp{},
+	}
+}
+
+type qdisc struct {
+	kind  string
+	major uint32
+	// defaultClass is the minor of the default class of an htb
+	defaultClass uint32
+	netem        netem
+}
+
+type class struct {
+	minor uint32
+	rate  uint64
+}
+
+type netem struct {
+	limit       int
+	delay       time.Duration
+	jitter      time.Duration
+	loss        float64
+	lossCorr    float64
+	gemodel     []float64
+	duplicate   float64
+	reorder     float64
+	reorderCorr float64
+	corrupt     float64
+}
+
+// tp is the u32 classifier of a priority, its hash tables hold the filters.
+type tp struct {
+	prio   int
+	tables []*htable
+}
+
+type htable struct {
+	id      uint32
+	divisor uint32
+	nodes   []*node
+}
+
+// node is a u32 filter, its handle is ht:bucket:id.
+type node struct {
+	bucket  uint32
+	id      uint32
+	matches []match
+	// hash is set for the filters hashing to a linked table
+	hash   *match
+	link   uint32
+	flowid string
+	mirred string
+}
+
+type match struct {
+	value uint32
+	mask  uint32
+	at    int
+}
+
+const (
+	rootTable   = 0x800
+	firstNode   = 0x800
+	defaultPrio = 49152
+)
+
+// spec holds the arguments of a tc command before its kind, e.g. htb or u32.
+type spec struct {
+	dev      string
+	parent   string
+	handle   string
+	classid  string
+	prio     int
+	root     bool
+	ingress  bool
+	kind     string
+	kindArgs []string
+}
+
+func parseSpec(args []string) (*spec, error) {
+	s := &spec{}
+	for i := 0; i < len(args); i++ {
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("Command line is not complete. Try option \"help\"")
+			}
+			i++
+			return args[i], nil
+		}
+		var err error
+		switch args[i] {
+		case "dev":
+			s.dev, err = value()
+		case "parent":
+			s.parent, err = value()
+		case "handle":
+			s.handle, err = value()
+		case "classid":
+			s.classid, err = value()
+		case "protocol", "proto":
+			var p string
+			if p, err = value(); err == nil && p != "ip" && p != "all" {
+				err = fmt.Errorf("the simulator only knows protocol ip, not %q", p)
+			}
+		case "prio", "pref", "priority", "preference":
+			var p string
+			if p, err = value(); err == nil {
+				if s.prio, err = strconv.Atoi(p); err != nil || s.prio <= 0 {
+					err = fmt.Errorf("Illegal \"priority\"")
+				}
+			}
+		case "root":
+			s.root = true
+		case "ingress":
+			s.ingress = true
+			s.kind = "ingress"
+		default:
+			s.kind, s.kindArgs = args[i], args[i+1:]
+			i = len(args)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Sim) tc(out io.Writer, args []string) error {
+	words := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "-s", "-d", "-p", "-i", "-stats", "-details":
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return exitError{fmt.Errorf("Option %q is unknown, try \"tc -help\".", arg), 255}
+			}
+			words = append(words, arg)
+		}
+	}
+	if len(words) == 0 {
+		return exitError{fmt.Errorf("Usage: tc [ OPTIONS ] OBJECT { COMMAND | help }"), 255}
+	}
+	object, verb, rest := words[0], "show", []string{}
+	if len(words) > 1 {
+		verb, rest = words[1], words[2:]
+	}
+	if verb == "delete" {
+		verb = "del"
+	}
+	if verb == "list" || verb == "ls" {
+		verb = "show"
+	}
+	sp, err := parseSpec(rest)
+	if err != nil {
+		return err
+	}
+	if sp.dev == "" && !(object == "qdisc" && verb == "show") {
+		return exitError{fmt.Errorf("Cannot find device \"\""), 1}
+	}
+	var l *link
+	if sp.dev != "" {
+		if l, err = s.link(sp.dev); err != nil {
+			return err
+		}
+	}
+	switch object + " " + verb {
+	case "qdisc show":
+		s.showQdiscs(out, l)
+		return nil
+	case "class show":
+		showClasses(out, l)
+		return nil
+	case "filter show":
+		return showFilters(out, l, sp.parent)
+	case "qdisc add":
+		err = l.addQdisc(sp)
+	case "qdisc change":
+		err = l.changeQdisc(sp)
+	case "qdisc del":
+		err = l.delQdisc(sp)
+	case "class add":
+		err = l.addClass(sp)
+	case "class change":
+		err = l.changeClass(sp)
+	case "class del":
+		err = l.delClass(sp)
+	case "filter add":
+		err = s.addFilter(l, sp)
+	case "filter del":
+		err = l.delFilter(sp)
+	default:
+		return exitError{fmt.Errorf("Command \"%s\" is unknown, try \"tc %s help\".", verb, object), 255}
+	}
+	if err != nil {
+		return err
+	}
+	s.logCommand("tc", args)
+	return nil
+}
+
+var (
+	errExists   = fmt.Errorf("RTNETLINK answers: File exists")
+	errNotFound = fmt.Errorf("RTNETLINK answers: No such file or directory")
+	errBusy     = fmt.Errorf("RTNETLINK answers: Device or resource busy")
+)
+
+// parseMajor parses a qdisc handle, e.g. 1: or 1:0.
+func parseMajor(handle string) (uint32, error) {
+	parts := strings.SplitN(handle, ":", 2)
+	if len(parts) != 2 || (parts[1] != "" && parts[1] != "0") {
+		return 0, fmt.Errorf("Invalid qdisc handle %q", handle)
+	}
+	major, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid qdisc handle %q", handle)
+	}
+	return uint32(major), nil
+}
+
+// parseClassID parses a class ID, e.g. 1:2.
+func parseClassID(classid string) (uint32, uint32, error) {
+	parts := strings.SplitN(classid, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, 0, fmt.Errorf("Invalid class ID %q", classid)
+	}
+	major, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid class ID %q", classid)
+	}
+	minor, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid class ID %q", classid)
+	}
+	return uint32(major), uint32(minor), nil
+}
+
+func (l *link) addQdisc(sp *spec) error {
+	q := &qdisc{kind: sp.kind}
+	switch sp.kind {
+	case "ingress":
+		if l.ingress != nil {
+			return errExists
+		}
+		q.major = 0xffff
+		l.ingress = q
+		return nil
+	case "htb":
+		if len(sp.kindArgs) >= 2 && sp.kindArgs[0] == "default" {
+			d, err := strconv.ParseUint(sp.kindArgs[1], 16, 32)
+			if err != nil {
+				return fmt.Errorf("HTB: Illegal \"default\"")
+			}
+			q.defaultClass = uint32(d)
+		}
+	case "netem":
+		n, err := parseNetem(sp.kindArgs)
+		if err != nil {
+			return err
+		}
+		q.netem = n
+	default:
+		return fmt.Errorf("the simulator doesn't know qdisc %q", sp.kind)
+	}
+	q.major = 0x8001
+	if sp.handle != "" {
+		major, err := parseMajor(sp.handle)
+		if err != nil {
+			return err
+		}
+		q.major = major
+	}
+	switch {
+	case sp.root:
+		if l.root != nil {
+			return errExists
+		}
+		l.root = q
+	case sp.parent != "":
+		if q.kind != "netem" {
+			return fmt.Errorf("the simulator only has netem qdiscs in classes")
+		}
+		class, err := l.class(sp.parent)
+		if err != nil {
+			return err
+		}
+		if _, found := l.leaves[sp.parent]; found {
+			return errExists
+		}
+		for _, leaf := range l.leaves {
+			if leaf.major == q.major {
+				return errExists
+			}
+		}
+		if q.major == l.root.major {
+			return errExists
+		}
+		l.leaves[classString(l.root.major, class.minor)] = q
+	default:
+		return fmt.Errorf("Error: Parent Qdisc doesn't exists.")
+	}
+	return nil
+}
+
+// class returns the class with an ID of the root htb.
+func (l *link) class(classid string) (*class, error) {
+	major, minor, err := parseClassID(classid)
+	if err != nil {
+		return nil, err
+	}
+	if l.root == nil || l.root.kind != "htb" || l.root.major != major {
+		return nil, fmt.Errorf("Error: Parent Qdisc doesn't exists.")
+	}
+	c, found := l.classes[minor]
+	if !found {
+		return nil, errNotFound
+	}
+	return c, nil
+}
+
+func classString(major, minor uint32) string {
+	return fmt.Sprintf("%x:%x", major, minor)
+}
+
+func (l *link) changeQdisc(sp *spec) error {
+	var q *qdisc
+	switch {
+	case sp.root:
+		q = l.root
+	case sp.parent != "":
+		if _, err := l.class(sp.parent); err != nil {
+			return err
+		}
+		major, minor, _ := parseClassID(sp.parent)
+		q = l.leaves[classString(major, minor)]
+	}
+	if q == nil || q.kind != sp.kind {
+		return errNotFound
+	}
+	if sp.handle != "" {
+		if major, err := parseMajor(sp.handle); err != nil || major != q.major {
+			return errNotFound
+		}
+	}
+	if q.kind != "netem" {
+		return fmt.Errorf("the simulator only changes netem qdiscs")
+	}
+	n, err := parseNetem(sp.kindArgs)
+	if err != nil {
+		return err
+	}
+	q.netem = n
+	return nil
+}
+
+func (l *link) delQdisc(sp *spec) error {
+	switch {
+	case sp.ingress:
+		if l.ingress == nil {
+			return fmt.Errorf("Error: Cannot find specified qdisc on specified device.")
+		}
+		l.ingress = nil
+		delete(l.filters, 0xffff)
+	case sp.root:
+		if l.root == nil {
+			return fmt.Errorf("Error: Cannot delete qdisc with handle of zero.")
+		}
+		if sp.handle != "" {
+			if major, err := parseMajor(sp.handle); err != nil || major != l.root.major {
+				return fmt.Errorf("Error: Specified qdisc handle not found.")
+			}
+		}
+		delete(l.filters, l.root.major)
+		l.root = nil
+		l.classes = map[uint32]*class{}
+		l.leaves = map[string]*qdisc{}
+	case sp.parent != "":
+		if _, err := l.class(sp.parent); err != nil {
+			return err
+		}
+		major, minor, _ := parseClassID(sp.parent)
+		if _, found := l.leaves[classString(major, minor)]; !found {
+			return fmt.Errorf("Error: Cannot find specified qdisc on specified device.")
+		}
+		delete(l.leaves, classString(major, minor))
+	default:
+		return fmt.Errorf("Error: Cannot find specified qdisc on specified device.")
+	}
+	return nil
+}
+
+// parseClassArgs parses the classid of a class command, and checks its parent is the root htb.
+func (l *link) parseClassArgs(sp *spec) (uint32, error) {
+	if l.root == nil || l.root.kind != "htb" {
+		return 0, fmt.Errorf("Error: Parent Qdisc doesn't exists.")
+	}
+	if sp.parent != "" {
+		if major, err := parseMajor(sp.parent); err != nil || major != l.root.major {
+			return 0, fmt.Errorf("the simulator only has classes at the root of the htb")
+		}
+	}
+	major, minor, err := parseClassID(sp.classid)
+	if err != nil {
+		return 0, err
+	}
+	if major != l.root.major {
+		return 0, fmt.Errorf("Error: Parent Qdisc doesn't exists.")
+	}
+	return minor, nil
+}
+
+func htbRate(sp *spec) (uint64, error) {
+	if sp.kind != "htb" {
+		return 0, fmt.Errorf("the simulator only has htb classes")
+	}
+	for i := 0; i+1 < len(sp.kindArgs); i++ {
+		if sp.kindArgs[i] == "rate" {
+			return parseRate(sp.kindArgs[i+1])
+		}
+	}
+	return 0, fmt.Errorf("Error: htb: rate is required")
+}
+
+func (l *link) addClass(sp *spec) error {
+	minor, err := l.parseClassArgs(sp)
+	if err != nil {
+		return err
+	}
+	rate, err := htbRate(sp)
+	if err != nil {
+		return err
+	}
+	if _, found := l.classes[minor]; found {
+		return errExists
+	}
+	l.classes[minor] = &class{minor: minor, rate: rate}
+	return nil
+}
+
+func (l *link) changeClass(sp *spec) error {
+	minor, err := l.parseClassArgs(sp)
+	if err != nil {
+		return err
+	}
+	rate, err := htbRate(sp)
+	if err != nil {
+		return err
+	}
+	c, found := l.classes[minor]
+	if !found {
+		return errNotFound
+	}
+	c.rate = rate
+	return nil
+}
+
+func (l *link) delClass(sp *spec) error {
+	minor, err := l.parseClassArgs(sp)
+	if err != nil {
+		return err
+	}
+	if _, found := l.classes[minor]; !found {
+		return errNotFound
+	}
+	classid := classString(l.root.major, minor)
+	// htb refuses to delete a class filters send traffic to
+	for _, t := range l.filters[l.root.major] {
+		for _, ht := range t.tables {
+			for _, n := range ht.nodes {
+				if n.flowid == classid {
+					return errBusy
+				}
+			}
+		}
+	}
+	delete(l.classes, minor)
+	delete(l.leaves, classid)
+	return nil
+}
+
+// filterParent returns the major of the qdisc of a filter command.
+func (l *link) filterParent(parent string) (uint32, error) {
+	major, err := parseMajor(parent)
+	if err != nil {
+		return 0, err
+	}
+	if (l.root == nil || l.root.major != major) && (l.ingress == nil || major != 0xffff) {
+		return 0, fmt.Errorf("Error: Parent Qdisc doesn't exists.")
+	}
+	return major, nil
+}
+
+// parseU32Handle parses a u32 handle, e.g. 2:, 2:a: or 800::800.
+func parseU32Handle(handle string) (ht, bucket, id uint32, err error) {
+	parts := strings.Split(handle, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, 0, fmt.Errorf("Illegal \"handle\"")
+	}
+	values := []uint32{}
+	for _, p := range parts {
+		if p == "" {
+			values = append(values, 0)
+			continue
+		}
+		v, err := strconv.ParseUint(p, 16, 32)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("Illegal \"handle\"")
+		}
+		values = append(values, uint32(v))
+	}
+	for len(values) < 3 {
+		values = append(values, 0)
+	}
+	return values[0], values[1], values[2], nil
+}
+
+func (t *tp) table(id uint32) *htable {
+	for _, ht := range t.tables {
+		if ht.id == id {
+			return ht
+		}
+	}
+	return nil
+}
+
+func (s *Sim) addFilter(l *link, sp *spec) error {
+	if sp.kind != "u32" {
+		return fmt.Errorf("the simulator only has u32 filters, not %q", sp.kind)
+	}
+	major, err := l.filterParent(sp.parent)
+	if err != nil {
+		return err
+	}
+	prio := sp.prio
+	if prio == 0 {
+		prio = defaultPrio
+	}
+	var t *tp
+	for _, existing := range l.filters[major] {
+		if existing.prio == prio {
+			t = existing
+		}
+	}
+	if t == nil {
+		t = &tp{prio: prio, tables: []*htable{{id: rootTable, divisor: 1}}}
+		l.filters[major] = append(l.filters[major], t)
+		sort.Slice(l.filters[major], func(i, j int) bool { return l.filters[major][i].prio < l.filters[major][j].prio })
+	}
+
+	n := &node{}
+	ht, bucket := uint32(rootTable), uint32(0)
+	args := sp.kindArgs
+	for i := 0; i < len(args); i++ {
+		next := func(count int) ([]string, error) {
+			if i+count >= len(args) {
+				return nil, fmt.Errorf("Illegal %q", args[i])
+			}
+			values := args[i+1 : i+1+count]
+			i += count
+			return values, nil
+		}
+		switch args[i] {
+		case "divisor":
+			v, err := next(1)
+			if err != nil {
+				return err
+			}
+			divisor, err := strconv.ParseUint(v[0], 10, 32)
+			if err != nil || divisor == 0 || divisor > 256 {
+				return fmt.Errorf("Illegal \"divisor\"")
+			}
+			id, _, _, err := parseU32Handle(sp.handle)
+			if err != nil || id == 0 {
+				return fmt.Errorf("the simulator needs the handle of a hash table")
+			}
+			if t.table(id) != nil {
+				return errExists
+			}
+			t.tables = append(t.tables, &htable{id: id, divisor: uint32(divisor)})
+			return nil
+		case "ht":
+			v, err := next(1)
+			if err != nil {
+				return err
+			}
+			if ht, bucket, _, err = parseU32Handle(v[0]); err != nil {
+				return err
+			}
+		case "match":
+			m, err := parseMatch(args, &i)
+			if err != nil {
+				return err
+			}
+			n.matches = append(n.matches, m)
+		case "hashkey":
+			v, err := next(4)
+			if err != nil {
+				return err
+			}
+			if v[0] != "mask" || v[2] != "at" {
+				return fmt.Errorf("Illegal \"hashkey\"")
+			}
+			mask, err := strconv.ParseUint(strings.TrimPrefix(v[1], "0x"), 16, 32)
+			if err != nil {
+				return fmt.Errorf("Illegal \"hashkey\"")
+			}
+			at, err := strconv.Atoi(v[3])
+			if err != nil {
+				return fmt.Errorf("Illegal \"hashkey\"")
+			}
+			n.hash = &match{mask: uint32(mask), at: at}
+		case "link":
+			v, err := next(1)
+			if err != nil {
+				return err
+			}
+			id, _, _, err := parseU32Handle(v[0])
+			if err != nil {
+				return err
+			}
+			if t.table(id) == nil {
+				return fmt.Errorf("Error: u32 Link handle not found.")
+			}
+			n.link = id
+		case "flowid", "classid":
+			v, err := next(1)
+			if err != nil {
+				return err
+			}
+			if _, _, err := parseClassID(v[0]); err != nil {
+				return err
+			}
+			n.flowid = v[0]
+		case "action":
+			// action mirred egress redirect dev IFB
+			v, err := next(5)
+			if err != nil {
+				return err
+			}
+			if v[0] != "mirred" || v[1] != "egress" || v[2] != "redirect" || v[3] != "dev" {
+				return fmt.Errorf("the simulator only knows action mirred egress redirect")
+			}
+			if _, err := s.link(v[4]); err != nil {
+				return err
+			}
+			n.mirred = v[4]
+		default:
+			return fmt.Errorf("What is %q?", args[i])
+		}
+	}
+	table := t.table(ht)
+	if table == nil {
+		return fmt.Errorf("Error: Specified hash table not found.")
+	}
+	if bucket >= table.divisor {
+		return fmt.Errorf("Error: Specified hash table bucket exceeds divisor.")
+	}
+	n.bucket, n.id = bucket, firstNode
+	for _, other := range table.nodes {
+		if other.bucket == bucket && other.id >= n.id {
+			n.id = other.id + 1
+		}
+	}
+	table.nodes = append(table.nodes, n)
+	return nil
+}
+
+// parseMatch parses match ip src|dst CIDR, match ip protocol|sport|dport VALUE MASK, or match u32
+// VALUE MASK [at OFFSET].
+func parseMatch(args []string, i *int) (match, error) {
+	rest := args[*i+1:]
+	if len(rest) >= 3 && rest[0] == "ip" && (rest[1] == "src" || rest[1] == "dst") {
+		_, ipnet, err := net.ParseCIDR(rest[2])
+		if err != nil || ipnet.IP.To4() == nil {
+			return match{}, fmt.Errorf("Illegal \"match\"")
+		}
+		m := match{at: 12}
+		if rest[1] == "dst" {
+			m.at = 16
+		}
+		ip := ipnet.IP.To4()
+		m.value = uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+		mask := ipnet.Mask
+		m.mask = uint32(mask[0])<<24 | uint32(mask[1])<<16 | uint32(mask[2])<<8 | uint32(mask[3])
+		*i += 3
+		return m, nil
+	}
+	if len(rest) >= 4 && rest[0] == "ip" && (rest[1] == "protocol" || rest[1] == "sport" || rest[1] == "dport") {
+		// match ip protocol N 0xff, match ip sport|dport N 0xffff, tc aligns them to 32 bits
+		value, err := strconv.ParseUint(rest[2], 0, 16)
+		if err != nil {
+			return match{}, fmt.Errorf("Illegal \"match\"")
+		}
+		mask, err := strconv.ParseUint(rest[3], 0, 16)
+		if err != nil {
+			return match{}, fmt.Errorf("Illegal \"match\"")
+		}
+		m := match{at: 20}
+		shift := uint(16)
+		switch rest[1] {
+		case "protocol":
+			m.at = 8
+		case "dport":
+			shift = 0
+		}
+		m.value, m.mask = uint32(value)<<shift, uint32(mask)<<shift
+		*i += 4
+		return m, nil
+	}
+	if len(rest) >= 3 && rest[0] == "u32" {
+		value, err := strconv.ParseUint(strings.TrimPrefix(rest[1], "0x"), 16, 32)
+		if err != nil {
+			return match{}, fmt.Errorf("Illegal \"match\"")
+		}
+		mask, err := strconv.ParseUint(strings.TrimPrefix(rest[2], "0x"), 16, 32)
+		if err != nil {
+			return match{}, fmt.Errorf("Illegal \"match\"")
+		}
+		m := match{value: uint32(value), mask: uint32(mask)}
+		*i += 3
+		if len(rest) >= 5 && rest[3] == "at" {
+			if m.at, err = strconv.Atoi(rest[4]); err != nil {
+				return match{}, fmt.Errorf("Illegal \"match\"")
+			}
+			*i += 2
+		}
+		return m, nil
+	}
+	return match{}, fmt.Errorf("Illegal \"match\"")
+}
+
+func (l *link) delFilter(sp *spec) error {
+	major, err := l.filterParent(sp.parent)
+	if err != nil {
+		return err
+	}
+	tps := []*tp{}
+	for _, t := range l.filters[major] {
+		if sp.prio == 0 || t.prio == sp.prio {
+			tps = append(tps, t)
+		}
+	}
+	if len(tps) == 0 {
+		return fmt.Errorf("Error: Filter with specified priority/protocol not found.")
+	}
+	if sp.handle == "" {
+		kept := []*tp{}
+		for _, t := range l.filters[major] {
+			if sp.prio != 0 && t.prio != sp.prio {
+				kept = append(kept, t)
+			}
+		}
+		l.filters[major] = kept
+		return nil
+	}
+	ht, bucket, id, err := parseU32Handle(sp.handle)
+	if err != nil {
+		return err
+	}
+	for _, t := range tps {
+		table := t.table(ht)
+		if table == nil {
+			continue
+		}
+		if id == 0 && bucket == 0 {
+			if ht == rootTable || len(table.nodes) > 0 {
+				return errBusy
+			}
+			for i, other := range t.tables {
+				if other == table {
+					t.tables = append(t.tables[:i], t.tables[i+1:]...)
+					return nil
+				}
+			}
+		}
+		for i, n := range table.nodes {
+			if n.bucket == bucket && n.id == id {
+				table.nodes = append(table.nodes[:i], table.nodes[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Error: Specified filter handle not found.")
+}
+
+func (s *Sim) showQdiscs(out io.Writer, only *link) {
+	links := s.sortedLinks()
+	if only != nil {
+		links = []*link{only}
+	}
+	for _, l := range links {
+		dev := ""
+		if only == nil {
+			// like tc, the device is only shown when all are
+			dev = "dev " + l.name + " "
+		}
+		switch {
+		case l.root == nil:
+			fmt.Fprintf(out, "qdisc noqueue 0: %sroot refcnt 2 \n", dev)
+		case l.root.kind == "htb":
+			fmt.Fprintf(out, "qdisc htb %x: %sroot refcnt 2 r2q 10 default 0x%x direct_packets_stat 0 direct_qlen 1000\n", l.root.major, dev, l.root.defaultClass)
+		default:
+			fmt.Fprintf(out, "qdisc netem %x: %sroot refcnt 2 %s\n", l.root.major, dev, l.root.netem)
+		}
+		parents := []string{}
+		for parent := range l.leaves {
+			parents = append(parents, parent)
+		}
+		sort.Slice(parents, func(i, j int) bool {
+			_, a, _ := parseClassID(parents[i])
+			_, b, _ := parseClassID(parents[j])
+			return a < b
+		})
+		for _, parent := range parents {
+			q := l.leaves[parent]
+			fmt.Fprintf(out, "qdisc netem %x: %sparent %s %s\n", q.major, dev, parent, q.netem)
+		}
+		if l.ingress != nil {
+			fmt.Fprintf(out, "qdisc ingress ffff: %sparent ffff:fff1 ----------------\n", dev)
+		}
+	}
+}
+
+func showClasses(out io.Writer, l *link) {
+	if l.root == nil || l.root.kind != "htb" {
+		return
+	}
+	minors := []int{}
+	for minor := range l.classes {
+		minors = append(minors, int(minor))
+	}
+	sort.Ints(minors)
+	for _, minor := range minors {
+		c := l.classes[uint32(minor)]
+		classid := classString(l.root.major, c.minor)
+		leaf := ""
+		if q, found := l.leaves[classid]; found {
+			leaf = fmt.Sprintf("leaf %x: ", q.major)
+		}
+		fmt.Fprintf(out, "class htb %s root %sprio 0 rate %s ceil %s burst 1600b cburst 1600b \n", classid, leaf, formatRate(c.rate), formatRate(c.rate))
+	}
+}
+
+func showFilters(out io.Writer, l *link, parent string) error {
+	majors := []int{}
+	for major := range l.filters {
+		majors = append(majors, int(major))
+	}
+	sort.Ints(majors)
+	if parent != "" {
+		major, err := l.filterParent(parent)
+		if err != nil {
+			return err
+		}
+		majors = []int{int(major)}
+	}
+	for _, major := range majors {
+		for _, t := range l.filters[uint32(major)] {
+			prefix := fmt.Sprintf("filter parent %x: protocol ip pref %d u32 chain 0 ", major, t.prio)
+			fmt.Fprintf(out, "%s\n", prefix)
+			// the kernel lists the newest hash table first
+			for i := len(t.tables) - 1; i >= 0; i-- {
+				ht := t.tables[i]
+				fmt.Fprintf(out, "%sfh %x: ht divisor %d \n", prefix, ht.id, ht.divisor)
+				nodes := append([]*node{}, ht.nodes...)
+				sort.SliceStable(nodes, func(i, j int) bool {
+					if nodes[i].bucket != nodes[j].bucket {
+						return nodes[i].bucket < nodes[j].bucket
+					}
+					return nodes[i].id < nodes[j].id
+				})
+				for _, n := range nodes {
+					bucket := ""
+					if n.bucket != 0 {
+						bucket = fmt.Sprintf("%x", n.bucket)
+					}
+					target := "terminal flowid ??? "
+					switch {
+					case n.link != 0:
+						target = fmt.Sprintf("link %x: ", n.link)
+					case n.flowid != "":
+						target = "flowid " + n.flowid + " "
+					}
+					fmt.Fprintf(out, "%sfh %x:%s:%x order %d key ht %x bkt %x %snot_in_hw \n", prefix, ht.id, bucket, n.id, n.id, ht.id, n.bucket, target)
+					for _, m := range n.matches {
+						fmt.Fprintf(out, "  match %08x/%08x at %d\n", m.value, m.mask, m.at)
+					}
+					if n.hash != nil {
+						fmt.Fprintf(out, "    hash mask %08x at %d \n", n.hash.mask, n.hash.at)
+					}
+					if n.mirred != "" {
+						fmt.Fprintf(out, "\taction order 1: mirred (Egress Redirect to device %s) stolen\n \tindex %d ref 1 bind 1\n\n", n.mirred, n.id-firstNode+1)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func parseNetem(args []string) (netem, error) {
+	n := netem{limit: 1000}
+	for i := 0; i < len(args); i++ {
+		var err error
+		// optional returns the next argument if it is a value rather than the next key
+		optional := func() (string, bool) {
+			if i+1 < len(args) && strings.IndexAny(args[i+1][:1], "0123456789.") == 0 {
+				i++
+				return args[i], true
+			}
+			return "", false
+		}
+		switch args[i] {
+		case "limit":
+			v, ok := optional()
+			if !ok {
+				return n, fmt.Errorf("Illegal \"limit\"")
+			}
+			if n.limit, err = strconv.Atoi(v); err != nil {
+				return n, fmt.Errorf("Illegal \"limit\"")
+			}
+		case "delay", "latency":
+			v, ok := optional()
+			if !ok {
+				return n, fmt.Errorf("Illegal \"latency\"")
+			}
+			if n.delay, err = parseTime(v); err != nil {
+				return n, err
+			}
+			if v, ok := optional(); ok {
+				if n.jitter, err = parseTime(v); err != nil {
+					return n, err
+				}
+				// the correlation of the jitter isn't shown
+				optional()
+			}
+		case "distribution":
+			// the distribution isn't shown either
+			if i+1 >= len(args) {
+				return n, fmt.Errorf("Illegal \"distribution\"")
+			}
+			i++
+		case "loss", "duplicate", "reorder", "corrupt":
+			key := args[i]
+			if key == "loss" && i+1 < len(args) && args[i+1] == "gemodel" {
+				i++
+				// p is required, r defaults to 100%-p, 1-h to 100% and 1-k to 0%
+				n.loss, n.lossCorr, n.gemodel = 0, 0, nil
+				for v, ok := optional(); ok; v, ok = optional() {
+					p, err := parsePercent(v)
+					if err != nil || len(n.gemodel) == 4 {
+						return n, fmt.Errorf("Illegal \"loss gemodel\"")
+					}
+					n.gemodel = append(n.gemodel, p)
+				}
+				if len(n.gemodel) == 0 {
+					return n, fmt.Errorf("Illegal \"loss gemodel p\"")
+				}
+				defaults := []float64{0, 100 - n.gemodel[0], 100, 0}
+				n.gemodel = append(n.gemodel, defaults[len(n.gemodel):]...)
+				continue
+			}
+			if key == "loss" && i+1 < len(args) && args[i+1] == "random" {
+				i++
+			}
+			v, ok := optional()
+			if !ok {
+				return n, fmt.Errorf("Illegal %q", key)
+			}
+			p, err := parsePercent(v)
+			if err != nil {
+				return n, fmt.Errorf("Illegal %q", key)
+			}
+			switch key {
+			case "loss":
+				n.loss, n.gemodel = p, nil
+			case "duplicate":
+				n.duplicate = p
+			case "reorder":
+				n.reorder = p
+			case "corrupt":
+				n.corrupt = p
+			}
+			if key != "reorder" && key != "loss" {
+				continue
+			}
+			if v, ok := optional(); ok {
+				corr := map[string]*float64{"loss": &n.lossCorr, "reorder": &n.reorderCorr}[key]
+				if *corr, err = parsePercent(v); err != nil {
+					return n, fmt.Errorf("Illegal %q", key)
+				}
+			}
+		default:
+			return n, fmt.Errorf("What is %q?", args[i])
+		}
+	}
+	if n.reorder > 0 && n.delay == 0 {
+		return n, fmt.Errorf("Error: netem: reordering requires a delay")
+	}
+	return n, nil
+}
+
+// String formats netem parameters like tc.
+func (n netem) String() string {
+	s := fmt.Sprintf("limit %d", n.limit)
+	if n.delay > 0 {
+		s += " delay " + formatTime(n.delay)
+		if n.jitter > 0 {
+			s += "  " + formatTime(n.jitter)
+		}
+	}
+	for _, p := range []struct {
+		key   string
+		value float64
+	}{{"loss", n.loss}, {"duplicate", n.duplicate}, {"reorder", n.reorder}, {"corrupt", n.corrupt}} {
+		if p.value > 0 {
+			s += fmt.Sprintf(" %s %s%%", p.key, strconv.FormatFloat(p.value, 'f', -1, 64))
+			if p.key == "reorder" && n.reorderCorr > 0 {
+				s += fmt.Sprintf(" %s%%", strconv.FormatFloat(n.reorderCorr, 'f', -1, 64))
+			}
+			if p.key == "loss" && n.lossCorr > 0 {
+				s += fmt.Sprintf(" %s%%", strconv.FormatFloat(n.lossCorr, 'f', -1, 64))
+			}
+		}
+		if p.key == "loss" && n.gemodel != nil {
+			s += " loss gemodel"
+			for i, key := range []string{"p", "r", "1-h", "1-k"} {
+				s += fmt.Sprintf(" %s %s%%", key, strconv.FormatFloat(n.gemodel[i], 'f', -1, 64))
+			}
+		}
+	}
+	return s
+}
+
+// parseTime parses a tc time, a number without a unit is in microseconds.
+func parseTime(value string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"usecs", time.Microsecond}, {"usec", time.Microsecond}, {"us", time.Microsecond},
+		{"msecs", time.Millisecond}, {"msec", time.Millisecond}, {"ms", time.Millisecond},
+		{"secs", time.Second}, {"sec", time.Second}, {"s", time.Second},
+		{"", time.Microsecond},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(value, u.suffix), 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("Illegal time %q", value)
+			}
+			return time.Duration(n * float64(u.unit)), nil
+		}
+	}
+	return 0, fmt.Errorf("Illegal time %q", value)
+}
+
+// formatTime formats a time like tc, e.g. 100.0ms.
+func formatTime(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+	}
+	return fmt.Sprintf("%dus", d/time.Microsecond)
+}
+
+func parsePercent(value string) (float64, error) {
+	if !strings.HasSuffix(value, "%") {
+		return 0, fmt.Errorf("Illegal percentage %q", value)
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("Illegal percentage %q", value)
+	}
+	return p, nil
+}
+
+// parseRate parses a tc rate into bits per second.
+func parseRate(value string) (uint64, error) {
+	units := []struct {
+		suffix string
+		bits   float64
+	}{
+		{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+		{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+	}
+	lower := strings.ToLower(value)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(lower, u.suffix), 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return uint64(n * u.bits), nil
+		}
+	}
+	return 0, fmt.Errorf("Illegal \"rate\"")
+}
+
+// formatRate formats a rate like tc, in the largest unit that keeps it whole, e.g. 1500Kbit.
+func formatRate(bits uint64) string {
+	units := []string{"", "K", "M", "G", "T"}
+	i := 0
+	for ; i < len(units)-1; i++ {
+		if bits < 1000 || (bits%1000 != 0 && bits < 1000*1000) {
+			break
+		}
+		bits /= 1000
+	}
+	return fmt.Sprintf("%d%sbit", bits, units[i])
+}
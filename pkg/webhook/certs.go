@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/util/cert"
+)
+
+// EnsureSelfSignedCert returns the serving certificate and key in certDir, generating a self-signed
+// pair for host and dnsNames if they don't exist yet. The CA that signed a generated certificate is
+// written to ca.crt, it is the caBundle of the ValidatingWebhookConfiguration. Only meant for local
+// testing, real clusters should mount a certificate issued by a trusted CA.
+func EnsureSelfSignedCert(certDir, host string, dnsNames []string) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(certDir, "tls.crt")
+	keyFile = filepath.Join(certDir, "tls.key")
+	caFile := filepath.Join(certDir, "ca.crt")
+
+	exists, err := cert.CanReadCertAndKey(certFile, keyFile)
+	if err != nil {
+		return "", "", err
+	}
+	if exists {
+		return certFile, keyFile, nil
+	}
+
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey(host, nil, dnsNames)
+	if err != nil {
+		return "", "", err
+	}
+	// the generated certificate is followed by the CA that signed it
+	block, rest := pem.Decode(certPEM)
+	if block == nil {
+		return "", "", fmt.Errorf("failed to decode generated certificate")
+	}
+	caPEM := bytes.TrimSpace(rest)
+	if err := cert.WriteCert(certFile, certPEM); err != nil {
+		return "", "", err
+	}
+	if err := cert.WriteKey(keyFile, keyPEM); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(caFile, append(caPEM, '\n'), 0644); err != nil {
+		return "", "", err
+	}
+	glog.Infof("Generated a self-signed certificate for %s in %s, use %s as the webhook's caBundle", host, certDir, caFile)
+	return certFile, keyFile, nil
+}
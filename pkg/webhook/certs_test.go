@@ -0,0 +1,57 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/util/cert"
+)
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := EnsureSelfSignedCert(dir, "kube-chaos-webhook.kube-system.svc", []string{"localhost"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("expected a usable key pair: %v", err)
+	}
+	ca, err := cert.CertsFromFile(filepath.Join(dir, "ca.crt"))
+	if err != nil || len(ca) != 1 || !ca[0].IsCA {
+		t.Errorf("expected ca.crt to hold the CA, got %v (%v)", ca, err)
+	}
+
+	// an existing certificate is kept
+	before, _ := ioutil.ReadFile(certFile)
+	if _, _, err := EnsureSelfSignedCert(dir, "other", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after, _ := ioutil.ReadFile(certFile)
+	if string(before) != string(after) {
+		t.Errorf("expected the existing certificate to be reused")
+	}
+}
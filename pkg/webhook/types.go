@@ -0,0 +1,49 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The admission.k8s.io/v1beta1 types aren't vendored, these are the parts of them the webhook uses.
+
+// AdmissionReview describes an admission review request/response.
+type AdmissionReview struct {
+	meta_v1.TypeMeta `json:",inline"`
+	Request          *AdmissionRequest  `json:"request,omitempty"`
+	Response         *AdmissionResponse `json:"response,omitempty"`
+}
+
+// AdmissionRequest describes the admission.Attributes for the admission request.
+type AdmissionRequest struct {
+	UID       types.UID                `json:"uid"`
+	Kind      meta_v1.GroupVersionKind `json:"kind"`
+	Namespace string                   `json:"namespace,omitempty"`
+	Operation string                   `json:"operation"`
+	Object    json.RawMessage          `json:"object,omitempty"`
+}
+
+// AdmissionResponse describes an admission response.
+type AdmissionResponse struct {
+	UID     types.UID       `json:"uid"`
+	Allowed bool            `json:"allowed"`
+	Result  *meta_v1.Status `json:"status,omitempty"`
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook implements a validating admission webhook for chaos annotations and experiments.
+package webhook // import "github.com/huanwei/kube-chaos/pkg/webhook"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/apis/chaos/v1alpha1"
+	"github.com/huanwei/kube-chaos/pkg/experiment"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	"github.com/huanwei/kube-chaos/pkg/workload"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Validator validates the chaos annotations of pods, workloads and services, and experiments,
+// with the parser the agent uses.
+type Validator struct {
+	policy *safeguard.Policy
+}
+
+func NewValidator(policy *safeguard.Policy) *Validator {
+	return &Validator{policy: policy}
+}
+
+// Validate returns the reasons the object in the request must be rejected, or nothing.
+func (v *Validator) Validate(req *AdmissionRequest) ([]string, error) {
+	if req.Kind.Group == v1alpha1.GroupName && req.Kind.Kind == "Experiment" {
+		exp := &v1alpha1.Experiment{}
+		if err := json.Unmarshal(req.Object, exp); err != nil {
+			return nil, err
+		}
+		return v.validateExperiment(req.Namespace, exp), nil
+	}
+	if req.Kind.Kind == "Pod" {
+		pod := &v1.Pod{}
+		if err := json.Unmarshal(req.Object, pod); err != nil {
+			return nil, err
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
+		return v.validatePod(pod), nil
+	}
+	// workloads and services only need their metadata
+	obj := &struct {
+		meta_v1.ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(req.Object, obj); err != nil {
+		return nil, err
+	}
+	return v.validateAnnotations(req.Kind.Kind, req.Namespace, obj.Annotations), nil
+}
+
+func (v *Validator) validateExperiment(namespace string, exp *v1alpha1.Experiment) []string {
+	reasons := []string{}
+	for _, err := range experiment.Validate(exp) {
+		reasons = append(reasons, err.Error())
+	}
+	if refusal := v.policy.NamespaceAllowed(namespace); refusal != nil {
+		reasons = append(reasons, refusal.Message)
+	}
+	return reasons
+}
+
+func (v *Validator) validatePod(pod *v1.Pod) []string {
+	reasons := v.validateAnnotations("Pod", pod.Namespace, pod.Annotations)
+	if !flow.HasChaosAnnotations(pod.Annotations) {
+		return reasons
+	}
+	if refusal := v.policy.Check(pod); refusal != nil && refusal.Reason != safeguard.ReasonNamespaceDenied && refusal.Reason != safeguard.ReasonNamespaceNotAllowed {
+		reasons = append(reasons, refusal.Message)
+	}
+	return reasons
+}
+
+func (v *Validator) validateAnnotations(kind, namespace string, annotations map[string]string) []string {
+	reasons := []string{}
+	if ordinals, found := annotations[workload.OrdinalsAnnotation]; found {
+		if kind != "StatefulSet" {
+			reasons = append(reasons, fmt.Sprintf("%s is only supported on StatefulSets", workload.OrdinalsAnnotation))
+		} else if _, err := workload.ParseOrdinals(ordinals); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", workload.OrdinalsAnnotation, err))
+		}
+	}
+	if !flow.HasChaosAnnotations(annotations) {
+		return reasons
+	}
+	ingress, ingressFound := annotations[flow.IngressChaosAnnotation]
+	egress, egressFound := annotations[flow.EgressChaosAnnotation]
+	// the agent ignores chaos info unless both annotations are present
+	if !ingressFound {
+		reasons = append(reasons, fmt.Sprintf("%s requires %s to be set too, set it to \"\" for no ingress chaos", flow.EgressChaosAnnotation, flow.IngressChaosAnnotation))
+	}
+	if !egressFound {
+		reasons = append(reasons, fmt.Sprintf("%s requires %s to be set too, set it to \"\" for no egress chaos", flow.IngressChaosAnnotation, flow.EgressChaosAnnotation))
+	}
+	if ingress != "" {
+		if err := flow.ValidateChaosInfo(ingress, ""); err != nil {
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if egress != "" {
+		if err := flow.ValidateChaosInfo("", egress); err != nil {
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if refusal := v.policy.NamespaceAllowed(namespace); refusal != nil {
+		reasons = append(reasons, refusal.Message)
+	}
+	return reasons
+}
+
+// ServeHTTP answers an AdmissionReview.
+func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+	resp := &AdmissionResponse{UID: req.UID, Allowed: true}
+	reasons, err := v.Validate(req)
+	switch {
+	case err != nil:
+		resp.Allowed = false
+		resp.Result = &meta_v1.Status{Message: fmt.Sprintf("failed to decode %s: %v", req.Kind.Kind, err)}
+	case len(reasons) > 0:
+		resp.Allowed = false
+		resp.Result = &meta_v1.Status{
+			Reason:  meta_v1.StatusReasonInvalid,
+			Message: fmt.Sprintf("invalid chaos on %s: %s", req.Kind.Kind, strings.Join(reasons, "; ")),
+		}
+		glog.V(2).Infof("Rejected %s %s in %s: %s", req.Operation, req.Kind.Kind, req.Namespace, resp.Result.Message)
+	}
+	review.Response = resp
+	review.Request = nil
+	data, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/safeguard"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func review(t *testing.T, v *Validator, kind, group, namespace, object string) *AdmissionResponse {
+	body, err := json.Marshal(&AdmissionReview{Request: &AdmissionRequest{
+		UID:       "1234",
+		Kind:      meta_v1.GroupVersionKind{Group: group, Version: "v1", Kind: kind},
+		Namespace: namespace,
+		Operation: "CREATE",
+		Object:    json.RawMessage(object),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	v.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	result := &AdmissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Response.UID != "1234" {
+		t.Errorf("expected the response to carry the request uid, got %q", result.Response.UID)
+	}
+	return result.Response
+}
+
+func TestValidate(t *testing.T) {
+	v := NewValidator(safeguard.NewPolicy(nil, []string{"prod"}, "", ""))
+	tests := []struct {
+		name      string
+		kind      string
+		group     string
+		namespace string
+		object    string
+		rejection string
+	}{
+		{
+			name:      "valid pod",
+			kind:      "Pod",
+			namespace: "default",
+			object:    `{"metadata":{"annotations":{"kubernetes.io/egress-chaos":"delay=100ms","kubernetes.io/ingress-chaos":""}}}`,
+		},
+		{
+			name:      "pod without chaos in a denied namespace",
+			kind:      "Pod",
+			namespace: "prod",
+			object:    `{"metadata":{"name":"web"}}`,
+		},
+		{
+			name:      "typo in the egress chaos",
+			kind:      "Pod",
+			namespace: "default",
+			object:    `{"metadata":{"annotations":{"kubernetes.io/egress-chaos":"dealy=100ms","kubernetes.io/ingress-chaos":""}}}`,
+			rejection: `kubernetes.io/egress-chaos: unknown chaos spec key "dealy"`,
+		},
+		{
+			name:      "one annotation only",
+			kind:      "Pod",
+			namespace: "default",
+			object:    `{"metadata":{"annotations":{"kubernetes.io/egress-chaos":"delay=100ms"}}}`,
+			rejection: "requires kubernetes.io/ingress-chaos to be set too",
+		},
+		{
+			name:      "pod in a denied namespace",
+			kind:      "Pod",
+			namespace: "prod",
+			object:    `{"metadata":{"annotations":{"kubernetes.io/egress-chaos":"delay=100ms","kubernetes.io/ingress-chaos":""}}}`,
+			rejection: "namespace prod is on the chaos deny list",
+		},
+		{
+			name:      "protected pod",
+			kind:      "Pod",
+			namespace: "default",
+			object:    `{"metadata":{"labels":{"chaos.kube-chaos/protected":"true"},"annotations":{"kubernetes.io/egress-chaos":"delay=100ms","kubernetes.io/ingress-chaos":""}}}`,
+			rejection: "chaos.kube-chaos/protected=true",
+		},
+		{
+			name:      "statefulset ordinals",
+			kind:      "StatefulSet",
+			group:     "apps",
+			namespace: "default",
+			object:    `{"metadata":{"annotations":{"chaos.kube-chaos/ordinals":"2-1","kubernetes.io/egress-chaos":"loss=1%","kubernetes.io/ingress-chaos":""}}}`,
+			rejection: "invalid ordinal range",
+		},
+		{
+			name:      "valid experiment",
+			kind:      "Experiment",
+			group:     "chaos.kube-chaos",
+			namespace: "default",
+			object:    `{"spec":{"selector":{"matchLabels":{"app":"web"}},"egress":"delay=100ms"}}`,
+		},
+		{
+			name:      "invalid experiment",
+			kind:      "Experiment",
+			group:     "chaos.kube-chaos",
+			namespace: "default",
+			object:    `{"spec":{"egress":"loss=1"}}`,
+			rejection: "spec.selector is required; spec.egress: invalid loss",
+		},
+		{
+			name:      "experiment in a denied namespace",
+			kind:      "Experiment",
+			group:     "chaos.kube-chaos",
+			namespace: "kube-system",
+			object:    `{"spec":{"selector":{"matchLabels":{"app":"web"}},"egress":"delay=100ms"}}`,
+			rejection: "namespace kube-system is on the chaos deny list",
+		},
+	}
+	for _, test := range tests {
+		resp := review(t, v, test.kind, test.group, test.namespace, test.object)
+		if test.rejection == "" {
+			if !resp.Allowed {
+				t.Errorf("%s: expected to be allowed, got %v", test.name, resp.Result.Message)
+			}
+			continue
+		}
+		if resp.Allowed {
+			t.Errorf("%s: expected to be rejected", test.name)
+			continue
+		}
+		if !strings.Contains(resp.Result.Message, test.rejection) {
+			t.Errorf("%s: expected the rejection to contain %q, got %q", test.name, test.rejection, resp.Result.Message)
+		}
+	}
+}
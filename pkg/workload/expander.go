@@ -0,0 +1,261 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"github.com/huanwei/kube-chaos/pkg/sets"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// OrdinalsAnnotation restricts the chaos of a StatefulSet to some of its pods, e.g. "0,2-3".
+	OrdinalsAnnotation = "chaos.kube-chaos/ordinals"
+	// SourceAnnotation is set on pods that inherit their chaos from a workload or a service, it
+	// names where the chaos came from. It only exists in the agent's copy of the pod.
+	SourceAnnotation = "chaos.kube-chaos/source"
+)
+
+// Expander finds the pods of the Deployments, StatefulSets, DaemonSets and Services that carry
+// chaos annotations. The expansion is redone on every sync, so new replicas inherit the chaos as
+// soon as they exist.
+type Expander struct {
+	client kubernetes.Interface
+}
+
+func NewExpander(client kubernetes.Interface) *Expander {
+	return &Expander{client: client}
+}
+
+// Expand adds the pods of annotated workloads and services to pods. A pod's own chaos annotations
+// win over inherited ones, and the first workload or service to claim a pod wins over the later ones.
+// It fails if a workload, a service or their pods can't be listed, rather than return the pods
+// without the chaos they inherit, which would be removed until the next sync.
+func (e *Expander) Expand(pods []v1.Pod) ([]v1.Pod, error) {
+	result := &inheritance{pods: pods, index: map[types.UID]int{}}
+	for i := range pods {
+		result.index[pods[i].UID] = i
+	}
+
+	deployments, err := e.client.AppsV1().Deployments(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments.Items {
+		if !flow.HasChaosAnnotations(d.Annotations) {
+			continue
+		}
+		options, err := selectorOptions(d.Spec.Selector)
+		if err != nil {
+			glog.Errorf("Failed to expand chaos of Deployment %s/%s: %v", d.Namespace, d.Name, err)
+			continue
+		}
+		replicaSets, err := e.client.AppsV1().ReplicaSets(d.Namespace).List(options)
+		if err != nil {
+			return nil, err
+		}
+		owners := sets.String{}
+		for _, rs := range replicaSets.Items {
+			if ref := meta_v1.GetControllerOf(&rs); ref != nil && ref.UID == d.UID {
+				owners.Insert(string(rs.UID))
+			}
+		}
+		if err := e.inheritFromOwners(result, d.Namespace, d.Spec.Selector, owners, "Deployment/"+d.Name, d.Annotations, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	statefulSets, err := e.client.AppsV1().StatefulSets(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range statefulSets.Items {
+		if !flow.HasChaosAnnotations(ss.Annotations) {
+			continue
+		}
+		var ordinals sets.Int
+		if spec, found := ss.Annotations[OrdinalsAnnotation]; found {
+			if ordinals, err = ParseOrdinals(spec); err != nil {
+				glog.Errorf("Failed to expand chaos of StatefulSet %s/%s: %v", ss.Namespace, ss.Name, err)
+				continue
+			}
+		}
+		if err := e.inheritFromOwners(result, ss.Namespace, ss.Spec.Selector, sets.NewString(string(ss.UID)), "StatefulSet/"+ss.Name, ss.Annotations, ordinals); err != nil {
+			return nil, err
+		}
+	}
+
+	daemonSets, err := e.client.AppsV1().DaemonSets(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range daemonSets.Items {
+		if !flow.HasChaosAnnotations(ds.Annotations) {
+			continue
+		}
+		if err := e.inheritFromOwners(result, ds.Namespace, ds.Spec.Selector, sets.NewString(string(ds.UID)), "DaemonSet/"+ds.Name, ds.Annotations, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	services, err := e.client.CoreV1().Services(meta_v1.NamespaceAll).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range services.Items {
+		// services without a selector have no pods of their own
+		if !flow.HasChaosAnnotations(svc.Annotations) || len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		selected, err := e.client.CoreV1().Pods(svc.Namespace).List(meta_v1.ListOptions{LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String()})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range selected.Items {
+			result.inherit(pod, "Service/"+svc.Name, svc.Annotations)
+		}
+	}
+	return result.pods, nil
+}
+
+// inheritFromOwners passes the chaos annotations on to the pods matching selector that are
+// controlled by one of owners, optionally only the StatefulSet pods with the given ordinals.
+func (e *Expander) inheritFromOwners(result *inheritance, namespace string, selector *meta_v1.LabelSelector, owners sets.String, source string, annotations map[string]string, ordinals sets.Int) error {
+	options, err := selectorOptions(selector)
+	if err != nil {
+		glog.Errorf("Failed to expand chaos of %s in %s: %v", source, namespace, err)
+		return nil
+	}
+	selected, err := e.client.CoreV1().Pods(namespace).List(options)
+	if err != nil {
+		return err
+	}
+	for _, pod := range selected.Items {
+		ref := meta_v1.GetControllerOf(&pod)
+		if ref == nil || !owners.Has(string(ref.UID)) {
+			continue
+		}
+		if ordinals != nil {
+			ordinal, ok := podOrdinal(pod.Name, ref.Name)
+			if !ok || !ordinals.Has(ordinal) {
+				continue
+			}
+		}
+		result.inherit(pod, source, annotations)
+	}
+	return nil
+}
+
+// inheritance is the list of pods under construction by Expand.
+type inheritance struct {
+	pods  []v1.Pod
+	index map[types.UID]int
+}
+
+// inherit copies the chaos annotations to the pod, unless it already has chaos of its own or
+// inherited some already.
+func (in *inheritance) inherit(pod v1.Pod, source string, annotations map[string]string) {
+	if i, found := in.index[pod.UID]; found {
+		if flow.HasChaosAnnotations(in.pods[i].Annotations) {
+			return
+		}
+		pod = in.pods[i]
+	}
+	copied := map[string]string{}
+	for k, v := range pod.Annotations {
+		copied[k] = v
+	}
+	copied[flow.EgressChaosAnnotation] = annotations[flow.EgressChaosAnnotation]
+	copied[flow.IngressChaosAnnotation] = annotations[flow.IngressChaosAnnotation]
+	copied[SourceAnnotation] = source
+	pod.Annotations = copied
+
+	if i, found := in.index[pod.UID]; found {
+		in.pods[i] = pod
+		return
+	}
+	in.index[pod.UID] = len(in.pods)
+	in.pods = append(in.pods, pod)
+}
+
+func selectorOptions(selector *meta_v1.LabelSelector) (meta_v1.ListOptions, error) {
+	if selector == nil {
+		return meta_v1.ListOptions{}, fmt.Errorf("no selector")
+	}
+	s, err := meta_v1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return meta_v1.ListOptions{}, err
+	}
+	return meta_v1.ListOptions{LabelSelector: s.String()}, nil
+}
+
+// podOrdinal returns the ordinal of a StatefulSet pod, which is named <statefulset>-<ordinal>.
+func podOrdinal(podName, statefulSetName string) (int, bool) {
+	if !strings.HasPrefix(podName, statefulSetName+"-") {
+		return 0, false
+	}
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(podName, statefulSetName+"-"))
+	if err != nil {
+		return 0, false
+	}
+	return ordinal, true
+}
+
+// MaxOrdinal is the largest ordinal ParseOrdinals accepts, so a range can't make the agent
+// allocate without limit.
+const MaxOrdinal = 9999
+
+// ParseOrdinals parses a comma separated list of ordinals and ordinal ranges, e.g. "0,2-3".
+func ParseOrdinals(spec string) (sets.Int, error) {
+	ordinals := sets.Int{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid ordinal %q in %q", part, spec)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid ordinal range %q in %q", part, spec)
+			}
+		}
+		if last > MaxOrdinal {
+			return nil, fmt.Errorf("ordinal %d in %q is beyond %d", last, spec, MaxOrdinal)
+		}
+		for i := first; i <= last; i++ {
+			ordinals.Insert(i)
+		}
+	}
+	if ordinals.Len() == 0 {
+		return nil, fmt.Errorf("no ordinals in %q", spec)
+	}
+	return ordinals, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workload
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/huanwei/kube-chaos/pkg/flow"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseOrdinals(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected []int
+	}{
+		{"0", []int{0}},
+		{"0,2-3", []int{0, 2, 3}},
+		{" 4 , 1-2,", []int{1, 2, 4}},
+		{"1-1", []int{1}},
+	}
+	for _, test := range tests {
+		ordinals, err := ParseOrdinals(test.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(ordinals.List(), test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.expected, ordinals.List())
+		}
+	}
+	for _, invalid := range []string{"", ",", "a", "-1", "3-1", "1-b", "10000", "0-1000000000"} {
+		if _, err := ParseOrdinals(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestPodOrdinal(t *testing.T) {
+	if ordinal, ok := podOrdinal("db-12", "db"); !ok || ordinal != 12 {
+		t.Errorf("expected ordinal 12, got %d (%v)", ordinal, ok)
+	}
+	for _, name := range []string{"db", "db-", "dbx-1", "db-a"} {
+		if _, ok := podOrdinal(name, "db"); ok {
+			t.Errorf("expected %q to have no ordinal", name)
+		}
+	}
+}
+
+func TestInherit(t *testing.T) {
+	chaos := map[string]string{flow.EgressChaosAnnotation: "delay=100ms", flow.IngressChaosAnnotation: ""}
+	own := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "own", UID: "1", Annotations: map[string]string{flow.EgressChaosAnnotation: "loss=1%"}}}
+	plain := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "plain", UID: "2", Annotations: map[string]string{"a": "b"}}}
+	replica := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "replica", UID: "3"}}
+
+	in := &inheritance{pods: []v1.Pod{own, plain}, index: map[types.UID]int{"1": 0, "2": 1}}
+	in.inherit(own, "Deployment/web", chaos)
+	in.inherit(plain, "Deployment/web", chaos)
+	in.inherit(replica, "Deployment/web", chaos)
+	in.inherit(replica, "Service/web", map[string]string{flow.EgressChaosAnnotation: "loss=50%"})
+
+	if len(in.pods) != 3 {
+		t.Fatalf("expected 3 pods, got %d", len(in.pods))
+	}
+	if in.pods[0].Annotations[flow.EgressChaosAnnotation] != "loss=1%" {
+		t.Errorf("expected the pod's own chaos to win, got %v", in.pods[0].Annotations)
+	}
+	if in.pods[1].Annotations[flow.EgressChaosAnnotation] != "delay=100ms" || in.pods[1].Annotations["a"] != "b" {
+		t.Errorf("expected the pod to inherit chaos and keep its annotations, got %v", in.pods[1].Annotations)
+	}
+	if plain.Annotations[flow.EgressChaosAnnotation] != "" {
+		t.Errorf("expected the listed pod not to be modified, got %v", plain.Annotations)
+	}
+	if in.pods[2].Annotations[SourceAnnotation] != "Deployment/web" || in.pods[2].Annotations[flow.EgressChaosAnnotation] != "delay=100ms" {
+		t.Errorf("expected the first source to win, got %v", in.pods[2].Annotations)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package workload maps pods to the workloads that own them.
+package workload // import "github.com/huanwei/kube-chaos/pkg/workload"
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Ref identifies a workload.
+type Ref struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (r Ref) String() string {
+	return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// Workload is a workload and the number of replicas it wants.
+type Workload struct {
+	Ref
+	Replicas int
+}
+
+// Resolver finds the Deployment, StatefulSet or ReplicaSet that owns a pod.
+type Resolver interface {
+	// Owner returns the top level workload owning the pod, or nil if the pod isn't owned by a
+	// Deployment, StatefulSet or ReplicaSet.
+	Owner(pod *v1.Pod) (*Workload, error)
+}
+
+// apiResolver resolves owners against the api server. Lookups are cached for the life of the
+// resolver, so create one per sync.
+type apiResolver struct {
+	client kubernetes.Interface
+	cache  map[Ref]*Workload
+}
+
+// NewResolver returns a Resolver that looks owners up in the api server.
+func NewResolver(client kubernetes.Interface) Resolver {
+	return &apiResolver{
+		client: client,
+		cache:  map[Ref]*Workload{},
+	}
+}
+
+func (r *apiResolver) Owner(pod *v1.Pod) (*Workload, error) {
+	owner := meta_v1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil
+	}
+	ref := Ref{Kind: owner.Kind, Namespace: pod.Namespace, Name: owner.Name}
+	if w, found := r.cache[ref]; found {
+		return w, nil
+	}
+	w, err := r.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	r.cache[ref] = w
+	return w, nil
+}
+
+func (r *apiResolver) lookup(ref Ref) (*Workload, error) {
+	switch ref.Kind {
+	case "ReplicaSet":
+		rs, err := r.client.AppsV1().ReplicaSets(ref.Namespace).Get(ref.Name, meta_v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		// a replica set managed by a deployment is accounted to the deployment, so that the
+		// old and new replica sets of a rollout share one budget.
+		if owner := meta_v1.GetControllerOf(rs); owner != nil && owner.Kind == "Deployment" {
+			d, err := r.client.AppsV1().Deployments(ref.Namespace).Get(owner.Name, meta_v1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return &Workload{
+				Ref:      Ref{Kind: "Deployment", Namespace: ref.Namespace, Name: d.Name},
+				Replicas: replicas(d.Spec.Replicas),
+			}, nil
+		}
+		return &Workload{Ref: ref, Replicas: replicas(rs.Spec.Replicas)}, nil
+	case "StatefulSet":
+		ss, err := r.client.AppsV1().StatefulSets(ref.Namespace).Get(ref.Name, meta_v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &Workload{Ref: ref, Replicas: replicas(ss.Spec.Replicas)}, nil
+	}
+	return nil, nil
+}
+
+func replicas(r *int32) int {
+	if r == nil {
+		return 1
+	}
+	return int(*r)
+}